@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
@@ -67,6 +68,21 @@ func (app *application) writeJSON(w http.ResponseWriter, status int, data interf
 	return nil
 }
 
+// failedValidation writes the validation errors for each field along with a bad request
+func (app *application) failedValidation(w http.ResponseWriter, r *http.Request, errors map[string]string) {
+	var payload struct {
+		Error   bool              `json:"error"`
+		Message string            `json:"message"`
+		Errors  map[string]string `json:"errors"`
+	}
+
+	payload.Error = true
+	payload.Message = "failed validation"
+	payload.Errors = errors
+
+	_ = app.writeJSON(w, http.StatusUnprocessableEntity, payload)
+}
+
 // invalidCredentials writes an error message when a user tries to login with invalid credentials
 func (app *application) invalidCredentials(w http.ResponseWriter) error {
 	var payload struct {
@@ -84,6 +100,37 @@ func (app *application) invalidCredentials(w http.ResponseWriter) error {
 	return nil
 }
 
+// twoFactorRequired writes an error message when a user with two-factor
+// authentication on logs in with their password alone, telling the client to
+// ask for their code
+func (app *application) twoFactorRequired(w http.ResponseWriter) error {
+	var payload struct {
+		Error             bool   `json:"error"`
+		Message           string `json:"message"`
+		TwoFactorRequired bool   `json:"two_factor_required"`
+	}
+
+	payload.Error = true
+	payload.Message = "Enter the code from your authenticator app, or a recovery code"
+	payload.TwoFactorRequired = true
+
+	return app.writeJSON(w, http.StatusUnauthorized, payload)
+}
+
+// forbidden writes an error message when an authenticated user lacks the
+// permission a route requires
+func (app *application) forbidden(w http.ResponseWriter, perm string) error {
+	var payload struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	payload.Error = true
+	payload.Message = fmt.Sprintf("You do not have the %s permission", perm)
+
+	return app.writeJSON(w, http.StatusForbidden, payload)
+}
+
 // verifyPassword checks if the given password matches the hashed password
 func (app *application) verifyPassword(hash, password string) (bool, error) {
 	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
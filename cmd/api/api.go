@@ -5,7 +5,10 @@ import (
 	"fmt"
 	"log"
 	"maize/internal/driver"
+	"maize/internal/encryption"
+	"maize/internal/keyring"
 	"maize/internal/models"
+	"maize/internal/storage"
 	"net/http"
 	"os"
 	"time"
@@ -30,8 +33,16 @@ type config struct {
 		username string
 		password string
 	}
-	secretkey string
-	frontend  string
+	secretkey            string
+	frontend             string
+	storage              storage.Config
+	lowStockInterval     time.Duration
+	tokenCleanupInterval time.Duration
+	timezone             string
+	piikey               string
+	keyring              string
+	invoicePath          string
+	require2FA           bool
 }
 
 // application is the application structure
@@ -41,6 +52,8 @@ type application struct {
 	errorLog *log.Logger
 	version  string
 	DB       models.DBModel
+	Storage  storage.Storage
+	Keys     *keyring.Ring
 }
 
 // serve is the application entry point
@@ -51,7 +64,7 @@ func (app *application) serve() error {
 		IdleTimeout:       30 * time.Second,
 		ReadTimeout:       10 * time.Second,
 		ReadHeaderTimeout: 5 * time.Second,
-		WriteTimeout:      5 * time.Second,
+		WriteTimeout:      2 * time.Minute, // long enough to stream exports
 	}
 
 	app.infoLog.Printf("Starting Back end server in %s mode on port %d", app.config.env, app.config.port)
@@ -65,6 +78,8 @@ func main() {
 	mailTrapUser := GoDotEnvVariable("MAILTRAP_USER")
 	mailTrapPass := GoDotEnvVariable("MAILTRAP_PASS")
 	secretKey := GoDotEnvVariable("SECRET_KEY")
+	piiKey := GoDotEnvVariable("PII_KEY")
+	keyringFile := GoDotEnvVariable("KEYRING_FILE")
 
 	flag.IntVar(&cfg.port, "port", 4001, "Server port to listen on")
 	flag.StringVar(&cfg.env, "env", "development", "Application enviornment {development|production|maintenance}")
@@ -75,6 +90,14 @@ func main() {
 	flag.StringVar(&cfg.secretkey, "secret", secretKey, "secret key")
 	flag.StringVar(&cfg.frontend, "frontend", "http://localhost:4000", "frontend url")
 	flag.IntVar(&cfg.smtp.port, "smtpport", 587, "SMTP port")
+	cfg.storage.RegisterFlags(flag.CommandLine)
+	flag.StringVar(&cfg.invoicePath, "invoicepath", "./invoices", "Directory the invoice service writes invoices to")
+	flag.StringVar(&cfg.timezone, "timezone", "UTC", "Time zone whose days the sales summaries are kept in")
+	flag.StringVar(&cfg.piikey, "piikey", piiKey, "Key encrypting customer names and emails, 16, 24 or 32 bytes")
+	flag.StringVar(&cfg.keyring, "keyring", keyringFile, "Key ring file, replacing -secret and -piikey")
+	flag.BoolVar(&cfg.require2FA, "require2fa", false, "Require every admin user to turn on two-factor authentication")
+	flag.DurationVar(&cfg.lowStockInterval, "lowstockinterval", 5*time.Minute, "How often to check for low stock")
+	flag.DurationVar(&cfg.tokenCleanupInterval, "tokencleanupinterval", time.Hour, "How often to delete expired tokens")
 
 	flag.Parse()
 
@@ -84,20 +107,53 @@ func main() {
 	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
 	errorLog := log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
 
+	loc, err := time.LoadLocation(cfg.timezone)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
+	keys, err := keyring.Open(cfg.keyring, map[string][]byte{
+		keyring.PurposeURLSigning:     []byte(cfg.secretkey),
+		keyring.PurposeLinkEncryption: []byte(cfg.secretkey),
+		keyring.PurposePII:            []byte(cfg.piikey),
+		keyring.PurposeBlindIndex:     []byte(cfg.piikey),
+	})
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
+	var pii *encryption.Encryption
+	if _, err := keys.Primary(keyring.PurposePII); err == nil {
+		pii, err = keys.PII()
+		if err != nil {
+			errorLog.Fatal(err)
+		}
+	}
+
 	conn, err := driver.OpenDb(cfg.db.dsn)
 	if err != nil {
 		errorLog.Fatal(err)
 	}
 	defer conn.Close()
 
+	store, err := storage.New(cfg.storage)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
 	app := &application{
 		config:   cfg,
 		infoLog:  infoLog,
 		errorLog: errorLog,
 		version:  version,
-		DB:       models.DBModel{DB: conn},
+		DB:       models.DBModel{DB: conn, Location: loc, Cipher: pii},
+		Keys:     keys,
+		Storage:  store,
 	}
 
+	go app.watchLowStock(cfg.lowStockInterval)
+	go app.cleanExpiredTokens(cfg.tokenCleanupInterval)
+
 	err = app.serve()
 	if err != nil {
 		log.Fatal(err)
@@ -2,14 +2,18 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"maize/internal/cards"
-	"maize/internal/encryption"
+	"maize/internal/keyring"
 	"maize/internal/models"
 	"maize/internal/urlsigner"
+	"maize/internal/validator"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -21,18 +25,22 @@ import (
 
 // stripePayload is the payload sent to the Stripe API
 type stripePayload struct {
-	Currency      string `json:"currency"`
-	Amount        string `json:"amount"`
-	PaymentMethod string `json:"payment_method"`
-	Email         string `json:"email"`
-	CardBrand     string `json:"card_brand"`
-	ExpiryMonth   int    `json:"exp_month"`
-	ExpiryYear    int    `json:"exp_year"`
-	LastFour      string `json:"last_four"`
-	Plan          string `json:"plan"`
-	ProductID     string `json:"product_id"`
-	FirstName     string `json:"first_name"`
-	LastName      string `json:"last_name"`
+	Currency        string         `json:"currency"`
+	Amount          string         `json:"amount"`
+	PaymentMethod   string         `json:"payment_method"`
+	Email           string         `json:"email"`
+	CardBrand       string         `json:"card_brand"`
+	ExpiryMonth     int            `json:"exp_month"`
+	ExpiryYear      int            `json:"exp_year"`
+	LastFour        string         `json:"last_four"`
+	Plan            string         `json:"plan"`
+	ProductID       string         `json:"product_id"`
+	VariantID       string         `json:"variant_id"`
+	ShippingRateID  string         `json:"shipping_rate_id"`
+	FirstName       string         `json:"first_name"`
+	LastName        string         `json:"last_name"`
+	BillingAddress  models.Address `json:"billing_address"`
+	ShippingAddress models.Address `json:"shipping_address"`
 }
 
 // jsonResponse is the response sent to the client
@@ -44,15 +52,17 @@ type jsonResponse struct {
 }
 
 type Invoice struct {
-	ID        int       `json:"id"`
-	MaizeID   int       `json:"maize_id"`
-	Amount    int       `json:"amount"`
-	Product   string    `json:"product"`
-	Quantity  int       `json:"quantity"`
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	Email     string    `json:"email"`
-	CreatedAt time.Time `json:"created_at"`
+	ID             int       `json:"id"`
+	MaizeID        int       `json:"maize_id"`
+	Amount         int       `json:"amount"`
+	Shipping       int       `json:"shipping"`
+	ShippingMethod string    `json:"shipping_method"`
+	Product        string    `json:"product"`
+	Quantity       int       `json:"quantity"`
+	FirstName      string    `json:"first_name"`
+	LastName       string    `json:"last_name"`
+	Email          string    `json:"email"`
+	CreatedAt      time.Time `json:"created_at"`
 }
 
 // GetPaymentIntent returns a payment intent
@@ -78,10 +88,69 @@ func (app *application) GetPaymentIntent(w http.ResponseWriter, r *http.Request)
 	}
 
 	okay := true
+	msg := ""
+	status := models.StatusCleared
+	var metadata map[string]string
 
-	pi, msg, err := card.Charge(payload.Currency, amount)
-	if err != nil {
-		okay = false
+	if payload.ProductID != "" {
+		maizeID, _ := strconv.Atoi(payload.ProductID)
+		variantID, _ := strconv.Atoi(payload.VariantID)
+
+		status, err = app.DB.NewOrderStatus(maizeID, variantID, 1)
+		if errors.Is(err, models.ErrOutOfStock) {
+			okay = false
+			msg = "Sorry, this item is out of stock"
+		} else if err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+
+		// a pre-order is captured when it ships, so it is only taken while
+		// the card hold will last until then
+		if status == models.StatusPreOrdered {
+			maize, err := app.DB.GetMaize(maizeID)
+			if err != nil {
+				app.badRequest(w, r, err)
+				return
+			}
+			if !maize.ShipsBy(time.Now().Add(cards.AuthorizationHold)) {
+				okay = false
+				msg = "Sorry, pre-orders for this item open a week before it ships"
+			}
+		}
+
+		// the amount charged, including shipping, is worked out here rather
+		// than trusted from the browser, for the address the order ships to;
+		// the breakdown is kept with the payment for when the order is saved
+		rateID, _ := strconv.Atoi(payload.ShippingRateID)
+		price, err := app.DB.PriceOrder(maizeID, variantID, 1, rateID, payload.ShippingAddress.Country)
+		if errors.Is(err, models.ErrNoShippingRate) {
+			okay = false
+			msg = "Please choose a shipping method for your address"
+		} else if err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+		amount = price.Total
+		metadata = price.Metadata()
+
+		if !payload.ShippingAddress.Complete() {
+			okay = false
+			msg = "Please enter a complete shipping address"
+		}
+	}
+
+	var pi *stripe.PaymentIntent
+	if okay {
+		// pre-orders only place a hold on the card; it is captured when stock arrives
+		if status == models.StatusPreOrdered {
+			pi, msg, err = card.Authorize(payload.Currency, amount, metadata)
+		} else {
+			pi, msg, err = card.Charge(payload.Currency, amount, metadata)
+		}
+		if err != nil {
+			okay = false
+		}
 	}
 
 	if okay {
@@ -121,6 +190,12 @@ func (app *application) GetMaizeByID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	maize.Variants, err = app.DB.GetVariantsForMaize(maizeID)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
 	out, err := json.MarshalIndent(maize, "", "   ")
 	if err != nil {
 		app.errorLog.Println(err)
@@ -151,13 +226,22 @@ func (app *application) CreateCustomerAndSubscribeToPlan(w http.ResponseWriter,
 
 	okay := true
 	var subscription *stripe.Subscription
+	var stripeCustomer *stripe.Customer
 	txnMsg := "Transaction successful"
 
-	stripeCustomer, msg, err := card.CreateCustomer(data.PaymentMethod, data.Email)
-	if err != nil {
-		app.errorLog.Println(err)
+	if !data.ShippingAddress.Complete() {
 		okay = false
-		txnMsg = msg
+		txnMsg = "Please enter a complete shipping address"
+	}
+
+	if okay {
+		var msg string
+		stripeCustomer, msg, err = card.CreateCustomer(data.PaymentMethod, data.Email)
+		if err != nil {
+			app.errorLog.Println(err)
+			okay = false
+			txnMsg = msg
+		}
 	}
 
 	if okay {
@@ -177,12 +261,24 @@ func (app *application) CreateCustomerAndSubscribeToPlan(w http.ResponseWriter,
 			return
 		}
 
+		plan, err := app.DB.GetMaize(productID)
+		if err != nil {
+			app.errorLog.Println(err)
+			return
+		}
+
 		customerID, err := app.SaveCustomer(data.FirstName, data.LastName, data.Email)
 		if err != nil {
 			app.errorLog.Println(err)
 			return
 		}
 
+		billingID, shippingID, err := app.DB.SaveAddresses(customerID, data.BillingAddress, data.ShippingAddress)
+		if err != nil {
+			app.errorLog.Println(err)
+			return
+		}
+
 		amount, err := strconv.Atoi(data.Amount)
 		if err != nil {
 			app.errorLog.Println(err)
@@ -207,14 +303,16 @@ func (app *application) CreateCustomerAndSubscribeToPlan(w http.ResponseWriter,
 		}
 
 		order := models.Order{
-			MaizeID:       productID,
-			TransactionID: txnID,
-			CustomerID:    customerID,
-			StatusID:      1,
-			Quantity:      1,
-			Amount:        amount,
-			CreatedAt:     time.Now(),
-			UpdatedAt:     time.Now(),
+			MaizeID:           productID,
+			TransactionID:     txnID,
+			CustomerID:        customerID,
+			StatusID:          1,
+			Quantity:          1,
+			Amount:            amount,
+			BillingAddressID:  billingID,
+			ShippingAddressID: shippingID,
+			CreatedAt:         time.Now(),
+			UpdatedAt:         time.Now(),
 		}
 
 		orderID, err := app.SaveOrder(order)
@@ -225,8 +323,8 @@ func (app *application) CreateCustomerAndSubscribeToPlan(w http.ResponseWriter,
 
 		inv := Invoice{
 			ID:        orderID,
-			Amount:    2000,
-			Product:   "Bronze Plan Monthly Subscription",
+			Amount:    plan.Price,
+			Product:   fmt.Sprintf("%s Monthly Subscription", plan.Name),
 			Quantity:  order.Quantity,
 			FirstName: data.FirstName,
 			LastName:  data.LastName,
@@ -294,6 +392,11 @@ func (app *application) CreateAuthToken(w http.ResponseWriter, r *http.Request)
 	var userInput struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		// Code is the second factor of users with two-factor authentication on
+		Code string `json:"code"`
+		// Name names the device the token is for, in the list of the user's
+		// tokens. It is made up from the User-Agent header when not given.
+		Name string `json:"name"`
 	}
 
 	err := app.readJSON(w, r, &userInput)
@@ -319,11 +422,30 @@ func (app *application) CreateAuthToken(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	if user.TwoFactorEnabled {
+		if userInput.Code == "" {
+			app.twoFactorRequired(w)
+			return
+		}
+
+		err = app.DB.VerifyTwoFactor(user.ID, userInput.Code)
+		if err != nil {
+			app.invalidCredentials(w)
+			return
+		}
+	}
+
 	token, err := models.GenerateToken(user.ID, 24*time.Hour, models.ScopeAuthentication)
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
 	}
+	token.SecondFactor = user.TwoFactorEnabled
+
+	token.Name = strings.TrimSpace(userInput.Name)
+	if token.Name == "" {
+		token.Name = deviceName(r.UserAgent())
+	}
 
 	err = app.DB.InsertToken(token, user)
 	if err != nil {
@@ -344,32 +466,52 @@ func (app *application) CreateAuthToken(w http.ResponseWriter, r *http.Request)
 	_ = app.writeJSON(w, http.StatusOK, payload)
 }
 
-func (app *application) authenticateToken(r *http.Request) (*models.User, error) {
+// bearerToken returns the token in the Authorization header of a request
+func (app *application) bearerToken(r *http.Request) (string, error) {
 	authorizationHeader := r.Header.Get("Authorization")
 	if authorizationHeader == "" {
-		return nil, errors.New("no authorization header")
+		return "", errors.New("no authorization header")
 	}
 
 	headerParts := strings.Split(authorizationHeader, " ")
 	if len(headerParts) != 2 || headerParts[0] != "Bearer" {
-		return nil, errors.New("invalid authorization header")
+		return "", errors.New("invalid authorization header")
 	}
 
 	token := headerParts[1]
-	if len(token) != 26 {
-		return nil, errors.New("invalid token")
+	if len(token) != 26 && !strings.HasPrefix(token, models.APIKeyPrefix) {
+		return "", errors.New("invalid token")
+	}
+
+	return token, nil
+}
+
+// authenticateToken returns the user the bearer token of a request belongs
+// to. When the token is an API key, it returns the key too.
+func (app *application) authenticateToken(r *http.Request) (*models.User, *models.APIKey, error) {
+	token, err := app.bearerToken(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if strings.HasPrefix(token, models.APIKeyPrefix) {
+		user, key, err := app.DB.GetUserByAPIKey(token)
+		if err != nil {
+			return nil, nil, errors.New("no matching API key found")
+		}
+		return user, key, nil
 	}
 
 	user, err := app.DB.GetUserByToken(token)
 	if err != nil {
-		return nil, errors.New("no matching user found")
+		return nil, nil, errors.New("no matching user found")
 	}
 
-	return user, nil
+	return user, nil, nil
 }
 
 func (app *application) CheckAuthentication(w http.ResponseWriter, r *http.Request) {
-	user, err := app.authenticateToken(r)
+	user, _, err := app.authenticateToken(r)
 	if err != nil {
 		app.invalidCredentials(w)
 		return
@@ -448,6 +590,12 @@ func (app *application) VirtualTerminalPaymentSucceeded(w http.ResponseWriter, r
 	app.writeJSON(w, http.StatusOK, txn)
 }
 
+// resetLinkTTL is how long a password reset link works
+const resetLinkTTL = time.Hour
+
+// inviteLinkTTL is how long the link inviting a new user to set a password works
+const inviteLinkTTL = 7 * 24 * time.Hour
+
 func (app *application) SendPasswordResetEmail(w http.ResponseWriter, r *http.Request) {
 	var payload struct {
 		Email string `json:"email"`
@@ -472,13 +620,19 @@ func (app *application) SendPasswordResetEmail(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	link := fmt.Sprintf("%s/reset-password?email=%s", app.config.frontend, payload.Email)
+	link := fmt.Sprintf("%s/reset-password?email=%s", app.config.frontend, url.QueryEscape(payload.Email))
 
-	sign := urlsigner.Signer{
-		Secret: []byte(app.config.secretkey),
+	sign, err := app.Keys.Signer(keyring.PurposeURLSigning)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
 	}
 
-	signedLink := sign.GenerateTokenFromString(link)
+	signedLink, err := sign.Sign(link, urlsigner.PurposeReset, resetLinkTTL)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
 
 	var data struct {
 		Link string
@@ -504,6 +658,9 @@ func (app *application) SendPasswordResetEmail(w http.ResponseWriter, r *http.Re
 
 }
 
+// ResetPassword sets a new password for the user a reset link was sent to. The
+// reset page posts the link back encrypted, as email, and the link can only be
+// used once.
 func (app *application) ResetPassword(w http.ResponseWriter, r *http.Request) {
 	var payload struct {
 		Email    string `json:"email"`
@@ -516,17 +673,47 @@ func (app *application) ResetPassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	encryptor := encryption.Encryption{
-		Key: []byte(app.config.secretkey),
+	encryptor, err := app.Keys.Encryption(keyring.PurposeLinkEncryption)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	link, err := encryptor.Decrypt(payload.Email)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	signer, err := app.Keys.Signer(keyring.PurposeURLSigning)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
 	}
 
-	realEmail, err := encryptor.Decrypt(payload.Email)
+	// an invited user sets their first password the same way
+	claims, err := signer.Verify(link, urlsigner.PurposeReset)
+	if errors.Is(err, urlsigner.ErrWrongPurpose) {
+		claims, err = signer.Verify(link, urlsigner.PurposeInvite)
+	}
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
 	}
 
-	user, err := app.DB.GetUserByEmail(realEmail)
+	u, err := url.Parse(link)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.DB.ConsumeNonce(claims.Nonce, claims.Purpose, claims.ExpiresAt)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	user, err := app.DB.GetUserByEmail(u.Query().Get("email"))
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
@@ -538,7 +725,8 @@ func (app *application) ResetPassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = app.DB.UpdatePasswordForUser(user, string(newHash))
+	// whoever knew the old password is logged out everywhere
+	err = app.DB.UpdatePasswordForUser(user, string(newHash), "")
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
@@ -555,10 +743,70 @@ func (app *application) ResetPassword(w http.ResponseWriter, r *http.Request) {
 	app.writeJSON(w, http.StatusCreated, resp)
 }
 
-func (app *application) AllSales(w http.ResponseWriter, r *http.Request) {
+// maxPageSize caps the number of rows the admin lists return at once
+const maxPageSize = 100
+
+// pageRequest is the paging part of a list request. Lists are read by page
+// number by default, or by cursor when Pagination is "cursor", which reads
+// the page after (or before) the opaque Cursor returned with the last page.
+type pageRequest struct {
+	PageSize    int    `json:"page_size"`
+	CurrentPage int    `json:"page"`
+	Pagination  string `json:"pagination"`
+	Cursor      string `json:"cursor"`
+}
+
+// byCursor reports whether the list is to be read by cursor
+func (p pageRequest) byCursor() bool {
+	return p.Pagination == "cursor"
+}
+
+// check validates the paging request and returns its decoded cursor
+func (p pageRequest) check(v *validator.Validator) models.Cursor {
+	v.Check(p.PageSize > 0 && p.PageSize <= maxPageSize, "page_size", fmt.Sprintf("Page size must be between 1 and %d", maxPageSize))
+	v.Check(p.Pagination == "" || p.Pagination == "offset" || p.Pagination == "cursor", "pagination", "Pagination must be offset or cursor")
+
+	if !p.byCursor() {
+		v.Check(p.CurrentPage > 0, "page", "Page must be at least 1")
+		return models.Cursor{}
+	}
+
+	cursor, err := models.DecodeCursor(p.Cursor)
+	v.Check(err == nil, "cursor", "Invalid cursor")
+	return cursor
+}
+
+// pageResponse is the paging part of a list response. Lists read by cursor
+// carry the cursors of the pages either side instead of a current page.
+type pageResponse struct {
+	CurrentPage  int `json:"current_page"`
+	PageSize     int `json:"page_size"`
+	LastPage     int `json:"last_page"`
+	TotalRecords int `json:"total_records"`
+	models.CursorPage
+}
+
+// checkOrderFilter checks the filters sent for the sales and subscriptions lists
+func checkOrderFilter(v *validator.Validator, f models.OrderFilter) {
+	for key, date := range map[string]string{"date_from": f.DateFrom, "date_to": f.DateTo} {
+		if date != "" {
+			_, err := time.Parse("2006-01-02", date)
+			v.Check(err == nil, key, "Dates must be YYYY-MM-DD")
+		}
+	}
+	v.Check(f.MinAmount >= 0 && f.MaxAmount >= 0, "amount", "Amounts cannot be negative")
+	v.Check(f.MaxAmount == 0 || f.MinAmount <= f.MaxAmount, "amount", "Minimum amount cannot be more than the maximum")
+	v.Check(f.LastFour == "" || len(f.LastFour) == 4, "last_four", "Last four must be four digits")
+	v.Check(models.ValidOrderSort(f.Sort), "sort", "Cannot sort by that column")
+	v.Check(f.Direction == "" || f.Direction == "asc" || f.Direction == "desc", "direction", "Direction must be asc or desc")
+}
+
+// orderList writes a page of the one-off or subscription orders matching the
+// filters of the request
+func (app *application) orderList(w http.ResponseWriter, r *http.Request, recurring bool) {
 	var payload struct {
-		PageSize    int `json:"page_size"`
-		CurrentPage int `json:"page"`
+		pageRequest
+		models.OrderFilter
 	}
 
 	err := app.readJSON(w, r, &payload)
@@ -567,62 +815,56 @@ func (app *application) AllSales(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	allSales, lastPage, totalRecords, err := app.DB.GetAllOrdersPaginated(payload.PageSize, payload.CurrentPage)
-	if err != nil {
-		app.badRequest(w, r, err)
+	v := validator.New()
+	checkOrderFilter(v, payload.OrderFilter)
+	cursor := payload.check(v)
+	if payload.byCursor() {
+		v.Check(payload.Sort == "" || payload.Sort == "created_at", "sort", "Lists read by cursor can only be sorted by date")
+	}
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
 		return
 	}
 
 	var resp struct {
-		CurrentPage  int             `json:"current_page"`
-		PageSize     int             `json:"page_size"`
-		LastPage     int             `json:"last_page"`
-		TotalRecords int             `json:"total_records"`
-		Orders       []*models.Order `json:"orders"`
+		pageResponse
+		Orders []*models.Order `json:"orders"`
 	}
 
-	resp.CurrentPage = payload.CurrentPage
 	resp.PageSize = payload.PageSize
-	resp.LastPage = lastPage
-	resp.TotalRecords = totalRecords
-	resp.Orders = allSales
-
-	app.writeJSON(w, http.StatusOK, resp)
-}
 
-func (app *application) AllSubs(w http.ResponseWriter, r *http.Request) {
-	var payload struct {
-		PageSize    int `json:"page_size"`
-		CurrentPage int `json:"page"`
+	switch {
+	case payload.byCursor() && recurring:
+		resp.Orders, resp.CursorPage, resp.TotalRecords, err = app.DB.GetAllSubsByCursor(payload.PageSize, cursor, payload.OrderFilter)
+	case payload.byCursor():
+		resp.Orders, resp.CursorPage, resp.TotalRecords, err = app.DB.GetAllOrdersByCursor(payload.PageSize, cursor, payload.OrderFilter)
+	case recurring:
+		resp.CurrentPage = payload.CurrentPage
+		resp.Orders, resp.LastPage, resp.TotalRecords, err = app.DB.GetAllSubsPaginated(payload.PageSize, payload.CurrentPage, payload.OrderFilter)
+	default:
+		resp.CurrentPage = payload.CurrentPage
+		resp.Orders, resp.LastPage, resp.TotalRecords, err = app.DB.GetAllOrdersPaginated(payload.PageSize, payload.CurrentPage, payload.OrderFilter)
 	}
-
-	err := app.readJSON(w, r, &payload)
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
 	}
 
-	allSubs, lastPage, totalRecords, err := app.DB.GetAllSubsPaginated(payload.PageSize, payload.CurrentPage)
-	if err != nil {
-		app.badRequest(w, r, err)
-		return
+	if payload.byCursor() {
+		resp.LastPage = models.LastPage(resp.TotalRecords, payload.PageSize)
 	}
 
-	var resp struct {
-		CurrentPage  int             `json:"current_page"`
-		PageSize     int             `json:"page_size"`
-		LastPage     int             `json:"last_page"`
-		TotalRecords int             `json:"total_records"`
-		Orders       []*models.Order `json:"orders"`
-	}
+	app.writeJSON(w, http.StatusOK, resp)
+}
 
-	resp.CurrentPage = payload.CurrentPage
-	resp.PageSize = payload.PageSize
-	resp.LastPage = lastPage
-	resp.TotalRecords = totalRecords
-	resp.Orders = allSubs
+// AllSales returns a page of one-off orders
+func (app *application) AllSales(w http.ResponseWriter, r *http.Request) {
+	app.orderList(w, r, false)
+}
 
-	app.writeJSON(w, http.StatusOK, allSubs)
+// AllSubs returns a page of subscriptions
+func (app *application) AllSubs(w http.ResponseWriter, r *http.Request) {
+	app.orderList(w, r, true)
 }
 
 func (app *application) GetSale(w http.ResponseWriter, r *http.Request) {
@@ -639,6 +881,18 @@ func (app *application) GetSale(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	err = app.loadFulfillment(&order)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	order.StatusHistory, err = app.DB.GetOrderStatusHistory(order.ID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
 	app.writeJSON(w, http.StatusOK, order)
 }
 
@@ -656,6 +910,18 @@ func (app *application) RefundPayment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	order, err := app.DB.GetOrderByID(paymentToRefund.ID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = order.CheckTransition(models.StatusRefunded)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
 	card := cards.Card{
 		Secret:   app.config.stripe.secret,
 		Key:      app.config.stripe.key,
@@ -668,12 +934,42 @@ func (app *application) RefundPayment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = app.DB.UpdateOrderStatus(paymentToRefund.ID, 2)
+	user := app.authenticatedUser(r)
+
+	_, err = app.DB.InsertRefund(models.Refund{
+		OrderID:       order.ID,
+		TransactionID: order.TransactionID,
+		Amount:        paymentToRefund.Amount,
+		Currency:      paymentToRefund.Currency,
+		Reason:        "Refunded",
+		Actor:         user.Email,
+	})
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
+	err = app.DB.TransitionOrderStatus(paymentToRefund.ID, models.StatusRefunded, user.Email, "Refunded")
 	if err != nil {
 		app.badRequest(w, r, errors.New("payment refunded, but the database update failed"))
 		return
 	}
 
+	// only orders that were filled from stock have units to put back
+	if order.StatusID == models.StatusCleared {
+		err = app.DB.AdjustInventory(models.InventoryMovement{
+			MaizeID:        order.MaizeID,
+			VariantID:      order.VariantID,
+			OrderID:        order.ID,
+			QuantityChange: order.Quantity,
+			Reason:         models.MovementRefund,
+			UserID:         user.ID,
+			Actor:          user.Email,
+		})
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+	}
+
 	var resp struct {
 		Error   bool   `json:"error"`
 		Message string `json:"message"`
@@ -698,6 +994,18 @@ func (app *application) CancelSub(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	order, err := app.DB.GetOrderByID(subToCancel.ID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = order.CheckTransition(models.StatusCancelled)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
 	card := cards.Card{
 		Secret:   app.config.stripe.secret,
 		Key:      app.config.stripe.key,
@@ -710,7 +1018,7 @@ func (app *application) CancelSub(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = app.DB.UpdateOrderStatus(subToCancel.ID, 3)
+	err = app.DB.TransitionOrderStatus(subToCancel.ID, models.StatusCancelled, app.authenticatedUser(r).Email, "Subscription cancelled")
 	if err != nil {
 		app.badRequest(w, r, errors.New("subscription cancelled, but the database update failed"))
 		return
@@ -727,14 +1035,56 @@ func (app *application) CancelSub(w http.ResponseWriter, r *http.Request) {
 	app.writeJSON(w, http.StatusOK, resp)
 }
 
+// AllUsers returns every user when the request has no body, or a page of users
+// when it asks for one. Pages by number are ordered by name, pages by cursor
+// newest first.
 func (app *application) AllUsers(w http.ResponseWriter, r *http.Request) {
-	allUsers, err := app.DB.GetAllUsers()
+	if r.ContentLength == 0 {
+		allUsers, err := app.DB.GetAllUsers()
+		if err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+
+		app.writeJSON(w, http.StatusOK, allUsers)
+		return
+	}
+
+	var payload pageRequest
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	cursor := payload.check(v)
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	var resp struct {
+		pageResponse
+		Users []*models.User `json:"users"`
+	}
+
+	resp.PageSize = payload.PageSize
+
+	if payload.byCursor() {
+		resp.Users, resp.CursorPage, resp.TotalRecords, err = app.DB.GetUsersByCursor(payload.PageSize, cursor)
+		resp.LastPage = models.LastPage(resp.TotalRecords, payload.PageSize)
+	} else {
+		resp.CurrentPage = payload.CurrentPage
+		resp.Users, resp.LastPage, resp.TotalRecords, err = app.DB.GetUsersPaginated(payload.PageSize, payload.CurrentPage)
+	}
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
 	}
 
-	app.writeJSON(w, http.StatusOK, allUsers)
+	app.writeJSON(w, http.StatusOK, resp)
 }
 
 func (app *application) OneUser(w http.ResponseWriter, r *http.Request) {
@@ -747,6 +1097,12 @@ func (app *application) OneUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	user.Roles, err = app.DB.GetUserRoles(userID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
 	app.writeJSON(w, http.StatusOK, user)
 }
 
@@ -776,23 +1132,61 @@ func (app *application) EditUser(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			err = app.DB.UpdatePasswordForUser(user, string(newHash))
+			// other devices are logged out; users changing their own
+			// password stay logged in here
+			keep := ""
+			if user.ID == app.authenticatedUser(r).ID {
+				keep, _ = app.bearerToken(r)
+			}
+
+			err = app.DB.UpdatePasswordForUser(user, string(newHash), keep)
+			if err != nil {
+				app.badRequest(w, r, err)
+				return
+			}
+		}
+
+		// roles are only changed when asked for, so an edit without them keeps them
+		if user.Roles != nil {
+			err = app.DB.SetUserRoles(userID, user.Roles)
 			if err != nil {
 				app.badRequest(w, r, err)
 				return
 			}
 		}
 	} else {
-		newHash, err := bcrypt.GenerateFromPassword([]byte(user.Password), 12)
+		// a user added without a password is sent an invitation to choose
+		// one, and cannot log in until they do
+		password := user.Password
+		if password == "" {
+			secret := make([]byte, 32)
+			_, err = rand.Read(secret)
+			if err != nil {
+				app.badRequest(w, r, err)
+				return
+			}
+			password = hex.EncodeToString(secret)
+		}
+
+		newHash, err := bcrypt.GenerateFromPassword([]byte(password), 12)
 		if err != nil {
 			app.badRequest(w, r, err)
 			return
 		}
-		err = app.DB.AddUser(user, string(newHash))
+		// a new user is created with their roles, or not at all
+		_, err = app.DB.AddUser(user, string(newHash))
 		if err != nil {
 			app.badRequest(w, r, err)
 			return
 		}
+
+		if user.Password == "" {
+			err = app.sendInvite(user)
+			if err != nil {
+				app.badRequest(w, r, fmt.Errorf("user added, but the invitation could not be sent: %w", err))
+				return
+			}
+		}
 	}
 
 	var resp struct {
@@ -804,6 +1198,31 @@ func (app *application) EditUser(w http.ResponseWriter, r *http.Request) {
 	app.writeJSON(w, http.StatusOK, resp)
 }
 
+// sendInvite emails a new user a link to set their password
+func (app *application) sendInvite(user models.User) error {
+	link := fmt.Sprintf("%s/accept-invite?email=%s", app.config.frontend, url.QueryEscape(user.Email))
+
+	sign, err := app.Keys.Signer(keyring.PurposeURLSigning)
+	if err != nil {
+		return err
+	}
+
+	signedLink, err := sign.Sign(link, urlsigner.PurposeInvite, inviteLinkTTL)
+	if err != nil {
+		return err
+	}
+
+	var data struct {
+		FirstName string
+		Link      string
+	}
+
+	data.FirstName = user.FirstName
+	data.Link = signedLink
+
+	return app.SendMail("info@maize.com", user.Email, "You have been invited to Maize", "invite", data)
+}
+
 func (app *application) DeleteUser(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 	userID, _ := strconv.Atoi(id)
@@ -823,6 +1242,17 @@ func (app *application) DeleteUser(w http.ResponseWriter, r *http.Request) {
 	app.writeJSON(w, http.StatusOK, resp)
 }
 
+// Roles returns every role with its permissions, for assigning to users
+func (app *application) Roles(w http.ResponseWriter, r *http.Request) {
+	roles, err := app.DB.GetRoles()
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, roles)
+}
+
 func (app *application) callInvoiceMicroService(inv Invoice) error {
 	url := GoDotEnvVariable("INVOICE_SERVICE_URL")
 
@@ -840,6 +1270,18 @@ func (app *application) callInvoiceMicroService(inv Invoice) error {
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
+
+	// the invoice service sends the invoice by email
+	entry := models.EmailLog{To: inv.Email, Subject: fmt.Sprintf("Invoice#%d", inv.ID), Template: "invoice"}
+	if err != nil {
+		entry.Error = err.Error()
+	} else if resp.StatusCode >= http.StatusMultipleChoices {
+		entry.Error = resp.Status
+	}
+	if logErr := app.DB.LogEmail(entry); logErr != nil {
+		app.errorLog.Println(logErr)
+	}
+
 	if err != nil {
 		return err
 	}
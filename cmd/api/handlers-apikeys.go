@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"maize/internal/models"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// APIKeys returns every API key, and the scopes the user may give a new one,
+// which are the permissions they have themselves
+func (app *application) APIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := app.DB.GetAPIKeys()
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	perms, err := app.DB.GetPermissions()
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	has, err := app.DB.GetUserPermissions(app.authenticatedUser(r).ID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error  bool                 `json:"error"`
+		Keys   []*models.APIKey     `json:"keys"`
+		Scopes []*models.Permission `json:"scopes"`
+	}
+
+	resp.Keys = append([]*models.APIKey{}, keys...)
+	resp.Scopes = []*models.Permission{}
+	for _, p := range perms {
+		if has[p.Name] {
+			resp.Scopes = append(resp.Scopes, p)
+		}
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// CreateAPIKey creates an API key that acts for the user within the scopes
+// they choose, and returns its plain text, which is not shown again
+func (app *application) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+		// Days until the key expires; 0 means it never does
+		Days int `json:"days"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	payload.Name = strings.TrimSpace(payload.Name)
+	switch {
+	case payload.Name == "":
+		app.badRequest(w, r, errors.New("an API key needs a name"))
+		return
+	case len(payload.Scopes) == 0:
+		app.badRequest(w, r, errors.New("an API key needs at least one scope"))
+		return
+	case payload.Days < 0:
+		app.badRequest(w, r, errors.New("days cannot be negative"))
+		return
+	}
+
+	user := app.authenticatedUser(r)
+
+	key, err := app.DB.CreateAPIKey(user.ID, payload.Name, payload.Scopes, time.Duration(payload.Days)*24*time.Hour)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	key.CreatedBy = user.Email
+
+	app.infoLog.Printf("API key %d (%s) created by %s with scopes %s", key.ID, key.Name, user.Email, strings.Join(key.Scopes, ","))
+
+	var resp struct {
+		Error   bool           `json:"error"`
+		Message string         `json:"message"`
+		Key     *models.APIKey `json:"api_key"`
+	}
+
+	resp.Message = "Copy this key now: it will not be shown again"
+	resp.Key = key
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// RevokeAPIKey revokes an API key, which stops working at once
+func (app *application) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	keyID, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	err := app.DB.RevokeAPIKey(keyID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.infoLog.Printf("API key %d revoked by %s", keyID, app.authenticatedUser(r).Email)
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Message = "API key revoked"
+	app.writeJSON(w, http.StatusOK, resp)
+}
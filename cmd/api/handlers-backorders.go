@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maize/internal/cards"
+	"maize/internal/models"
+	"net/http"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+// Backorders returns the queue of backordered and pre-ordered orders waiting on
+// stock, with the time the card hold of each pre-order lapses
+func (app *application) Backorders(w http.ResponseWriter, r *http.Request) {
+	orders, err := app.DB.GetBackorders()
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	type backorder struct {
+		*models.Order
+		HoldExpiresAt *time.Time `json:"hold_expires_at,omitempty"`
+	}
+
+	resp := []backorder{}
+	for _, o := range orders {
+		b := backorder{Order: o}
+		if o.StatusID == models.StatusPreOrdered {
+			expires := o.CreatedAt.Add(cards.AuthorizationHold)
+			b.HoldExpiresAt = &expires
+		}
+		resp = append(resp, b)
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// waitingOrder reads the order ID from the request body and loads the order,
+// making sure it is still waiting on stock or on payment
+func (app *application) waitingOrder(w http.ResponseWriter, r *http.Request) (models.Order, error) {
+	var payload struct {
+		ID int `json:"id"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		return models.Order{}, err
+	}
+
+	order, err := app.DB.GetOrderByID(payload.ID)
+	if err != nil {
+		return order, err
+	}
+
+	switch order.StatusID {
+	case models.StatusBackordered, models.StatusPreOrdered, models.StatusPaymentRequired:
+	default:
+		return order, errors.New("order is not waiting on stock")
+	}
+
+	return order, nil
+}
+
+// FulfilBackorder ships a backordered or pre-ordered order once stock has arrived,
+// capturing the held payment of a pre-order and taking the units from inventory.
+// A pre-order whose hold can no longer be captured is moved to payment required
+// and the customer is asked to pay again.
+func (app *application) FulfilBackorder(w http.ResponseWriter, r *http.Request) {
+	order, err := app.waitingOrder(w, r)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	stock, err := app.DB.GetStockLevel(order.MaizeID, order.VariantID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if stock < order.Quantity {
+		app.badRequest(w, r, errors.New("not enough stock to fulfil this order"))
+		return
+	}
+
+	err = order.CheckTransition(models.StatusCleared)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	user := app.authenticatedUser(r)
+
+	if order.StatusID == models.StatusPreOrdered {
+		card := cards.Card{
+			Secret:   app.config.stripe.secret,
+			Key:      app.config.stripe.key,
+			Currency: order.Transaction.Currency,
+		}
+
+		err = card.Capture(order.Transaction.PaymentIntent)
+		if cards.HoldLapsed(err) {
+			app.paymentRequired(w, r, order, user.Email, err)
+			return
+		} else if err != nil {
+			// anything else, such as a rate limit or a network error, may be
+			// retried
+			app.badRequest(w, r, err)
+			return
+		}
+
+		err = app.DB.UpdateTransactionStatus(order.TransactionID, models.TransactionCleared)
+		if err != nil {
+			app.badRequest(w, r, errors.New("payment captured, but the database update failed"))
+			return
+		}
+	}
+
+	err = app.DB.TransitionOrderStatus(order.ID, models.StatusCleared, user.Email, "Backorder fulfilled")
+	if err != nil {
+		app.badRequest(w, r, errors.New("order fulfilled, but the database update failed"))
+		return
+	}
+
+	err = app.DB.AdjustInventory(models.InventoryMovement{
+		MaizeID:        order.MaizeID,
+		VariantID:      order.VariantID,
+		OrderID:        order.ID,
+		QuantityChange: -order.Quantity,
+		Reason:         models.MovementSale,
+		Note:           "Backorder fulfilled",
+		UserID:         user.ID,
+		Actor:          user.Email,
+	})
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = false
+	resp.Message = "Order fulfilled"
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// paymentRequired records that the held payment of a pre-order could not be
+// captured, and emails the customer a link to pay for the order again
+func (app *application) paymentRequired(w http.ResponseWriter, r *http.Request, order models.Order, actor string, captureErr error) {
+	err := order.CheckTransition(models.StatusPaymentRequired)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.DB.UpdateTransactionStatus(order.TransactionID, models.TransactionDeclined)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
+	note := "Payment capture failed: the card hold lapsed"
+	if stripeErr, ok := captureErr.(*stripe.Error); ok && stripeErr.Msg != "" {
+		note = fmt.Sprintf("Payment capture failed: %s", stripeErr.Msg)
+	}
+	err = app.DB.TransitionOrderStatus(order.ID, models.StatusPaymentRequired, actor, note)
+	if err != nil {
+		app.badRequest(w, r, errors.New("payment capture failed, and the database update failed"))
+		return
+	}
+
+	data := struct {
+		Order models.Order
+		Link  string
+	}{
+		Order: order,
+		Link:  fmt.Sprintf("%s/maize/%d", app.config.frontend, order.MaizeID),
+	}
+
+	err = app.SendMail("info@maize.com", order.Customer.Email, fmt.Sprintf("Payment needed for your Maize order %d", order.ID), "payment-required", data)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = true
+	resp.Message = "The payment could not be captured, so the customer has been asked to pay again"
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// CancelBackorder cancels an order that is waiting on stock. The hold on a
+// pre-order is released; a backorder, which was charged, is refunded in full.
+// An order waiting on payment holds no funds and is simply cancelled.
+func (app *application) CancelBackorder(w http.ResponseWriter, r *http.Request) {
+	order, err := app.waitingOrder(w, r)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	card := cards.Card{
+		Secret:   app.config.stripe.secret,
+		Key:      app.config.stripe.key,
+		Currency: order.Transaction.Currency,
+	}
+
+	statusID := models.StatusRefunded
+	txnStatusID := models.TransactionRefunded
+
+	if order.StatusID == models.StatusPreOrdered || order.StatusID == models.StatusPaymentRequired {
+		statusID = models.StatusCancelled
+		txnStatusID = models.TransactionDeclined
+	}
+
+	err = order.CheckTransition(statusID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	switch order.StatusID {
+	case models.StatusPreOrdered:
+		err = card.CancelAuthorization(order.Transaction.PaymentIntent)
+	case models.StatusPaymentRequired:
+	default:
+		err = card.Refund(order.Transaction.PaymentIntent, order.Transaction.Amount)
+	}
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if statusID == models.StatusRefunded {
+		_, err = app.DB.InsertRefund(models.Refund{
+			OrderID:       order.ID,
+			TransactionID: order.TransactionID,
+			Amount:        order.Transaction.Amount,
+			Currency:      order.Transaction.Currency,
+			Reason:        "Backorder cancelled",
+			Actor:         app.authenticatedUser(r).Email,
+		})
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+	}
+
+	err = app.DB.UpdateTransactionStatus(order.TransactionID, txnStatusID)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
+	err = app.DB.TransitionOrderStatus(order.ID, statusID, app.authenticatedUser(r).Email, "Backorder cancelled")
+	if err != nil {
+		app.badRequest(w, r, errors.New("order cancelled, but the database update failed"))
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = false
+	resp.Message = "Order cancelled"
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
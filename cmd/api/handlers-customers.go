@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"maize/internal/models"
+	"maize/internal/validator"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi"
+)
+
+// Customers returns a page of the customers with the email address or customer
+// ID searched for, with the rows sharing an email address grouped
+func (app *application) Customers(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		PageSize    int    `json:"page_size"`
+		CurrentPage int    `json:"page"`
+		Query       string `json:"query"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(payload.PageSize > 0 && payload.PageSize <= maxPageSize, "page_size", fmt.Sprintf("Page size must be between 1 and %d", maxPageSize))
+	v.Check(payload.CurrentPage > 0, "page", "Page must be at least 1")
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	var resp struct {
+		pageResponse
+		Customers []*models.CustomerSummary `json:"customers"`
+	}
+
+	resp.PageSize = payload.PageSize
+	resp.CurrentPage = payload.CurrentPage
+
+	resp.Customers, resp.LastPage, resp.TotalRecords, err = app.DB.SearchCustomers(payload.Query, payload.PageSize, payload.CurrentPage)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// GetCustomer returns a customer with their orders, subscriptions, lifetime
+// value, refunds, disputes and notes
+func (app *application) GetCustomer(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	customerID, _ := strconv.Atoi(id)
+
+	profile, err := app.DB.GetCustomerProfile(customerID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, profile)
+}
+
+// AddCustomerNote keeps a note on a customer
+func (app *application) AddCustomerNote(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	customerID, _ := strconv.Atoi(id)
+
+	var payload struct {
+		Body string `json:"body"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(strings.TrimSpace(payload.Body) != "", "body", "Write something in the note")
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	var resp jsonResponse
+
+	resp.ID, err = app.DB.InsertCustomerNote(models.CustomerNote{
+		CustomerID: customerID,
+		Body:       strings.TrimSpace(payload.Body),
+		Actor:      app.authenticatedUser(r).Email,
+	})
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	resp.OK = true
+	resp.Message = "Note saved"
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// OpenDispute records a dispute a customer has raised with their card issuer
+// against an order. The amount defaults to that of the order.
+func (app *application) OpenDispute(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		OrderID int    `json:"order_id"`
+		Amount  int    `json:"amount"`
+		Reason  string `json:"reason"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	order, err := app.DB.GetOrderByID(payload.OrderID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if payload.Amount == 0 {
+		payload.Amount = order.Transaction.Amount
+	}
+
+	v := validator.New()
+	v.Check(payload.Amount > 0 && payload.Amount <= order.Transaction.Amount, "amount", "Amount must be more than zero and no more than the order took")
+	v.Check(strings.TrimSpace(payload.Reason) != "", "reason", "Give the reason the customer disputed the charge")
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	var resp jsonResponse
+
+	resp.ID, err = app.DB.InsertDispute(models.Dispute{
+		OrderID:       order.ID,
+		TransactionID: order.TransactionID,
+		Amount:        payload.Amount,
+		Currency:      order.Transaction.Currency,
+		Reason:        strings.TrimSpace(payload.Reason),
+		Actor:         app.authenticatedUser(r).Email,
+	})
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	resp.OK = true
+	resp.Message = fmt.Sprintf("Dispute %d has been opened", resp.ID)
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// ResolveDispute records whether an open dispute was won or lost
+func (app *application) ResolveDispute(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		ID     int    `json:"id"`
+		Status string `json:"status"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(payload.Status == models.DisputeWon || payload.Status == models.DisputeLost, "status", "Status must be won or lost")
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	err = app.DB.ResolveDispute(payload.ID, payload.Status, app.authenticatedUser(r).Email)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp jsonResponse
+	resp.OK = true
+	resp.Message = "Dispute " + payload.Status
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// MergeCustomers merges duplicate customers into a surviving one, moving their
+// orders, subscriptions, addresses and notes. A dry run returns the rows that
+// would move without changing anything.
+func (app *application) MergeCustomers(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		SurvivorID int   `json:"survivor_id"`
+		MergedIDs  []int `json:"merged_ids"`
+		DryRun     bool  `json:"dry_run"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(payload.SurvivorID > 0, "survivor_id", "Choose the customer to keep")
+	v.Check(len(payload.MergedIDs) > 0, "merged_ids", "Choose the customers to merge")
+	v.Check(len(payload.MergedIDs) <= maxPageSize, "merged_ids", fmt.Sprintf("Merge at most %d customers at once", maxPageSize))
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	result, err := app.DB.MergeCustomers(payload.SurvivorID, payload.MergedIDs, app.authenticatedUser(r).Email, payload.DryRun)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"maize/internal/export"
+	"maize/internal/models"
+	"maize/internal/validator"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// exportSheets names the tables that can be exported, and the sheets they are
+// written to
+var exportSheets = map[string]string{
+	"sales":        "Sales",
+	"subs":         "Subscriptions",
+	"transactions": "Transactions",
+	"customers":    "Customers",
+}
+
+// Export streams the sales, subscriptions, transactions or customers matching
+// the filters of the list views as CSV or XLSX. Amounts are written both in
+// cents and formatted. Rows are written as they are read, so once the export
+// has started an error can only cut it short; it is logged.
+func (app *application) Export(w http.ResponseWriter, r *http.Request) {
+	kind := chi.URLParam(r, "kind")
+
+	var payload struct {
+		Format string `json:"format"`
+		models.OrderFilter
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	sheet, ok := exportSheets[kind]
+
+	v := validator.New()
+	v.Check(ok, "kind", "Cannot export that list")
+	v.Check(export.Valid(payload.Format), "format", "Format must be csv or xlsx")
+	checkOrderFilter(v, payload.OrderFilter)
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	filename := fmt.Sprintf("%s-%s.%s", kind, time.Now().Format("2006-01-02"), payload.Format)
+	w.Header().Set("Content-Type", export.ContentType(payload.Format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+
+	out, err := export.New(w, payload.Format, sheet)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	switch kind {
+	case "sales":
+		err = app.exportOrders(out, false, payload.OrderFilter)
+	case "subs":
+		err = app.exportOrders(out, true, payload.OrderFilter)
+	case "transactions":
+		err = app.exportTransactions(out, payload.OrderFilter)
+	case "customers":
+		err = app.exportCustomers(out, payload.OrderFilter)
+	}
+	if err != nil {
+		app.errorLog.Printf("export of %s cut short: %s", kind, err)
+		return
+	}
+
+	err = out.Close()
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// exportOrders writes the one-off or subscription orders matching filter
+func (app *application) exportOrders(out export.Writer, recurring bool, filter models.OrderFilter) error {
+	err := out.Write("Order", "Date", "Status", "Customer", "Email", "Product", "Variant", "SKU",
+		"Quantity", "Shipping Method", "Shipping (cents)", "Shipping", "Amount (cents)", "Amount",
+		"Currency", "Transaction", "Card Last Four")
+	if err != nil {
+		return err
+	}
+
+	return app.DB.EachOrder(recurring, filter, func(o *models.Order) error {
+		return out.Write(
+			o.ID,
+			o.CreatedAt,
+			models.StatusName(o.StatusID),
+			o.Customer.FirstName+" "+o.Customer.LastName,
+			o.Customer.Email,
+			o.Maize.Name,
+			o.Variant.Name,
+			o.Variant.SKU,
+			o.Quantity,
+			o.ShippingMethod,
+			o.ShippingAmount,
+			export.Money(o.ShippingAmount, o.Transaction.Currency),
+			o.Transaction.Amount,
+			export.Money(o.Transaction.Amount, o.Transaction.Currency),
+			o.Transaction.Currency,
+			o.Transaction.ID,
+			o.Transaction.LastFour,
+		)
+	})
+}
+
+// exportTransactions writes the transactions of the orders matching filter
+func (app *application) exportTransactions(out export.Writer, filter models.OrderFilter) error {
+	err := out.Write("Transaction", "Date", "Status", "Amount (cents)", "Amount", "Currency",
+		"Card Last Four", "Card Expiry", "Payment Intent", "Bank Return Code", "Order", "Order Status",
+		"Product", "Customer", "Email")
+	if err != nil {
+		return err
+	}
+
+	return app.DB.EachTransaction(filter, func(t models.TransactionRecord) error {
+		return out.Write(
+			t.Transaction.ID,
+			t.Transaction.CreatedAt,
+			t.Status,
+			t.Transaction.Amount,
+			export.Money(t.Transaction.Amount, t.Transaction.Currency),
+			t.Transaction.Currency,
+			t.Transaction.LastFour,
+			fmt.Sprintf("%02d/%d", t.Transaction.ExpiryMonth, t.Transaction.ExpiryYear),
+			t.Transaction.PaymentIntent,
+			t.Transaction.BankReturnCode,
+			t.Order.ID,
+			models.StatusName(t.Order.StatusID),
+			t.Order.Maize.Name,
+			t.Order.Customer.FirstName+" "+t.Order.Customer.LastName,
+			t.Order.Customer.Email,
+		)
+	})
+}
+
+// exportCustomers writes the customers who placed orders matching filter
+func (app *application) exportCustomers(out export.Writer, filter models.OrderFilter) error {
+	err := out.Write("Customer", "First Name", "Last Name", "Email", "Customer Since", "Orders",
+		"Total Spent (cents)", "Total Spent", "First Order", "Last Order")
+	if err != nil {
+		return err
+	}
+
+	return app.DB.EachCustomer(filter, func(c models.CustomerRecord) error {
+		return out.Write(
+			c.Customer.ID,
+			c.Customer.FirstName,
+			c.Customer.LastName,
+			c.Customer.Email,
+			c.Customer.CreatedAt,
+			c.Orders,
+			c.TotalSpent,
+			export.Money(c.TotalSpent, ""),
+			c.FirstOrderAt,
+			c.LastOrderAt,
+		)
+	})
+}
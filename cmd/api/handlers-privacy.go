@@ -0,0 +1,192 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maize/internal/models"
+	"maize/internal/validator"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DataExport answers a data subject access request: everything held about a
+// customer's email address, as a ZIP of one JSON file per table along with
+// their invoices, or as a single JSON document. The export is audited.
+func (app *application) DataExport(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Email  string `json:"email"`
+		Format string `json:"format"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	payload.Email = strings.TrimSpace(payload.Email)
+	if payload.Format == "" {
+		payload.Format = "zip"
+	}
+
+	v := validator.New()
+	v.Check(payload.Email != "", "email", "Enter the customer's email address")
+	v.Check(payload.Format == "zip" || payload.Format == "json", "format", "Format must be zip or json")
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	tables, err := app.DB.GetCustomerData(payload.Email)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var orderIDs []string
+	customers := 0
+	for _, t := range tables {
+		switch t.Name {
+		case "customers":
+			customers = len(t.Rows)
+		case "orders":
+			for _, row := range t.Rows {
+				orderIDs = append(orderIDs, fmt.Sprint(row["id"]))
+			}
+		}
+	}
+
+	_, err = app.DB.InsertDataRequest(models.DataRequest{
+		Kind:      models.DataRequestExport,
+		Email:     payload.Email,
+		Customers: customers,
+		Detail:    fmt.Sprintf("%d tables, %d orders, as %s", len(tables), len(orderIDs), payload.Format),
+		Actor:     app.authenticatedUser(r).Email,
+	})
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	filename := fmt.Sprintf("customer-data-%s.%s", time.Now().Format("2006-01-02"), payload.Format)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+
+	if payload.Format == "json" {
+		bundle := make(map[string]interface{}, len(tables))
+		for _, t := range tables {
+			bundle[t.Name] = t.Rows
+		}
+		app.writeJSON(w, http.StatusOK, bundle)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+
+	err = app.writeDataZip(w, tables, orderIDs)
+	if err != nil {
+		app.errorLog.Printf("data export cut short: %s", err)
+	}
+}
+
+// writeDataZip writes the tables as JSON files and the invoices of the orders
+// as PDFs to a ZIP. Invoices the invoice service has not written are skipped.
+func (app *application) writeDataZip(w io.Writer, tables []*models.DataTable, orderIDs []string) error {
+	zw := zip.NewWriter(w)
+
+	for _, t := range tables {
+		f, err := zw.Create(t.Name + ".json")
+		if err != nil {
+			return err
+		}
+
+		rows := t.Rows
+		if rows == nil {
+			rows = []map[string]interface{}{}
+		}
+
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "\t")
+		err = enc.Encode(rows)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, id := range orderIDs {
+		err := addFile(zw, filepath.Join(app.config.invoicePath, id+".pdf"), "invoices/"+id+".pdf")
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+// addFile copies the file at path into the ZIP as name
+func addFile(zw *zip.Writer, path, name string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, in)
+	return err
+}
+
+// EraseCustomerData answers a request for erasure: the customer's name,
+// addresses, card details, notes and email address are pseudonymized, while
+// their orders, transactions and refunds stay for the accounts. Invoices are
+// kept as the law requires. The erasure is audited.
+func (app *application) EraseCustomerData(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Email   string `json:"email"`
+		Confirm string `json:"confirm"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	payload.Email = strings.TrimSpace(payload.Email)
+
+	customers, err := app.DB.CountCustomers(payload.Email)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(payload.Email != "", "email", "Enter the customer's email address")
+	v.Check(customers > 0, "email", "No customer has that email address")
+	v.Check(strings.EqualFold(strings.TrimSpace(payload.Confirm), payload.Email), "confirm", "Type the email address again to confirm the erasure")
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	dr, err := app.DB.EraseCustomer(payload.Email, app.authenticatedUser(r).Email)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp jsonResponse
+	resp.OK = true
+	resp.ID = dr.ID
+	resp.Message = fmt.Sprintf("Erased %d customer records; the customer is now %s", dr.Customers, dr.Email)
+	resp.Content = dr.Detail
+	app.writeJSON(w, http.StatusOK, resp)
+}
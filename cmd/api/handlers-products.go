@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"maize/internal/images"
+	"maize/internal/models"
+	"maize/internal/validator"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// imagePrefix is the path below which the web application serves stored images
+const imagePrefix = "/images/"
+
+// Inventory returns stock and sales for every product, with variants rolled up
+// under their parent
+func (app *application) Inventory(w http.ResponseWriter, r *http.Request) {
+	products, err := app.DB.GetInventoryReport()
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, products)
+}
+
+// OneProduct returns a single product along with its variants
+func (app *application) OneProduct(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	maizeID, _ := strconv.Atoi(id)
+
+	maize, err := app.DB.GetMaize(maizeID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	maize.Variants, err = app.DB.GetVariantsForMaize(maizeID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, maize)
+}
+
+// EditProduct adds a new product, or updates an existing one
+func (app *application) EditProduct(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	maizeID, _ := strconv.Atoi(id)
+
+	var maize models.Maize
+
+	err := app.readJSON(w, r, &maize)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(strings.TrimSpace(maize.Name) != "", "name", "Name is required")
+	v.Check(maize.Price > 0, "price", "Price must be greater than zero")
+	v.Check(maize.InventoryLevel >= 0, "inventory_level", "Inventory cannot be negative")
+	v.Check(!maize.IsRecurring || maize.PlanID != "", "plan_id", "Recurring products need a Stripe plan ID")
+	v.Check(models.ValidBackorderPolicy(maize.BackorderPolicy), "backorder_policy", "Backorder policy must be deny, allow or preorder")
+	v.Check(maize.LowStockThreshold >= 0, "low_stock_threshold", "Low stock threshold cannot be negative")
+	v.Check(maize.WeightGrams >= 0, "weight_grams", "Weight cannot be negative")
+	if maize.ExpectedShipDate != "" {
+		_, err = time.Parse("2006-01-02", maize.ExpectedShipDate)
+		v.Check(err == nil, "expected_ship_date", "Expected ship date must be a date")
+	}
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	var resp jsonResponse
+
+	if maizeID > 0 {
+		maize.ID = maizeID
+		err = app.DB.UpdateMaize(maize)
+		if err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+		resp.ID = maizeID
+	} else {
+		user := app.authenticatedUser(r)
+		resp.ID, err = app.DB.InsertMaize(maize, user.ID, user.Email)
+		if err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+	}
+
+	resp.OK = true
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// EditVariant adds a new variant to a product, or updates an existing one
+func (app *application) EditVariant(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	variantID, _ := strconv.Atoi(id)
+
+	var variant models.MaizeVariant
+
+	err := app.readJSON(w, r, &variant)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(variant.MaizeID > 0, "maize_id", "Variant must belong to a product")
+	v.Check(strings.TrimSpace(variant.Name) != "", "name", "Name is required")
+	v.Check(strings.TrimSpace(variant.SKU) != "", "sku", "SKU is required")
+	v.Check(variant.Price >= 0, "price", "Price cannot be negative")
+	v.Check(variant.InventoryLevel >= 0, "inventory_level", "Inventory cannot be negative")
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	var resp jsonResponse
+
+	if variantID > 0 {
+		existing, err := app.DB.GetVariant(variantID)
+		if err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+
+		if existing.MaizeID != variant.MaizeID {
+			app.badRequest(w, r, errors.New("variant does not belong to product"))
+			return
+		}
+
+		variant.ID = variantID
+		err = app.DB.UpdateVariant(variant)
+		if err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+		resp.ID = variantID
+	} else {
+		user := app.authenticatedUser(r)
+		resp.ID, err = app.DB.InsertVariant(variant, user.ID, user.Email)
+		if err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+	}
+
+	resp.OK = true
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// AdjustStock adds or removes stock from a product, or one of its variants, by hand
+func (app *application) AdjustStock(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	maizeID, _ := strconv.Atoi(id)
+
+	var payload struct {
+		VariantID      int    `json:"variant_id"`
+		QuantityChange int    `json:"quantity_change"`
+		Note           string `json:"note"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(payload.QuantityChange != 0, "quantity_change", "Quantity must not be zero")
+	v.Check(strings.TrimSpace(payload.Note) != "", "note", "Give a reason for the adjustment")
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	user := app.authenticatedUser(r)
+	err = app.DB.AdjustInventory(models.InventoryMovement{
+		MaizeID:        maizeID,
+		VariantID:      payload.VariantID,
+		QuantityChange: payload.QuantityChange,
+		Reason:         models.MovementAdjustment,
+		Note:           payload.Note,
+		UserID:         user.ID,
+		Actor:          user.Email,
+	})
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = false
+	resp.Message = "Stock adjusted"
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// InventoryMovements returns the recent stock movements of a product and its variants
+func (app *application) InventoryMovements(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	maizeID, _ := strconv.Atoi(id)
+
+	movements, err := app.DB.GetInventoryMovements(maizeID, 100)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, movements)
+}
+
+// DeleteVariant removes a variant from its product
+func (app *application) DeleteVariant(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	variantID, _ := strconv.Atoi(id)
+
+	err := app.DB.DeleteVariant(variantID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = false
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// UploadProductImage validates an uploaded product image, stores it along with
+// a generated thumbnail and points the product at the new files
+func (app *application) UploadProductImage(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	maizeID, _ := strconv.Atoi(id)
+
+	maize, err := app.DB.GetMaize(maizeID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	// leave room for the multipart framing around the file itself
+	r.Body = http.MaxBytesReader(w, r.Body, images.MaxUploadSize+1<<20)
+
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		app.badRequest(w, r, fmt.Errorf("could not read upload: %w", err))
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, images.MaxUploadSize+1))
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	upload, err := images.Process(data)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	name := make([]byte, 8)
+	_, err = rand.Read(name)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	base := fmt.Sprintf("products/%d/%s", maize.ID, hex.EncodeToString(name))
+	imageKey := base + upload.Extension
+	thumbKey := base + "_thumb" + upload.ThumbnailExt
+
+	err = app.Storage.Put(r.Context(), imageKey, bytes.NewReader(upload.Original), upload.ContentType)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.Storage.Put(r.Context(), thumbKey, bytes.NewReader(upload.Thumbnail), upload.ThumbnailType)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.DB.UpdateMaizeImage(maize.ID, imagePrefix+imageKey, imagePrefix+thumbKey)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	// remove the files this upload replaced; images under ./static are left alone
+	for _, old := range []string{maize.Image, maize.Thumbnail} {
+		if strings.HasPrefix(old, imagePrefix) {
+			err = app.Storage.Delete(r.Context(), strings.TrimPrefix(old, imagePrefix))
+			if err != nil {
+				app.errorLog.Println(err)
+			}
+		}
+	}
+
+	var resp struct {
+		Error     bool   `json:"error"`
+		Message   string `json:"message"`
+		Image     string `json:"image"`
+		Thumbnail string `json:"thumbnail"`
+	}
+
+	resp.Error = false
+	resp.Message = "Image uploaded"
+	resp.Image = imagePrefix + imageKey
+	resp.Thumbnail = imagePrefix + thumbKey
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"maize/internal/models"
+	"maize/internal/validator"
+	"net/http"
+	"time"
+)
+
+// maxReportPeriods caps the number of points a report returns
+const maxReportPeriods = 1000
+
+// reportRange reads and validates the date range of a report request. Dates
+// are YYYY-MM-DD and inclusive, in the IANA time zone given, UTC by default.
+// It writes the validation errors and returns false when they are bad.
+func (app *application) reportRange(w http.ResponseWriter, r *http.Request) (models.ReportRange, int, bool) {
+	var payload struct {
+		From     string `json:"from"`
+		To       string `json:"to"`
+		Interval string `json:"interval"`
+		Timezone string `json:"timezone"`
+		Limit    int    `json:"limit"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return models.ReportRange{}, 0, false
+	}
+
+	if payload.Interval == "" {
+		payload.Interval = models.IntervalDay
+	}
+	if payload.Timezone == "" {
+		payload.Timezone = "UTC"
+	}
+	if payload.Limit == 0 {
+		payload.Limit = 10
+	}
+
+	v := validator.New()
+
+	loc, err := time.LoadLocation(payload.Timezone)
+	v.Check(err == nil, "timezone", "Unknown time zone")
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	from, err := time.Parse("2006-01-02", payload.From)
+	v.Check(err == nil, "from", "Dates must be YYYY-MM-DD")
+	to, err := time.Parse("2006-01-02", payload.To)
+	v.Check(err == nil, "to", "Dates must be YYYY-MM-DD")
+	v.Check(!to.Before(from), "to", "The range cannot end before it starts")
+
+	v.Check(payload.Interval == models.IntervalDay || payload.Interval == models.IntervalWeek || payload.Interval == models.IntervalMonth,
+		"interval", "Interval must be day, week or month")
+	v.Check(payload.Limit > 0 && payload.Limit <= maxPageSize, "limit", fmt.Sprintf("Limit must be between 1 and %d", maxPageSize))
+
+	rr := models.NewReportRange(from, to, payload.Interval, loc)
+	if v.Valid() {
+		v.Check(len(rr.Periods()) <= maxReportPeriods, "interval", "Too many periods; choose a shorter range or a longer interval")
+	}
+
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return rr, 0, false
+	}
+
+	return rr, payload.Limit, true
+}
+
+// RevenueReport returns gross and net revenue, refunds and the average order
+// value per period
+func (app *application) RevenueReport(w http.ResponseWriter, r *http.Request) {
+	rr, _, ok := app.reportRange(w, r)
+	if !ok {
+		return
+	}
+
+	points, err := app.DB.RevenueReport(rr)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, points)
+}
+
+// SubscriptionReport returns new, churned and active subscriptions and MRR
+// per period
+func (app *application) SubscriptionReport(w http.ResponseWriter, r *http.Request) {
+	rr, _, ok := app.reportRange(w, r)
+	if !ok {
+		return
+	}
+
+	points, err := app.DB.SubscriptionReport(rr)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, points)
+}
+
+// TopProductsReport returns the best selling products of the range
+func (app *application) TopProductsReport(w http.ResponseWriter, r *http.Request) {
+	rr, limit, ok := app.reportRange(w, r)
+	if !ok {
+		return
+	}
+
+	products, err := app.DB.TopProducts(rr, limit)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, products)
+}
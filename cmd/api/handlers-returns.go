@@ -0,0 +1,364 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maize/internal/cards"
+	"maize/internal/keyring"
+	"maize/internal/models"
+	"maize/internal/urlsigner"
+	"maize/internal/validator"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// openReturn validates a return for quantity units of an order and opens it,
+// writing the response
+func (app *application) openReturn(w http.ResponseWriter, r *http.Request, order models.Order, quantity int, reason, actor string) {
+	maize, err := app.DB.GetMaize(order.MaizeID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	open, _, err := app.DB.ReturnedQuantity(order.ID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(order.StatusID == models.StatusCleared, "order_id", "Only paid orders can be returned")
+	v.Check(!maize.IsRecurring, "order_id", "Subscriptions cannot be returned")
+	v.Check(quantity > 0, "quantity", "Quantity must be at least one")
+	v.Check(quantity <= order.Quantity-open, "quantity", fmt.Sprintf("Only %d units of this order can still be returned", order.Quantity-open))
+	v.Check(strings.TrimSpace(reason) != "", "reason", "Please tell us why you are returning the order")
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	rt := models.Return{
+		OrderID:  order.ID,
+		Quantity: quantity,
+		Reason:   strings.TrimSpace(reason),
+	}
+
+	var resp jsonResponse
+
+	resp.ID, err = app.DB.InsertReturn(rt, actor)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	resp.OK = true
+	resp.Message = fmt.Sprintf("Return %d has been requested", resp.ID)
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// CustomerReturn lets a customer request a return, identifying the order by
+// its number and the email address it was placed with
+func (app *application) CustomerReturn(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		OrderID  int    `json:"order_id"`
+		Email    string `json:"email"`
+		Quantity int    `json:"quantity"`
+		Reason   string `json:"reason"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	order, err := app.DB.GetOrderByID(payload.OrderID)
+	if err != nil || !strings.EqualFold(order.Customer.Email, strings.TrimSpace(payload.Email)) {
+		// the same answer either way, so order numbers cannot be probed
+		app.badRequest(w, r, errors.New("no order found with that order number and email address"))
+		return
+	}
+
+	app.openReturn(w, r, order, payload.Quantity, payload.Reason, models.CustomerActor(order.CustomerID))
+}
+
+// OpenReturn opens a return on behalf of a customer
+func (app *application) OpenReturn(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		OrderID  int    `json:"order_id"`
+		Quantity int    `json:"quantity"`
+		Reason   string `json:"reason"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	order, err := app.DB.GetOrderByID(payload.OrderID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.openReturn(w, r, order, payload.Quantity, payload.Reason, app.authenticatedUser(r).Email)
+}
+
+// Returns returns all returns, optionally only those with a given status
+func (app *application) Returns(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Status string `json:"status"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	returns, err := app.DB.GetReturns(payload.Status)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, returns)
+}
+
+// GetReturn returns one return along with its history
+func (app *application) GetReturn(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	returnID, _ := strconv.Atoi(id)
+
+	rt, err := app.DB.GetReturn(returnID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, rt)
+}
+
+// returnAction reads the return ID and an optional note from the request body
+// and loads the return
+func (app *application) returnAction(w http.ResponseWriter, r *http.Request) (models.Return, string, error) {
+	var payload struct {
+		ID   int    `json:"id"`
+		Note string `json:"note"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		return models.Return{}, "", err
+	}
+
+	rt, err := app.DB.GetReturn(payload.ID)
+	if err != nil {
+		return rt, "", err
+	}
+
+	return rt, strings.TrimSpace(payload.Note), nil
+}
+
+// returnLabelTTL is how long the link to a return label works
+const returnLabelTTL = 30 * 24 * time.Hour
+
+// ApproveReturn approves a return and emails the customer a signed link to
+// their return label
+func (app *application) ApproveReturn(w http.ResponseWriter, r *http.Request) {
+	rt, note, err := app.returnAction(w, r)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	sign, err := app.Keys.Signer(keyring.PurposeURLSigning)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	link := fmt.Sprintf("%s/returns/label?id=%d", app.config.frontend, rt.ID)
+	rt.LabelURL, err = sign.Sign(link, urlsigner.PurposeDownload, returnLabelTTL)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.DB.TransitionReturn(rt, models.ReturnApproved, app.authenticatedUser(r).Email, note)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = false
+	resp.Message = "Return approved"
+
+	data := struct {
+		Return models.Return
+		Link   string
+	}{
+		Return: rt,
+		Link:   rt.LabelURL,
+	}
+
+	err = app.SendMail("info@maize.com", rt.Order.Customer.Email, fmt.Sprintf("Your return %d has been approved", rt.ID), "return-approved", data)
+	if err != nil {
+		app.errorLog.Println(err)
+		resp.Message = "Return approved, but the return label could not be emailed"
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// RejectReturn rejects a return that has not been received
+func (app *application) RejectReturn(w http.ResponseWriter, r *http.Request) {
+	rt, note, err := app.returnAction(w, r)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.DB.TransitionReturn(rt, models.ReturnRejected, app.authenticatedUser(r).Email, note)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = false
+	resp.Message = "Return rejected"
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// ReceiveReturn records that the goods of an approved return have arrived,
+// puts them back into stock and refunds them. When the refund fails the return
+// stays refunding, and calling this again retries the refund.
+func (app *application) ReceiveReturn(w http.ResponseWriter, r *http.Request) {
+	rt, note, err := app.returnAction(w, r)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	user := app.authenticatedUser(r)
+
+	if rt.Status == models.ReturnApproved {
+		err = app.DB.TransitionReturn(rt, models.ReturnReceived, user.Email, note)
+		if err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+		rt.Status = models.ReturnReceived
+
+		err = app.DB.AdjustInventory(models.InventoryMovement{
+			MaizeID:        rt.Order.MaizeID,
+			VariantID:      rt.Order.VariantID,
+			OrderID:        rt.OrderID,
+			QuantityChange: rt.Quantity,
+			Reason:         models.MovementReturn,
+			Note:           fmt.Sprintf("Return %d", rt.ID),
+			UserID:         user.ID,
+			Actor:          user.Email,
+		})
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+	}
+
+	// the return is moved to refunding before the card is refunded, so only
+	// one request can claim the refund
+	if rt.Status == models.ReturnReceived {
+		// the units returned are refunded at the price paid for them; shipping is not refunded
+		rt.RefundAmount = rt.Order.Amount * rt.Quantity / rt.Order.Quantity
+
+		err = app.DB.TransitionReturn(rt, models.ReturnRefunding, user.Email, "Refund started")
+		if err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+		rt.Status = models.ReturnRefunding
+	}
+
+	if rt.Status != models.ReturnRefunding {
+		app.badRequest(w, r, models.ErrReturnTransition)
+		return
+	}
+
+	card := cards.Card{
+		Secret:   app.config.stripe.secret,
+		Key:      app.config.stripe.key,
+		Currency: rt.Order.Transaction.Currency,
+	}
+
+	// a return that is still refunding may or may not have been refunded
+	// before, so the refund is keyed by the return and Stripe issues it once
+	err = card.RefundOnce(rt.Order.Transaction.PaymentIntent, rt.RefundAmount, fmt.Sprintf("return-%d", rt.ID))
+	if err != nil {
+		app.badRequest(w, r, fmt.Errorf("goods received, but the refund failed: %w", err))
+		return
+	}
+
+	err = app.DB.TransitionReturn(rt, models.ReturnRefunded, user.Email, "Refund issued")
+	if err != nil {
+		app.badRequest(w, r, errors.New("refund issued, but the database update failed"))
+		return
+	}
+
+	_, err = app.DB.InsertRefund(models.Refund{
+		OrderID:       rt.OrderID,
+		TransactionID: rt.Order.TransactionID,
+		Amount:        rt.RefundAmount,
+		Currency:      rt.Order.Transaction.Currency,
+		Reason:        fmt.Sprintf("Return %d", rt.ID),
+		Actor:         user.Email,
+	})
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
+	_, refunded, err := app.DB.ReturnedQuantity(rt.OrderID)
+	if err != nil {
+		app.errorLog.Println(err)
+	} else if refunded >= rt.Order.Quantity {
+		err = app.DB.UpdateTransactionStatus(rt.Order.TransactionID, models.TransactionRefunded)
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+		err = app.DB.TransitionOrderStatus(rt.OrderID, models.StatusRefunded, user.Email, fmt.Sprintf("Fully returned, last with return %d", rt.ID))
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+	} else {
+		err = app.DB.UpdateTransactionStatus(rt.Order.TransactionID, models.TransactionPartiallyRefunded)
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = false
+	resp.Message = "Return received and refunded"
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"maize/internal/models"
+	"maize/internal/validator"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi"
+)
+
+// ShippingQuote returns the subtotal of an item and the shipping methods
+// available for sending it to a country, so the buyer can choose one
+func (app *application) ShippingQuote(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		ProductID string `json:"product_id"`
+		VariantID string `json:"variant_id"`
+		Quantity  int    `json:"quantity"`
+		Country   string `json:"country"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if payload.Quantity < 1 {
+		payload.Quantity = 1
+	}
+
+	maizeID, _ := strconv.Atoi(payload.ProductID)
+	variantID, _ := strconv.Atoi(payload.VariantID)
+
+	subtotal, quotes, err := app.DB.ShippingOptions(maizeID, variantID, payload.Quantity, payload.Country)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error    bool                   `json:"error"`
+		Subtotal int                    `json:"subtotal"`
+		Quotes   []models.ShippingQuote `json:"quotes"`
+	}
+
+	resp.Error = false
+	resp.Subtotal = subtotal
+	resp.Quotes = quotes
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// ShippingZones returns all shipping zones along with their rates
+func (app *application) ShippingZones(w http.ResponseWriter, r *http.Request) {
+	zones, err := app.DB.GetShippingZones()
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, zones)
+}
+
+// EditShippingZone adds a new shipping zone, or updates an existing one
+func (app *application) EditShippingZone(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	zoneID, _ := strconv.Atoi(id)
+
+	var zone models.ShippingZone
+
+	err := app.readJSON(w, r, &zone)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(strings.TrimSpace(zone.Name) != "", "name", "Name is required")
+	v.Check(strings.TrimSpace(zone.Countries) != "", "countries", "List at least one country code, or * for everywhere else")
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	var resp jsonResponse
+
+	if zoneID > 0 {
+		zone.ID = zoneID
+		err = app.DB.UpdateShippingZone(zone)
+		if err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+		resp.ID = zoneID
+	} else {
+		resp.ID, err = app.DB.InsertShippingZone(zone)
+		if err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+	}
+
+	resp.OK = true
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// DeleteShippingZone deletes a shipping zone and its rates
+func (app *application) DeleteShippingZone(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	zoneID, _ := strconv.Atoi(id)
+
+	err := app.DB.DeleteShippingZone(zoneID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = false
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// EditShippingRate adds a new rate to a shipping zone, or updates an existing one
+func (app *application) EditShippingRate(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	rateID, _ := strconv.Atoi(id)
+
+	var rate models.ShippingRate
+
+	err := app.readJSON(w, r, &rate)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(rate.ZoneID > 0, "zone_id", "Rate must belong to a zone")
+	v.Check(strings.TrimSpace(rate.Name) != "", "name", "Name is required")
+	v.Check(models.ValidShippingRule(rate.Rule), "rule", "Rule must be flat, weight or free_over")
+	v.Check(rate.Amount >= 0, "amount", "Amount cannot be negative")
+	v.Check(rate.PerKg >= 0, "per_kg", "Per kg charge cannot be negative")
+	v.Check(rate.FreeOver >= 0, "free_over", "Free over amount cannot be negative")
+	v.Check(rate.Rule != models.RuleFreeOver || rate.FreeOver > 0, "free_over", "Free over rates need a threshold")
+	v.Check(rate.MaxWeightGrams >= 0, "max_weight_grams", "Maximum weight cannot be negative")
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	var resp jsonResponse
+
+	if rateID > 0 {
+		rate.ID = rateID
+		err = app.DB.UpdateShippingRate(rate)
+		if err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+		resp.ID = rateID
+	} else {
+		resp.ID, err = app.DB.InsertShippingRate(rate)
+		if err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+	}
+
+	resp.OK = true
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// DeleteShippingRate deletes a shipping rate
+func (app *application) DeleteShippingRate(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	rateID, _ := strconv.Atoi(id)
+
+	err := app.DB.DeleteShippingRate(rateID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = false
+	app.writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maize/internal/models"
+	"maize/internal/validator"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// trackingURLs maps the carriers we know about to their tracking pages
+var trackingURLs = map[string]string{
+	"usps":  "https://tools.usps.com/go/TrackConfirmAction?tLabels=%s",
+	"ups":   "https://www.ups.com/track?tracknum=%s",
+	"fedex": "https://www.fedex.com/fedextrack/?trknbr=%s",
+	"dhl":   "https://www.dhl.com/en/express/tracking.html?AWB=%s",
+}
+
+// trackingURL returns the carrier's tracking page for a shipment, or an empty
+// string for carriers we do not know
+func trackingURL(carrier, trackingNumber string) string {
+	format, ok := trackingURLs[strings.ToLower(strings.TrimSpace(carrier))]
+	if !ok || trackingNumber == "" {
+		return ""
+	}
+	return fmt.Sprintf(format, url.QueryEscape(trackingNumber))
+}
+
+// loadFulfillment adds the addresses and shipments of an order to it
+func (app *application) loadFulfillment(order *models.Order) error {
+	if order.BillingAddressID > 0 {
+		a, err := app.DB.GetAddress(order.BillingAddressID)
+		if err != nil {
+			return err
+		}
+		order.BillingAddress = &a
+	}
+
+	if order.ShippingAddressID > 0 {
+		a, err := app.DB.GetAddress(order.ShippingAddressID)
+		if err != nil {
+			return err
+		}
+		order.ShippingAddress = &a
+	}
+
+	shipments, err := app.DB.GetShipmentsForOrder(order.ID)
+	if err != nil {
+		return err
+	}
+
+	order.Shipments = shipments
+	order.FulfillmentStatus = models.FulfillmentStatus(shipments)
+
+	return nil
+}
+
+// ShipOrder records a shipment against an order and emails the customer a
+// shipping notification
+func (app *application) ShipOrder(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		OrderID        int    `json:"order_id"`
+		Carrier        string `json:"carrier"`
+		TrackingNumber string `json:"tracking_number"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(strings.TrimSpace(payload.Carrier) != "", "carrier", "Carrier is required")
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	order, err := app.DB.GetOrderByID(payload.OrderID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if order.StatusID != models.StatusCleared {
+		app.badRequest(w, r, errors.New("only paid orders can be shipped"))
+		return
+	}
+
+	if order.ShippingAddressID == 0 {
+		app.badRequest(w, r, errors.New("order has no shipping address"))
+		return
+	}
+
+	shipment := models.Shipment{
+		OrderID:        order.ID,
+		Carrier:        strings.TrimSpace(payload.Carrier),
+		TrackingNumber: strings.TrimSpace(payload.TrackingNumber),
+		ShippedAt:      time.Now(),
+	}
+
+	shipment.ID, err = app.DB.InsertShipment(shipment)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.loadFulfillment(&order)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	data := struct {
+		Order       models.Order
+		Shipment    models.Shipment
+		TrackingURL string
+	}{
+		Order:       order,
+		Shipment:    shipment,
+		TrackingURL: trackingURL(shipment.Carrier, shipment.TrackingNumber),
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = false
+	resp.Message = "Order shipped"
+
+	err = app.SendMail("info@maize.com", order.Customer.Email, fmt.Sprintf("Your Maize order %d has shipped", order.ID), "shipping-notification", data)
+	if err != nil {
+		app.errorLog.Println(err)
+		resp.Message = "Order shipped, but the shipping notification could not be sent"
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// MarkDelivered records that a shipment has reached the customer
+func (app *application) MarkDelivered(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		ID int `json:"id"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	shipment, err := app.DB.GetShipment(payload.ID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if shipment.DeliveredAt != nil {
+		app.badRequest(w, r, errors.New("shipment has already been delivered"))
+		return
+	}
+
+	err = app.DB.MarkShipmentDelivered(shipment.ID, time.Now())
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Error = false
+	resp.Message = "Shipment delivered"
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"maize/internal/models"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi"
+)
+
+// ListTokens returns the user's unexpired tokens, one for each device they
+// are logged in on, marking the one the request was made with
+func (app *application) ListTokens(w http.ResponseWriter, r *http.Request) {
+	tokens, err := app.DB.GetTokensForUser(app.authenticatedUser(r).ID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	current, _ := app.bearerToken(r)
+
+	type token struct {
+		*models.Token
+		Current bool `json:"current"`
+	}
+
+	resp := []token{}
+	for _, t := range tokens {
+		resp = append(resp, token{Token: t, Current: t.IsToken(current)})
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// RevokeToken revokes one of the user's tokens, logging out the device it was
+// issued to
+func (app *application) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	tokenID, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	err := app.DB.RevokeToken(app.authenticatedUser(r).ID, tokenID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Message = "Token revoked"
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// RevokeOtherTokens revokes every token of the user but the one the request
+// was made with, logging out all their other devices
+func (app *application) RevokeOtherTokens(w http.ResponseWriter, r *http.Request) {
+	current, err := app.bearerToken(r)
+	if err != nil {
+		app.invalidCredentials(w)
+		return
+	}
+
+	n, err := app.DB.RevokeOtherTokens(app.authenticatedUser(r).ID, current)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Message = fmt.Sprintf("Logged out of %d other devices", n)
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// Logout revokes the token the request was made with
+func (app *application) Logout(w http.ResponseWriter, r *http.Request) {
+	current, err := app.bearerToken(r)
+	if err != nil {
+		app.invalidCredentials(w)
+		return
+	}
+
+	err = app.DB.RevokePlainTextToken(current)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Message = "Logged out"
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// deviceName makes up a name for the device a token is issued to from its
+// User-Agent header, such as "Firefox on Linux"
+func deviceName(userAgent string) string {
+	browsers := []struct{ token, name string }{
+		// checked in order, since most browsers claim to be the ones after them
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+	}
+	systems := []struct{ token, name string }{
+		{"Android", "Android"},
+		{"iPhone", "iOS"},
+		{"iPad", "iPadOS"},
+		{"Mac OS X", "macOS"},
+		{"Windows", "Windows"},
+		{"Linux", "Linux"},
+	}
+
+	browser, system := "", ""
+	for _, b := range browsers {
+		if strings.Contains(userAgent, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	for _, s := range systems {
+		if strings.Contains(userAgent, s.token) {
+			system = s.name
+			break
+		}
+	}
+
+	switch {
+	case browser != "" && system != "":
+		return browser + " on " + system
+	case browser != "":
+		return browser
+	case system != "":
+		return system
+	case userAgent != "":
+		if len(userAgent) > 60 {
+			userAgent = userAgent[:60]
+		}
+		return userAgent
+	default:
+		return "Unknown device"
+	}
+}
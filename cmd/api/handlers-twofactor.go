@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"maize/internal/models"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+)
+
+// twoFactorCode is the body of the requests that take a two-factor code
+type twoFactorCode struct {
+	Code string `json:"code"`
+}
+
+// TwoFactorStatus returns whether the user has two-factor authentication on,
+// how many recovery codes they have left and whether it is required
+func (app *application) TwoFactorStatus(w http.ResponseWriter, r *http.Request) {
+	user := app.authenticatedUser(r)
+
+	left, err := app.DB.RecoveryCodesLeft(user.ID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error             bool `json:"error"`
+		Enabled           bool `json:"enabled"`
+		Required          bool `json:"required"`
+		RecoveryCodesLeft int  `json:"recovery_codes_left"`
+	}
+
+	resp.Enabled = user.TwoFactorEnabled
+	resp.Required = app.config.require2FA
+	resp.RecoveryCodesLeft = left
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// StartTwoFactor gives the user a new TOTP secret to enrol in their
+// authenticator app, which takes effect once EnableTwoFactor confirms it
+func (app *application) StartTwoFactor(w http.ResponseWriter, r *http.Request) {
+	setup, err := app.DB.StartTwoFactor(*app.authenticatedUser(r))
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error bool `json:"error"`
+		models.TwoFactorSetup
+	}
+
+	resp.TwoFactorSetup = setup
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// EnableTwoFactor turns on two-factor authentication once the user sends a
+// code from their app, logs out their other devices, and returns their
+// recovery codes
+func (app *application) EnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var payload twoFactorCode
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	// the device enabling it stays logged in; every other is logged out
+	current, _ := app.bearerToken(r)
+
+	codes, err := app.DB.EnableTwoFactor(app.authenticatedUser(r).ID, payload.Code, current)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeRecoveryCodes(w, codes)
+}
+
+// NewRecoveryCodes replaces the user's recovery codes, given a code from
+// their app or one of the codes being replaced
+func (app *application) NewRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	var payload twoFactorCode
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	user := app.authenticatedUser(r)
+
+	err = app.DB.VerifyTwoFactor(user.ID, payload.Code)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	codes, err := app.DB.NewRecoveryCodes(user.ID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeRecoveryCodes(w, codes)
+}
+
+// writeRecoveryCodes writes recovery codes for the user to keep
+func (app *application) writeRecoveryCodes(w http.ResponseWriter, codes []string) {
+	var resp struct {
+		Error         bool     `json:"error"`
+		Message       string   `json:"message"`
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+
+	resp.Message = "Keep these recovery codes somewhere safe: each logs you in once without your app, and they will not be shown again"
+	resp.RecoveryCodes = codes
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// DisableTwoFactor turns off two-factor authentication, given a code, unless
+// the application requires it
+func (app *application) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if app.config.require2FA {
+		app.badRequest(w, r, errors.New("two-factor authentication is required, so it cannot be turned off"))
+		return
+	}
+
+	var payload twoFactorCode
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	user := app.authenticatedUser(r)
+
+	err = app.DB.VerifyTwoFactor(user.ID, payload.Code)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.DB.DisableTwoFactor(user.ID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Message = "Two-factor authentication is off"
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// ResetUserTwoFactor turns off two-factor authentication for another user
+// who has lost their app and recovery codes, and signs them out, so they can
+// log in with their password and enrol again
+func (app *application) ResetUserTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	if userID == app.authenticatedUser(r).ID {
+		app.badRequest(w, r, errors.New("you cannot reset your own two-factor authentication; turn it off instead"))
+		return
+	}
+
+	_, err := app.DB.GetOneUserByID(userID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.DB.ResetTwoFactor(userID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.infoLog.Printf("two-factor authentication of user %d reset by %s", userID, app.authenticatedUser(r).Email)
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	resp.Message = "Two-factor authentication reset"
+	app.writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"maize/internal/models"
+	"time"
+)
+
+// watchLowStock periodically emails the users who manage the catalog about
+// products whose stock has fallen below their low stock threshold. Each
+// product is reported once, until it is restocked to at least its threshold.
+func (app *application) watchLowStock(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		app.alertLowStock()
+	}
+}
+
+// alertLowStock sends a single round of low stock alerts
+func (app *application) alertLowStock() {
+	err := app.DB.ResetLowStockAlerts()
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	products, err := app.DB.GetLowStockMaize()
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	if len(products) == 0 {
+		return
+	}
+
+	users, err := app.DB.GetUsersWithPermission(models.PermCatalogWrite)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	for _, p := range products {
+		data := struct {
+			Product *models.Maize
+			Link    string
+		}{
+			Product: p,
+			Link:    fmt.Sprintf("%s/admin/all-products/%d", app.config.frontend, p.ID),
+		}
+
+		subject := fmt.Sprintf("Low stock: %s", p.Name)
+
+		sent := false
+		for _, u := range users {
+			err = app.SendMail("info@maize.com", u.Email, subject, "low-stock", data)
+			if err != nil {
+				app.errorLog.Println(err)
+				continue
+			}
+			sent = true
+		}
+
+		// try again next time if nobody could be told
+		if sent {
+			err = app.DB.MarkLowStockAlerted(p.ID)
+			if err != nil {
+				app.errorLog.Println(err)
+			}
+		}
+	}
+}
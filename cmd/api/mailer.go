@@ -5,6 +5,7 @@ import (
 	"embed"
 	"fmt"
 	"html/template"
+	"maize/internal/models"
 	"time"
 
 	mail "github.com/xhit/go-simple-mail/v2"
@@ -13,7 +14,23 @@ import (
 //go:embed templates
 var emailTemplateFS embed.FS
 
+// SendMail renders the tmpl email templates with data and sends them to one
+// address, recording the email in the email log
 func (app *application) SendMail(from, to, subject, tmpl string, data interface{}) error {
+	err := app.sendMail(from, to, subject, tmpl, data)
+
+	entry := models.EmailLog{To: to, Subject: subject, Template: tmpl}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	if logErr := app.DB.LogEmail(entry); logErr != nil {
+		app.errorLog.Println(logErr)
+	}
+
+	return err
+}
+
+func (app *application) sendMail(from, to, subject, tmpl string, data interface{}) error {
 	templateToRender := fmt.Sprintf("templates/%s.html.tmpl", tmpl)
 
 	t, err := template.New("email-html").ParseFS(emailTemplateFS, templateToRender)
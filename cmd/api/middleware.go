@@ -1,14 +1,122 @@
 package main
 
-import "net/http"
+import (
+	"context"
+	"maize/internal/models"
+	"net/http"
+)
+
+type contextKey string
+
+// userContextKey is the request context key for the authenticated user
+const userContextKey = contextKey("user")
+
+// apiKeyContextKey is the request context key for the API key a request was
+// made with, if it was made with one rather than a token
+const apiKeyContextKey = contextKey("api-key")
 
 func (app *application) Auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		_, err := app.authenticateToken(r)
+		user, key, err := app.authenticateToken(r)
 		if err != nil {
 			app.invalidCredentials(w)
 			return
 		}
+
+		ctx := context.WithValue(r.Context(), userContextKey, user)
+		if key != nil {
+			ctx = context.WithValue(ctx, apiKeyContextKey, key)
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// NoAPIKeys turns away requests made with an API key, for routes that only a
+// user logged in on a device may use, such as managing their tokens or the
+// API keys themselves. It must run after Auth.
+func (app *application) NoAPIKeys(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.authenticatedAPIKey(r) != nil {
+			var payload struct {
+				Error   bool   `json:"error"`
+				Message string `json:"message"`
+			}
+
+			payload.Error = true
+			payload.Message = "This cannot be done with an API key"
+
+			app.writeJSON(w, http.StatusForbidden, payload)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Require2FA turns away users who have not turned on two-factor
+// authentication, when the application requires it, so the only thing they
+// can do is turn it on. It must run after Auth.
+func (app *application) Require2FA(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// an API key is a credential of its own, used without a person to
+		// type a code
+		if app.config.require2FA && !app.authenticatedUser(r).TwoFactorEnabled && app.authenticatedAPIKey(r) == nil {
+			var payload struct {
+				Error   bool   `json:"error"`
+				Message string `json:"message"`
+			}
+
+			payload.Error = true
+			payload.Message = "Turn on two-factor authentication to continue"
+
+			app.writeJSON(w, http.StatusForbidden, payload)
+			return
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
+
+// RequirePermission returns middleware that lets a request through only when
+// the user the Auth middleware found has perm through one of their roles and,
+// for a request made with an API key, the key has perm as a scope. It must run
+// after Auth.
+func (app *application) RequirePermission(perm string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if key := app.authenticatedAPIKey(r); key != nil && !key.HasScope(perm) {
+				app.forbidden(w, perm)
+				return
+			}
+
+			ok, err := app.DB.HasPermission(app.authenticatedUser(r).ID, perm)
+			if err != nil {
+				app.errorLog.Println(err)
+				app.badRequest(w, r, err)
+				return
+			}
+			if !ok {
+				app.forbidden(w, perm)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// authenticatedUser returns the user the Auth middleware found for the request
+func (app *application) authenticatedUser(r *http.Request) *models.User {
+	user, ok := r.Context().Value(userContextKey).(*models.User)
+	if !ok {
+		return &models.User{}
+	}
+	return user
+}
+
+// authenticatedAPIKey returns the API key the request was made with, or nil
+// when it was made with a token
+func (app *application) authenticatedAPIKey(r *http.Request) *models.APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey).(*models.APIKey)
+	return key
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"maize/internal/models"
 	"net/http"
 
 	"github.com/go-chi/chi"
@@ -22,6 +23,9 @@ func (app *application) routes() http.Handler {
 
 	mux.Post("/api/payment-intent", app.GetPaymentIntent)
 
+	mux.Post("/api/shipping-quote", app.ShippingQuote)
+	mux.Post("/api/returns", app.CustomerReturn)
+
 	mux.Get("/api/maize/{id}", app.GetMaizeByID)
 
 	mux.Post("/api/create-customer-and-subscribe-to-plan", app.CreateCustomerAndSubscribeToPlan)
@@ -31,22 +35,99 @@ func (app *application) routes() http.Handler {
 	mux.Post("/api/forgot-password", app.SendPasswordResetEmail)
 	mux.Post("/api/reset-password", app.ResetPassword)
 
+	// a user's tokens, one for each device they are logged in on
+	mux.Route("/api/tokens", func(mux chi.Router) {
+		mux.Use(app.Auth)
+		mux.Use(app.NoAPIKeys)
+
+		mux.Post("/list", app.ListTokens)
+		mux.Post("/revoke/{id}", app.RevokeToken)
+		mux.Post("/revoke-others", app.RevokeOtherTokens)
+	})
+	mux.With(app.Auth, app.NoAPIKeys).Post("/api/logout", app.Logout)
+
+	// two-factor enrolment is open to users who have not turned it on, even
+	// where Require2FA turns them away from everything else
+	mux.Route("/api/2fa", func(mux chi.Router) {
+		mux.Use(app.Auth)
+		mux.Use(app.NoAPIKeys)
+
+		mux.Post("/status", app.TwoFactorStatus)
+		mux.Post("/setup", app.StartTwoFactor)
+		mux.Post("/enable", app.EnableTwoFactor)
+		mux.Post("/recovery-codes", app.NewRecoveryCodes)
+		mux.Post("/disable", app.DisableTwoFactor)
+	})
+
 	mux.Route("/api/admin", func(mux chi.Router) {
 		mux.Use(app.Auth)
+		mux.Use(app.Require2FA)
+
+		// each route requires a permission, granted to users by their roles
+		can := app.RequirePermission
+
+		mux.With(can(models.PermTerminalCharge)).Post("/virtual-terminal-succeeded", app.VirtualTerminalPaymentSucceeded)
+		mux.With(can(models.PermOrdersRead)).Post("/all-sales", app.AllSales)
+		mux.With(can(models.PermOrdersRead)).Post("/all-subs", app.AllSubs)
+		mux.With(can(models.PermExportsRead)).Post("/export/{kind}", app.Export)
+
+		mux.With(can(models.PermReportsRead)).Post("/reports/revenue", app.RevenueReport)
+		mux.With(can(models.PermReportsRead)).Post("/reports/subscriptions", app.SubscriptionReport)
+		mux.With(can(models.PermReportsRead)).Post("/reports/top-products", app.TopProductsReport)
+
+		mux.With(can(models.PermOrdersRead)).Post("/get-sale/{id}", app.GetSale)
+		mux.With(can(models.PermRefundsWrite)).Post("/refund", app.RefundPayment)
+		mux.With(can(models.PermSubscriptionsWrite)).Post("/cancel-sub", app.CancelSub)
+		mux.With(can(models.PermOrdersWrite)).Post("/ship-order", app.ShipOrder)
+		mux.With(can(models.PermOrdersWrite)).Post("/shipments/delivered", app.MarkDelivered)
+
+		mux.With(can(models.PermReturnsRead)).Post("/returns", app.Returns)
+		mux.With(can(models.PermReturnsWrite)).Post("/returns/open", app.OpenReturn)
+		mux.With(can(models.PermReturnsWrite)).Post("/returns/approve", app.ApproveReturn)
+		mux.With(can(models.PermReturnsWrite)).Post("/returns/reject", app.RejectReturn)
+		mux.With(can(models.PermReturnsWrite), can(models.PermRefundsWrite)).Post("/returns/receive", app.ReceiveReturn)
+		mux.With(can(models.PermReturnsRead)).Post("/returns/{id}", app.GetReturn)
+
+		mux.With(can(models.PermOrdersRead)).Post("/backorders", app.Backorders)
+		mux.With(can(models.PermOrdersWrite)).Post("/backorders/fulfil", app.FulfilBackorder)
+		mux.With(can(models.PermOrdersWrite)).Post("/backorders/cancel", app.CancelBackorder)
+
+		mux.With(can(models.PermCustomersRead)).Post("/customers", app.Customers)
+		mux.With(can(models.PermCustomersWrite)).Post("/customers/merge", app.MergeCustomers)
+		mux.With(can(models.PermCustomersPrivacy)).Post("/customers/data-export", app.DataExport)
+		mux.With(can(models.PermCustomersPrivacy)).Post("/customers/erase", app.EraseCustomerData)
+		mux.With(can(models.PermCustomersRead)).Post("/customers/{id}", app.GetCustomer)
+		mux.With(can(models.PermCustomersWrite)).Post("/customers/notes/{id}", app.AddCustomerNote)
+		mux.With(can(models.PermCustomersWrite)).Post("/customers/disputes/open", app.OpenDispute)
+		mux.With(can(models.PermCustomersWrite)).Post("/customers/disputes/resolve", app.ResolveDispute)
 
-		mux.Post("/virtual-terminal-succeeded", app.VirtualTerminalPaymentSucceeded)
-		mux.Post("/all-sales", app.AllSales)
-		mux.Post("/all-subs", app.AllSubs)
+		mux.With(can(models.PermUsersRead)).Post("/all-users", app.AllUsers)
+		mux.With(can(models.PermUsersRead)).Post("/all-users/{id}", app.OneUser)
+		mux.With(can(models.PermUsersWrite)).Post("/all-users/edit/{id}", app.EditUser)
+		mux.With(can(models.PermUsersWrite)).Post("/all-users/delete/{id}", app.DeleteUser)
+		mux.With(can(models.PermUsersWrite)).Post("/all-users/2fa/reset/{id}", app.ResetUserTwoFactor)
+		mux.With(can(models.PermUsersRead)).Post("/roles", app.Roles)
 
-		mux.Post("/get-sale/{id}", app.GetSale)
-		mux.Post("/refund", app.RefundPayment)
-		mux.Post("/cancel-sub", app.CancelSub)
+		// API keys act for whoever made them, so only a logged-in user may
+		// manage them, never another key
+		mux.With(can(models.PermAPIKeysWrite), app.NoAPIKeys).Post("/api-keys", app.APIKeys)
+		mux.With(can(models.PermAPIKeysWrite), app.NoAPIKeys).Post("/api-keys/create", app.CreateAPIKey)
+		mux.With(can(models.PermAPIKeysWrite), app.NoAPIKeys).Post("/api-keys/revoke/{id}", app.RevokeAPIKey)
 
-		mux.Post("/all-users", app.AllUsers)
-		mux.Post("/all-users/{id}", app.OneUser)
-		mux.Post("/all-users/edit/{id}", app.EditUser)
-		mux.Post("/all-users/delete/{id}", app.DeleteUser)
+		mux.With(can(models.PermCatalogRead)).Post("/inventory", app.Inventory)
+		mux.With(can(models.PermCatalogRead)).Post("/all-products/{id}", app.OneProduct)
+		mux.With(can(models.PermCatalogWrite)).Post("/all-products/edit/{id}", app.EditProduct)
+		mux.With(can(models.PermCatalogWrite)).Post("/all-products/image/{id}", app.UploadProductImage)
+		mux.With(can(models.PermCatalogWrite)).Post("/all-products/stock/{id}", app.AdjustStock)
+		mux.With(can(models.PermCatalogRead)).Post("/all-products/movements/{id}", app.InventoryMovements)
+		mux.With(can(models.PermCatalogWrite)).Post("/all-products/variants/edit/{id}", app.EditVariant)
+		mux.With(can(models.PermCatalogWrite)).Post("/all-products/variants/delete/{id}", app.DeleteVariant)
 
+		mux.With(can(models.PermCatalogRead)).Post("/shipping-zones", app.ShippingZones)
+		mux.With(can(models.PermCatalogWrite)).Post("/shipping-zones/edit/{id}", app.EditShippingZone)
+		mux.With(can(models.PermCatalogWrite)).Post("/shipping-zones/delete/{id}", app.DeleteShippingZone)
+		mux.With(can(models.PermCatalogWrite)).Post("/shipping-rates/edit/{id}", app.EditShippingRate)
+		mux.With(can(models.PermCatalogWrite)).Post("/shipping-rates/delete/{id}", app.DeleteShippingRate)
 	})
 
 	return mux
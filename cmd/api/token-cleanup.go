@@ -0,0 +1,22 @@
+package main
+
+import "time"
+
+// cleanExpiredTokens periodically deletes the tokens that have expired. They
+// no longer authenticate anyone, but would otherwise pile up, one for every
+// login on every device.
+func (app *application) cleanExpiredTokens(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n, err := app.DB.DeleteExpiredTokens()
+		if err != nil {
+			app.errorLog.Println(err)
+			continue
+		}
+		if n > 0 {
+			app.infoLog.Printf("Deleted %d expired tokens", n)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maize/internal/keyring"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// manageKeys generates, rotates, lists and prunes the keys of the key ring file
+func manageKeys(app *application, args []string) error {
+	if app.config.keyring == "" {
+		return errors.New("no key ring file; set -keyring or KEYRING_FILE")
+	}
+	if len(args) == 0 {
+		return errors.New("keys needs a subcommand: generate, rotate, list or prune")
+	}
+
+	switch args[0] {
+	case "generate":
+		return generateKeys(app)
+	case "rotate":
+		return rotateKey(app, args[1:])
+	case "list":
+		return listKeys(app)
+	case "prune":
+		return pruneKeys(app)
+	}
+
+	return fmt.Errorf("unknown keys subcommand %q", args[0])
+}
+
+// generateKeys creates the key ring file with a key for every purpose. The
+// secret and PII keys configured before, if any, are kept, so links already
+// sent and data already encrypted stay readable.
+func generateKeys(app *application) error {
+	_, err := os.Stat(app.config.keyring)
+	if err == nil {
+		return fmt.Errorf("%s already exists; rotate its keys instead", app.config.keyring)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	ring := keyring.FromSecrets(map[string][]byte{
+		keyring.PurposeURLSigning:     []byte(app.config.secretkey),
+		keyring.PurposeLinkEncryption: []byte(app.config.secretkey),
+		keyring.PurposePII:            []byte(app.config.piikey),
+		keyring.PurposeBlindIndex:     []byte(app.config.piikey),
+	})
+
+	for _, p := range keyring.Purposes {
+		if _, err := ring.Primary(p); err == nil {
+			app.infoLog.Printf("%s: keeping the configured key", p)
+			continue
+		}
+
+		k, err := ring.Rotate(p, 0)
+		if err != nil {
+			return err
+		}
+		app.infoLog.Printf("%s: generated key %s", p, k.ID)
+		if p == keyring.PurposePII {
+			app.infoLog.Printf("%s: run encrypt-pii to encrypt existing data with it", p)
+		}
+	}
+
+	err = ring.Save(app.config.keyring)
+	if err != nil {
+		return err
+	}
+
+	app.infoLog.Printf("Wrote %s; start the servers with -keyring to use it", app.config.keyring)
+
+	return nil
+}
+
+// rotateKey replaces the primary key of a purpose. The old key keeps verifying
+// and decrypting for the grace given, or the purpose's default.
+func rotateKey(app *application, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("rotate needs a purpose: %s", strings.Join(keyring.Purposes, ", "))
+	}
+
+	purpose := args[0]
+	grace, ok := keyring.DefaultGrace[purpose]
+	if !ok {
+		return fmt.Errorf("unknown purpose %q: use %s", purpose, strings.Join(keyring.Purposes, ", "))
+	}
+
+	if len(args) > 1 {
+		var err error
+		grace, err = time.ParseDuration(args[1])
+		if err != nil {
+			return err
+		}
+	}
+
+	ring, err := keyring.Load(app.config.keyring)
+	if err != nil {
+		return err
+	}
+
+	k, err := ring.Rotate(purpose, grace)
+	if err != nil {
+		return err
+	}
+
+	err = ring.Save(app.config.keyring)
+	if err != nil {
+		return err
+	}
+
+	app.infoLog.Printf("%s: key %s is now primary", purpose, k.ID)
+	if grace > 0 {
+		app.infoLog.Printf("%s: the old key verifies until %s", purpose, time.Now().Add(grace).Format(time.RFC3339))
+	}
+	if purpose == keyring.PurposePII || purpose == keyring.PurposeBlindIndex {
+		app.infoLog.Printf("%s: restart the servers, then run encrypt-pii to move existing data to the new key", purpose)
+	} else {
+		app.infoLog.Printf("%s: restart the servers to start using the new key", purpose)
+	}
+
+	return nil
+}
+
+// listKeys prints the keys of the ring, without their secrets
+func listKeys(app *application) error {
+	ring, err := keyring.Load(app.config.keyring)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tPURPOSE\tCREATED\tSTATUS")
+
+	for _, k := range ring.Keys {
+		status := "primary"
+		switch {
+		case k.Expired(now):
+			status = "expired"
+		case k.RetiredAt != nil && k.ExpiresAt != nil:
+			status = "retired, verifies until " + k.ExpiresAt.Format(time.RFC3339)
+		case k.RetiredAt != nil:
+			status = "retired"
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", k.ID, k.Purpose, k.CreatedAt.Format(time.RFC3339), status)
+	}
+
+	return tw.Flush()
+}
+
+// pruneKeys removes the keys whose grace has run out
+func pruneKeys(app *application) error {
+	ring, err := keyring.Load(app.config.keyring)
+	if err != nil {
+		return err
+	}
+
+	n := ring.Prune(time.Now())
+	if n == 0 {
+		app.infoLog.Println("No expired keys")
+		return nil
+	}
+
+	err = ring.Save(app.config.keyring)
+	if err != nil {
+		return err
+	}
+
+	app.infoLog.Printf("Removed %d expired keys", n)
+
+	return nil
+}
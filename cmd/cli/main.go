@@ -0,0 +1,129 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"maize/internal/driver"
+	"maize/internal/encryption"
+	"maize/internal/keyring"
+	"maize/internal/models"
+	"os"
+	"time"
+)
+
+// config is the command line configuration structure
+type config struct {
+	db struct {
+		dsn string
+	}
+	timezone  string
+	secretkey string
+	piikey    string
+	keyring   string
+}
+
+// application is the command line structure
+type application struct {
+	config   config
+	infoLog  *log.Logger
+	errorLog *log.Logger
+	DB       models.DBModel
+}
+
+// commands are the tasks the command line runs, by name
+var commands = map[string]func(app *application, args []string) error{
+	"backfill-reports": backfillReports,
+	"decrypt-pii":      decryptPII,
+	"encrypt-pii":      encryptPII,
+	"reset-2fa":        resetTwoFactor,
+}
+
+// offline are the tasks that run without the database or the key ring
+var offline = map[string]func(app *application, args []string) error{
+	"keys": manageKeys,
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] <command>\n\nCommands:\n", os.Args[0])
+	fmt.Fprintf(flag.CommandLine.Output(), "  backfill-reports\trebuild the daily sales summaries from history\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  encrypt-pii [batch]\tencrypt customer names and emails stored in plaintext or under retired keys\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  decrypt-pii [batch]\twrite encrypted customer names and emails back in plaintext, before rolling back their encryption\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  reset-2fa <email>\tturn off two-factor authentication for a user who lost their app and codes\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  keys generate		create the key ring file, keeping -secret and -piikey\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  keys rotate <purpose> [grace]\treplace the key of a purpose, keeping the old one for grace\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  keys list		list the keys of the key ring\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  keys prune		remove the keys whose grace has run out\n\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	var cfg config
+
+	flag.StringVar(&cfg.db.dsn, "dsn", "maize:maize@tcp(localhost:3306)/maize?parseTime=true&tls=false", "DSN")
+	flag.StringVar(&cfg.timezone, "timezone", "UTC", "Time zone whose days the sales summaries are kept in")
+	flag.StringVar(&cfg.secretkey, "secret", os.Getenv("SECRET_KEY"), "secret key")
+	flag.StringVar(&cfg.piikey, "piikey", os.Getenv("PII_KEY"), "Key encrypting customer names and emails, 16, 24 or 32 bytes")
+	flag.StringVar(&cfg.keyring, "keyring", os.Getenv("KEYRING_FILE"), "Key ring file, replacing -secret and -piikey")
+	flag.Usage = usage
+
+	flag.Parse()
+
+	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
+	errorLog := log.New(os.Stderr, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
+
+	if command, ok := offline[flag.Arg(0)]; ok {
+		app := &application{config: cfg, infoLog: infoLog, errorLog: errorLog}
+
+		err := command(app, flag.Args()[1:])
+		if err != nil {
+			errorLog.Fatal(err)
+		}
+		return
+	}
+
+	command, ok := commands[flag.Arg(0)]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	loc, err := time.LoadLocation(cfg.timezone)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
+	keys, err := keyring.Open(cfg.keyring, map[string][]byte{
+		keyring.PurposePII:        []byte(cfg.piikey),
+		keyring.PurposeBlindIndex: []byte(cfg.piikey),
+	})
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
+	var pii *encryption.Encryption
+	if _, err := keys.Primary(keyring.PurposePII); err == nil {
+		pii, err = keys.PII()
+		if err != nil {
+			errorLog.Fatal(err)
+		}
+	}
+
+	conn, err := driver.OpenDb(cfg.db.dsn)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+	defer conn.Close()
+
+	app := &application{
+		config:   cfg,
+		infoLog:  infoLog,
+		errorLog: errorLog,
+		DB:       models.DBModel{DB: conn, Location: loc, Cipher: pii},
+	}
+
+	err = command(app, flag.Args()[1:])
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+// encryptPII encrypts the customer names and emails stored in plaintext, or
+// under retired keys, in batches of the size given, 500 by default
+func encryptPII(app *application, args []string) error {
+	if app.DB.Cipher == nil {
+		return errors.New("no encryption key; set -keyring, or -piikey or PII_KEY")
+	}
+
+	batch := 500
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			return errors.New("batch size must be a positive number")
+		}
+		batch = n
+	}
+
+	started := time.Now()
+
+	app.infoLog.Printf("Encrypting personal data in batches of %d", batch)
+
+	err := app.DB.EncryptPII(batch, func(table string, changed int) {
+		app.infoLog.Printf("%s: %d rows encrypted", table, changed)
+	})
+	if err != nil {
+		return err
+	}
+
+	app.infoLog.Printf("Encrypted personal data in %s", time.Since(started).Round(time.Second))
+
+	return nil
+}
+
+// decryptPII writes the encrypted customer names and emails back in
+// plaintext, in batches of the size given, 500 by default, before the
+// migration that encrypted them is rolled back
+func decryptPII(app *application, args []string) error {
+	if app.DB.Cipher == nil {
+		return errors.New("no encryption key; set -keyring, or -piikey or PII_KEY")
+	}
+
+	batch := 500
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			return errors.New("batch size must be a positive number")
+		}
+		batch = n
+	}
+
+	started := time.Now()
+
+	app.infoLog.Printf("Decrypting personal data in batches of %d", batch)
+
+	err := app.DB.DecryptPII(batch, func(table string, changed int) {
+		app.infoLog.Printf("%s: %d rows decrypted", table, changed)
+	})
+	if err != nil {
+		return err
+	}
+
+	app.infoLog.Printf("Decrypted personal data in %s", time.Since(started).Round(time.Second))
+
+	return nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"time"
+)
+
+// backfillReports rebuilds the daily sales summaries the reports read from
+func backfillReports(app *application, args []string) error {
+	started := time.Now()
+	days := 0
+
+	app.infoLog.Printf("Rebuilding daily sales summaries in %s", app.DB.Location)
+
+	err := app.DB.BackfillSummaries(func(day time.Time, maizeID int) {
+		days++
+		if days%100 == 0 {
+			app.infoLog.Printf("Rebuilt %d days, up to %s for product %d", days, day.Format("2006-01-02"), maizeID)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	app.infoLog.Printf("Rebuilt %d days of summaries in %s", days, time.Since(started).Round(time.Second))
+
+	return nil
+}
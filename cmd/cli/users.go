@@ -0,0 +1,26 @@
+package main
+
+import "errors"
+
+// resetTwoFactor turns off two-factor authentication for the user with an
+// email address and signs them out, for when the only user who could reset it
+// from the admin pages is the one who lost their app and recovery codes
+func resetTwoFactor(app *application, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: reset-2fa <email>")
+	}
+
+	user, err := app.DB.GetUserByEmail(args[0])
+	if err != nil {
+		return err
+	}
+
+	err = app.DB.ResetTwoFactor(user.ID)
+	if err != nil {
+		return err
+	}
+
+	app.infoLog.Printf("Two-factor authentication of %s reset; they can log in with their password", user.Email)
+
+	return nil
+}
@@ -10,14 +10,17 @@ import (
 )
 
 type Order struct {
-	ID        int       `json:"id"`
-	Quantity  int       `json:"quantity"`
-	Amount    int       `json:"amount"`
-	Product   string    `json:"product"`
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	Email     string    `json:"email"`
-	CreatedAt time.Time `json:"created_at"`
+	ID             int       `json:"id"`
+	Quantity       int       `json:"quantity"`
+	Amount         int       `json:"amount"`
+	Shipping       int       `json:"shipping"`
+	ShippingMethod string    `json:"shipping_method"`
+	Product        string    `json:"product"`
+	FirstName      string    `json:"first_name"`
+	LastName       string    `json:"last_name"`
+	Email          string    `json:"email"`
+	ReceiptURL     string    `json:"receipt_url"`
+	CreatedAt      time.Time `json:"created_at"`
 }
 
 func (app *application) CreateAndSendInvoice(w http.ResponseWriter, r *http.Request) {
@@ -39,7 +42,7 @@ func (app *application) CreateAndSendInvoice(w http.ResponseWriter, r *http.Requ
 		fmt.Sprintf("./invoices/%d.pdf", order.ID),
 	}
 
-	err = app.SendMail("info@maize.com", order.Email, "Invoice#"+fmt.Sprint(order.ID), "invoice", attachments, nil)
+	err = app.SendMail("info@maize.com", order.Email, "Invoice#"+fmt.Sprint(order.ID), "invoice", attachments, order)
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
@@ -85,7 +88,24 @@ func (app *application) createInvoicePDF(order Order) error {
 	pdf.CellFormat(20, 8, fmt.Sprintf("%d", order.Quantity), "", 0, "C", false, 0, "")
 
 	pdf.SetX(185)
-	pdf.CellFormat(20, 8, fmt.Sprintf("$%.2f", float32(order.Amount/100.0)), "", 0, "R", false, 0, "")
+	pdf.CellFormat(20, 8, fmt.Sprintf("$%.2f", float32(order.Amount)/100), "", 0, "R", false, 0, "")
+
+	if order.ShippingMethod != "" {
+		pdf.Ln(8)
+		pdf.SetX(10)
+		pdf.CellFormat(155, 8, fmt.Sprintf("Shipping - %s", order.ShippingMethod), "", 0, "L", false, 0, "")
+
+		pdf.SetX(185)
+		pdf.CellFormat(20, 8, fmt.Sprintf("$%.2f", float32(order.Shipping)/100), "", 0, "R", false, 0, "")
+
+		pdf.Ln(8)
+		pdf.SetX(166)
+		pdf.SetFont("Arial", "B", 11)
+		pdf.CellFormat(20, 8, "Total", "", 0, "C", false, 0, "")
+
+		pdf.SetX(185)
+		pdf.CellFormat(20, 8, fmt.Sprintf("$%.2f", float32(order.Amount+order.Shipping)/100), "", 0, "R", false, 0, "")
+	}
 
 	invoicePath := fmt.Sprintf("./invoices/%d.pdf", order.ID)
 	err := pdf.OutputFileAndClose(invoicePath)
@@ -3,21 +3,44 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"maize/internal/cards"
-	"maize/internal/encryption"
+	"maize/internal/keyring"
 	"maize/internal/models"
+	"maize/internal/storage"
 	"maize/internal/urlsigner"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi"
+	"github.com/stripe/stripe-go/v72"
 )
 
-// Home displays the home page
+// Home displays the storefront catalog of one-off products and plans
 func (app *application) Home(w http.ResponseWriter, r *http.Request) {
-	if err := app.renderTemplate(w, r, "home", &templateData{}); err != nil {
+	products, err := app.DB.GetActiveMaize(false)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	plans, err := app.DB.GetActiveMaize(true)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["products"] = products
+	data["plans"] = plans
+
+	if err := app.renderTemplate(w, r, "home", &templateData{
+		Data: data,
+	}); err != nil {
 		app.errorLog.Println(err)
 	}
 }
@@ -42,19 +65,29 @@ type TransactionData struct {
 	ExpiryMonth     int
 	ExpiryYear      int
 	BankReturnCode  string
+	PaymentStatus   string
+	PaymentMetadata map[string]string
+	OrderStatusID   int
+	ExpectedShip    string
 }
 
 type Invoice struct {
-	ID        int       `json:"id"`
-	Quantity  int       `json:"quantity"`
-	Amount    int       `json:"amount"`
-	Product   string    `json:"product"`
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	Email     string    `json:"email"`
-	CreatedAt time.Time `json:"created_at"`
+	ID             int       `json:"id"`
+	Quantity       int       `json:"quantity"`
+	Amount         int       `json:"amount"`
+	Shipping       int       `json:"shipping"`
+	ShippingMethod string    `json:"shipping_method"`
+	Product        string    `json:"product"`
+	FirstName      string    `json:"first_name"`
+	LastName       string    `json:"last_name"`
+	Email          string    `json:"email"`
+	ReceiptURL     string    `json:"receipt_url"`
+	CreatedAt      time.Time `json:"created_at"`
 }
 
+// receiptLinkTTL is how long the receipt link sent with an invoice works
+const receiptLinkTTL = 90 * 24 * time.Hour
+
 // GetTransactionData gets the transaction data from the request
 func (app *application) GetTransactionData(r *http.Request) (TransactionData, error) {
 	var txnData TransactionData
@@ -69,9 +102,6 @@ func (app *application) GetTransactionData(r *http.Request) (TransactionData, er
 	email := r.Form.Get("email")
 	paymentIntent := r.Form.Get("payment_intent")
 	paymentMethod := r.Form.Get("payment_method")
-	paymentAmount := r.Form.Get("payment_amount")
-	paymentCurrency := r.Form.Get("payment_currency")
-	amount, _ := strconv.Atoi(paymentAmount)
 
 	card := cards.Card{
 		Secret: app.config.stripe.secret,
@@ -100,12 +130,16 @@ func (app *application) GetTransactionData(r *http.Request) (TransactionData, er
 		Email:           email,
 		PaymentIntentID: paymentIntent,
 		PaymentMethodID: paymentMethod,
-		PaymentAmount:   amount,
-		PaymentCurrency: paymentCurrency,
+		// the amount and currency come from the confirmed payment intent, not
+		// the form, which the client could have altered
+		PaymentAmount:   int(pi.Amount),
+		PaymentCurrency: string(pi.Currency),
 		LastFour:        lastFour,
 		ExpiryMonth:     int(expiryMonth),
 		ExpiryYear:      int(expiryYear),
 		BankReturnCode:  pi.Charges.Data[0].ID,
+		PaymentStatus:   string(pi.Status),
+		PaymentMetadata: pi.Metadata,
 	}
 	return txnData, nil
 }
@@ -160,18 +194,87 @@ func (app *application) PaymentSucceeded(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	maize, err := app.DB.GetMaize(maizeID)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	productName := maize.Name
+	variantID, _ := strconv.Atoi(r.Form.Get("variant_id"))
+	if variantID > 0 {
+		variant, err := app.DB.GetVariant(variantID)
+		if err != nil {
+			app.errorLog.Println(err)
+			return
+		}
+
+		if variant.MaizeID != maize.ID {
+			app.errorLog.Println("variant", variantID, "does not belong to product", maizeID)
+			return
+		}
+
+		productName = fmt.Sprintf("%s - %s (%s)", maize.Name, variant.Name, variant.SKU)
+	}
+
 	txnData, err := app.GetTransactionData(r)
 	if err != nil {
 		app.errorLog.Println(err)
 		return
 	}
 
+	billing := readAddress(r, "billing")
+	shipping := billing
+	if r.Form.Get("shipping_same") == "" {
+		shipping = readAddress(r, "shipping")
+	}
+
+	// the payment intent is refused without a complete shipping address, so
+	// one can only be missing here if the form was altered after payment
+	if !shipping.Complete() {
+		app.rejectCheckout(w, r, maize, txnData, "Please enter a complete shipping address")
+		return
+	}
+
+	// the order is split into item subtotal and shipping as quoted when the
+	// payment intent was made, which must be for this item and address and
+	// add up to what was paid
+	price, err := models.QuotedPrice(txnData.PaymentMetadata)
+	if err != nil || price.MaizeID != maizeID || price.VariantID != variantID ||
+		price.Total != txnData.PaymentAmount || !strings.EqualFold(price.Country, shipping.Country) {
+		app.errorLog.Println("payment", txnData.PaymentIntentID, "does not match the order:", price, err)
+		app.rejectCheckout(w, r, maize, txnData, "Your order changed after it was priced, please check out again")
+		return
+	}
+
+	// a payment that was only authorized is a pre-order, captured when stock
+	// arrives; a charged payment that stock can no longer cover is backordered
+	// rather than lost
+	statusID := models.StatusPreOrdered
+	txnStatusID := models.TransactionPending
+	if txnData.PaymentStatus != string(stripe.PaymentIntentStatusRequiresCapture) {
+		txnStatusID = models.TransactionCleared
+		statusID, err = app.DB.NewOrderStatus(maizeID, variantID, 1)
+		if err != nil || statusID == models.StatusPreOrdered {
+			if err != nil && !errors.Is(err, models.ErrOutOfStock) {
+				app.errorLog.Println(err)
+			}
+			statusID = models.StatusBackordered
+		}
+	}
+
 	customerID, err := app.SaveCustomer(txnData.FirstName, txnData.LastName, txnData.Email)
 	if err != nil {
 		app.errorLog.Println(err)
 		return
 	}
 
+	billingID, shippingID, err := app.DB.SaveAddresses(customerID, billing, shipping)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
 	txn := models.Transaction{
 		Amount:              txnData.PaymentAmount,
 		Currency:            txnData.PaymentCurrency,
@@ -181,11 +284,7 @@ func (app *application) PaymentSucceeded(w http.ResponseWriter, r *http.Request)
 		BankReturnCode:      txnData.BankReturnCode,
 		PaymentIntent:       txnData.PaymentIntentID,
 		PaymentMethod:       txnData.PaymentMethodID,
-		TransactionStatusId: 2,
-	}
-	if err != nil {
-		app.errorLog.Println(err)
-		return
+		TransactionStatusId: txnStatusID,
 	}
 
 	txnID, err := app.SaveTransaction(txn)
@@ -195,31 +294,51 @@ func (app *application) PaymentSucceeded(w http.ResponseWriter, r *http.Request)
 	}
 
 	order := models.Order{
-		MaizeID:       maizeID,
-		TransactionID: txnID,
-		CustomerID:    customerID,
-		StatusID:      1,
-		Quantity:      1,
-		Amount:        txnData.PaymentAmount,
-		CreatedAt:     time.Now(),
-		UpdatedAt:     time.Now(),
-	}
-
-	orderID, err := app.SaveOrder(order)
+		MaizeID:           maizeID,
+		VariantID:         variantID,
+		TransactionID:     txnID,
+		CustomerID:        customerID,
+		StatusID:          statusID,
+		Quantity:          1,
+		Amount:            price.Subtotal,
+		BillingAddressID:  billingID,
+		ShippingAddressID: shippingID,
+		ShippingRateID:    price.ShippingRateID,
+		ShippingMethod:    price.ShippingMethod,
+		ShippingAmount:    price.Shipping,
+		CreatedAt:         time.Now(),
+		UpdatedAt:         time.Now(),
+	}
+
+	// a cleared order takes its stock as it is saved, or is backordered if
+	// another sale took the last units first
+	order, err = app.DB.PlaceOrder(order)
 	if err != nil {
 		app.errorLog.Println(err)
 		return
 	}
+	orderID := order.ID
+
+	txnData.OrderStatusID = order.StatusID
+	txnData.ExpectedShip = maize.ExpectedShipDate
 
 	inv := Invoice{
-		ID:        orderID,
-		Amount:    order.Amount,
-		Product:   "Maize",
-		Quantity:  order.Quantity,
-		FirstName: txnData.FirstName,
-		LastName:  txnData.LastName,
-		Email:     txnData.Email,
-		CreatedAt: time.Now(),
+		ID:             orderID,
+		Amount:         order.Amount,
+		Shipping:       order.ShippingAmount,
+		ShippingMethod: order.ShippingMethod,
+		Product:        productName,
+		Quantity:       order.Quantity,
+		FirstName:      txnData.FirstName,
+		LastName:       txnData.LastName,
+		Email:          txnData.Email,
+		CreatedAt:      time.Now(),
+	}
+
+	// the invoice links to the receipt, which is shown here only once
+	inv.ReceiptURL, err = app.receiptLink(orderID)
+	if err != nil {
+		app.errorLog.Println(err)
 	}
 
 	err = app.callInvoiceMicroService(inv)
@@ -248,6 +367,18 @@ func (app *application) callInvoiceMicroService(inv Invoice) error {
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
+
+	// the invoice service sends the invoice by email
+	entry := models.EmailLog{To: inv.Email, Subject: fmt.Sprintf("Invoice#%d", inv.ID), Template: "invoice"}
+	if err != nil {
+		entry.Error = err.Error()
+	} else if resp.StatusCode >= http.StatusMultipleChoices {
+		entry.Error = resp.Status
+	}
+	if logErr := app.DB.LogEmail(entry); logErr != nil {
+		app.errorLog.Println(logErr)
+	}
+
 	if err != nil {
 		return err
 	}
@@ -259,9 +390,23 @@ func (app *application) callInvoiceMicroService(inv Invoice) error {
 	return nil
 }
 
-// BronzePlanReceipt displays the bronze plan receipt page
-func (app *application) BronzePlanReceipt(w http.ResponseWriter, r *http.Request) {
-	if err := app.renderTemplate(w, r, "receipt-plan", &templateData{}); err != nil {
+// PlanReceipt displays the receipt page for any subscription plan
+func (app *application) PlanReceipt(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	maizeID, _ := strconv.Atoi(id)
+
+	maize, err := app.DB.GetMaize(maizeID)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["maize"] = maize
+
+	if err := app.renderTemplate(w, r, "receipt-plan", &templateData{
+		Data: data,
+	}); err != nil {
 		app.errorLog.Println(err)
 		return
 	}
@@ -281,6 +426,77 @@ func (app *application) Receipt(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// receiptLink returns a signed link to the receipt of an order
+func (app *application) receiptLink(orderID int) (string, error) {
+	signer, err := app.Keys.Signer(keyring.PurposeURLSigning)
+	if err != nil {
+		return "", err
+	}
+
+	link := fmt.Sprintf("%s/orders/%d/receipt", app.config.frontend, orderID)
+	return signer.Sign(link, urlsigner.PurposeReceipt, receiptLinkTTL)
+}
+
+// OrderReceipt displays the receipt of an order to whoever has the signed link
+// sent with its invoice. The link can be used until it expires.
+func (app *application) OrderReceipt(w http.ResponseWriter, r *http.Request) {
+	testUrl := fmt.Sprintf("%s%s", app.config.frontend, r.RequestURI)
+
+	signer, err := app.Keys.Signer(keyring.PurposeURLSigning)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	_, err = signer.Verify(testUrl, urlsigner.PurposeReceipt)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	orderID, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	order, err := app.DB.GetOrderByID(orderID)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	maize, err := app.DB.GetMaize(order.MaizeID)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	txn := TransactionData{
+		FirstName:       order.Customer.FirstName,
+		LastName:        order.Customer.LastName,
+		Email:           order.Customer.Email,
+		PaymentIntentID: order.Transaction.PaymentIntent,
+		PaymentAmount:   order.Transaction.Amount,
+		PaymentCurrency: order.Transaction.Currency,
+		LastFour:        order.Transaction.LastFour,
+		ExpiryMonth:     order.Transaction.ExpiryMonth,
+		ExpiryYear:      order.Transaction.ExpiryYear,
+		BankReturnCode:  order.Transaction.BankReturnCode,
+		OrderStatusID:   order.StatusID,
+		ExpectedShip:    maize.ExpectedShipDate,
+	}
+
+	data := make(map[string]interface{})
+	data["txn"] = txn
+
+	if err := app.renderTemplate(w, r, "receipt", &templateData{
+		Data: data,
+	}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
 // VirtualTerminalReceipt displays the virtual terminal receipt page
 func (app *application) VirtualTerminalReceipt(w http.ResponseWriter, r *http.Request) {
 	txn := app.Session.Get(r.Context(), "receipt").(TransactionData)
@@ -310,17 +526,57 @@ func (app *application) SaveCustomer(firstName, lastName, email string) (int, er
 	return id, nil
 }
 
-// SaveTransaction saves a transaction to the database
-func (app *application) SaveTransaction(txn models.Transaction) (int, error) {
-	id, err := app.DB.InsertTransaction(txn)
+// rejectCheckout gives back a payment that cannot become an order, and shows
+// the checkout page again with the reason
+func (app *application) rejectCheckout(w http.ResponseWriter, r *http.Request, maize models.Maize, txnData TransactionData, msg string) {
+	card := cards.Card{
+		Secret: app.config.stripe.secret,
+		Key:    app.config.stripe.key,
+	}
+
+	var err error
+	if txnData.PaymentStatus == string(stripe.PaymentIntentStatusRequiresCapture) {
+		err = card.CancelAuthorization(txnData.PaymentIntentID)
+	} else {
+		err = card.Refund(txnData.PaymentIntentID, txnData.PaymentAmount)
+	}
 	if err != nil {
-		return 0, err
+		app.errorLog.Println(err)
+	}
+
+	maize.Variants, err = app.DB.GetVariantsForMaize(maize.ID)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["maize"] = maize
+
+	if err := app.renderTemplate(w, r, "buy-once", &templateData{
+		Data:  data,
+		Error: msg + ". Your card has not been charged.",
+	}, "stripe-js", "address"); err != nil {
+		app.errorLog.Println(err)
 	}
-	return id, nil
 }
 
-func (app *application) SaveOrder(order models.Order) (int, error) {
-	id, err := app.DB.InsertOrder(order)
+// readAddress reads the address posted in the form fields starting with prefix
+func readAddress(r *http.Request, prefix string) models.Address {
+	return models.Address{
+		Name:       r.Form.Get(prefix + "_name"),
+		Line1:      r.Form.Get(prefix + "_line1"),
+		Line2:      r.Form.Get(prefix + "_line2"),
+		City:       r.Form.Get(prefix + "_city"),
+		State:      r.Form.Get(prefix + "_state"),
+		PostalCode: r.Form.Get(prefix + "_postal_code"),
+		Country:    r.Form.Get(prefix + "_country"),
+	}
+}
+
+// SaveTransaction saves a transaction to the database
+func (app *application) SaveTransaction(txn models.Transaction) (int, error) {
+	id, err := app.DB.InsertTransaction(txn)
 	if err != nil {
 		return 0, err
 	}
@@ -338,29 +594,58 @@ func (app *application) ChargeOnce(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !maize.IsActive {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	if maize.IsRecurring {
+		http.Redirect(w, r, fmt.Sprintf("/plans/%d", maize.ID), http.StatusSeeOther)
+		return
+	}
+
+	maize.Variants, err = app.DB.GetVariantsForMaize(maize.ID)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
 	data := make(map[string]interface{})
 	data["maize"] = maize
 
 	if err := app.renderTemplate(w, r, "buy-once", &templateData{
 		Data: data,
-	}, "stripe-js"); err != nil {
+	}, "stripe-js", "address"); err != nil {
 		app.errorLog.Println(err)
 	}
 }
 
-// BronzePlan creates a bronze plan for the customer
-func (app *application) BronzePlan(w http.ResponseWriter, r *http.Request) {
-	maize, err := app.DB.GetMaize(2)
+// Plan displays the subscription page for any recurring maize plan
+func (app *application) Plan(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	maizeID, _ := strconv.Atoi(id)
+
+	maize, err := app.DB.GetMaize(maizeID)
 	if err != nil {
 		app.errorLog.Println(err)
 		return
 	}
 
+	if !maize.IsActive {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	if !maize.IsRecurring {
+		http.Redirect(w, r, fmt.Sprintf("/maize/%d", maize.ID), http.StatusSeeOther)
+		return
+	}
+
 	data := make(map[string]interface{})
 	data["maize"] = maize
-	if err := app.renderTemplate(w, r, "bronze-plan", &templateData{
+	if err := app.renderTemplate(w, r, "plan", &templateData{
 		Data: data,
-	}); err != nil {
+	}, "address"); err != nil {
 		app.errorLog.Println(err)
 	}
 }
@@ -391,10 +676,51 @@ func (app *application) PostLoginPage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	err = app.verifySecondFactor(id, r.Form.Get("code"), r.Form.Get("token"))
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
 	app.Session.Put(r.Context(), "userID", id)
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
+// secondFactorTokenAge is how soon after the API issues a token that checked
+// the second factor the login page must present it
+const secondFactorTokenAge = time.Minute
+
+// verifySecondFactor checks the second factor of a user logging in, when they
+// have two-factor authentication on: a code from their app or a recovery
+// code, or else the token the API just issued them after checking their code
+// itself. Older tokens, and tokens from logins without a code, are refused.
+func (app *application) verifySecondFactor(userID int, code, token string) error {
+	user, err := app.DB.GetOneUserByID(userID)
+	if err != nil {
+		return err
+	}
+	if !user.TwoFactorEnabled {
+		return nil
+	}
+
+	if code != "" {
+		return app.DB.VerifyTwoFactor(userID, code)
+	}
+
+	if token != "" {
+		ok, err := app.DB.SecondFactorToken(userID, token, secondFactorTokenAge)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+	}
+
+	return models.ErrTwoFactorCode
+}
+
 func (app *application) Logout(w http.ResponseWriter, r *http.Request) {
 	app.Session.Destroy(r.Context())
 	app.Session.RenewToken(r.Context())
@@ -408,34 +734,54 @@ func (app *application) ForgotPassword(w http.ResponseWriter, r *http.Request) {
 }
 
 func (app *application) ShowResetPassword(w http.ResponseWriter, r *http.Request) {
-	email := r.URL.Query().Get("email")
+	app.showSetPassword(w, r, urlsigner.PurposeReset)
+}
+
+// AcceptInvite lets a user who was added without a password choose one
+func (app *application) AcceptInvite(w http.ResponseWriter, r *http.Request) {
+	app.showSetPassword(w, r, urlsigner.PurposeInvite)
+}
+
+// showSetPassword displays the password form for a signed link of purpose
+func (app *application) showSetPassword(w http.ResponseWriter, r *http.Request, purpose string) {
 	url := r.RequestURI
 	testUrl := fmt.Sprintf("%s%s", app.config.frontend, url)
 
-	signer := urlsigner.Signer{
-		Secret: []byte(app.config.secretkey),
+	signer, err := app.Keys.Signer(keyring.PurposeURLSigning)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
 	}
 
-	valid := signer.VerifyToken(testUrl)
-
-	if !valid {
-		app.errorLog.Println("Invalid url tampering detected")
+	claims, err := signer.Verify(testUrl, purpose)
+	if err != nil {
+		app.errorLog.Println(err)
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
-	expired := signer.Expired(testUrl, 60)
-	if expired {
-		app.errorLog.Println("Url expired")
+	used, err := app.DB.NonceUsed(claims.Nonce)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if used {
+		app.errorLog.Println(models.ErrLinkUsed)
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
-	encryptor := encryption.Encryption{
-		Key: []byte(app.config.secretkey),
+	encryptor, err := app.Keys.Encryption(keyring.PurposeLinkEncryption)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
 	}
 
-	encryptedEmail, err := encryptor.Encrypt(email)
+	// the API checks the link again, and marks it used, when the form is sent
+	encryptedEmail, err := encryptor.Encrypt(testUrl)
 	if err != nil {
 		app.errorLog.Println(err)
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
@@ -444,6 +790,7 @@ func (app *application) ShowResetPassword(w http.ResponseWriter, r *http.Request
 
 	data := make(map[string]interface{})
 	data["email"] = encryptedEmail
+	data["invite"] = purpose == urlsigner.PurposeInvite
 
 	if err := app.renderTemplate(w, r, "reset-password", &templateData{
 		Data: data,
@@ -454,13 +801,13 @@ func (app *application) ShowResetPassword(w http.ResponseWriter, r *http.Request
 }
 
 func (app *application) AllSales(w http.ResponseWriter, r *http.Request) {
-	if err := app.renderTemplate(w, r, "all-sales", &templateData{}); err != nil {
+	if err := app.renderTemplate(w, r, "all-sales", &templateData{}, "order-filters"); err != nil {
 		app.errorLog.Println(err)
 	}
 }
 
 func (app *application) AllSubs(w http.ResponseWriter, r *http.Request) {
-	if err := app.renderTemplate(w, r, "all-subs", &templateData{}); err != nil {
+	if err := app.renderTemplate(w, r, "all-subs", &templateData{}, "order-filters"); err != nil {
 		app.errorLog.Println(err)
 	}
 }
@@ -471,6 +818,7 @@ func (app *application) ShowSale(w http.ResponseWriter, r *http.Request) {
 	stringMap["back"] = "/admin/all-sales"
 	stringMap["refund-url"] = "/api/admin/refund"
 	stringMap["refund-btn"] = "Refund Order"
+	stringMap["return-url"] = "/api/admin/returns/open"
 	if err := app.renderTemplate(w, r, "sale", &templateData{
 		StringMap: stringMap,
 	}); err != nil {
@@ -491,14 +839,177 @@ func (app *application) ShowSub(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Customers displays the customers, with a search by email address or customer ID
+func (app *application) Customers(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "customers", &templateData{}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// ShowCustomer displays a customer with their orders, subscriptions, lifetime
+// value, refunds, disputes and notes
+func (app *application) ShowCustomer(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "customer", &templateData{}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
 func (app *application) AllUsers(w http.ResponseWriter, r *http.Request) {
 	if err := app.renderTemplate(w, r, "all-users", &templateData{}); err != nil {
 		app.errorLog.Println(err)
 	}
 }
 
+// APIKeys displays the API keys, and lets the user create and revoke them
+func (app *application) APIKeys(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "api-keys", &templateData{}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
 func (app *application) OneUser(w http.ResponseWriter, r *http.Request) {
 	if err := app.renderTemplate(w, r, "one-user", &templateData{}); err != nil {
 		app.errorLog.Println(err)
 	}
 }
+
+// TwoFactor displays the page where users turn two-factor authentication on
+// or off and replace their recovery codes
+func (app *application) TwoFactor(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "two-factor", &templateData{}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// Devices displays the devices the user is logged in on, for logging them out
+func (app *application) Devices(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "devices", &templateData{}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// Backorders displays the queue of orders waiting on stock
+func (app *application) Backorders(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "backorders", &templateData{}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// ShippingRates displays the shipping zones and their rates for editing
+func (app *application) ShippingRates(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "shipping", &templateData{}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// Dashboard displays charts of revenue, subscriptions and top products
+func (app *application) Dashboard(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "dashboard", &templateData{}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// NewReturn displays the form customers use to request a return
+func (app *application) NewReturn(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "return-new", &templateData{}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// ReturnLabel displays the printable label of an approved return. The link is
+// signed when the return is approved and is valid for 30 days.
+func (app *application) ReturnLabel(w http.ResponseWriter, r *http.Request) {
+	url := r.RequestURI
+	testUrl := fmt.Sprintf("%s%s", app.config.frontend, url)
+
+	signer, err := app.Keys.Signer(keyring.PurposeURLSigning)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	_, err = signer.Verify(testUrl, urlsigner.PurposeDownload)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	returnID, _ := strconv.Atoi(r.URL.Query().Get("id"))
+	rt, err := app.DB.GetReturn(returnID)
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["return"] = rt
+
+	if rt.Order.ShippingAddressID > 0 {
+		from, err := app.DB.GetAddress(rt.Order.ShippingAddressID)
+		if err != nil {
+			app.errorLog.Println(err)
+		} else {
+			data["from"] = from
+		}
+	}
+
+	if err := app.renderTemplate(w, r, "return-label", &templateData{
+		Data: data,
+	}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// AllReturns displays the returns waiting on an admin, and their history
+func (app *application) AllReturns(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "all-returns", &templateData{}, "return"); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// ShowReturn displays a single return with its history and the actions open to it
+func (app *application) ShowReturn(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "return", &templateData{}, "return"); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+func (app *application) AllProducts(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "all-products", &templateData{}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+func (app *application) OneProduct(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "one-product", &templateData{}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// ServeImage streams a stored product image from the configured storage backend
+func (app *application) ServeImage(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "*")
+
+	obj, contentType, err := app.Storage.Get(r.Context(), key)
+	if err != nil {
+		if !errors.Is(err, storage.ErrNotFound) {
+			app.errorLog.Println(err)
+		}
+		http.NotFound(w, r)
+		return
+	}
+	defer obj.Close()
+
+	// image keys are random and never reused, so they can be cached forever
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	_, err = io.Copy(w, obj)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+}
@@ -7,7 +7,10 @@ import (
 	"html/template"
 	"log"
 	"maize/internal/driver"
+	"maize/internal/encryption"
+	"maize/internal/keyring"
 	"maize/internal/models"
+	"maize/internal/storage"
 	"net/http"
 	"os"
 	"time"
@@ -33,8 +36,13 @@ type config struct {
 		secret string
 		key    string
 	}
-	secretkey string
-	frontend  string
+	secretkey  string
+	frontend   string
+	storage    storage.Config
+	timezone   string
+	piikey     string
+	keyring    string
+	require2FA bool
 }
 
 // application is the application structure
@@ -46,6 +54,8 @@ type application struct {
 	version       string
 	DB            models.DBModel
 	Session       *scs.SessionManager
+	Storage       storage.Storage
+	Keys          *keyring.Ring
 }
 
 // serve is the application entry point
@@ -67,6 +77,8 @@ func main() {
 	gob.Register(TransactionData{})
 	var cfg config
 	secretKey := GoDotEnvVariable("SECRET_KEY")
+	piiKey := GoDotEnvVariable("PII_KEY")
+	keyringFile := GoDotEnvVariable("KEYRING_FILE")
 
 	flag.IntVar(&cfg.port, "port", 4000, "Port to listen on")
 	flag.StringVar(&cfg.env, "env", "development", "Application environment {development|production}")
@@ -74,6 +86,12 @@ func main() {
 	flag.StringVar(&cfg.api, "api", "http://localhost:4001", "URL to API")
 	flag.StringVar(&cfg.secretkey, "secret", secretKey, "secret key")
 	flag.StringVar(&cfg.frontend, "frontend", "http://localhost:4000", "frontend url")
+	cfg.storage.RegisterFlags(flag.CommandLine)
+	flag.StringVar(&cfg.timezone, "timezone", "UTC", "Time zone whose days the sales summaries are kept in")
+	flag.StringVar(&cfg.piikey, "piikey", piiKey, "Key encrypting customer names and emails, 16, 24 or 32 bytes")
+	flag.StringVar(&cfg.keyring, "keyring", keyringFile, "Key ring file, replacing -secret and -piikey")
+
+	flag.BoolVar(&cfg.require2FA, "require2fa", false, "Require every admin user to turn on two-factor authentication")
 
 	flag.Parse()
 
@@ -83,12 +101,40 @@ func main() {
 	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
 	errorLog := log.New(os.Stderr, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
 
+	loc, err := time.LoadLocation(cfg.timezone)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
+	keys, err := keyring.Open(cfg.keyring, map[string][]byte{
+		keyring.PurposeURLSigning:     []byte(cfg.secretkey),
+		keyring.PurposeLinkEncryption: []byte(cfg.secretkey),
+		keyring.PurposePII:            []byte(cfg.piikey),
+		keyring.PurposeBlindIndex:     []byte(cfg.piikey),
+	})
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
+	var pii *encryption.Encryption
+	if _, err := keys.Primary(keyring.PurposePII); err == nil {
+		pii, err = keys.PII()
+		if err != nil {
+			errorLog.Fatal(err)
+		}
+	}
+
 	conn, err := driver.OpenDb(cfg.db.dsn)
 	if err != nil {
 		errorLog.Fatal(err)
 	}
 	defer conn.Close()
 
+	store, err := storage.New(cfg.storage)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+
 	session = scs.New()
 	session.Lifetime = 24 * time.Hour
 	session.Store = mysqlstore.New(conn)
@@ -101,8 +147,10 @@ func main() {
 		errorLog:      errorLog,
 		templateCache: tc,
 		version:       version,
-		DB:            models.DBModel{DB: conn},
+		DB:            models.DBModel{DB: conn, Location: loc, Cipher: pii},
+		Keys:          keys,
 		Session:       session,
+		Storage:       store,
 	}
 
 	go app.ListenToWsChannel()
@@ -1,6 +1,10 @@
 package main
 
-import "net/http"
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+)
 
 // SessionLoad is a middleware that loads the session from the request.
 func SessionLoad(next http.Handler) http.Handler {
@@ -16,3 +20,50 @@ func (app *application) Auth(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// Require2FA sends users who have not turned on two-factor authentication to
+// the page where they do, when the application requires it. A session whose
+// user has been deleted is logged out. It must run after Auth.
+func (app *application) Require2FA(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.config.require2FA {
+			user, err := app.DB.GetOneUserByID(app.Session.GetInt(r.Context(), "userID"))
+			if errors.Is(err, sql.ErrNoRows) {
+				http.Redirect(w, r, "/logout", http.StatusTemporaryRedirect)
+				return
+			} else if err != nil {
+				app.errorLog.Println(err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			if !user.TwoFactorEnabled {
+				http.Redirect(w, r, "/two-factor", http.StatusTemporaryRedirect)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequirePermission returns middleware that only lets the logged in user
+// through when they have perm through one of their roles. It must run after
+// Auth.
+func (app *application) RequirePermission(perm string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ok, err := app.DB.HasPermission(app.Session.GetInt(r.Context(), "userID"), perm)
+			if err != nil {
+				app.errorLog.Println(err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			if !ok {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"html/template"
 	"net/http"
-	"strings"
 )
 
 type templateData struct {
@@ -23,6 +22,14 @@ type templateData struct {
 	CSSVersion           string
 	StripeSecretKey      string
 	StripePublishableKey string
+	// Permissions is the set of permissions the logged in user has
+	Permissions map[string]bool
+}
+
+// Can reports whether the logged in user has a permission, so templates only
+// offer what the user is allowed to do
+func (td *templateData) Can(perm string) bool {
+	return td.Permissions[perm]
 }
 
 // functions is a map of functions that can be used in templates
@@ -48,6 +55,12 @@ func (app *application) addDefaultData(td *templateData, r *http.Request) *templ
 	if app.Session.Exists(r.Context(), "userID") {
 		td.IsAuthenticated = 1
 		td.UserID = app.Session.GetInt(r.Context(), "userID")
+
+		perms, err := app.DB.GetUserPermissions(td.UserID)
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+		td.Permissions = perms
 	} else {
 		td.IsAuthenticated = 0
 		td.UserID = 0
@@ -94,18 +107,14 @@ func (app *application) parseTemplate(partials []string, page string, templateTo
 	var t *template.Template
 	var err error
 
-	// build partials
-	if len(partials) > 0 {
-		for i, x := range partials {
-			partials[i] = fmt.Sprintf("templates/%s.partial.gohtml", x)
-		}
+	// build partials; each one is its own pattern, since ParseFS does not split on commas
+	patterns := []string{"templates/base.layout.gohtml"}
+	for _, x := range partials {
+		patterns = append(patterns, fmt.Sprintf("templates/%s.partial.gohtml", x))
 	}
+	patterns = append(patterns, templateToRender)
 
-	if len(partials) > 0 {
-		t, err = template.New(fmt.Sprintf("%s.page.gohtml", page)).Funcs(functions).ParseFS(templateFS, "templates/base.layout.gohtml", strings.Join(partials, ","), templateToRender)
-	} else {
-		t, err = template.New(fmt.Sprintf("%s.page.gohtml", page)).Funcs(functions).ParseFS(templateFS, "templates/base.layout.gohtml", templateToRender)
-	}
+	t, err = template.New(fmt.Sprintf("%s.page.gohtml", page)).Funcs(functions).ParseFS(templateFS, patterns...)
 	if err != nil {
 		app.errorLog.Println(err)
 		return nil, err
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"maize/internal/models"
 	"net/http"
 
 	"github.com/go-chi/chi"
@@ -14,32 +15,56 @@ func (app *application) routes() http.Handler {
 	mux.Get("/", app.Home)
 	mux.Get("/ws", app.WsEndPoint)
 
+	mux.With(app.Auth).Get("/two-factor", app.TwoFactor)
+	mux.With(app.Auth).Get("/devices", app.Devices)
+
 	mux.Route("/admin", func(mux chi.Router) {
 		mux.Use(app.Auth)
-		mux.Get("/virtual-terminal", app.VirtualTerminal)
-		mux.Get("/all-sales", app.AllSales)
-		mux.Get("/all-subs", app.AllSubs)
-		mux.Get("/sales/{id}", app.ShowSale)
-		mux.Get("/subs/{id}", app.ShowSub)
-		mux.Get("/all-users", app.AllUsers)
-		mux.Get("/all-users/{id}", app.OneUser)
+		mux.Use(app.Require2FA)
+
+		// each page requires the permission its API calls do
+		can := app.RequirePermission
+
+		mux.With(can(models.PermTerminalCharge)).Get("/virtual-terminal", app.VirtualTerminal)
+		mux.With(can(models.PermReportsRead)).Get("/dashboard", app.Dashboard)
+		mux.With(can(models.PermOrdersRead)).Get("/all-sales", app.AllSales)
+		mux.With(can(models.PermOrdersRead)).Get("/all-subs", app.AllSubs)
+		mux.With(can(models.PermOrdersRead)).Get("/backorders", app.Backorders)
+		mux.With(can(models.PermReturnsRead)).Get("/returns", app.AllReturns)
+		mux.With(can(models.PermReturnsRead)).Get("/returns/{id}", app.ShowReturn)
+		mux.With(can(models.PermOrdersRead)).Get("/sales/{id}", app.ShowSale)
+		mux.With(can(models.PermOrdersRead)).Get("/subs/{id}", app.ShowSub)
+		mux.With(can(models.PermCustomersRead)).Get("/customers", app.Customers)
+		mux.With(can(models.PermCustomersRead)).Get("/customers/{id}", app.ShowCustomer)
+		mux.With(can(models.PermUsersRead)).Get("/all-users", app.AllUsers)
+		mux.With(can(models.PermUsersRead)).Get("/all-users/{id}", app.OneUser)
+		mux.With(can(models.PermAPIKeysWrite)).Get("/api-keys", app.APIKeys)
+		mux.With(can(models.PermCatalogRead)).Get("/all-products", app.AllProducts)
+		mux.With(can(models.PermCatalogRead)).Get("/all-products/{id}", app.OneProduct)
+		mux.With(can(models.PermCatalogRead)).Get("/shipping", app.ShippingRates)
 	})
 
 	mux.Get("/maize/{id}", app.ChargeOnce)
 	mux.Post("/payment-succeeded", app.PaymentSucceeded)
 	mux.Get("/receipt", app.Receipt)
 
-	mux.Get("/plans/bronze", app.BronzePlan)
-	mux.Get("/receipt/bronze", app.BronzePlanReceipt)
+	mux.Get("/returns/new", app.NewReturn)
+	mux.Get("/returns/label", app.ReturnLabel)
+
+	mux.Get("/plans/{id}", app.Plan)
+	mux.Get("/receipt/plans/{id}", app.PlanReceipt)
+	mux.Get("/orders/{id}/receipt", app.OrderReceipt)
 
 	mux.Get("/login", app.LoginPage)
 	mux.Get("/logout", app.Logout)
 	mux.Post("/login", app.PostLoginPage)
 	mux.Get("/forgot-password", app.ForgotPassword)
 	mux.Get("/reset-password", app.ShowResetPassword)
+	mux.Get("/accept-invite", app.AcceptInvite)
 
 	fileServer := http.FileServer(http.Dir("./static"))
 	mux.Handle("/static/*", http.StripPrefix("/static/", fileServer))
+	mux.Get("/images/*", app.ServeImage)
 
 	return mux
 }
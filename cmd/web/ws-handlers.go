@@ -90,6 +90,12 @@ func (app *application) ListenToWsChannel() {
 			response.UserID = e.UserID
 			app.broadcastToAll(response)
 
+		case "resetTwoFactor":
+			response.Action = "logout"
+			response.Message = "Your two-factor authentication has been reset"
+			response.UserID = e.UserID
+			app.broadcastToAll(response)
+
 		default:
 		}
 	}
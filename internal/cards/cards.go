@@ -1,6 +1,8 @@
 package cards
 
 import (
+	"time"
+
 	"github.com/stripe/stripe-go/v72"
 	"github.com/stripe/stripe-go/v72/customer"
 	"github.com/stripe/stripe-go/v72/paymentintent"
@@ -25,9 +27,10 @@ type Transaction struct {
 	BankReturnCode      string
 }
 
-// Charge represents a charge.
-func (c *Card) Charge(currency string, amount int) (*stripe.PaymentIntent, string, error) {
-	return c.CreatePaymentIntent(currency, amount)
+// Charge represents a charge. The metadata, which may be nil, is kept with the
+// payment intent.
+func (c *Card) Charge(currency string, amount int, metadata map[string]string) (*stripe.PaymentIntent, string, error) {
+	return c.CreatePaymentIntent(currency, amount, metadata)
 }
 
 // CreateCustomer creates a customer.
@@ -55,13 +58,14 @@ func (c *Card) CreateCustomer(pm, email string) (*stripe.Customer, string, error
 }
 
 // CreatePaymentIntent creates a payment intent.
-func (c *Card) CreatePaymentIntent(currency string, amount int) (*stripe.PaymentIntent, string, error) {
+func (c *Card) CreatePaymentIntent(currency string, amount int, metadata map[string]string) (*stripe.PaymentIntent, string, error) {
 	stripe.Key = c.Secret
 
 	params := &stripe.PaymentIntentParams{
 		Amount:   stripe.Int64(int64(amount)),
 		Currency: stripe.String(currency),
 	}
+	params.Metadata = metadata
 
 	pi, err := paymentintent.New(params)
 	if err != nil {
@@ -74,6 +78,76 @@ func (c *Card) CreatePaymentIntent(currency string, amount int) (*stripe.Payment
 	return pi, "", nil
 }
 
+// AuthorizationHold is how long Stripe keeps an uncaptured authorization before
+// cancelling it, after which Capture fails
+const AuthorizationHold = 7 * 24 * time.Hour
+
+// Authorize creates a payment intent that only places a hold on the card. The
+// funds are taken later with Capture, or released with CancelAuthorization.
+// The hold lasts AuthorizationHold, so it suits only goods that ship by then.
+func (c *Card) Authorize(currency string, amount int, metadata map[string]string) (*stripe.PaymentIntent, string, error) {
+	stripe.Key = c.Secret
+
+	params := &stripe.PaymentIntentParams{
+		Amount:        stripe.Int64(int64(amount)),
+		Currency:      stripe.String(currency),
+		CaptureMethod: stripe.String(string(stripe.PaymentIntentCaptureMethodManual)),
+	}
+	params.Metadata = metadata
+
+	pi, err := paymentintent.New(params)
+	if err != nil {
+		msg := ""
+		if stripeErr, ok := err.(*stripe.Error); ok {
+			msg = cardErrorMessage(stripeErr.Code)
+		}
+		return nil, msg, err
+	}
+	return pi, "", nil
+}
+
+// Capture takes the funds held by an authorized payment intent.
+func (c *Card) Capture(pi string) error {
+	stripe.Key = c.Secret
+
+	_, err := paymentintent.Capture(pi, nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// HoldLapsed reports whether err, returned by Capture, means the hold has
+// lapsed or was cancelled, so the payment can never be captured. Any other
+// error, such as a rate limit or a network failure, may be retried.
+func HoldLapsed(err error) bool {
+	stripeErr, ok := err.(*stripe.Error)
+	if !ok {
+		return false
+	}
+
+	if stripeErr.Code == stripe.ErrorCodeChargeExpiredForCapture {
+		return true
+	}
+
+	return stripeErr.Code == stripe.ErrorCodePaymentIntentUnexpectedState &&
+		stripeErr.PaymentIntent != nil &&
+		stripeErr.PaymentIntent.Status == stripe.PaymentIntentStatusCanceled
+}
+
+// CancelAuthorization releases the funds held by an authorized payment intent.
+func (c *Card) CancelAuthorization(pi string) error {
+	stripe.Key = c.Secret
+
+	_, err := paymentintent.Cancel(pi, nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 // GetPaymentMethod returns a payment method.
 func (c *Card) GetPaymentMethod(s string) (*stripe.PaymentMethod, error) {
 	stripe.Key = c.Secret
@@ -121,6 +195,13 @@ func (c *Card) SubscribeToPlan(cust *stripe.Customer, plan, email, last4, cardTy
 }
 
 func (c *Card) Refund(pi string, amount int) error {
+	return c.RefundOnce(pi, amount, "")
+}
+
+// RefundOnce refunds amount of a payment intent. Stripe issues a single refund
+// for every call made with the same idempotency key, so a refund that may or
+// may not have gone through can be retried; an empty key is not checked.
+func (c *Card) RefundOnce(pi string, amount int, idempotencyKey string) error {
 	stripe.Key = c.Secret
 	amountToRefund := int64(amount)
 
@@ -128,6 +209,9 @@ func (c *Card) Refund(pi string, amount int) error {
 		Amount:        &amountToRefund,
 		PaymentIntent: &pi,
 	}
+	if idempotencyKey != "" {
+		refundParams.SetIdempotencyKey(idempotencyKey)
+	}
 
 	_, err := refund.New(refundParams)
 	if err != nil {
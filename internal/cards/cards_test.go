@@ -0,0 +1,38 @@
+package cards
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+func TestHoldLapsed(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"charge expired", &stripe.Error{Code: stripe.ErrorCodeChargeExpiredForCapture}, true},
+		{"intent cancelled", &stripe.Error{
+			Code:          stripe.ErrorCodePaymentIntentUnexpectedState,
+			PaymentIntent: &stripe.PaymentIntent{Status: stripe.PaymentIntentStatusCanceled},
+		}, true},
+		{"intent already captured", &stripe.Error{
+			Code:          stripe.ErrorCodePaymentIntentUnexpectedState,
+			PaymentIntent: &stripe.PaymentIntent{Status: stripe.PaymentIntentStatusSucceeded},
+		}, false},
+		{"rate limited", &stripe.Error{Code: stripe.ErrorCodeRateLimit, Type: stripe.ErrorTypeInvalidRequest}, false},
+		{"authentication", &stripe.Error{Type: stripe.ErrorTypeAuthentication}, false},
+		{"api connection", &stripe.Error{Type: stripe.ErrorTypeAPIConnection}, false},
+		{"idempotency", &stripe.Error{Type: stripe.ErrorTypeIdempotency}, false},
+		{"network", errors.New("connection reset"), false},
+		{"nil", nil, false},
+	}
+
+	for _, tt := range tests {
+		if got := HoldLapsed(tt.err); got != tt.want {
+			t.Errorf("%s: HoldLapsed = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
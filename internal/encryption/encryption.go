@@ -3,49 +3,213 @@ package encryption
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"strings"
 )
 
+// Ciphertexts are written as version.keyID.data, where data is the base64url
+// of a random nonce followed by the AES-GCM sealed text. The version and key
+// ID are authenticated along with the text. Ciphertexts without a version were
+// written with AES-CFB, unauthenticated, before versions were kept.
+const version = "v2"
+
+// Errors returned by Decrypt
+var (
+	// ErrMalformed is returned for input that is not a ciphertext Encrypt wrote
+	ErrMalformed = errors.New("encryption: malformed ciphertext")
+	// ErrUnknownKey is returned when no key in the ring has the ciphertext's ID
+	ErrUnknownKey = errors.New("encryption: unknown key")
+	// ErrTampered is returned when the ciphertext fails authentication, because
+	// it was changed or encrypted with another key of the same ID
+	ErrTampered = errors.New("encryption: ciphertext failed authentication")
+)
+
+// Encryption encrypts with its primary Key and decrypts with it or any of its
+// Retired keys, so keys can be rotated without losing what the old ones wrote
 type Encryption struct {
 	Key []byte
+	// KeyID names Key in the ciphertexts it writes. It is derived from Key
+	// when empty.
+	KeyID string
+	// Retired holds the keys that still decrypt, by ID
+	Retired map[string][]byte
+	// HashKey keys Hash. Key does when it is empty.
+	HashKey []byte
+	// RetiredHashKeys are hash keys HashKey replaced, which Hashes still
+	// hashes with, so values indexed before a rotation are still found
+	RetiredHashKeys [][]byte
 }
 
-func (e *Encryption) Encrypt(text string) (string, error) {
-	plainText := []byte(text)
+// New returns an Encryption for key, which must be 16, 24 or 32 bytes long
+func New(key []byte) (*Encryption, error) {
+	return NewRing(key)
+}
 
-	block, err := aes.NewCipher(e.Key)
+// NewRing returns an Encryption that encrypts with key and decrypts with key
+// or any of retired. Keys are known by the IDs KeyID derives from them.
+func NewRing(key []byte, retired ...[]byte) (*Encryption, error) {
+	e := &Encryption{Key: key, KeyID: KeyID(key), Retired: make(map[string][]byte)}
+
+	for _, k := range append([][]byte{key}, retired...) {
+		_, err := aes.NewCipher(k)
+		if err != nil {
+			return nil, err
+		}
+		if id := KeyID(k); id != e.KeyID {
+			e.Retired[id] = k
+		}
+	}
+
+	return e, nil
+}
+
+// KeyID returns the ID a key is known by when none is given, a fingerprint
+// that does not reveal the key
+func KeyID(key []byte) string {
+	sum := sha256.Sum256(append([]byte("key-id:"), key...))
+	return hex.EncodeToString(sum[:4])
+}
+
+// keyID returns the ID of the primary key
+func (e *Encryption) keyID() string {
+	if e.KeyID != "" {
+		return e.KeyID
+	}
+	return KeyID(e.Key)
+}
+
+// key returns the key with the given ID
+func (e *Encryption) key(id string) ([]byte, error) {
+	if id == e.keyID() {
+		return e.Key, nil
+	}
+	if k, ok := e.Retired[id]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnknownKey, id)
+}
+
+// Hash returns a keyed hash of text as hex. The same text always hashes the
+// same, so a hash stored next to an encrypted value finds it without
+// decrypting anything. The hash key is derived from HashKey, or from Key when
+// there is none, in which case hashes change when the primary key does.
+func (e *Encryption) Hash(text string) string {
+	key := e.HashKey
+	if len(key) == 0 {
+		key = e.Key
+	}
+	return hash(key, text)
+}
+
+// Hashes returns the hash of text with HashKey, as Hash does, followed by its
+// hashes with each of RetiredHashKeys, for finding values by a hash that may
+// have been stored before the hash key was rotated
+func (e *Encryption) Hashes(text string) []string {
+	hashes := []string{e.Hash(text)}
+	for _, key := range e.RetiredHashKeys {
+		hashes = append(hashes, hash(key, text))
+	}
+	return hashes
+}
+
+// hash returns the keyed hash of text as hex, with a key derived from key
+func hash(key []byte, text string) string {
+	derived := sha256.Sum256(append([]byte("blind-index:"), key...))
+
+	mac := hmac.New(sha256.New, derived[:])
+	mac.Write([]byte(text))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Encrypt encrypts and authenticates text with the primary key
+func (e *Encryption) Encrypt(text string) (string, error) {
+	gcm, err := newGCM(e.Key)
 	if err != nil {
 		return "", err
 	}
 
-	cipherText := make([]byte, aes.BlockSize+len(plainText))
-	iv := cipherText[:aes.BlockSize]
+	header := version + "." + e.keyID()
 
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(text)+gcm.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return "", err
 	}
 
-	stream := cipher.NewCFBEncrypter(block, iv)
-	stream.XORKeyStream(cipherText[aes.BlockSize:], plainText)
+	sealed := gcm.Seal(nonce, nonce, []byte(text), []byte(header))
 
-	return base64.URLEncoding.EncodeToString(cipherText), nil
+	return header + "." + base64.RawURLEncoding.EncodeToString(sealed), nil
 }
 
+// Decrypt decrypts a ciphertext Encrypt wrote with any key in the ring. It
+// returns ErrMalformed or ErrTampered when the ciphertext cannot be trusted,
+// and ErrUnknownKey, wrapped with the key ID, when the ring lacks its key;
+// check for them with errors.Is. Unversioned ciphertexts are rejected; use
+// DecryptLegacy for those.
 func (e *Encryption) Decrypt(cryptoText string) (string, error) {
-	cipherText, err := base64.URLEncoding.DecodeString(cryptoText)
+	parts := strings.SplitN(cryptoText, ".", 3)
+	if len(parts) != 3 || parts[0] != version {
+		return "", ErrMalformed
+	}
+
+	key, err := e.key(parts[1])
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", ErrMalformed
+	}
+
+	gcm, err := newGCM(key)
 	if err != nil {
 		return "", err
 	}
 
+	if len(sealed) < gcm.NonceSize()+gcm.Overhead() {
+		return "", ErrMalformed
+	}
+
+	nonce, sealed := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+
+	plainText, err := gcm.Open(nil, nonce, sealed, []byte(parts[0]+"."+parts[1]))
+	if err != nil {
+		return "", ErrTampered
+	}
+
+	return string(plainText), nil
+}
+
+// IsLegacy reports whether a ciphertext was written before versions were kept
+func IsLegacy(cryptoText string) bool {
+	return !strings.HasPrefix(cryptoText, version+".")
+}
+
+// DecryptLegacy decrypts an unversioned ciphertext with the primary key. Those
+// are not authenticated, so a changed ciphertext decrypts to changed text
+// without an error: only use it on ciphertexts nobody else could have written,
+// such as those stored in the database, and re-encrypt them with Rotate.
+func (e *Encryption) DecryptLegacy(cryptoText string) (string, error) {
+	cipherText, err := base64.URLEncoding.DecodeString(cryptoText)
+	if err != nil {
+		return "", ErrMalformed
+	}
+
 	block, err := aes.NewCipher(e.Key)
 	if err != nil {
 		return "", err
 	}
 
 	if len(cipherText) < aes.BlockSize {
-		return "", err
+		return "", ErrMalformed
 	}
 
 	iv := cipherText[:aes.BlockSize]
@@ -56,3 +220,52 @@ func (e *Encryption) Decrypt(cryptoText string) (string, error) {
 
 	return string(cipherText), nil
 }
+
+// NeedsRotation reports whether a ciphertext is legacy or was encrypted with a
+// retired key
+func (e *Encryption) NeedsRotation(cryptoText string) bool {
+	if IsLegacy(cryptoText) {
+		return true
+	}
+
+	parts := strings.SplitN(cryptoText, ".", 3)
+	return len(parts) != 3 || parts[1] != e.keyID()
+}
+
+// Rotate re-encrypts a legacy ciphertext, or one encrypted with a retired key,
+// with the primary key, and returns other ciphertexts unchanged. It also
+// returns the text, so anything derived from it can be rebuilt.
+func (e *Encryption) Rotate(cryptoText string) (string, string, error) {
+	var text string
+	var err error
+
+	if IsLegacy(cryptoText) {
+		text, err = e.DecryptLegacy(cryptoText)
+	} else {
+		text, err = e.Decrypt(cryptoText)
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	if !e.NeedsRotation(cryptoText) {
+		return cryptoText, text, nil
+	}
+
+	rotated, err := e.Encrypt(text)
+	if err != nil {
+		return "", "", err
+	}
+
+	return rotated, text, nil
+}
+
+// newGCM returns AES-GCM with key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
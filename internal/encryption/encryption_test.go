@@ -0,0 +1,193 @@
+package encryption
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+var (
+	testKey     = []byte("0123456789abcdef0123456789abcdef")
+	testRetired = []byte("fedcba9876543210fedcba9876543210")
+)
+
+// legacyText and legacyCipherText were written by the AES-CFB Encrypt of
+// earlier versions with testKey
+const (
+	legacyText       = "jane@example.com"
+	legacyCipherText = "ZmVkY2JhOTg3NjU0MzIxMLQ5FTqMlTbVH1SK_xTj2HE="
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	e, err := New(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, text := range []string{"", "jane@example.com", strings.Repeat("maize ", 100)} {
+		ct, err := e.Encrypt(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(ct, version+"."+KeyID(testKey)+".") {
+			t.Errorf("Encrypt(%q) = %q, want the version and key ID first", text, ct)
+		}
+
+		got, err := e.Decrypt(ct)
+		if err != nil {
+			t.Fatalf("Decrypt(Encrypt(%q)): %v", text, err)
+		}
+		if got != text {
+			t.Errorf("Decrypt(Encrypt(%q)) = %q", text, got)
+		}
+	}
+}
+
+func TestDecryptErrors(t *testing.T) {
+	e, err := New(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ct, err := e.Encrypt("jane@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.SplitN(ct, ".", 3)
+
+	// flip one byte of the sealed text
+	sealed, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed[len(sealed)/2] ^= 1
+	flipped := parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(sealed)
+
+	// the same key under another ID: the header is authenticated, so it fails
+	// even though the key could open the text
+	other := &Encryption{Key: testKey, KeyID: "other"}
+	relabelled := version + ".other." + parts[2]
+
+	tests := []struct {
+		name string
+		e    *Encryption
+		text string
+		want error
+	}{
+		{"flipped byte", e, flipped, ErrTampered},
+		{"relabelled header", other, relabelled, ErrTampered},
+		{"empty", e, "", ErrMalformed},
+		{"garbage", e, "not a ciphertext", ErrMalformed},
+		{"wrong version", e, "v1." + parts[1] + "." + parts[2], ErrMalformed},
+		{"bad base64", e, parts[0] + "." + parts[1] + ".!!!", ErrMalformed},
+		{"too short", e, parts[0] + "." + parts[1] + ".AAAA", ErrMalformed},
+		{"legacy", e, legacyCipherText, ErrMalformed},
+		{"unknown key", e, version + ".deadbeef." + parts[2], ErrUnknownKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.e.Decrypt(tt.text)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Decrypt = %q, %v; want error %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecryptLegacy(t *testing.T) {
+	e, err := New(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !IsLegacy(legacyCipherText) {
+		t.Fatal("IsLegacy = false for a legacy ciphertext")
+	}
+
+	got, err := e.DecryptLegacy(legacyCipherText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != legacyText {
+		t.Errorf("DecryptLegacy = %q, want %q", got, legacyText)
+	}
+
+	_, err = e.DecryptLegacy("AAAA")
+	if !errors.Is(err, ErrMalformed) {
+		t.Errorf("DecryptLegacy of a short ciphertext: %v, want %v", err, ErrMalformed)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	old, err := New(testRetired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retiredCT, err := old.Encrypt("retired key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := NewRing(testKey, testRetired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	currentCT, err := e.Encrypt("current key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		text      string
+		want      string
+		needsIt   bool
+		unchanged bool
+	}{
+		{"legacy", legacyCipherText, legacyText, true, false},
+		{"retired key", retiredCT, "retired key", true, false},
+		{"primary key", currentCT, "current key", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := e.NeedsRotation(tt.text); got != tt.needsIt {
+				t.Errorf("NeedsRotation = %v, want %v", got, tt.needsIt)
+			}
+
+			rotated, text, err := e.Rotate(tt.text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if text != tt.want {
+				t.Errorf("Rotate text = %q, want %q", text, tt.want)
+			}
+			if (rotated == tt.text) != tt.unchanged {
+				t.Errorf("Rotate(%q) = %q, want unchanged %v", tt.text, rotated, tt.unchanged)
+			}
+			if e.NeedsRotation(rotated) {
+				t.Errorf("rotated ciphertext %q still needs rotation", rotated)
+			}
+
+			got, err := e.Decrypt(rotated)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Decrypt(rotated) = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// once the retired key leaves the ring, what it wrote no longer decrypts
+	current, err := New(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = current.Rotate(retiredCT)
+	if !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Rotate without the retired key: %v, want %v", err, ErrUnknownKey)
+	}
+}
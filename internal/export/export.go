@@ -0,0 +1,133 @@
+// Package export writes tables of rows as CSV or XLSX, one row at a time, so
+// that large exports never have to be held in memory.
+package export
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats the tables can be written in
+const (
+	CSV  = "csv"
+	XLSX = "xlsx"
+)
+
+// Writer writes rows of a table. Values may be strings, ints, floats or times;
+// numbers are written as numbers and everything else as text. Close must be
+// called once the last row has been written.
+type Writer interface {
+	Write(row ...interface{}) error
+	Close() error
+}
+
+// New returns a Writer writing to w in format, with sheet naming the sheet of
+// an XLSX workbook
+func New(w io.Writer, format, sheet string) (Writer, error) {
+	switch format {
+	case CSV:
+		return &csvWriter{w: csv.NewWriter(w)}, nil
+	case XLSX:
+		return newXLSXWriter(w, sheet)
+	default:
+		return nil, fmt.Errorf("unknown export format %q", format)
+	}
+}
+
+// Valid reports whether format is one of the export formats
+func Valid(format string) bool {
+	return format == CSV || format == XLSX
+}
+
+// ContentType returns the MIME type of format
+func ContentType(format string) string {
+	if format == XLSX {
+		return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	}
+	return "text/csv; charset=utf-8"
+}
+
+// currencySymbols maps the currencies we take to their symbols
+var currencySymbols = map[string]string{
+	"":    "$",
+	"usd": "$",
+	"cad": "$",
+	"eur": "€",
+	"gbp": "£",
+}
+
+// Money formats an amount in cents of currency, like $12.34
+func Money(cents int, currency string) string {
+	sign := ""
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+
+	amount := fmt.Sprintf("%d.%02d", cents/100, cents%100)
+
+	if symbol, ok := currencySymbols[strings.ToLower(currency)]; ok {
+		return sign + symbol + amount
+	}
+	return sign + amount + " " + strings.ToUpper(currency)
+}
+
+// timeLayout is how times are written
+const timeLayout = "2006-01-02 15:04:05"
+
+// text returns the text of a value
+func text(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Time:
+		if v.IsZero() {
+			return ""
+		}
+		return v.Format(timeLayout)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// csvWriter writes rows as CSV
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func (c *csvWriter) Write(row ...interface{}) error {
+	record := make([]string, len(row))
+	for i, v := range row {
+		record[i] = text(v)
+		if s, ok := v.(string); ok {
+			record[i] = defuse(s)
+		}
+	}
+	return c.w.Write(record)
+}
+
+func (c *csvWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// defuse stops spreadsheets from running text that looks like a formula, such
+// as a customer named =HYPERLINK(...), by quoting it as text
+func defuse(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
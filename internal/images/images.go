@@ -0,0 +1,159 @@
+package images
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+
+	// register the gif decoder so uploaded gifs can be thumbnailed
+	_ "image/gif"
+)
+
+// MaxUploadSize is the largest image, in bytes, that may be uploaded
+const MaxUploadSize = 5 << 20
+
+// maxPixels guards against images that are small on disk but huge once decoded
+const maxPixels = 40_000_000
+
+// ThumbnailSize is the length, in pixels, of the longest side of a thumbnail
+const ThumbnailSize = 320
+
+var allowedTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// Upload is a validated image along with its generated thumbnail
+type Upload struct {
+	Original      []byte
+	ContentType   string
+	Extension     string
+	Thumbnail     []byte
+	ThumbnailType string
+	ThumbnailExt  string
+	Width, Height int
+}
+
+// Process validates the size and type of an uploaded image and generates a thumbnail
+func Process(data []byte) (*Upload, error) {
+	if len(data) == 0 {
+		return nil, errors.New("image is empty")
+	}
+
+	if len(data) > MaxUploadSize {
+		return nil, fmt.Errorf("image must be smaller than %d MB", MaxUploadSize>>20)
+	}
+
+	contentType := http.DetectContentType(data)
+	ext, ok := allowedTypes[contentType]
+	if !ok {
+		return nil, fmt.Errorf("images of type %s are not allowed; use jpeg, png or gif", contentType)
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("image could not be read: %w", err)
+	}
+
+	if cfg.Width*cfg.Height > maxPixels {
+		return nil, errors.New("image dimensions are too large")
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("image could not be read: %w", err)
+	}
+
+	upload := &Upload{
+		Original:    data,
+		ContentType: contentType,
+		Extension:   ext,
+		Width:       cfg.Width,
+		Height:      cfg.Height,
+	}
+
+	thumb := Thumbnail(img, ThumbnailSize)
+
+	var buf bytes.Buffer
+	if contentType == "image/jpeg" {
+		err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 85})
+		upload.ThumbnailType, upload.ThumbnailExt = "image/jpeg", ".jpg"
+	} else {
+		// png keeps the transparency that gifs and pngs may have
+		err = png.Encode(&buf, thumb)
+		upload.ThumbnailType, upload.ThumbnailExt = "image/png", ".png"
+	}
+	if err != nil {
+		return nil, err
+	}
+	upload.Thumbnail = buf.Bytes()
+
+	return upload, nil
+}
+
+// Thumbnail scales an image down so that its longest side is at most size
+// pixels, averaging the source pixels covered by each thumbnail pixel. Images
+// that are already small enough are returned unchanged.
+func Thumbnail(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return src
+	}
+
+	tw, th := size, h*size/w
+	if h > w {
+		tw, th = w*size/h, size
+	}
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, tw, th))
+
+	for y := 0; y < th; y++ {
+		y0 := b.Min.Y + y*h/th
+		y1 := b.Min.Y + (y+1)*h/th
+		if y1 == y0 {
+			y1++
+		}
+
+		for x := 0; x < tw; x++ {
+			x0 := b.Min.X + x*w/tw
+			x1 := b.Min.X + (x+1)*w/tw
+			if x1 == x0 {
+				x1++
+			}
+
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := color.NRGBA64Model.Convert(src.At(sx, sy)).(color.NRGBA64)
+					r += uint64(c.R)
+					g += uint64(c.G)
+					bl += uint64(c.B)
+					a += uint64(c.A)
+					n++
+				}
+			}
+
+			dst.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(r / n >> 8),
+				G: uint8(g / n >> 8),
+				B: uint8(bl / n >> 8),
+				A: uint8(a / n >> 8),
+			})
+		}
+	}
+
+	return dst
+}
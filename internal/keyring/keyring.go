@@ -0,0 +1,310 @@
+package keyring
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maize/internal/encryption"
+	"maize/internal/urlsigner"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Key purposes. Each purpose has its own keys, so one can be rotated, or
+// leak, without touching the others.
+const (
+	// PurposeURLSigning signs links sent by email
+	PurposeURLSigning = "url-signing"
+	// PurposeLinkEncryption encrypts what the links carry, such as the email
+	// address in a password reset link
+	PurposeLinkEncryption = "link-encryption"
+	// PurposePII encrypts customer names and email addresses in the database
+	PurposePII = "pii"
+	// PurposeBlindIndex keys the hashes customer email addresses are found by
+	PurposeBlindIndex = "blind-index"
+)
+
+// Purposes lists every key purpose
+var Purposes = []string{PurposeURLSigning, PurposeLinkEncryption, PurposePII, PurposeBlindIndex}
+
+// DefaultGrace is how long a rotated key of each purpose keeps verifying or
+// decrypting by default: as long as the links it signed or encrypted live. PII
+// and blind index keys never expire on their own, since data stays encrypted
+// or indexed with them until cli encrypt-pii has run; prune them after.
+var DefaultGrace = map[string]time.Duration{
+	PurposeURLSigning:     30 * 24 * time.Hour,
+	PurposeLinkEncryption: 24 * time.Hour,
+	PurposePII:            0,
+	PurposeBlindIndex:     0,
+}
+
+// keySize is the size of generated keys, for AES-256
+const keySize = 32
+
+// ErrNoKey is returned when a ring has no key for a purpose
+var ErrNoKey = errors.New("keyring: no key for purpose")
+
+// Key is one secret of a ring. The primary key of a purpose is its newest key
+// that is not retired. Retired keys still verify and decrypt until they
+// expire, or for ever when ExpiresAt is nil.
+type Key struct {
+	ID        string     `json:"id"`
+	Purpose   string     `json:"purpose"`
+	Secret    []byte     `json:"secret"`
+	CreatedAt time.Time  `json:"created_at"`
+	RetiredAt *time.Time `json:"retired_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Expired reports whether the key has stopped verifying and decrypting
+func (k *Key) Expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
+
+// Ring is the keys of every purpose, as kept in the key ring file
+type Ring struct {
+	Keys []*Key `json:"keys"`
+}
+
+// Load reads a ring from a file written by Save
+func Load(path string) (*Ring, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var r Ring
+	err = json.Unmarshal(b, &r)
+	if err != nil {
+		return nil, fmt.Errorf("keyring: %s: %w", path, err)
+	}
+
+	for _, p := range Purposes {
+		if _, err := r.Primary(p); err != nil {
+			return nil, fmt.Errorf("keyring: %s: %w", path, err)
+		}
+	}
+
+	return &r, nil
+}
+
+// Open loads the ring in the file at path, or returns the ring FromSecrets
+// builds from secrets when there is no file configured
+func Open(path string, secrets map[string][]byte) (*Ring, error) {
+	if path == "" {
+		return FromSecrets(secrets), nil
+	}
+	return Load(path)
+}
+
+// Save writes the ring to a file only its owner can read, replacing it whole
+// so a failed write never leaves half a ring
+func (r *Ring) Save(path string) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".keyring-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(append(b, '\n'))
+	if err == nil {
+		err = tmp.Chmod(0600)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// FromSecrets returns a ring holding one key for each purpose, by purpose, as
+// configured before rings were kept. Keys are known by the fingerprints
+// encryption.KeyID derives, which is how ciphertexts written with them name
+// them.
+func FromSecrets(secrets map[string][]byte) *Ring {
+	var r Ring
+
+	for _, p := range Purposes {
+		if len(secrets[p]) == 0 {
+			continue
+		}
+		r.Keys = append(r.Keys, &Key{
+			ID:        encryption.KeyID(secrets[p]),
+			Purpose:   p,
+			Secret:    secrets[p],
+			CreatedAt: time.Now(),
+		})
+	}
+
+	return &r
+}
+
+// Primary returns the key of a purpose that signs and encrypts
+func (r *Ring) Primary(purpose string) (*Key, error) {
+	var primary *Key
+
+	for _, k := range r.Keys {
+		if k.Purpose != purpose || k.RetiredAt != nil {
+			continue
+		}
+		if primary == nil || k.CreatedAt.After(primary.CreatedAt) {
+			primary = k
+		}
+	}
+
+	if primary == nil {
+		return nil, fmt.Errorf("%w %s", ErrNoKey, purpose)
+	}
+
+	return primary, nil
+}
+
+// retired returns the retired keys of a purpose that have not expired, newest
+// first
+func (r *Ring) retired(purpose string, now time.Time) []*Key {
+	var keys []*Key
+
+	for _, k := range r.Keys {
+		if k.Purpose == purpose && k.RetiredAt != nil && !k.Expired(now) {
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.After(keys[j].CreatedAt) })
+
+	return keys
+}
+
+// Rotate adds a new primary key for a purpose and retires the one it replaces,
+// which keeps verifying and decrypting for grace, or for ever when grace is 0.
+// It returns the new key.
+func (r *Ring) Rotate(purpose string, grace time.Duration) (*Key, error) {
+	secret := make([]byte, keySize)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 4)
+	_, err = rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	if old, err := r.Primary(purpose); err == nil {
+		old.RetiredAt = &now
+		if grace > 0 {
+			expires := now.Add(grace)
+			old.ExpiresAt = &expires
+		}
+	}
+
+	k := &Key{
+		ID:        hex.EncodeToString(id),
+		Purpose:   purpose,
+		Secret:    secret,
+		CreatedAt: now,
+	}
+	r.Keys = append(r.Keys, k)
+
+	return k, nil
+}
+
+// Prune removes the keys that have expired, and returns how many it removed
+func (r *Ring) Prune(now time.Time) int {
+	kept := r.Keys[:0]
+	for _, k := range r.Keys {
+		if !k.Expired(now) {
+			kept = append(kept, k)
+		}
+	}
+
+	pruned := len(r.Keys) - len(kept)
+	r.Keys = kept
+
+	return pruned
+}
+
+// Signer returns a signer that signs with the primary key of a purpose and
+// verifies with it or any of its unexpired retired keys
+func (r *Ring) Signer(purpose string) (*urlsigner.Signer, error) {
+	primary, err := r.Primary(purpose)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &urlsigner.Signer{Secret: primary.Secret, KeyID: primary.ID, Retired: make(map[string][]byte)}
+	for _, k := range r.retired(purpose, time.Now()) {
+		s.Retired[k.ID] = k.Secret
+	}
+
+	return s, nil
+}
+
+// Encryption returns an Encryption that encrypts with the primary key of a
+// purpose and decrypts with it or any of its unexpired retired keys. Each key
+// is also known by its fingerprint, the ID ciphertexts written before the
+// ring name it by.
+func (r *Ring) Encryption(purpose string) (*encryption.Encryption, error) {
+	primary, err := r.Primary(purpose)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &encryption.Encryption{
+		Key:     primary.Secret,
+		KeyID:   primary.ID,
+		Retired: make(map[string][]byte),
+	}
+
+	for _, k := range append([]*Key{primary}, r.retired(purpose, time.Now())...) {
+		if _, err := encryption.New(k.Secret); err != nil {
+			return nil, fmt.Errorf("keyring: key %s: %w", k.ID, err)
+		}
+		if k != primary {
+			e.Retired[k.ID] = k.Secret
+		}
+		if id := encryption.KeyID(k.Secret); id != primary.ID {
+			e.Retired[id] = k.Secret
+		}
+	}
+
+	return e, nil
+}
+
+// PII returns the Encryption of customer data, which hashes email addresses
+// with the blind index key. Its retired blind index keys that have not
+// expired hash too, so rows indexed with them are still found by email until
+// cli encrypt-pii has indexed them again.
+func (r *Ring) PII() (*encryption.Encryption, error) {
+	e, err := r.Encryption(PurposePII)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := r.Primary(PurposeBlindIndex)
+	if err != nil {
+		return nil, err
+	}
+	e.HashKey = index.Secret
+
+	for _, k := range r.retired(PurposeBlindIndex, time.Now()) {
+		e.RetiredHashKeys = append(e.RetiredHashKeys, k.Secret)
+	}
+
+	return e, nil
+}
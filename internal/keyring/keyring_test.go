@@ -0,0 +1,281 @@
+package keyring
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testRing returns a ring with a generated key for every purpose
+func testRing(t *testing.T) *Ring {
+	t.Helper()
+
+	r := &Ring{}
+	for _, p := range Purposes {
+		if _, err := r.Rotate(p, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return r
+}
+
+func TestRotate(t *testing.T) {
+	r := testRing(t)
+
+	old, err := r.Primary(PurposeURLSigning)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k, err := r.Rotate(PurposeURLSigning, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	primary, err := r.Primary(PurposeURLSigning)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if primary != k || k.ID == old.ID || string(k.Secret) == string(old.Secret) {
+		t.Fatalf("Primary = %s, want the new key %s", primary.ID, k.ID)
+	}
+	if len(k.Secret) != keySize {
+		t.Errorf("new key is %d bytes, want %d", len(k.Secret), keySize)
+	}
+	if old.RetiredAt == nil || old.ExpiresAt == nil {
+		t.Fatalf("old key not retired with an expiry: %+v", old)
+	}
+	if d := time.Until(*old.ExpiresAt); d < 59*time.Minute || d > time.Hour {
+		t.Errorf("old key expires in %s, want an hour", d)
+	}
+
+	// other purposes are untouched
+	for _, p := range Purposes {
+		if p == PurposeURLSigning {
+			continue
+		}
+		if n := len(r.retired(p, time.Now())); n != 0 {
+			t.Errorf("%s has %d retired keys, want 0", p, n)
+		}
+	}
+
+	// with no grace, the old key never expires
+	pii, err := r.Primary(PurposePII)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.Rotate(PurposePII, 0); err != nil {
+		t.Fatal(err)
+	}
+	if pii.RetiredAt == nil || pii.ExpiresAt != nil || pii.Expired(time.Now().Add(100*365*24*time.Hour)) {
+		t.Errorf("PII key rotated without grace: %+v, want retired for ever", pii)
+	}
+}
+
+func TestGrace(t *testing.T) {
+	r := testRing(t)
+
+	old, err := r.Primary(PurposeURLSigning)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.Rotate(PurposeURLSigning, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := r.Signer(PurposeURLSigning)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Retired[old.ID]; !ok {
+		t.Error("retired key missing from the signer during its grace period")
+	}
+
+	if n := len(r.retired(PurposeURLSigning, old.ExpiresAt.Add(-time.Second))); n != 1 {
+		t.Errorf("retired keys just before expiry = %d, want 1", n)
+	}
+	if n := len(r.retired(PurposeURLSigning, *old.ExpiresAt)); n != 0 {
+		t.Errorf("retired keys at expiry = %d, want 0", n)
+	}
+
+	past := time.Now().Add(-time.Second)
+	old.ExpiresAt = &past
+
+	s, err = r.Signer(PurposeURLSigning)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Retired[old.ID]; ok {
+		t.Error("retired key still in the signer after its grace period")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	r := testRing(t)
+
+	for _, p := range []string{PurposeURLSigning, PurposeLinkEncryption} {
+		if _, err := r.Rotate(p, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// retired for ever, so never pruned
+	if _, err := r.Rotate(PurposePII, 0); err != nil {
+		t.Fatal(err)
+	}
+	before := len(r.Keys)
+
+	if n := r.Prune(time.Now()); n != 0 {
+		t.Errorf("Prune before any key expired = %d, want 0", n)
+	}
+
+	n := r.Prune(time.Now().Add(2 * time.Hour))
+	if n != 2 {
+		t.Errorf("Prune after the grace periods = %d, want 2", n)
+	}
+	if len(r.Keys) != before-2 {
+		t.Errorf("ring has %d keys, want %d", len(r.Keys), before-2)
+	}
+	for _, k := range r.Keys {
+		if k.Expired(time.Now().Add(2 * time.Hour)) {
+			t.Errorf("expired key %s kept", k.ID)
+		}
+	}
+	for _, p := range Purposes {
+		if _, err := r.Primary(p); err != nil {
+			t.Errorf("Prune removed the primary key: %v", err)
+		}
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "keyring.json")
+
+	r := testRing(t)
+	if _, err := r.Rotate(PurposeURLSigning, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path, []byte("the ring this replaces"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("ring file mode = %o, want 600", mode)
+	}
+
+	// the ring is written to a temporary file renamed over the old one, which
+	// must not be left behind
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("directory holds %d files after Save, want 1", len(entries))
+	}
+
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Keys) != len(r.Keys) {
+		t.Fatalf("loaded %d keys, want %d", len(loaded.Keys), len(r.Keys))
+	}
+	for i, k := range loaded.Keys {
+		want := r.Keys[i]
+		if k.ID != want.ID || k.Purpose != want.Purpose || string(k.Secret) != string(want.Secret) ||
+			(k.RetiredAt == nil) != (want.RetiredAt == nil) || (k.ExpiresAt == nil) != (want.ExpiresAt == nil) {
+			t.Errorf("key %d = %+v, want %+v", i, k, want)
+		}
+	}
+
+	// a save that fails leaves the old ring in place
+	if err := r.Save(filepath.Join(dir, "missing", "keyring.json")); err == nil {
+		t.Error("Save into a missing directory succeeded")
+	}
+	if _, err := Load(path); err != nil {
+		t.Errorf("Load after a failed save: %v", err)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	dir := t.TempDir()
+
+	incomplete := &Ring{}
+	if _, err := incomplete.Rotate(PurposeURLSigning, 0); err != nil {
+		t.Fatal(err)
+	}
+	incompletePath := filepath.Join(dir, "incomplete.json")
+	if err := incomplete.Save(incompletePath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(incompletePath); !errors.Is(err, ErrNoKey) {
+		t.Errorf("Load of a ring missing purposes: %v, want %v", err, ErrNoKey)
+	}
+
+	garbagePath := filepath.Join(dir, "garbage.json")
+	if err := os.WriteFile(garbagePath, []byte("not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(garbagePath); err == nil {
+		t.Error("Load of garbage succeeded")
+	}
+}
+
+// TestPIIRetiredBlindIndex checks that rotating the blind index key keeps the
+// hashes of the old key, so email lookups find rows indexed before rotation
+func TestPIIRetiredBlindIndex(t *testing.T) {
+	r := testRing(t)
+
+	before, err := r.PII()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldHash := before.Hash("jane@example.com")
+
+	if _, err = r.Rotate(PurposeBlindIndex, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := r.PII()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hashes := after.Hashes("jane@example.com")
+	if len(hashes) != 2 {
+		t.Fatalf("Hashes = %v, want the new and the old hash", hashes)
+	}
+	if hashes[0] != after.Hash("jane@example.com") || hashes[0] == oldHash {
+		t.Errorf("Hashes[0] = %s, want the hash with the new key", hashes[0])
+	}
+	if hashes[1] != oldHash {
+		t.Errorf("Hashes[1] = %s, want the hash with the old key %s", hashes[1], oldHash)
+	}
+
+	// once pruned, the old key no longer hashes
+	for _, k := range r.Keys {
+		if k.Purpose == PurposeBlindIndex && k.RetiredAt != nil {
+			past := time.Now().Add(-time.Second)
+			k.ExpiresAt = &past
+		}
+	}
+	r.Prune(time.Now())
+
+	pruned, err := r.PII()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashes := pruned.Hashes("jane@example.com"); len(hashes) != 1 {
+		t.Errorf("Hashes after pruning = %v, want only the new hash", hashes)
+	}
+}
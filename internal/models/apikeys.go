@@ -0,0 +1,269 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// APIKeyPrefix starts every API key, telling them apart from tokens
+const APIKeyPrefix = "mzk_"
+
+// apiKeyDisplayLen is how much of a key is kept in plain text, to recognise it
+// by in the list of keys
+const apiKeyDisplayLen = 12
+
+// Errors returned by the API key methods
+var (
+	ErrAPIKeyNotFound = errors.New("no such API key")
+	ErrAPIKeyScope    = errors.New("an API key cannot have a scope its creator does not have")
+)
+
+// APIKey is a model for the api_keys table. A key acts for the user who
+// created it, within its scopes, which are the names of permissions. Only the
+// hash of the key is kept; its plain text is returned once, when it is
+// created.
+type APIKey struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"user_id"`
+	CreatedBy  string     `json:"created_by"`
+	Name       string     `json:"name"`
+	PlainText  string     `json:"key,omitempty"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// HasScope reports whether the key may be used for a permission
+func (k *APIKey) HasScope(perm string) bool {
+	for _, s := range k.Scopes {
+		if s == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// apiKeyHash returns the hash a key is stored as. Keys are random and long,
+// so a fast hash is enough, as it is for tokens.
+func apiKeyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAPIKey creates a key for a user with the given scopes, which never
+// expires when ttl is 0, and returns it with its plain text. It returns
+// ErrAPIKeyScope when the user lacks any of the scopes.
+func (m *DBModel) CreateAPIKey(userID int, name string, scopes []string, ttl time.Duration) (*APIKey, error) {
+	perms, err := m.GetUserPermissions(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var kept []string
+	for _, s := range scopes {
+		if !perms[s] {
+			return nil, fmt.Errorf("%w: %s", ErrAPIKeyScope, s)
+		}
+		if !seen[s] {
+			seen[s] = true
+			kept = append(kept, s)
+		}
+	}
+
+	b := make([]byte, 20)
+	_, err = rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &APIKey{
+		UserID:    userID,
+		Name:      name,
+		PlainText: APIKeyPrefix + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)),
+		Scopes:    kept,
+		CreatedAt: time.Now(),
+	}
+	k.Prefix = k.PlainText[:apiKeyDisplayLen]
+	if ttl > 0 {
+		expires := k.CreatedAt.Add(ttl)
+		k.ExpiresAt = &expires
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+	insert into api_keys
+		(user_id, name, prefix, key_hash, scopes, expires_at, created_at, updated_at)
+	values (?, ?, ?, ?, ?, ?, ?, ?)`
+
+	result, err := m.DB.ExecContext(ctx, stmt,
+		k.UserID,
+		k.Name,
+		k.Prefix,
+		apiKeyHash(k.PlainText),
+		strings.Join(k.Scopes, ","),
+		k.ExpiresAt,
+		k.CreatedAt,
+		k.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	k.ID = int(id)
+
+	return k, nil
+}
+
+// apiKeyColumns are the columns scanAPIKey reads, in order
+const apiKeyColumns = `
+		k.id, k.user_id, u.email, k.name, k.prefix, k.scopes, k.expires_at, k.last_used_at,
+		k.revoked_at, k.created_at`
+
+// scanAPIKey reads a row of apiKeyColumns
+func scanAPIKey(row interface{ Scan(...interface{}) error }) (*APIKey, error) {
+	var k APIKey
+	var scopes string
+	var expires, lastUsed, revoked sql.NullTime
+
+	err := row.Scan(
+		&k.ID,
+		&k.UserID,
+		&k.CreatedBy,
+		&k.Name,
+		&k.Prefix,
+		&scopes,
+		&expires,
+		&lastUsed,
+		&revoked,
+		&k.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	k.Scopes = []string{}
+	if scopes != "" {
+		k.Scopes = strings.Split(scopes, ",")
+	}
+	if expires.Valid {
+		k.ExpiresAt = &expires.Time
+	}
+	if lastUsed.Valid {
+		k.LastUsedAt = &lastUsed.Time
+	}
+	if revoked.Valid {
+		k.RevokedAt = &revoked.Time
+	}
+
+	return &k, nil
+}
+
+// GetAPIKeys returns every API key, revoked and expired ones included, newest
+// first
+func (m *DBModel) GetAPIKeys() ([]*APIKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var keys []*APIKey
+
+	stmt := `
+	select` + apiKeyColumns + `
+	from
+		api_keys k
+		left join users u on (u.id = k.user_id)
+	order by k.id desc`
+
+	rows, err := m.DB.QueryContext(ctx, stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+
+	return keys, rows.Err()
+}
+
+// GetUserByAPIKey returns an API key that is neither revoked nor expired, and
+// the user it acts for, and notes that the key was used
+func (m *DBModel) GetUserByAPIKey(key string) (*User, *APIKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+	select` + apiKeyColumns + `
+	from
+		api_keys k
+		inner join users u on (u.id = k.user_id)
+	where
+		k.key_hash = ? and k.revoked_at is null and (k.expires_at is null or k.expires_at > ?)`
+
+	k, err := scanAPIKey(m.DB.QueryRowContext(ctx, stmt, apiKeyHash(key), time.Now()))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user, err := m.GetOneUserByID(k.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if k.LastUsedAt == nil || time.Since(*k.LastUsedAt) > lastUsedPrecision {
+		_, err = m.DB.ExecContext(ctx, `update api_keys set last_used_at = ? where id = ?`, time.Now(), k.ID)
+		if err != nil {
+			// the key is still good, only its last use is not recorded
+			log.Println(err)
+		}
+	}
+
+	return &user, k, nil
+}
+
+// RevokeAPIKey revokes a key for good. It is kept, revoked, so the list of
+// keys shows what each was and when it stopped working.
+func (m *DBModel) RevokeAPIKey(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `update api_keys set revoked_at = ?, updated_at = ? where id = ? and revoked_at is null`
+
+	result, err := m.DB.ExecContext(ctx, stmt, time.Now(), time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrAPIKeyNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,238 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Backorder policies decide what happens when maize is ordered with no stock left
+const (
+	BackorderDeny     = "deny"
+	BackorderAllow    = "allow"
+	BackorderPreOrder = "preorder"
+)
+
+// ErrOutOfStock is returned when maize with a deny policy has too little stock,
+// and when a change would take stock below zero
+var ErrOutOfStock = errors.New("out of stock")
+
+// ValidBackorderPolicy reports whether p is one of the known backorder policies
+func ValidBackorderPolicy(p string) bool {
+	return p == BackorderDeny || p == BackorderAllow || p == BackorderPreOrder
+}
+
+// OrderStatusFor returns the status a new order for quantity units of the maize
+// should be given when stock units are on hand: cleared when the order can be
+// filled now, otherwise backordered or pre-ordered according to the maize's
+// policy. ErrOutOfStock is returned when the policy denies the sale.
+func (m Maize) OrderStatusFor(stock, quantity int) (int, error) {
+	if stock >= quantity {
+		return StatusCleared, nil
+	}
+
+	switch m.BackorderPolicy {
+	case BackorderAllow:
+		return StatusBackordered, nil
+	case BackorderPreOrder:
+		return StatusPreOrdered, nil
+	default:
+		return 0, ErrOutOfStock
+	}
+}
+
+// nullDate maps an empty YYYY-MM-DD date to NULL
+func nullDate(d string) sql.NullString {
+	return sql.NullString{String: d, Valid: d != ""}
+}
+
+// GetStockLevel returns the stock on hand for a maize, or for one of its
+// variants when variantID is not zero
+func (m *DBModel) GetStockLevel(maizeID, variantID int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var stock int
+	var err error
+
+	if variantID > 0 {
+		err = m.DB.QueryRowContext(ctx,
+			`select inventory_level from maize_variants where id = ? and maize_id = ?`,
+			variantID, maizeID).Scan(&stock)
+	} else {
+		err = m.DB.QueryRowContext(ctx,
+			`select inventory_level from maize where id = ?`, maizeID).Scan(&stock)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return stock, nil
+}
+
+// ShipsBy reports whether the maize has an expected ship date no later than t
+func (m Maize) ShipsBy(t time.Time) bool {
+	if m.ExpectedShipDate == "" {
+		return false
+	}
+
+	ships, err := time.Parse("2006-01-02", m.ExpectedShipDate)
+	if err != nil {
+		return false
+	}
+
+	return !ships.After(t)
+}
+
+// GetBackorders returns all backordered and pre-ordered orders, and the
+// pre-orders whose payment lapsed, oldest first, along with the stock
+// currently on hand for each
+func (m *DBModel) GetBackorders() ([]*Order, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var orders []*Order
+
+	stmt := `
+	select
+		o.id, o.maize_id, o.transaction_id, o.customer_id,
+		o.status_id, o.quantity, o.amount, o.created_at, o.updated_at,
+		m.id, m.name, m.inventory_level, m.backorder_policy,
+		coalesce(date_format(m.expected_ship_date, '%Y-%m-%d'), ''),
+		t.id, t.amount, t.currency, t.payment_intent, t.transaction_status_id,
+		c.id, c.first_name, c.last_name, c.email,
+		coalesce(o.variant_id, 0), coalesce(v.name, ''), coalesce(v.sku, ''),
+		coalesce(v.inventory_level, 0)
+	from
+		orders o
+			left join maize m on (o.maize_id = m.id)
+			left join
+				transactions t on (o.transaction_id = t.id)
+			left join
+				customers c on (o.customer_id = c.id)
+			left join
+				maize_variants v on (o.variant_id = v.id)
+	where
+		o.status_id in (?, ?, ?)
+	order by
+		o.created_at asc, o.id asc`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, StatusBackordered, StatusPreOrdered, StatusPaymentRequired)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var o Order
+		err = rows.Scan(
+			&o.ID,
+			&o.MaizeID,
+			&o.TransactionID,
+			&o.CustomerID,
+			&o.StatusID,
+			&o.Quantity,
+			&o.Amount,
+			&o.CreatedAt,
+			&o.UpdatedAt,
+			&o.Maize.ID,
+			&o.Maize.Name,
+			&o.Maize.InventoryLevel,
+			&o.Maize.BackorderPolicy,
+			&o.Maize.ExpectedShipDate,
+			&o.Transaction.ID,
+			&o.Transaction.Amount,
+			&o.Transaction.Currency,
+			&o.Transaction.PaymentIntent,
+			&o.Transaction.TransactionStatusId,
+			&o.Customer.ID,
+			&o.Customer.FirstName,
+			&o.Customer.LastName,
+			&o.Customer.Email,
+			&o.VariantID,
+			&o.Variant.Name,
+			&o.Variant.SKU,
+			&o.Variant.InventoryLevel,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		err = m.openCustomer(&o.Customer)
+		if err != nil {
+			return nil, err
+		}
+
+		orders = append(orders, &o)
+	}
+
+	return orders, nil
+}
+
+// UpdateTransactionStatus sets the status of a transaction
+func (m *DBModel) UpdateTransactionStatus(id, statusID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `update transactions set transaction_status_id = ?, updated_at = ? where id = ?`
+
+	_, err = tx.ExecContext(ctx, stmt, statusID, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	// whether an order counts towards the takings of the day it was placed
+	// depends on the status of its transaction
+	rows, err := tx.QueryContext(ctx, `select id, created_at from orders where transaction_id = ?`, id)
+	if err != nil {
+		return err
+	}
+
+	placed := make(map[int]time.Time)
+	for rows.Next() {
+		var orderID int
+		var createdAt time.Time
+		err = rows.Scan(&orderID, &createdAt)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		placed[orderID] = createdAt
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for orderID, createdAt := range placed {
+		err = m.refreshOrderDay(ctx, tx, orderID, createdAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// NewOrderStatus returns the status a new order for quantity units of a maize,
+// or of one of its variants, should be given based on current stock
+func (m *DBModel) NewOrderStatus(maizeID, variantID, quantity int) (int, error) {
+	maize, err := m.GetMaize(maizeID)
+	if err != nil {
+		return 0, err
+	}
+
+	stock, err := m.GetStockLevel(maizeID, variantID)
+	if err != nil {
+		return 0, err
+	}
+
+	return maize.OrderStatusFor(stock, quantity)
+}
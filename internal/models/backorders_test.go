@@ -0,0 +1,46 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShipsBy(t *testing.T) {
+	by := time.Date(2022, 8, 25, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		date string
+		want bool
+	}{
+		{"", false},
+		{"not a date", false},
+		{"2022-08-20", true},
+		{"2022-08-25", true},
+		{"2022-08-26", false},
+	}
+
+	for _, tt := range tests {
+		if got := (Maize{ExpectedShipDate: tt.date}).ShipsBy(by); got != tt.want {
+			t.Errorf("ShipsBy with ship date %q = %v, want %v", tt.date, got, tt.want)
+		}
+	}
+}
+
+// TestPaymentRequiredTransitions checks that a pre-order whose capture failed
+// can only be cancelled, and that only a pre-order can get there
+func TestPaymentRequiredTransitions(t *testing.T) {
+	if !CanTransition(StatusPreOrdered, StatusPaymentRequired) {
+		t.Error("a pre-order cannot move to payment required")
+	}
+	if CanTransition(StatusBackordered, StatusPaymentRequired) {
+		t.Error("a backorder, which was charged, can move to payment required")
+	}
+	if !CanTransition(StatusPaymentRequired, StatusCancelled) {
+		t.Error("an order waiting on payment cannot be cancelled")
+	}
+	for _, to := range []int{StatusCleared, StatusRefunded, StatusPreOrdered} {
+		if CanTransition(StatusPaymentRequired, to) {
+			t.Errorf("an order waiting on payment can move to %s", StatusName(to))
+		}
+	}
+}
@@ -0,0 +1,568 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Customers place an order with their name and email each time, so the same
+// person may have several rows in the customers table. Rows with the same
+// email address, ignoring case, are treated as one customer.
+
+// Dispute statuses. A dispute is open until the card issuer decides it for
+// or against us.
+const (
+	DisputeOpen = "open"
+	DisputeWon  = "won"
+	DisputeLost = "lost"
+)
+
+// ErrDisputeClosed is returned when a dispute that has been decided is changed
+var ErrDisputeClosed = errors.New("dispute has already been decided")
+
+// CustomerSummary is a customer as listed in a search: all the rows sharing
+// an email address, named after the latest of them
+type CustomerSummary struct {
+	ID        int        `json:"id"`
+	FirstName string     `json:"first_name"`
+	LastName  string     `json:"last_name"`
+	Email     string     `json:"email"`
+	Accounts  int        `json:"accounts"`
+	Orders    int        `json:"orders"`
+	FirstSeen time.Time  `json:"first_seen"`
+	LastOrder *time.Time `json:"last_order"`
+}
+
+// CustomerTotal is what a customer has spent in one currency. Net is what
+// they paid, less refunds and disputes lost.
+type CustomerTotal struct {
+	Currency string `json:"currency"`
+	Gross    int    `json:"gross"`
+	Refunds  int    `json:"refunds"`
+	Disputed int    `json:"disputed"`
+	Net      int    `json:"net"`
+}
+
+// CustomerNote is a model for the customer_notes table
+type CustomerNote struct {
+	ID         int       `json:"id"`
+	CustomerID int       `json:"customer_id"`
+	Body       string    `json:"body"`
+	Actor      string    `json:"actor"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Dispute is a model for the disputes table, the chargebacks customers have
+// raised with their card issuer
+type Dispute struct {
+	ID            int       `json:"id"`
+	OrderID       int       `json:"order_id"`
+	TransactionID int       `json:"transaction_id"`
+	Amount        int       `json:"amount"`
+	Currency      string    `json:"currency"`
+	Reason        string    `json:"reason"`
+	Status        string    `json:"status"`
+	Actor         string    `json:"actor"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// CustomerProfile is everything known about a customer, across all the rows
+// sharing their email address
+type CustomerProfile struct {
+	Customer      Customer         `json:"customer"`
+	Accounts      []*Customer      `json:"accounts"`
+	Orders        []*Order         `json:"orders"`
+	Subscriptions []*Order         `json:"subscriptions"`
+	LifetimeValue []*CustomerTotal `json:"lifetime_value"`
+	Refunds       []*Refund        `json:"refunds"`
+	Disputes      []*Dispute       `json:"disputes"`
+	Notes         []*CustomerNote  `json:"notes"`
+	Merges        []*CustomerMerge `json:"merges"`
+}
+
+// customerKey identifies the email address of a customer row c
+var customerKey = emailKey("c.email_hash", "c.email")
+
+// customerSearch returns the where clause matching the customer rows that
+// share an email address with the customer row whose ID is query, or whose
+// email address is query. Email addresses are matched whole, through their
+// blind index; names may be encrypted and are not searched.
+func (m *DBModel) customerSearch(query string) (string, []interface{}) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return "", nil
+	}
+
+	if id, err := strconv.Atoi(query); err == nil {
+		return `
+	where ` + customerKey + ` in (
+		select ` + emailKey("x.email_hash", "x.email") + ` from customers x where x.id = ?)`, []interface{}{id}
+	}
+
+	return m.bindEmail(`
+	where `+customerKey+` in `+emailKeyList, query)
+}
+
+// SearchCustomers returns a page of the customers with the email address or
+// customer ID in query, or of every customer when it is empty, newest first,
+// along with the last page number and the number of customers found
+func (m *DBModel) SearchCustomers(query string, pageSize, page int) ([]*CustomerSummary, int, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var customers []*CustomerSummary
+
+	where, args := m.customerSearch(query)
+
+	var totalRecords int
+	row := m.DB.QueryRowContext(ctx, `select count(distinct `+customerKey+`) from customers c `+where, args...)
+	err := row.Scan(&totalRecords)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	stmt := `
+	select
+		c.id, c.first_name, c.last_name, c.email, g.accounts, g.orders, g.first_seen, g.last_order
+	from (
+		select
+			max(c.id) as id, count(distinct c.id) as accounts, count(o.id) as orders,
+			min(c.created_at) as first_seen, max(o.created_at) as last_order
+		from
+			customers c
+				left join orders o on (o.customer_id = c.id)
+		` + where + `
+		group by
+			` + customerKey + `
+	) g
+		join customers c on (c.id = g.id)
+	order by
+		c.id desc
+	limit ? offset ?`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, append(args, pageSize, (page-1)*pageSize)...)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c CustomerSummary
+		var lastOrder sql.NullTime
+		err = rows.Scan(
+			&c.ID,
+			&c.FirstName,
+			&c.LastName,
+			&c.Email,
+			&c.Accounts,
+			&c.Orders,
+			&c.FirstSeen,
+			&lastOrder,
+		)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		if lastOrder.Valid {
+			c.LastOrder = &lastOrder.Time
+		}
+
+		for _, f := range []*string{&c.FirstName, &c.LastName, &c.Email} {
+			*f, err = m.open(*f)
+			if err != nil {
+				return nil, 0, 0, err
+			}
+		}
+
+		customers = append(customers, &c)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, 0, err
+	}
+
+	return customers, LastPage(totalRecords, pageSize), totalRecords, nil
+}
+
+// GetCustomerProfile returns the customer with the given row ID along with
+// their orders, subscriptions, lifetime value, refunds, disputes, notes and
+// the customers merged into them, gathered from every row sharing its email address
+func (m *DBModel) GetCustomerProfile(id int) (CustomerProfile, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var p CustomerProfile
+
+	rows, err := m.DB.QueryContext(ctx, `
+	select
+		c.id, c.first_name, c.last_name, c.email, c.created_at, c.updated_at
+	from
+		customers c
+			join customers me on (`+customerKey+` = `+emailKey("me.email_hash", "me.email")+`)
+	where
+		me.id = ?
+	order by
+		c.id desc`, id)
+	if err != nil {
+		return p, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c Customer
+		err = rows.Scan(&c.ID, &c.FirstName, &c.LastName, &c.Email, &c.CreatedAt, &c.UpdatedAt)
+		if err != nil {
+			return p, err
+		}
+		err = m.openCustomer(&c)
+		if err != nil {
+			return p, err
+		}
+		p.Accounts = append(p.Accounts, &c)
+	}
+	if err = rows.Err(); err != nil {
+		return p, err
+	}
+	if len(p.Accounts) == 0 {
+		return p, sql.ErrNoRows
+	}
+
+	// the latest row has the name the customer used last
+	p.Customer = *p.Accounts[0]
+
+	ids := make([]interface{}, len(p.Accounts))
+	for i, c := range p.Accounts {
+		ids[i] = c.ID
+	}
+	in := "(?" + strings.Repeat(", ?", len(ids)-1) + ")"
+
+	p.Orders, err = m.customerOrders(ctx, in, ids, false)
+	if err != nil {
+		return p, err
+	}
+
+	p.Subscriptions, err = m.customerOrders(ctx, in, ids, true)
+	if err != nil {
+		return p, err
+	}
+
+	p.Refunds, err = m.customerRefunds(ctx, in, ids)
+	if err != nil {
+		return p, err
+	}
+
+	p.Disputes, err = m.customerDisputes(ctx, in, ids)
+	if err != nil {
+		return p, err
+	}
+
+	p.Notes, err = m.customerNotes(ctx, in, ids)
+	if err != nil {
+		return p, err
+	}
+
+	p.LifetimeValue, err = m.customerTotals(ctx, in, ids)
+	if err != nil {
+		return p, err
+	}
+
+	p.Merges, err = m.customerMerges(ctx, in, ids)
+	if err != nil {
+		return p, err
+	}
+
+	return p, nil
+}
+
+// customerOrders returns the one-off orders or subscriptions of the customer
+// rows in ids, newest first
+func (m *DBModel) customerOrders(ctx context.Context, in string, ids []interface{}, recurring bool) ([]*Order, error) {
+	isRecurring := 0
+	if recurring {
+		isRecurring = 1
+	}
+
+	stmt := orderListSelect + `
+	where
+		o.customer_id in ` + in + ` and m.is_recurring = ?
+	order by
+		o.created_at desc, o.id desc`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, append(append([]interface{}{}, ids...), isRecurring)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return m.scanOrderList(rows)
+}
+
+// customerRefunds returns the refunds made on the orders of the customer rows
+// in ids, newest first
+func (m *DBModel) customerRefunds(ctx context.Context, in string, ids []interface{}) ([]*Refund, error) {
+	stmt := `
+	select
+		rf.id, rf.order_id, rf.transaction_id, rf.amount, rf.currency, rf.reason, rf.actor, rf.created_at
+	from
+		refunds rf
+			join orders o on (rf.order_id = o.id)
+	where
+		o.customer_id in ` + in + `
+	order by
+		rf.created_at desc, rf.id desc`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, ids...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var refunds []*Refund
+
+	for rows.Next() {
+		var rf Refund
+		err = rows.Scan(
+			&rf.ID,
+			&rf.OrderID,
+			&rf.TransactionID,
+			&rf.Amount,
+			&rf.Currency,
+			&rf.Reason,
+			&rf.Actor,
+			&rf.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		refunds = append(refunds, &rf)
+	}
+
+	return refunds, rows.Err()
+}
+
+// customerDisputes returns the disputes raised on the orders of the customer
+// rows in ids, newest first
+func (m *DBModel) customerDisputes(ctx context.Context, in string, ids []interface{}) ([]*Dispute, error) {
+	stmt := `
+	select
+		d.id, d.order_id, d.transaction_id, d.amount, d.currency, d.reason, d.status, d.actor,
+		d.created_at, d.updated_at
+	from
+		disputes d
+			join orders o on (d.order_id = o.id)
+	where
+		o.customer_id in ` + in + `
+	order by
+		d.created_at desc, d.id desc`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, ids...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var disputes []*Dispute
+
+	for rows.Next() {
+		var d Dispute
+		err = rows.Scan(
+			&d.ID,
+			&d.OrderID,
+			&d.TransactionID,
+			&d.Amount,
+			&d.Currency,
+			&d.Reason,
+			&d.Status,
+			&d.Actor,
+			&d.CreatedAt,
+			&d.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		disputes = append(disputes, &d)
+	}
+
+	return disputes, rows.Err()
+}
+
+// customerNotes returns the notes kept on the customer rows in ids, newest first
+func (m *DBModel) customerNotes(ctx context.Context, in string, ids []interface{}) ([]*CustomerNote, error) {
+	stmt := `
+	select
+		id, customer_id, body, actor, created_at
+	from
+		customer_notes
+	where
+		customer_id in ` + in + `
+	order by
+		created_at desc, id desc`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, ids...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notes []*CustomerNote
+
+	for rows.Next() {
+		var n CustomerNote
+		err = rows.Scan(&n.ID, &n.CustomerID, &n.Body, &n.Actor, &n.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		notes = append(notes, &n)
+	}
+
+	return notes, rows.Err()
+}
+
+// customerTotals returns what the customer rows in ids have spent, per currency
+func (m *DBModel) customerTotals(ctx context.Context, in string, ids []interface{}) ([]*CustomerTotal, error) {
+	stmt := `
+	select
+		currency, sum(gross), sum(refunds), sum(disputed)
+	from (
+		select
+			t.currency, t.amount as gross, 0 as refunds, 0 as disputed
+		from
+			orders o
+				join transactions t on (o.transaction_id = t.id)
+		where
+			o.customer_id in ` + in + ` and t.transaction_status_id in (?, ?, ?)
+		union all
+		select
+			rf.currency, 0, rf.amount, 0
+		from
+			refunds rf
+				join orders o on (rf.order_id = o.id)
+		where
+			o.customer_id in ` + in + `
+		union all
+		select
+			d.currency, 0, 0, d.amount
+		from
+			disputes d
+				join orders o on (d.order_id = o.id)
+		where
+			o.customer_id in ` + in + ` and d.status = ?
+	) spent
+	group by
+		currency
+	order by
+		currency`
+
+	args := append(append([]interface{}{}, ids...), paidTransactionStatuses...)
+	args = append(args, ids...)
+	args = append(args, ids...)
+	args = append(args, DisputeLost)
+
+	rows, err := m.DB.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var totals []*CustomerTotal
+
+	for rows.Next() {
+		var t CustomerTotal
+		err = rows.Scan(&t.Currency, &t.Gross, &t.Refunds, &t.Disputed)
+		if err != nil {
+			return nil, err
+		}
+		t.Net = t.Gross - t.Refunds - t.Disputed
+		totals = append(totals, &t)
+	}
+
+	return totals, rows.Err()
+}
+
+// InsertCustomerNote keeps a note on a customer
+func (m *DBModel) InsertCustomerNote(n CustomerNote) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+	INSERT INTO customer_notes
+		(customer_id, body, actor, created_at, updated_at)
+	VALUES (?, ?, ?, ?, ?)`
+
+	result, err := m.DB.ExecContext(ctx, stmt,
+		n.CustomerID,
+		n.Body,
+		n.Actor,
+		time.Now(),
+		time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// InsertDispute records a dispute raised on an order
+func (m *DBModel) InsertDispute(d Dispute) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+	INSERT INTO disputes
+		(order_id, transaction_id, amount, currency, reason, status, actor, created_at, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	result, err := m.DB.ExecContext(ctx, stmt,
+		d.OrderID,
+		d.TransactionID,
+		d.Amount,
+		d.Currency,
+		d.Reason,
+		DisputeOpen,
+		d.Actor,
+		time.Now(),
+		time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// ResolveDispute records the card issuer's decision on an open dispute
+func (m *DBModel) ResolveDispute(id int, status, actor string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+	update disputes set status = ?, actor = ?, updated_at = ?
+	where id = ? and status = ?`
+
+	result, err := m.DB.ExecContext(ctx, stmt, status, actor, time.Now(), id, DisputeOpen)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrDisputeClosed
+	}
+
+	return nil
+}
@@ -0,0 +1,202 @@
+package models
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// exportTimeout bounds how long an export may read from the database. Exports
+// read rows one at a time for as long as the client keeps up.
+const exportTimeout = 2 * time.Minute
+
+// TransactionRecord is a transaction along with the order it paid for
+type TransactionRecord struct {
+	Transaction Transaction
+	Status      string
+	Order       Order
+}
+
+// CustomerRecord is a customer along with a summary of their orders
+type CustomerRecord struct {
+	Customer     Customer
+	Orders       int
+	TotalSpent   int
+	FirstOrderAt time.Time
+	LastOrderAt  time.Time
+}
+
+// EachOrder calls fn with every one-off or subscription order matching filter,
+// in the order of the list views, stopping at the first error
+func (m *DBModel) EachOrder(recurring bool, filter OrderFilter, fn func(*Order) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+
+	where, args := m.orderListWhere(recurring, filter)
+
+	stmt := orderListSelect + `
+	where
+		` + where + `
+	order by
+		` + filter.orderBy()
+
+	rows, err := m.DB.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		o, err := m.scanOrderListRow(rows)
+		if err != nil {
+			return err
+		}
+
+		err = fn(o)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// EachTransaction calls fn with the transaction of every order, one-off or
+// subscription, matching filter, stopping at the first error
+func (m *DBModel) EachTransaction(filter OrderFilter, fn func(TransactionRecord) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+
+	conds, args := filter.where(m)
+	where := strings.Join(append([]string{"1 = 1"}, conds...), " and ")
+
+	stmt := `
+	select
+		t.id, t.amount, t.currency, t.last_four, t.expiry_month, t.expiry_year,
+		t.payment_intent, t.bank_return_code, t.transaction_status_id, ts.name,
+		t.created_at,
+		o.id, o.status_id, o.quantity, o.amount, o.shipping_amount,
+		m.name, c.first_name, c.last_name, c.email
+	from
+		transactions t
+			join orders o on (o.transaction_id = t.id)
+			left join transaction_statuses ts on (t.transaction_status_id = ts.id)
+			left join maize m on (o.maize_id = m.id)
+			left join customers c on (o.customer_id = c.id)
+	where
+		` + where + `
+	order by
+		` + filter.orderBy()
+
+	rows, err := m.DB.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r TransactionRecord
+		err = rows.Scan(
+			&r.Transaction.ID,
+			&r.Transaction.Amount,
+			&r.Transaction.Currency,
+			&r.Transaction.LastFour,
+			&r.Transaction.ExpiryMonth,
+			&r.Transaction.ExpiryYear,
+			&r.Transaction.PaymentIntent,
+			&r.Transaction.BankReturnCode,
+			&r.Transaction.TransactionStatusId,
+			&r.Status,
+			&r.Transaction.CreatedAt,
+			&r.Order.ID,
+			&r.Order.StatusID,
+			&r.Order.Quantity,
+			&r.Order.Amount,
+			&r.Order.ShippingAmount,
+			&r.Order.Maize.Name,
+			&r.Order.Customer.FirstName,
+			&r.Order.Customer.LastName,
+			&r.Order.Customer.Email,
+		)
+		if err != nil {
+			return err
+		}
+
+		err = m.openCustomer(&r.Order.Customer)
+		if err != nil {
+			return err
+		}
+		r.Order.TransactionID = r.Transaction.ID
+
+		err = fn(r)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// EachCustomer calls fn with every customer who placed an order matching
+// filter, summarising only those orders, in the order they were created,
+// stopping at the first error. Names may be encrypted, so the database cannot
+// sort by them.
+func (m *DBModel) EachCustomer(filter OrderFilter, fn func(CustomerRecord) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+
+	conds, args := filter.where(m)
+	where := strings.Join(append([]string{"1 = 1"}, conds...), " and ")
+
+	stmt := `
+	select
+		c.id, c.first_name, c.last_name, c.email, c.created_at,
+		count(o.id), coalesce(sum(t.amount), 0), min(o.created_at), max(o.created_at)
+	from
+		customers c
+			join orders o on (o.customer_id = c.id)
+			left join maize m on (o.maize_id = m.id)
+			left join transactions t on (o.transaction_id = t.id)
+	where
+		` + where + `
+	group by
+		c.id, c.first_name, c.last_name, c.email, c.created_at
+	order by
+		c.id`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r CustomerRecord
+		err = rows.Scan(
+			&r.Customer.ID,
+			&r.Customer.FirstName,
+			&r.Customer.LastName,
+			&r.Customer.Email,
+			&r.Customer.CreatedAt,
+			&r.Orders,
+			&r.TotalSpent,
+			&r.FirstOrderAt,
+			&r.LastOrderAt,
+		)
+		if err != nil {
+			return err
+		}
+
+		err = m.openCustomer(&r.Customer)
+		if err != nil {
+			return err
+		}
+
+		err = fn(r)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,163 @@
+package models
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeDB is a database/sql driver for model tests. Each statement is passed
+// to exec, which returns the rows affected, or to query, which returns the
+// rows read, so a test can stand in for the few tables it touches.
+type fakeDB struct {
+	mu    sync.Mutex
+	exec  func(query string, args []driver.Value) (int64, error)
+	query func(query string, args []driver.Value) ([][]driver.Value, error)
+	// log is every statement run, in order, with "begin", "commit" and
+	// "rollback" for transactions
+	log []string
+}
+
+var (
+	fakeDBs   = make(map[string]*fakeDB)
+	fakeDBsMu sync.Mutex
+)
+
+func init() {
+	sql.Register("fake", fakeDriver{})
+}
+
+// openFake returns a DBModel on a fakeDB
+func openFake(t *testing.T, f *fakeDB) *DBModel {
+	t.Helper()
+
+	fakeDBsMu.Lock()
+	fakeDBs[t.Name()] = f
+	fakeDBsMu.Unlock()
+
+	db, err := sql.Open("fake", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		fakeDBsMu.Lock()
+		delete(fakeDBs, t.Name())
+		fakeDBsMu.Unlock()
+	})
+
+	return &DBModel{DB: db}
+}
+
+func (f *fakeDB) record(s string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.log = append(f.log, strings.Join(strings.Fields(s), " "))
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fakeDBsMu.Lock()
+	defer fakeDBsMu.Unlock()
+
+	f, ok := fakeDBs[name]
+	if !ok {
+		return nil, fmt.Errorf("no fake database %q", name)
+	}
+	return &fakeConn{f}, nil
+}
+
+type fakeConn struct{ f *fakeDB }
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{c.f, query}, nil
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	c.f.record("begin")
+	return fakeTx{c.f}, nil
+}
+
+type fakeTx struct{ f *fakeDB }
+
+func (tx fakeTx) Commit() error {
+	tx.f.record("commit")
+	return nil
+}
+
+func (tx fakeTx) Rollback() error {
+	tx.f.record("rollback")
+	return nil
+}
+
+type fakeStmt struct {
+	f     *fakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.f.record(s.query)
+	if s.f.exec == nil {
+		return nil, errors.New("fake database: unexpected exec")
+	}
+	n, err := s.f.exec(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return fakeResult(n), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.f.record(s.query)
+	if s.f.query == nil {
+		return nil, errors.New("fake database: unexpected query")
+	}
+	rows, err := s.f.query(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{rows: rows}, nil
+}
+
+type fakeResult int64
+
+func (r fakeResult) LastInsertId() (int64, error) { return int64(r), nil }
+func (r fakeResult) RowsAffected() (int64, error) { return int64(r), nil }
+
+type fakeRows struct {
+	rows [][]driver.Value
+	i    int
+}
+
+func (r *fakeRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return nil
+	}
+	cols := make([]string, len(r.rows[0]))
+	for i := range cols {
+		cols[i] = fmt.Sprintf("c%d", i)
+	}
+	return cols
+}
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.i >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.i])
+	r.i++
+	return nil
+}
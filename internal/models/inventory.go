@@ -0,0 +1,299 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// Reasons recorded against inventory movements
+const (
+	MovementSale       = "sale"
+	MovementRefund     = "refund"
+	MovementAdjustment = "adjustment"
+	MovementReturn     = "return"
+	MovementOpening    = "opening"
+)
+
+// InventoryMovement is a model for the inventory_movements table. Every change
+// to the stock of a maize or variant is recorded as a movement.
+type InventoryMovement struct {
+	ID             int       `json:"id"`
+	MaizeID        int       `json:"maize_id"`
+	VariantID      int       `json:"variant_id"`
+	OrderID        int       `json:"order_id"`
+	QuantityChange int       `json:"quantity_change"`
+	InventoryAfter int       `json:"inventory_after"`
+	Reason         string    `json:"reason"`
+	Note           string    `json:"note"`
+	UserID         int       `json:"user_id"`
+	Actor          string    `json:"actor"`
+	VariantName    string    `json:"variant_name"`
+	SKU            string    `json:"sku"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// CustomerActor is how a customer is recorded as the actor of an inventory
+// movement or return event: by customer ID, so that no email address is kept
+// outside the encrypted customers table
+func CustomerActor(customerID int) string {
+	return "customer:" + strconv.Itoa(customerID)
+}
+
+// AdjustInventory changes the stock of a maize, or of one of its variants when
+// mv.VariantID is not zero, by mv.QuantityChange units and records the change.
+// mv.InventoryAfter is filled in from the resulting stock level. It returns
+// ErrOutOfStock rather than take the stock below zero.
+func (m *DBModel) AdjustInventory(mv InventoryMovement) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = adjustInventory(ctx, tx, mv)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// adjustInventory changes stock and records the movement within tx
+func adjustInventory(ctx context.Context, tx queryExecer, mv InventoryMovement) error {
+	var err error
+	mv.InventoryAfter, err = changeStock(ctx, tx, mv.MaizeID, mv.VariantID, mv.QuantityChange)
+	if err != nil {
+		return err
+	}
+
+	return recordMovement(ctx, tx, mv)
+}
+
+// changeStock adds change units to the stock of a maize, or of one of its
+// variants when variantID is not zero, within tx and returns the new stock
+// level. The check and the change are one statement, so concurrent sales
+// cannot take stock below zero; ErrOutOfStock is returned instead.
+func changeStock(ctx context.Context, tx queryExecer, maizeID, variantID, change int) (int, error) {
+	var after int
+
+	if variantID > 0 {
+		result, err := tx.ExecContext(ctx,
+			`update maize_variants set inventory_level = inventory_level + ?, updated_at = ?
+			where id = ? and maize_id = ? and inventory_level >= ?`,
+			change, time.Now(), variantID, maizeID, -change)
+		if err != nil {
+			return 0, err
+		}
+
+		n, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			err = tx.QueryRowContext(ctx,
+				`select inventory_level from maize_variants where id = ? and maize_id = ?`,
+				variantID, maizeID).Scan(&after)
+			if errors.Is(err, sql.ErrNoRows) {
+				return 0, errors.New("variant does not belong to product")
+			} else if err != nil {
+				return 0, err
+			}
+			return 0, ErrOutOfStock
+		}
+
+		err = syncParentInventory(ctx, tx, maizeID)
+		if err != nil {
+			return 0, err
+		}
+
+		err = tx.QueryRowContext(ctx,
+			`select inventory_level from maize_variants where id = ?`, variantID).Scan(&after)
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		result, err := tx.ExecContext(ctx,
+			`update maize set inventory_level = inventory_level + ?, updated_at = ?
+			where id = ? and inventory_level >= ?`,
+			change, time.Now(), maizeID, -change)
+		if err != nil {
+			return 0, err
+		}
+
+		n, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			return 0, ErrOutOfStock
+		}
+
+		err = tx.QueryRowContext(ctx,
+			`select inventory_level from maize where id = ?`, maizeID).Scan(&after)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return after, nil
+}
+
+// recordMovement inserts an inventory movement within tx
+func recordMovement(ctx context.Context, tx execer, mv InventoryMovement) error {
+	stmt := `
+	INSERT INTO inventory_movements
+		(maize_id, variant_id, order_id, quantity_change, inventory_after, reason, note,
+		user_id, actor, created_at, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	_, err := tx.ExecContext(ctx, stmt,
+		mv.MaizeID,
+		nullInt(mv.VariantID),
+		nullInt(mv.OrderID),
+		mv.QuantityChange,
+		mv.InventoryAfter,
+		mv.Reason,
+		mv.Note,
+		nullInt(mv.UserID),
+		mv.Actor,
+		time.Now(),
+		time.Now())
+
+	return err
+}
+
+// GetInventoryMovements returns the most recent stock movements for a maize,
+// including those of its variants, newest first
+func (m *DBModel) GetInventoryMovements(maizeID, limit int) ([]*InventoryMovement, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var movements []*InventoryMovement
+
+	stmt := `
+	select
+		im.id, im.maize_id, coalesce(im.variant_id, 0), coalesce(im.order_id, 0),
+		im.quantity_change, im.inventory_after, im.reason, im.note,
+		coalesce(im.user_id, 0), im.actor, coalesce(v.name, ''), coalesce(v.sku, ''),
+		im.created_at
+	from
+		inventory_movements im
+			left join maize_variants v on (im.variant_id = v.id)
+	where
+		im.maize_id = ?
+	order by
+		im.created_at desc, im.id desc
+	limit ?`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, maizeID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var mv InventoryMovement
+		err = rows.Scan(
+			&mv.ID,
+			&mv.MaizeID,
+			&mv.VariantID,
+			&mv.OrderID,
+			&mv.QuantityChange,
+			&mv.InventoryAfter,
+			&mv.Reason,
+			&mv.Note,
+			&mv.UserID,
+			&mv.Actor,
+			&mv.VariantName,
+			&mv.SKU,
+			&mv.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		movements = append(movements, &mv)
+	}
+
+	return movements, nil
+}
+
+// GetLowStockMaize returns active maize whose stock has fallen below their low
+// stock threshold and whose admins have not yet been alerted
+func (m *DBModel) GetLowStockMaize() ([]*Maize, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var items []*Maize
+
+	stmt := `
+	select
+		id, name, inventory_level, low_stock_threshold
+	from
+		maize
+	where
+		is_active = 1 and low_stock_threshold > 0
+		and inventory_level < low_stock_threshold and low_stock_alerted = 0
+	order by
+		name`
+
+	rows, err := m.DB.QueryContext(ctx, stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var maize Maize
+		err = rows.Scan(
+			&maize.ID,
+			&maize.Name,
+			&maize.InventoryLevel,
+			&maize.LowStockThreshold,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, &maize)
+	}
+
+	return items, nil
+}
+
+// MarkLowStockAlerted records that admins have been alerted about a maize
+func (m *DBModel) MarkLowStockAlerted(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `update maize set low_stock_alerted = 1 where id = ?`, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ResetLowStockAlerts re-arms the alert for maize that have been restocked to
+// at least their threshold, so that the next shortage is reported again
+func (m *DBModel) ResetLowStockAlerts() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+	update maize set low_stock_alerted = 0
+	where low_stock_alerted = 1 and inventory_level >= low_stock_threshold`
+
+	_, err := m.DB.ExecContext(ctx, stmt)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
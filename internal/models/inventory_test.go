@@ -0,0 +1,205 @@
+package models
+
+import (
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// inventoryDB is a fakeDB on which every insert gets ID 7 and stock reads
+// return level
+func inventoryDB(level int64) *fakeDB {
+	return &fakeDB{
+		exec: func(query string, args []driver.Value) (int64, error) {
+			if strings.Contains(query, "INSERT INTO") {
+				return 7, nil
+			}
+			return 1, nil
+		},
+		query: func(query string, args []driver.Value) ([][]driver.Value, error) {
+			return [][]driver.Value{{level}}, nil
+		},
+	}
+}
+
+// statements returns the first three words of each logged statement, enough
+// to tell what it did
+func statements(log []string) string {
+	var out []string
+	for _, s := range log {
+		f := strings.Fields(s)
+		if len(f) > 3 {
+			f = f[:3]
+		}
+		out = append(out, strings.Join(f, " "))
+	}
+	return strings.Join(out, "\n")
+}
+
+func TestInsertMaizeOpeningStock(t *testing.T) {
+	f := inventoryDB(12)
+	m := openFake(t, f)
+
+	id, err := m.InsertMaize(Maize{Name: "Popcorn", InventoryLevel: 12}, 3, "admin@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 7 {
+		t.Errorf("id = %d, want 7", id)
+	}
+
+	want := strings.Join([]string{
+		"begin",
+		"INSERT INTO maize",
+		"update maize set",
+		"select inventory_level from",
+		"INSERT INTO inventory_movements",
+		"commit",
+	}, "\n")
+	if got := statements(f.log); got != want {
+		t.Errorf("statements:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestInsertMaizeNoStock(t *testing.T) {
+	f := inventoryDB(0)
+	m := openFake(t, f)
+
+	_, err := m.InsertMaize(Maize{Name: "Popcorn"}, 3, "admin@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := statements(f.log), "begin\nINSERT INTO maize\ncommit"; got != want {
+		t.Errorf("statements:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestInsertVariantOpeningStock(t *testing.T) {
+	f := inventoryDB(5)
+	m := openFake(t, f)
+
+	var movement []driver.Value
+	exec := f.exec
+	f.exec = func(query string, args []driver.Value) (int64, error) {
+		if strings.Contains(query, "inventory_movements") {
+			movement = args
+		}
+		return exec(query, args)
+	}
+
+	_, err := m.InsertVariant(MaizeVariant{MaizeID: 2, Name: "Coarse", SKU: "POP-C", InventoryLevel: 5}, 3, "admin@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := strings.Join([]string{
+		"begin",
+		"INSERT INTO maize_variants",
+		"update maize_variants set",
+		"update maize set",
+		"select inventory_level from",
+		"INSERT INTO inventory_movements",
+		"commit",
+	}, "\n")
+	if got := statements(f.log); got != want {
+		t.Errorf("statements:\n%s\nwant:\n%s", got, want)
+	}
+
+	// maize, variant, order, change, after, reason
+	if len(movement) < 6 || movement[0] != int64(2) || movement[1] != int64(7) ||
+		movement[3] != int64(5) || movement[4] != int64(5) || movement[5] != MovementOpening {
+		t.Errorf("movement = %v, want 5 units of variant 7 of maize 2 as opening stock", movement)
+	}
+}
+
+func TestInsertMaizeRollsBack(t *testing.T) {
+	f := inventoryDB(12)
+	f.query = func(query string, args []driver.Value) ([][]driver.Value, error) {
+		return nil, errors.New("connection lost")
+	}
+	m := openFake(t, f)
+
+	_, err := m.InsertMaize(Maize{Name: "Popcorn", InventoryLevel: 12}, 3, "admin@example.com")
+	if err == nil {
+		t.Fatal("InsertMaize succeeded without recording its opening stock")
+	}
+
+	if last := f.log[len(f.log)-1]; last != "rollback" {
+		t.Errorf("last statement = %s, want rollback", last)
+	}
+}
+
+// TestPlaceOrderSoldOut checks that a cleared order whose stock another sale
+// took first is backordered rather than taking the stock below zero
+func TestPlaceOrderSoldOut(t *testing.T) {
+	f := inventoryDB(0)
+	f.exec = func(query string, args []driver.Value) (int64, error) {
+		switch {
+		case strings.HasPrefix(strings.TrimSpace(query), "update maize set"):
+			// the conditional update finds too little stock
+			return 0, nil
+		case strings.Contains(query, "INSERT INTO orders"):
+			if args[3] != int64(StatusBackordered) {
+				t.Errorf("order inserted with status %v, want %d", args[3], StatusBackordered)
+			}
+			return 11, nil
+		case strings.Contains(query, "inventory_movements"):
+			t.Error("a movement was recorded for an order that took no stock")
+		}
+		return 1, nil
+	}
+	m := openFake(t, f)
+
+	order, err := m.PlaceOrder(Order{MaizeID: 2, CustomerID: 5, StatusID: StatusCleared, Quantity: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.ID != 11 || order.StatusID != StatusBackordered {
+		t.Errorf("order = %d with status %d, want 11 backordered", order.ID, order.StatusID)
+	}
+	if last := f.log[len(f.log)-1]; last != "commit" {
+		t.Errorf("last statement = %s, want commit", last)
+	}
+}
+
+func TestPlaceOrderTakesStock(t *testing.T) {
+	f := inventoryDB(4)
+	var movement []driver.Value
+	exec := f.exec
+	f.exec = func(query string, args []driver.Value) (int64, error) {
+		if strings.Contains(query, "inventory_movements") {
+			movement = args
+		}
+		return exec(query, args)
+	}
+	m := openFake(t, f)
+
+	order, err := m.PlaceOrder(Order{MaizeID: 2, CustomerID: 5, StatusID: StatusCleared, Quantity: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.StatusID != StatusCleared {
+		t.Errorf("status = %d, want cleared", order.StatusID)
+	}
+
+	// maize, variant, order, change, after, reason, note, user, actor
+	if len(movement) < 9 || movement[2] != int64(7) || movement[3] != int64(-1) ||
+		movement[4] != int64(4) || movement[5] != MovementSale || movement[8] != "customer:5" {
+		t.Errorf("movement = %v, want a sale of 1 unit for order 7 by customer:5", movement)
+	}
+}
+
+func TestAdjustInventoryNotBelowZero(t *testing.T) {
+	f := inventoryDB(0)
+	f.exec = func(query string, args []driver.Value) (int64, error) {
+		return 0, nil
+	}
+	m := openFake(t, f)
+
+	err := m.AdjustInventory(InventoryMovement{MaizeID: 2, QuantityChange: -3, Reason: MovementAdjustment})
+	if !errors.Is(err, ErrOutOfStock) {
+		t.Errorf("AdjustInventory = %v, want %v", err, ErrOutOfStock)
+	}
+}
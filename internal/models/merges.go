@@ -0,0 +1,269 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrMergeSelf is returned when a customer is to be merged into itself
+var ErrMergeSelf = errors.New("a customer cannot be merged into itself")
+
+// CustomerMerge is a model for the customer_merges table, the audit trail of
+// customers merged into another. The merged customer's row is deleted, so its
+// name and email are kept here; the IDs are not foreign keys for the same
+// reason.
+type CustomerMerge struct {
+	ID         int       `json:"id"`
+	SurvivorID int       `json:"survivor_id"`
+	MergedID   int       `json:"merged_id"`
+	FirstName  string    `json:"first_name"`
+	LastName   string    `json:"last_name"`
+	Email      string    `json:"email"`
+	Orders     int       `json:"orders"`
+	Addresses  int       `json:"addresses"`
+	Notes      int       `json:"notes"`
+	Actor      string    `json:"actor"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// MergedCustomer is one customer merged, or to be merged, into the survivor,
+// with the rows moved over
+type MergedCustomer struct {
+	Customer  Customer `json:"customer"`
+	OrderIDs  []int    `json:"order_ids"`
+	Addresses int      `json:"addresses"`
+	Notes     int      `json:"notes"`
+}
+
+// MergeResult is what a merge changed, or would change on a dry run
+type MergeResult struct {
+	Survivor Customer          `json:"survivor"`
+	Merged   []*MergedCustomer `json:"merged"`
+	DryRun   bool              `json:"dry_run"`
+}
+
+// MergeCustomers moves the orders, subscriptions, addresses and notes of the
+// customers in mergedIDs to the survivor, deletes them and records each merge,
+// all in one transaction. A dry run does the same and rolls it back, so the
+// result previews exactly the rows a merge would move.
+func (m *DBModel) MergeCustomers(survivorID int, mergedIDs []int, actor string, dryRun bool) (MergeResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result := MergeResult{DryRun: dryRun}
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	result.Survivor, err = m.lockCustomer(ctx, tx, survivorID)
+	if err != nil {
+		return result, err
+	}
+
+	seen := map[int]bool{survivorID: true}
+
+	for _, id := range mergedIDs {
+		if id == survivorID {
+			return result, ErrMergeSelf
+		}
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		mc, err := m.mergeCustomer(ctx, tx, survivorID, id, actor)
+		if err != nil {
+			return result, err
+		}
+		result.Merged = append(result.Merged, mc)
+	}
+
+	if dryRun {
+		return result, nil
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
+
+// lockCustomer reads a customer, locking the row until the end of tx
+func (m *DBModel) lockCustomer(ctx context.Context, tx *sql.Tx, id int) (Customer, error) {
+	var c Customer
+
+	row := tx.QueryRowContext(ctx, `
+	select id, first_name, last_name, email, created_at, updated_at
+	from customers where id = ? for update`, id)
+	err := row.Scan(&c.ID, &c.FirstName, &c.LastName, &c.Email, &c.CreatedAt, &c.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return c, fmt.Errorf("no customer %d", id)
+	}
+	if err != nil {
+		return c, err
+	}
+
+	err = m.openCustomer(&c)
+	return c, err
+}
+
+// mergeCustomer moves the rows of one customer to the survivor, records the
+// merge and deletes the customer
+func (m *DBModel) mergeCustomer(ctx context.Context, tx *sql.Tx, survivorID, id int, actor string) (*MergedCustomer, error) {
+	c, err := m.lockCustomer(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	mc := &MergedCustomer{Customer: c}
+
+	rows, err := tx.QueryContext(ctx, `select id from orders where customer_id = ? order by id for update`, id)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var orderID int
+		err = rows.Scan(&orderID)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		mc.OrderIDs = append(mc.OrderIDs, orderID)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	// orders keep their updated_at, which dates cancellations made before
+	// their status history was kept
+	_, err = tx.ExecContext(ctx, `update orders set customer_id = ? where customer_id = ?`, survivorID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	moved, err := tx.ExecContext(ctx, `update addresses set customer_id = ?, updated_at = ? where customer_id = ?`, survivorID, now, id)
+	if err != nil {
+		return nil, err
+	}
+	n, err := moved.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	mc.Addresses = int(n)
+
+	moved, err = tx.ExecContext(ctx, `update customer_notes set customer_id = ?, updated_at = ? where customer_id = ?`, survivorID, now, id)
+	if err != nil {
+		return nil, err
+	}
+	n, err = moved.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	mc.Notes = int(n)
+
+	var sealed [3]string
+	for i, v := range []string{c.FirstName, c.LastName, c.Email} {
+		sealed[i], err = m.seal(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	stmt := `
+	INSERT INTO customer_merges
+		(survivor_id, merged_id, first_name, last_name, email, email_hash, orders, addresses, notes,
+		actor, created_at, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	_, err = tx.ExecContext(ctx, stmt,
+		survivorID,
+		id,
+		sealed[0],
+		sealed[1],
+		sealed[2],
+		m.emailHash(c.Email),
+		len(mc.OrderIDs),
+		mc.Addresses,
+		mc.Notes,
+		actor,
+		now,
+		now)
+	if err != nil {
+		return nil, err
+	}
+
+	// earlier merges into this customer now belong to the survivor
+	_, err = tx.ExecContext(ctx, `update customer_merges set survivor_id = ? where survivor_id = ?`, survivorID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from customers where id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return mc, nil
+}
+
+// customerMerges returns the merges into the customer rows in ids, newest first
+func (m *DBModel) customerMerges(ctx context.Context, in string, ids []interface{}) ([]*CustomerMerge, error) {
+	stmt := `
+	select
+		id, survivor_id, merged_id, first_name, last_name, email, orders, addresses, notes,
+		actor, created_at
+	from
+		customer_merges
+	where
+		survivor_id in ` + in + `
+	order by
+		created_at desc, id desc`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, ids...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var merges []*CustomerMerge
+
+	for rows.Next() {
+		var cm CustomerMerge
+		err = rows.Scan(
+			&cm.ID,
+			&cm.SurvivorID,
+			&cm.MergedID,
+			&cm.FirstName,
+			&cm.LastName,
+			&cm.Email,
+			&cm.Orders,
+			&cm.Addresses,
+			&cm.Notes,
+			&cm.Actor,
+			&cm.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range []*string{&cm.FirstName, &cm.LastName, &cm.Email} {
+			*f, err = m.open(*f)
+			if err != nil {
+				return nil, err
+			}
+		}
+		merges = append(merges, &cm)
+	}
+
+	return merges, rows.Err()
+}
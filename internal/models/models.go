@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"maize/internal/encryption"
 	"strings"
 	"time"
 
@@ -13,6 +14,12 @@ import (
 // DBModel is a wrapper around a sql.DB that provides a few convenience methods
 type DBModel struct {
 	DB *sql.DB
+	// Location is the time zone whose days the daily sales summaries cover,
+	// UTC when nil
+	Location *time.Location
+	// Cipher encrypts customer names and email addresses, which are stored in
+	// plaintext when nil
+	Cipher *encryption.Encryption
 }
 
 // Models is a collection of DBModel
@@ -31,32 +38,51 @@ func NewModels(db *sql.DB) Models {
 
 // Maize is a model for the maize table
 type Maize struct {
-	ID             int       `json:"id"`
-	Name           string    `json:"name"`
-	Description    string    `json:"description"`
-	InventoryLevel int       `json:"inventory_level"`
-	Price          int       `json:"price"`
-	Image          string    `json:"image"`
-	IsRecurring    bool      `json:"is_recurring"`
-	PlanID         string    `json:"plan_id"`
-	CreatedAt      time.Time `json:"-"`
-	UpdatedAt      time.Time `json:"-"`
+	ID                int             `json:"id"`
+	Name              string          `json:"name"`
+	Description       string          `json:"description"`
+	InventoryLevel    int             `json:"inventory_level"`
+	Price             int             `json:"price"`
+	Image             string          `json:"image"`
+	Thumbnail         string          `json:"thumbnail"`
+	IsRecurring       bool            `json:"is_recurring"`
+	PlanID            string          `json:"plan_id"`
+	IsActive          bool            `json:"is_active"`
+	BackorderPolicy   string          `json:"backorder_policy"`
+	ExpectedShipDate  string          `json:"expected_ship_date"`
+	LowStockThreshold int             `json:"low_stock_threshold"`
+	WeightGrams       int             `json:"weight_grams"`
+	CreatedAt         time.Time       `json:"-"`
+	UpdatedAt         time.Time       `json:"-"`
+	Variants          []*MaizeVariant `json:"variants,omitempty"`
 }
 
 // Order is a model for the orders table
 type Order struct {
-	ID            int         `json:"id"`
-	MaizeID       int         `json:"maize_id"`
-	TransactionID int         `json:"transaction_id"`
-	CustomerID    int         `json:"customer_id"`
-	StatusID      int         `json:"status_id"`
-	Quantity      int         `json:"quantity"`
-	Amount        int         `json:"amount"`
-	CreatedAt     time.Time   `json:"-"`
-	UpdatedAt     time.Time   `json:"-"`
-	Maize         Maize       `json:"maize"`
-	Transaction   Transaction `json:"transaction"`
-	Customer      Customer    `json:"customer"`
+	ID                int                  `json:"id"`
+	MaizeID           int                  `json:"maize_id"`
+	TransactionID     int                  `json:"transaction_id"`
+	CustomerID        int                  `json:"customer_id"`
+	StatusID          int                  `json:"status_id"`
+	Quantity          int                  `json:"quantity"`
+	Amount            int                  `json:"amount"`
+	VariantID         int                  `json:"variant_id"`
+	BillingAddressID  int                  `json:"billing_address_id"`
+	ShippingAddressID int                  `json:"shipping_address_id"`
+	ShippingRateID    int                  `json:"shipping_rate_id"`
+	ShippingMethod    string               `json:"shipping_method"`
+	ShippingAmount    int                  `json:"shipping_amount"`
+	CreatedAt         time.Time            `json:"-"`
+	UpdatedAt         time.Time            `json:"-"`
+	Maize             Maize                `json:"maize"`
+	Variant           MaizeVariant         `json:"variant"`
+	Transaction       Transaction          `json:"transaction"`
+	Customer          Customer             `json:"customer"`
+	BillingAddress    *Address             `json:"billing_address,omitempty"`
+	ShippingAddress   *Address             `json:"shipping_address,omitempty"`
+	Shipments         []*Shipment          `json:"shipments,omitempty"`
+	FulfillmentStatus string               `json:"fulfillment_status,omitempty"`
+	StatusHistory     []*OrderStatusChange `json:"status_history,omitempty"`
 }
 
 // Status is a model for the status table
@@ -67,6 +93,18 @@ type Status struct {
 	UpdatedAt time.Time `json:"-"`
 }
 
+// Order statuses, matching the rows of the statuses table
+const (
+	StatusCleared     = 1
+	StatusRefunded    = 2
+	StatusCancelled   = 3
+	StatusBackordered = 4
+	StatusPreOrdered  = 5
+	// StatusPaymentRequired is a pre-order whose card hold lapsed before it
+	// could be captured, so the customer must pay again
+	StatusPaymentRequired = 6
+)
+
 // TransactionStatus is a model for the transaction_status table
 type TransactionStatus struct {
 	ID        int       `json:"id"`
@@ -75,6 +113,15 @@ type TransactionStatus struct {
 	UpdatedAt time.Time `json:"-"`
 }
 
+// Transaction statuses, matching the rows of the transaction_statuses table
+const (
+	TransactionPending           = 1
+	TransactionCleared           = 2
+	TransactionDeclined          = 3
+	TransactionRefunded          = 4
+	TransactionPartiallyRefunded = 5
+)
+
 // Transaction is a model for the transactions table
 type Transaction struct {
 	ID                  int       `json:"id"`
@@ -100,6 +147,11 @@ type User struct {
 	Password  string    `json:"password"`
 	CreatedAt time.Time `json:"-"`
 	UpdatedAt time.Time `json:"-"`
+	// TwoFactorEnabled is set once the user has enrolled an authenticator app
+	TwoFactorEnabled bool `json:"two_factor_enabled"`
+	// Roles names the roles of the user, where they were asked for. Editing a
+	// user without them leaves their roles as they are.
+	Roles []string `json:"roles,omitempty"`
 }
 
 // Customer is a model for the customers table
@@ -120,8 +172,9 @@ func (m *DBModel) GetMaize(id int) (Maize, error) {
 	var maize Maize
 	row := m.DB.QueryRowContext(ctx,
 		`SELECT
-		 id, name, description, inventory_level, price, coalesce(image, ''),is_recurring, plan_id,
-	 	 created_at, updated_at
+		 id, name, description, inventory_level, price, coalesce(image, ''), coalesce(thumbnail, ''), is_recurring, plan_id,
+	 	 is_active, backorder_policy, coalesce(date_format(expected_ship_date, '%Y-%m-%d'), ''),
+	 	 low_stock_threshold, weight_grams, created_at, updated_at
 	 	 from 
 	 		maize
 		 where id = ?`, id)
@@ -132,8 +185,14 @@ func (m *DBModel) GetMaize(id int) (Maize, error) {
 		&maize.InventoryLevel,
 		&maize.Price,
 		&maize.Image,
+		&maize.Thumbnail,
 		&maize.IsRecurring,
 		&maize.PlanID,
+		&maize.IsActive,
+		&maize.BackorderPolicy,
+		&maize.ExpectedShipDate,
+		&maize.LowStockThreshold,
+		&maize.WeightGrams,
 		&maize.CreatedAt,
 		&maize.UpdatedAt)
 	if err != nil {
@@ -143,6 +202,174 @@ func (m *DBModel) GetMaize(id int) (Maize, error) {
 	return maize, nil
 }
 
+// GetActiveMaize returns all active maize that are (or are not) recurring plans
+func (m *DBModel) GetActiveMaize(isRecurring bool) ([]*Maize, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var items []*Maize
+
+	stmt := `
+	select
+		id, name, description, inventory_level, price, coalesce(image, ''), coalesce(thumbnail, ''), is_recurring, plan_id,
+		is_active, backorder_policy, coalesce(date_format(expected_ship_date, '%Y-%m-%d'), ''),
+		low_stock_threshold, weight_grams, created_at, updated_at
+	from
+		maize
+	where
+		is_active = 1 and is_recurring = ?
+	order by
+		price, name`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, isRecurring)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var maize Maize
+		err = rows.Scan(
+			&maize.ID,
+			&maize.Name,
+			&maize.Description,
+			&maize.InventoryLevel,
+			&maize.Price,
+			&maize.Image,
+			&maize.Thumbnail,
+			&maize.IsRecurring,
+			&maize.PlanID,
+			&maize.IsActive,
+			&maize.BackorderPolicy,
+			&maize.ExpectedShipDate,
+			&maize.LowStockThreshold,
+			&maize.WeightGrams,
+			&maize.CreatedAt,
+			&maize.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, &maize)
+	}
+
+	return items, nil
+}
+
+// InsertMaize inserts a new maize product. Its opening stock,
+// maize.InventoryLevel, is recorded as a movement by the user, in the same
+// transaction; later changes go through AdjustInventory.
+func (m *DBModel) InsertMaize(maize Maize, userID int, actor string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	stmt := `
+	INSERT INTO maize
+		 (name, description, inventory_level, price, image, is_recurring, plan_id,
+		 is_active, backorder_policy, expected_ship_date, low_stock_threshold, weight_grams,
+		 created_at, updated_at)
+	VALUES (?, ?, 0, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	result, err := tx.ExecContext(ctx, stmt,
+		maize.Name,
+		maize.Description,
+		maize.Price,
+		maize.Image,
+		maize.IsRecurring,
+		maize.PlanID,
+		maize.IsActive,
+		maize.BackorderPolicy,
+		nullDate(maize.ExpectedShipDate),
+		maize.LowStockThreshold,
+		maize.WeightGrams,
+		time.Now(),
+		time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	if maize.InventoryLevel != 0 {
+		err = adjustInventory(ctx, tx, InventoryMovement{
+			MaizeID:        int(id),
+			QuantityChange: maize.InventoryLevel,
+			Reason:         MovementOpening,
+			Note:           "Product created",
+			UserID:         userID,
+			Actor:          actor,
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// UpdateMaize updates an existing maize product. Stock is left alone; it only
+// changes through AdjustInventory.
+func (m *DBModel) UpdateMaize(maize Maize) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+	update maize set
+		name = ?, description = ?, price = ?,
+		is_recurring = ?, plan_id = ?, is_active = ?, backorder_policy = ?,
+		expected_ship_date = ?, low_stock_threshold = ?, weight_grams = ?, updated_at = ?
+	where id = ?`
+
+	_, err := m.DB.ExecContext(ctx, stmt,
+		maize.Name,
+		maize.Description,
+		maize.Price,
+		maize.IsRecurring,
+		maize.PlanID,
+		maize.IsActive,
+		maize.BackorderPolicy,
+		nullDate(maize.ExpectedShipDate),
+		maize.LowStockThreshold,
+		maize.WeightGrams,
+		time.Now(),
+		maize.ID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UpdateMaizeImage sets the image and thumbnail URLs of a maize product
+func (m *DBModel) UpdateMaizeImage(id int, image, thumbnail string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `update maize set image = ?, thumbnail = ?, updated_at = ? where id = ?`
+
+	_, err := m.DB.ExecContext(ctx, stmt, image, thumbnail, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 // InsertTransaction inserts a new transaction
 func (m *DBModel) InsertTransaction(txn Transaction) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -178,26 +405,109 @@ func (m *DBModel) InsertTransaction(txn Transaction) (int, error) {
 	return int(id), nil
 }
 
-// InsertOrder inserts a new order
+// InsertOrder inserts a new order that takes no stock, such as a subscription
 func (m *DBModel) InsertOrder(order Order) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	id, err := m.insertOrder(ctx, tx, order)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// PlaceOrder inserts a new order for maize and, when it is cleared, takes its
+// units from stock in the same transaction. An order that stock can no longer
+// cover, because another sale took it first, is backordered instead. The order
+// is returned with its ID and final status.
+func (m *DBModel) PlaceOrder(order Order) (Order, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return order, err
+	}
+	defer tx.Rollback()
+
+	var after int
+	if order.StatusID == StatusCleared {
+		after, err = changeStock(ctx, tx, order.MaizeID, order.VariantID, -order.Quantity)
+		if errors.Is(err, ErrOutOfStock) {
+			order.StatusID = StatusBackordered
+		} else if err != nil {
+			return order, err
+		}
+	}
+
+	order.ID, err = m.insertOrder(ctx, tx, order)
+	if err != nil {
+		return order, err
+	}
+
+	// orders waiting on stock take their units when they are fulfilled
+	if order.StatusID == StatusCleared {
+		err = recordMovement(ctx, tx, InventoryMovement{
+			MaizeID:        order.MaizeID,
+			VariantID:      order.VariantID,
+			OrderID:        order.ID,
+			QuantityChange: -order.Quantity,
+			InventoryAfter: after,
+			Reason:         MovementSale,
+			Actor:          CustomerActor(order.CustomerID),
+		})
+		if err != nil {
+			return order, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return order, err
+	}
+
+	return order, nil
+}
+
+// insertOrder inserts a new order and its first status within tx
+func (m *DBModel) insertOrder(ctx context.Context, tx *sql.Tx, order Order) (int, error) {
 	stmt := `
 	INSERT INTO orders
-		 (maize_id, transaction_id, status_id, quantity, customer_id,
-		 amount, created_at, updated_at)
-	VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+		 (maize_id, variant_id, transaction_id, status_id, quantity, customer_id,
+		 amount, billing_address_id, shipping_address_id, shipping_rate_id, shipping_method,
+		 shipping_amount, created_at, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 
-	result, err := m.DB.ExecContext(ctx, stmt,
+	now := time.Now()
+
+	result, err := tx.ExecContext(ctx, stmt,
 		order.MaizeID,
+		nullInt(order.VariantID),
 		order.TransactionID,
 		order.StatusID,
 		order.Quantity,
 		order.CustomerID,
 		order.Amount,
-		time.Now(),
-		time.Now())
+		nullInt(order.BillingAddressID),
+		nullInt(order.ShippingAddressID),
+		nullInt(order.ShippingRateID),
+		order.ShippingMethod,
+		order.ShippingAmount,
+		now,
+		now)
 	if err != nil {
 		return 0, err
 	}
@@ -207,6 +517,16 @@ func (m *DBModel) InsertOrder(order Order) (int, error) {
 		return 0, err
 	}
 
+	err = insertStatusChange(ctx, tx, int(id), 0, order.StatusID, "", "Order placed")
+	if err != nil {
+		return 0, err
+	}
+
+	err = m.refreshDailySummary(ctx, tx, dayOf(now, m.location()), order.MaizeID)
+	if err != nil {
+		return 0, err
+	}
+
 	return int(id), nil
 }
 
@@ -215,15 +535,25 @@ func (m *DBModel) InsertCustomer(c Customer) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	var sealed [3]string
+	for i, v := range []string{c.FirstName, c.LastName, c.Email} {
+		var err error
+		sealed[i], err = m.seal(v)
+		if err != nil {
+			return 0, err
+		}
+	}
+
 	stmt := `
 	INSERT INTO customers
-		 (first_name, last_name, email, created_at, updated_at)
-	VALUES (?, ?, ?, ?, ?)`
+		 (first_name, last_name, email, email_hash, created_at, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?)`
 
 	result, err := m.DB.ExecContext(ctx, stmt,
-		c.FirstName,
-		c.LastName,
-		c.Email,
+		sealed[0],
+		sealed[1],
+		sealed[2],
+		m.emailHash(c.Email),
 		time.Now(),
 		time.Now())
 	if err != nil {
@@ -248,7 +578,7 @@ func (m *DBModel) GetUserByEmail(email string) (User, error) {
 
 	row := m.DB.QueryRowContext(ctx,
 		`SELECT
-		 	id, first_name, last_name, email, password, created_at, updated_at
+		 	id, first_name, last_name, email, password, totp_enabled, created_at, updated_at
 		from 
 			users
 		where email = ?`, email)
@@ -259,6 +589,7 @@ func (m *DBModel) GetUserByEmail(email string) (User, error) {
 		&u.LastName,
 		&u.Email,
 		&u.Password,
+		&u.TwoFactorEnabled,
 		&u.CreatedAt,
 		&u.UpdatedAt,
 	)
@@ -292,29 +623,46 @@ func (m *DBModel) Authenticate(email, password string) (int, error) {
 	return id, nil
 }
 
-func (m *DBModel) UpdatePasswordForUser(u User, hash string) error {
+// UpdatePasswordForUser sets a user's password, and revokes all their tokens
+// but the one whose plain text is keep, if any, so whoever knew the old
+// password is logged out everywhere
+func (m *DBModel) UpdatePasswordForUser(u User, hash string, keep string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	stmt := `
 	UPDATE users
 	SET password = ?, updated_at = ?
 	WHERE id = ?`
 
-	_, err := m.DB.ExecContext(ctx, stmt, hash, time.Now(), u.ID)
+	_, err = tx.ExecContext(ctx, stmt, hash, time.Now(), u.ID)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	_, err = revokeOtherTokens(ctx, tx, u.ID, keep)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetAllOrdersPaginated returns a page of one-off orders matching filter
+func (m *DBModel) GetAllOrdersPaginated(pageSize, page int, filter OrderFilter) ([]*Order, int, int, error) {
+	return m.getOrdersPaginated(false, pageSize, page, filter)
 }
 
-func (m *DBModel) GetAllOrdersPaginated(pageSize, page int) ([]*Order, int, int, error) {
+func (m *DBModel) GetAllOrders() ([]*Order, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	offset := (page - 1) * pageSize
-
 	var orders []*Order
 
 	stmt := `
@@ -323,21 +671,22 @@ func (m *DBModel) GetAllOrdersPaginated(pageSize, page int) ([]*Order, int, int,
 		o.status_id, o.quantity, o.amount, o.created_at, o.updated_at,
 	    m.id, m.name, t.id, t.amount, t.currency, t.last_four,
 	    t.expiry_month, t.expiry_year, t.payment_intent, t.bank_return_code,
-	    c.id, c.first_name, c.last_name, c.email
+	    c.id, c.first_name, c.last_name, c.email,
+		coalesce(o.variant_id, 0), coalesce(v.name, ''), coalesce(v.sku, '')
 	from 	
 		orders o
 			left join maize m on (o.maize_id = m.id)
 			left join transactions t on (o.transaction_id = t.id)
 			left join customers c on (o.customer_id = c.id)
+			left join maize_variants v on (o.variant_id = v.id)
 	where 
 		m.is_recurring = 0	
 	order BY
-		o.created_at desc
-		limit ? offset ?`
+		o.created_at desc`
 
-	rows, err := m.DB.QueryContext(ctx, stmt, pageSize, offset)
+	rows, err := m.DB.QueryContext(ctx, stmt)
 	if err != nil {
-		return nil, 0, 0, err
+		return nil, err
 	}
 
 	defer rows.Close()
@@ -368,184 +717,169 @@ func (m *DBModel) GetAllOrdersPaginated(pageSize, page int) ([]*Order, int, int,
 			&o.Customer.FirstName,
 			&o.Customer.LastName,
 			&o.Customer.Email,
+			&o.VariantID,
+			&o.Variant.Name,
+			&o.Variant.SKU,
 		)
 		if err != nil {
-			return nil, 0, 0, err
+			return nil, err
 		}
 
-		orders = append(orders, &o)
-	}
-
-	stmt = `select count(o.id)
-		   	  from orders o
-			left join maize m on (o.maize_id = m.id)
-			where
-				m.is_recurring = 0`
-
-	var totalRecords int
-	countRow := m.DB.QueryRowContext(ctx, stmt)
+		err = m.openCustomer(&o.Customer)
+		if err != nil {
+			return nil, err
+		}
 
-	err = countRow.Scan(&totalRecords)
-	if err != nil {
-		return nil, 0, 0, err
+		orders = append(orders, &o)
 	}
 
-	lastPage := totalRecords / pageSize
-
-	return orders, lastPage, totalRecords, nil
+	return orders, nil
 }
 
-func (m *DBModel) GetAllOrders() ([]*Order, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	var orders []*Order
+// GetAllSubsPaginated returns a page of subscription orders matching filter
+func (m *DBModel) GetAllSubsPaginated(pageSize, page int, filter OrderFilter) ([]*Order, int, int, error) {
+	return m.getOrdersPaginated(true, pageSize, page, filter)
+}
 
-	stmt := `
+// orderListSelect is the query shared by the paginated order lists. It ends
+// with the from clause, leaving the where clause to the caller.
+const orderListSelect = `
 	select 
 		o.id, o.maize_id, o.transaction_id, o.customer_id,
-		o.status_id, o.quantity, o.amount, o.created_at, o.updated_at,
+		o.status_id, o.quantity, o.amount, o.shipping_method, o.shipping_amount,
+		o.created_at, o.updated_at,
 	    m.id, m.name, t.id, t.amount, t.currency, t.last_four,
 	    t.expiry_month, t.expiry_year, t.payment_intent, t.bank_return_code,
-	    c.id, c.first_name, c.last_name, c.email
+	    c.id, c.first_name, c.last_name, c.email,
+		coalesce(o.variant_id, 0), coalesce(v.name, ''), coalesce(v.sku, '')
 	from 	
 		orders o
 			left join maize m on (o.maize_id = m.id)
 			left join transactions t on (o.transaction_id = t.id)
 			left join customers c on (o.customer_id = c.id)
-	where 
-		m.is_recurring = 0	
-	order BY
-		o.created_at desc`
+			left join maize_variants v on (o.variant_id = v.id)`
 
-	rows, err := m.DB.QueryContext(ctx, stmt)
+// scanOrderListRow scans a row selected by orderListSelect
+func (m *DBModel) scanOrderListRow(rows *sql.Rows) (*Order, error) {
+	var o Order
+	err := rows.Scan(
+		&o.ID,
+		&o.MaizeID,
+		&o.TransactionID,
+		&o.CustomerID,
+		&o.StatusID,
+		&o.Quantity,
+		&o.Amount,
+		&o.ShippingMethod,
+		&o.ShippingAmount,
+		&o.CreatedAt,
+		&o.UpdatedAt,
+		&o.Maize.ID,
+		&o.Maize.Name,
+		&o.Transaction.ID,
+		&o.Transaction.Amount,
+		&o.Transaction.Currency,
+		&o.Transaction.LastFour,
+		&o.Transaction.ExpiryMonth,
+		&o.Transaction.ExpiryYear,
+		&o.Transaction.PaymentIntent,
+		&o.Transaction.BankReturnCode,
+		&o.Customer.ID,
+		&o.Customer.FirstName,
+		&o.Customer.LastName,
+		&o.Customer.Email,
+		&o.VariantID,
+		&o.Variant.Name,
+		&o.Variant.SKU,
+	)
 	if err != nil {
 		return nil, err
 	}
 
-	defer rows.Close()
+	err = m.openCustomer(&o.Customer)
+	if err != nil {
+		return nil, err
+	}
+
+	return &o, nil
+}
+
+// scanOrderList scans the rows selected by orderListSelect
+func (m *DBModel) scanOrderList(rows *sql.Rows) ([]*Order, error) {
+	var orders []*Order
 
 	for rows.Next() {
-		var o Order
-		err = rows.Scan(
-			&o.ID,
-			&o.MaizeID,
-			&o.TransactionID,
-			&o.CustomerID,
-			&o.StatusID,
-			&o.Quantity,
-			&o.Amount,
-			&o.CreatedAt,
-			&o.UpdatedAt,
-			&o.Maize.ID,
-			&o.Maize.Name,
-			&o.Transaction.ID,
-			&o.Transaction.Amount,
-			&o.Transaction.Currency,
-			&o.Transaction.LastFour,
-			&o.Transaction.ExpiryMonth,
-			&o.Transaction.ExpiryYear,
-			&o.Transaction.PaymentIntent,
-			&o.Transaction.BankReturnCode,
-			&o.Customer.ID,
-			&o.Customer.FirstName,
-			&o.Customer.LastName,
-			&o.Customer.Email,
-		)
+		o, err := m.scanOrderListRow(rows)
 		if err != nil {
 			return nil, err
 		}
 
-		orders = append(orders, &o)
+		orders = append(orders, o)
 	}
 
-	return orders, nil
+	return orders, rows.Err()
+}
+
+// orderListWhere returns the where clause and arguments selecting the
+// subscription or one-off orders matching filter
+func (m *DBModel) orderListWhere(recurring bool, filter OrderFilter) (string, []interface{}) {
+	conds, args := filter.where(m)
+	conds = append([]string{"m.is_recurring = ?"}, conds...)
+	args = append([]interface{}{recurring}, args...)
+	return strings.Join(conds, " and "), args
+}
+
+// countOrders returns the number of orders matching the where clause built by
+// orderListWhere
+func (m *DBModel) countOrders(ctx context.Context, where string, args []interface{}) (int, error) {
+	stmt := `select count(o.id)
+		   	  from orders o
+			left join maize m on (o.maize_id = m.id)
+			left join transactions t on (o.transaction_id = t.id)
+			left join customers c on (o.customer_id = c.id)
+			where
+				` + where
+
+	var totalRecords int
+	err := m.DB.QueryRowContext(ctx, stmt, args...).Scan(&totalRecords)
+	return totalRecords, err
 }
 
-func (m *DBModel) GetAllSubsPaginated(pageSize, page int) ([]*Order, int, int, error) {
+// getOrdersPaginated returns a page of subscription or one-off orders matching
+// filter, along with the last page number and the number of matching orders
+func (m *DBModel) getOrdersPaginated(recurring bool, pageSize, page int, filter OrderFilter) ([]*Order, int, int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	offset := (page - 1) * pageSize
 
-	var orders []*Order
+	where, args := m.orderListWhere(recurring, filter)
 
-	stmt := `
-	select 
-		o.id, o.maize_id, o.transaction_id, o.customer_id,
-		o.status_id, o.quantity, o.amount, o.created_at, o.updated_at,
-	    m.id, m.name, t.id, t.amount, t.currency, t.last_four,
-	    t.expiry_month, t.expiry_year, t.payment_intent, t.bank_return_code,
-	    c.id, c.first_name, c.last_name, c.email
-	from 	
-		orders o
-			left join maize m on (o.maize_id = m.id)
-			left join transactions t on (o.transaction_id = t.id)
-			left join customers c on (o.customer_id = c.id)
+	stmt := orderListSelect + `
 	where 
-		m.is_recurring = 1	
+		` + where + `
 	order BY
-		o.created_at desc
+		` + filter.orderBy() + `
 		limit ? offset ?`
 
-	rows, err := m.DB.QueryContext(ctx, stmt, pageSize, offset)
+	rows, err := m.DB.QueryContext(ctx, stmt, append(args, pageSize, offset)...)
 	if err != nil {
 		return nil, 0, 0, err
 	}
 
 	defer rows.Close()
 
-	for rows.Next() {
-		var o Order
-		err = rows.Scan(
-			&o.ID,
-			&o.MaizeID,
-			&o.TransactionID,
-			&o.CustomerID,
-			&o.StatusID,
-			&o.Quantity,
-			&o.Amount,
-			&o.CreatedAt,
-			&o.UpdatedAt,
-			&o.Maize.ID,
-			&o.Maize.Name,
-			&o.Transaction.ID,
-			&o.Transaction.Amount,
-			&o.Transaction.Currency,
-			&o.Transaction.LastFour,
-			&o.Transaction.ExpiryMonth,
-			&o.Transaction.ExpiryYear,
-			&o.Transaction.PaymentIntent,
-			&o.Transaction.BankReturnCode,
-			&o.Customer.ID,
-			&o.Customer.FirstName,
-			&o.Customer.LastName,
-			&o.Customer.Email,
-		)
-		if err != nil {
-			return nil, 0, 0, err
-		}
-
-		orders = append(orders, &o)
+	orders, err := m.scanOrderList(rows)
+	if err != nil {
+		return nil, 0, 0, err
 	}
 
-	stmt = `select count(o.id)
-		   	  from orders o
-			left join maize m on (o.maize_id = m.id)
-			where
-				m.is_recurring = 1`
-
-	var totalRecords int
-	countRow := m.DB.QueryRowContext(ctx, stmt)
-
-	err = countRow.Scan(&totalRecords)
+	totalRecords, err := m.countOrders(ctx, where, args)
 	if err != nil {
 		return nil, 0, 0, err
 	}
 
-	lastPage := totalRecords / pageSize
-
-	return orders, lastPage, totalRecords, nil
+	return orders, LastPage(totalRecords, pageSize), totalRecords, nil
 }
 
 func (m *DBModel) GetAllSubs() ([]*Order, error) {
@@ -560,12 +894,14 @@ func (m *DBModel) GetAllSubs() ([]*Order, error) {
 		o.status_id, o.quantity, o.amount, o.created_at, o.updated_at,
 	    m.id, m.name, t.id, t.amount, t.currency, t.last_four,
 	    t.expiry_month, t.expiry_year, t.payment_intent, t.bank_return_code,
-	    c.id, c.first_name, c.last_name, c.email
+	    c.id, c.first_name, c.last_name, c.email,
+		coalesce(o.variant_id, 0), coalesce(v.name, ''), coalesce(v.sku, '')
 	from 	
 		orders o
 			left join maize m on (o.maize_id = m.id)
 			left join transactions t on (o.transaction_id = t.id)
 			left join customers c on (o.customer_id = c.id)
+			left join maize_variants v on (o.variant_id = v.id)
 	where 
 		m.is_recurring = 1	
 	order BY
@@ -604,11 +940,19 @@ func (m *DBModel) GetAllSubs() ([]*Order, error) {
 			&o.Customer.FirstName,
 			&o.Customer.LastName,
 			&o.Customer.Email,
+			&o.VariantID,
+			&o.Variant.Name,
+			&o.Variant.SKU,
 		)
 		if err != nil {
 			return nil, err
 		}
 
+		err = m.openCustomer(&o.Customer)
+		if err != nil {
+			return nil, err
+		}
+
 		orders = append(orders, &o)
 	}
 
@@ -627,7 +971,10 @@ func (m *DBModel) GetOrderByID(id int) (Order, error) {
 		o.status_id, o.quantity, o.amount, o.created_at, o.updated_at,
 		m.id, m.name, t.id, t.amount, t.currency, t.last_four,
 		t.expiry_month, t.expiry_year, t.payment_intent, t.bank_return_code,
-		c.id, c.first_name, c.last_name, c.email
+		c.id, c.first_name, c.last_name, c.email,
+		coalesce(o.variant_id, 0), coalesce(v.name, ''), coalesce(v.sku, ''),
+		coalesce(o.billing_address_id, 0), coalesce(o.shipping_address_id, 0),
+		coalesce(o.shipping_rate_id, 0), o.shipping_method, o.shipping_amount
 	from
 		orders o
 			left join maize m on (o.maize_id = m.id)
@@ -635,6 +982,8 @@ func (m *DBModel) GetOrderByID(id int) (Order, error) {
 				transactions t on (o.transaction_id = t.id)
 			left join
 				customers c on (o.customer_id = c.id)
+			left join
+				maize_variants v on (o.variant_id = v.id)
 		where
 			o.id = ?`
 
@@ -664,28 +1013,27 @@ func (m *DBModel) GetOrderByID(id int) (Order, error) {
 		&o.Customer.FirstName,
 		&o.Customer.LastName,
 		&o.Customer.Email,
+		&o.VariantID,
+		&o.Variant.Name,
+		&o.Variant.SKU,
+		&o.BillingAddressID,
+		&o.ShippingAddressID,
+		&o.ShippingRateID,
+		&o.ShippingMethod,
+		&o.ShippingAmount,
 	)
 
 	if err != nil {
 		return o, err
 	}
 
-	return o, nil
-
-}
-
-func (m *DBModel) UpdateOrderStatus(id, statusID int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	stmt := `update orders set status_id = ? where id = ?`
-
-	_, err := m.DB.ExecContext(ctx, stmt, statusID, id)
+	err = m.openCustomer(&o.Customer)
 	if err != nil {
-		return err
+		return o, err
 	}
 
-	return nil
+	return o, nil
+
 }
 
 func (m *DBModel) GetAllUsers() ([]*User, error) {
@@ -736,7 +1084,7 @@ func (m *DBModel) GetOneUserByID(id int) (User, error) {
 
 	stmt := `
 	select 
-		u.id, u.first_name, u.last_name, u.email, u.created_at, u.updated_at
+		u.id, u.first_name, u.last_name, u.email, u.totp_enabled, u.created_at, u.updated_at
 	from 	
 		users u
 	where 
@@ -749,6 +1097,7 @@ func (m *DBModel) GetOneUserByID(id int) (User, error) {
 		&u.FirstName,
 		&u.LastName,
 		&u.Email,
+		&u.TwoFactorEnabled,
 		&u.CreatedAt,
 		&u.UpdatedAt,
 	)
@@ -775,37 +1124,74 @@ func (m *DBModel) EditUser(u User) error {
 	return nil
 }
 
-func (m *DBModel) AddUser(u User, hash string) error {
+// AddUser inserts a user with the roles named in u.Roles and returns its ID.
+// The user is only created if every role exists; otherwise it returns
+// ErrUnknownRole.
+func (m *DBModel) AddUser(u User, hash string) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
 	stmt := `
 	insert into users (first_name, last_name, email, password, created_at, updated_at) values (?, ?, ?, ?, ?, ?)`
 
-	_, err := m.DB.ExecContext(ctx, stmt, u.FirstName, u.LastName, u.Email, hash, time.Now(), time.Now())
+	result, err := tx.ExecContext(ctx, stmt, u.FirstName, u.LastName, u.Email, hash, time.Now(), time.Now())
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	return nil
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	err = setUserRoles(ctx, tx, int(id), u.Roles)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
 }
 
+// DeleteUser deletes a user, their roles and their tokens. It returns
+// ErrLastAdmin rather than delete the only user with the admin role.
 func (m *DBModel) DeleteUser(id int) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	stmt := `delete from users where id = ?`
 
-	_, err := m.DB.ExecContext(ctx, stmt, id)
+	_, err = tx.ExecContext(ctx, stmt, id)
 	if err != nil {
 		return err
 	}
 
 	stmt = `delete from tokens where user_id = ?`
-	_, err = m.DB.ExecContext(ctx, stmt, id)
+	_, err = tx.ExecContext(ctx, stmt, id)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	err = m.checkAdminLeft(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrLinkUsed is returned when a single-use link is used again
+var ErrLinkUsed = errors.New("this link has already been used")
+
+// ConsumeNonce marks the nonce of a signed link used, returning ErrLinkUsed
+// if it already was. The nonce is kept until the link expires, after which the
+// link no longer verifies anyway, so expired nonces are removed as it goes.
+func (m *DBModel) ConsumeNonce(nonce, purpose string, expiresAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from url_nonces where expires_at < ?`, time.Now())
+	if err != nil {
+		return err
+	}
+
+	stmt := `
+	INSERT IGNORE INTO url_nonces
+		(nonce, purpose, expires_at, created_at, updated_at)
+	VALUES (?, ?, ?, ?, ?)`
+
+	result, err := m.DB.ExecContext(ctx, stmt,
+		nonce,
+		purpose,
+		expiresAt,
+		time.Now(),
+		time.Now())
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrLinkUsed
+	}
+
+	return nil
+}
+
+// NonceUsed reports whether the nonce of a signed link has been consumed
+func (m *DBModel) NonceUsed(nonce string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var n int
+	err := m.DB.QueryRowContext(ctx, `select count(*) from url_nonces where nonce = ?`, nonce).Scan(&n)
+	return n > 0, err
+}
@@ -0,0 +1,45 @@
+package models
+
+import (
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConsumeNonce(t *testing.T) {
+	used := make(map[string]bool)
+
+	m := openFake(t, &fakeDB{
+		exec: func(query string, args []driver.Value) (int64, error) {
+			if !strings.Contains(query, "INSERT IGNORE INTO url_nonces") {
+				return 0, nil
+			}
+			// nonce has a unique index, so a second insert is ignored
+			nonce := args[0].(string)
+			if used[nonce] {
+				return 0, nil
+			}
+			used[nonce] = true
+			return 1, nil
+		},
+	})
+
+	expires := time.Now().Add(time.Hour)
+
+	err := m.ConsumeNonce("abc", "reset", expires)
+	if err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+
+	err = m.ConsumeNonce("abc", "reset", expires)
+	if !errors.Is(err, ErrLinkUsed) {
+		t.Errorf("reuse: %v, want %v", err, ErrLinkUsed)
+	}
+
+	err = m.ConsumeNonce("def", "reset", expires)
+	if err != nil {
+		t.Errorf("another nonce: %v", err)
+	}
+}
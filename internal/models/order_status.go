@@ -0,0 +1,186 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// orderTransitions lists the statuses an order may move to from each status.
+// Refunded and cancelled orders are final.
+var orderTransitions = map[int][]int{
+	StatusCleared:         {StatusRefunded, StatusCancelled},
+	StatusBackordered:     {StatusCleared, StatusRefunded},
+	StatusPreOrdered:      {StatusCleared, StatusCancelled, StatusPaymentRequired},
+	StatusPaymentRequired: {StatusCancelled},
+}
+
+// statusNames names the order statuses, matching the rows of the statuses table
+var statusNames = map[int]string{
+	StatusCleared:         "Cleared",
+	StatusRefunded:        "Refunded",
+	StatusCancelled:       "Cancelled",
+	StatusBackordered:     "Backordered",
+	StatusPreOrdered:      "Pre-ordered",
+	StatusPaymentRequired: "Payment required",
+}
+
+// StatusName returns the name of an order status
+func StatusName(statusID int) string {
+	if name, ok := statusNames[statusID]; ok {
+		return name
+	}
+	return fmt.Sprintf("status %d", statusID)
+}
+
+// TransitionError is returned when an order cannot move between two statuses
+type TransitionError struct {
+	OrderID int
+	From    int
+	To      int
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("order %d cannot be moved from %s to %s", e.OrderID, StatusName(e.From), StatusName(e.To))
+}
+
+// CanTransition reports whether an order may move from one status to another
+func CanTransition(from, to int) bool {
+	for _, s := range orderTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckTransition returns a *TransitionError when the order may not move to
+// status to. Call it before doing anything, like refunding a card, that cannot
+// be undone if the status change is then rejected.
+func (o Order) CheckTransition(to int) error {
+	if !CanTransition(o.StatusID, to) {
+		return &TransitionError{OrderID: o.ID, From: o.StatusID, To: to}
+	}
+	return nil
+}
+
+// OrderStatusChange is a model for the order_status_history table. FromStatusID
+// is zero for the status an order was created with.
+type OrderStatusChange struct {
+	ID           int       `json:"id"`
+	OrderID      int       `json:"order_id"`
+	FromStatusID int       `json:"from_status_id"`
+	ToStatusID   int       `json:"to_status_id"`
+	FromStatus   string    `json:"from_status"`
+	ToStatus     string    `json:"to_status"`
+	Actor        string    `json:"actor"`
+	Reason       string    `json:"reason"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// insertStatusChange records a change of status of an order
+func insertStatusChange(ctx context.Context, tx *sql.Tx, orderID, from, to int, actor, reason string) error {
+	stmt := `
+	INSERT INTO order_status_history
+		(order_id, from_status_id, to_status_id, actor, reason, created_at, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?)`
+
+	_, err := tx.ExecContext(ctx, stmt, orderID, nullInt(from), to, actor, reason, time.Now(), time.Now())
+	return err
+}
+
+// TransitionOrderStatus moves an order to a new status and records who did it
+// and why. A *TransitionError is returned when the move is not allowed from the
+// order's current status.
+func (m *DBModel) TransitionOrderStatus(id, to int, actor, reason string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var from int
+	err = tx.QueryRowContext(ctx, `select status_id from orders where id = ? for update`, id).Scan(&from)
+	if err != nil {
+		return err
+	}
+
+	if !CanTransition(from, to) {
+		return &TransitionError{OrderID: id, From: from, To: to}
+	}
+
+	now := time.Now()
+
+	_, err = tx.ExecContext(ctx, `update orders set status_id = ?, updated_at = ? where id = ?`, to, now, id)
+	if err != nil {
+		return err
+	}
+
+	err = insertStatusChange(ctx, tx, id, from, to, actor, reason)
+	if err != nil {
+		return err
+	}
+
+	// cancelled subscriptions count as churned on the daily summaries
+	if to == StatusCancelled {
+		err = m.refreshOrderDay(ctx, tx, id, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetOrderStatusHistory returns the status changes of an order, oldest first
+func (m *DBModel) GetOrderStatusHistory(orderID int) ([]*OrderStatusChange, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var changes []*OrderStatusChange
+
+	stmt := `
+	select
+		h.id, h.order_id, coalesce(h.from_status_id, 0), h.to_status_id,
+		coalesce(f.name, ''), t.name, h.actor, h.reason, h.created_at
+	from
+		order_status_history h
+			left join statuses f on (h.from_status_id = f.id)
+			left join statuses t on (h.to_status_id = t.id)
+	where
+		h.order_id = ?
+	order by
+		h.created_at, h.id`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c OrderStatusChange
+		err = rows.Scan(
+			&c.ID,
+			&c.OrderID,
+			&c.FromStatusID,
+			&c.ToStatusID,
+			&c.FromStatus,
+			&c.ToStatus,
+			&c.Actor,
+			&c.Reason,
+			&c.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		changes = append(changes, &c)
+	}
+
+	return changes, nil
+}
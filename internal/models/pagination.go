@@ -0,0 +1,317 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrBadCursor is returned when a pagination cursor cannot be decoded
+var ErrBadCursor = errors.New("invalid pagination cursor")
+
+// LastPage returns the number of the last page when totalRecords are split
+// into pages of pageSize. There is always at least one page, even if empty.
+func LastPage(totalRecords, pageSize int) int {
+	if pageSize <= 0 || totalRecords <= pageSize {
+		return 1
+	}
+	return (totalRecords + pageSize - 1) / pageSize
+}
+
+// Cursor marks a position in a list ordered by created_at and id. Pages are
+// read after the position, or before it when Before is set. The zero Cursor
+// is the start of the list.
+type Cursor struct {
+	CreatedAt time.Time `json:"t"`
+	ID        int       `json:"i"`
+	Before    bool      `json:"b,omitempty"`
+}
+
+// CursorPage holds the cursors of the pages either side of a page read by
+// cursor. They are empty when there is no such page.
+type CursorPage struct {
+	Next string `json:"next_cursor,omitempty"`
+	Prev string `json:"prev_cursor,omitempty"`
+}
+
+// EncodeCursor returns the opaque form of c handed to clients
+func EncodeCursor(c Cursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// DecodeCursor reads a cursor made by EncodeCursor. The empty string is the
+// start of the list.
+func DecodeCursor(s string) (Cursor, error) {
+	var c Cursor
+	if s == "" {
+		return c, nil
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, ErrBadCursor
+	}
+
+	err = json.Unmarshal(b, &c)
+	if err != nil || c.ID <= 0 {
+		return Cursor{}, ErrBadCursor
+	}
+
+	return c, nil
+}
+
+// isStart reports whether c is the start of the list
+func (c Cursor) isStart() bool {
+	return c.ID == 0
+}
+
+// keyset returns the condition selecting the rows past the cursor, with its
+// arguments, and the order to read them in, for a list on the columns
+// createdCol and idCol shown in descending order when desc is set. Rows read
+// before the cursor come back in reverse; window puts them right.
+func (c Cursor) keyset(createdCol, idCol string, desc bool) (cond string, args []interface{}, orderBy string) {
+	// reading backwards flips the direction of the list
+	readDesc := desc != c.Before
+
+	op, dir := ">", "asc"
+	if readDesc {
+		op, dir = "<", "desc"
+	}
+	orderBy = createdCol + " " + dir + ", " + idCol + " " + dir
+
+	if !c.isStart() {
+		cond = "(" + createdCol + " " + op + " ? or (" + createdCol + " = ? and " + idCol + " " + op + " ?))"
+		args = []interface{}{c.CreatedAt, c.CreatedAt, c.ID}
+	}
+
+	return cond, args, orderBy
+}
+
+// window takes the keys of the rows read for the cursor, at most pageSize+1 in
+// the order they were read, and returns the indexes of the rows on the page in
+// display order, along with the cursors of the pages either side of it.
+func (c Cursor) window(keys []Cursor, pageSize int) ([]int, CursorPage) {
+	var page CursorPage
+
+	more := len(keys) > pageSize
+	if more {
+		keys = keys[:pageSize]
+	}
+
+	idx := make([]int, len(keys))
+	for i := range idx {
+		idx[i] = i
+		if c.Before {
+			idx[i] = len(keys) - 1 - i
+		}
+	}
+
+	if len(idx) == 0 {
+		return idx, page
+	}
+
+	first, last := keys[idx[0]], keys[idx[len(idx)-1]]
+
+	// a page read forwards has a next page when more rows were found, and a
+	// previous one unless it is the first; the other way round when read backwards
+	hasNext, hasPrev := more, !c.isStart()
+	if c.Before {
+		hasNext, hasPrev = true, more
+	}
+
+	if hasNext {
+		page.Next = EncodeCursor(Cursor{CreatedAt: last.CreatedAt, ID: last.ID})
+	}
+	if hasPrev {
+		page.Prev = EncodeCursor(Cursor{CreatedAt: first.CreatedAt, ID: first.ID, Before: true})
+	}
+
+	return idx, page
+}
+
+// GetAllOrdersByCursor returns the page of one-off orders matching filter
+// after (or before) cursor, with the cursors either side of it and the number
+// of matching orders
+func (m *DBModel) GetAllOrdersByCursor(pageSize int, cursor Cursor, filter OrderFilter) ([]*Order, CursorPage, int, error) {
+	return m.getOrdersByCursor(false, pageSize, cursor, filter)
+}
+
+// GetAllSubsByCursor returns the page of subscription orders matching filter
+// after (or before) cursor, with the cursors either side of it and the number
+// of matching orders
+func (m *DBModel) GetAllSubsByCursor(pageSize int, cursor Cursor, filter OrderFilter) ([]*Order, CursorPage, int, error) {
+	return m.getOrdersByCursor(true, pageSize, cursor, filter)
+}
+
+// getOrdersByCursor reads a page of orders by keyset on created_at and id,
+// which stays fast however deep into the list the page is. Lists read by
+// cursor are always sorted by date; filter.Direction picks the direction.
+func (m *DBModel) getOrdersByCursor(recurring bool, pageSize int, cursor Cursor, filter OrderFilter) ([]*Order, CursorPage, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	where, args := m.orderListWhere(recurring, filter)
+
+	totalRecords, err := m.countOrders(ctx, where, args)
+	if err != nil {
+		return nil, CursorPage{}, 0, err
+	}
+
+	desc := !strings.EqualFold(filter.Direction, "asc")
+	cond, keyArgs, orderBy := cursor.keyset("o.created_at", "o.id", desc)
+
+	stmt := orderListSelect + `
+	where
+		` + where
+	if cond != "" {
+		stmt += " and " + cond
+	}
+	stmt += `
+	order by
+		` + orderBy + `
+		limit ?`
+
+	queryArgs := append(append(append([]interface{}{}, args...), keyArgs...), pageSize+1)
+
+	rows, err := m.DB.QueryContext(ctx, stmt, queryArgs...)
+	if err != nil {
+		return nil, CursorPage{}, 0, err
+	}
+	defer rows.Close()
+
+	read, err := m.scanOrderList(rows)
+	if err != nil {
+		return nil, CursorPage{}, 0, err
+	}
+
+	keys := make([]Cursor, len(read))
+	for i, o := range read {
+		keys[i] = Cursor{CreatedAt: o.CreatedAt, ID: o.ID}
+	}
+
+	idx, page := cursor.window(keys, pageSize)
+
+	orders := make([]*Order, len(idx))
+	for i, j := range idx {
+		orders[i] = read[j]
+	}
+
+	return orders, page, totalRecords, nil
+}
+
+// GetUsersPaginated returns a page of users ordered by name, along with the
+// last page number and the number of users
+func (m *DBModel) GetUsersPaginated(pageSize, page int) ([]*User, int, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+	select
+		u.id, u.first_name, u.last_name, u.email, u.created_at, u.updated_at
+	from
+		users u
+	order by last_name, first_name, id
+	limit ? offset ?`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, pageSize, (page-1)*pageSize)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer rows.Close()
+
+	users, err := scanUserList(rows)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	var totalRecords int
+	err = m.DB.QueryRowContext(ctx, `select count(id) from users`).Scan(&totalRecords)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	return users, LastPage(totalRecords, pageSize), totalRecords, nil
+}
+
+// GetUsersByCursor returns the page of users after (or before) cursor, newest
+// first, with the cursors either side of it and the number of users
+func (m *DBModel) GetUsersByCursor(pageSize int, cursor Cursor) ([]*User, CursorPage, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var totalRecords int
+	err := m.DB.QueryRowContext(ctx, `select count(id) from users`).Scan(&totalRecords)
+	if err != nil {
+		return nil, CursorPage{}, 0, err
+	}
+
+	cond, args, orderBy := cursor.keyset("u.created_at", "u.id", true)
+
+	stmt := `
+	select
+		u.id, u.first_name, u.last_name, u.email, u.created_at, u.updated_at
+	from
+		users u`
+	if cond != "" {
+		stmt += `
+	where ` + cond
+	}
+	stmt += `
+	order by ` + orderBy + `
+	limit ?`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, append(args, pageSize+1)...)
+	if err != nil {
+		return nil, CursorPage{}, 0, err
+	}
+	defer rows.Close()
+
+	read, err := scanUserList(rows)
+	if err != nil {
+		return nil, CursorPage{}, 0, err
+	}
+
+	keys := make([]Cursor, len(read))
+	for i, u := range read {
+		keys[i] = Cursor{CreatedAt: u.CreatedAt, ID: u.ID}
+	}
+
+	idx, page := cursor.window(keys, pageSize)
+
+	users := make([]*User, len(idx))
+	for i, j := range idx {
+		users[i] = read[j]
+	}
+
+	return users, page, totalRecords, nil
+}
+
+// scanUserList scans rows of id, first_name, last_name, email, created_at and
+// updated_at from the users table
+func scanUserList(rows *sql.Rows) ([]*User, error) {
+	var users []*User
+
+	for rows.Next() {
+		var u User
+		err := rows.Scan(
+			&u.ID,
+			&u.FirstName,
+			&u.LastName,
+			&u.Email,
+			&u.CreatedAt,
+			&u.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, &u)
+	}
+
+	return users, rows.Err()
+}
@@ -0,0 +1,432 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"maize/internal/encryption"
+	"strings"
+	"time"
+)
+
+// Personal data, and the TOTP secrets of users, is encrypted column by column
+// with the model's Cipher. Email addresses get a blind index alongside, a
+// keyed hash of the normalized address, so rows can still be found and grouped
+// by email. Without a Cipher values are written as they are and the index is
+// a plain hash; EncryptPII encrypts and re-indexes what was written before a
+// Cipher was set, or with a key since retired.
+
+// encryptedPrefix marks a value encrypted with the Cipher. Values without it
+// were written in plaintext.
+const encryptedPrefix = "enc:"
+
+// encryptedColumns lists the columns of each table that are encrypted
+var encryptedColumns = map[string][]string{
+	"customers":       {"first_name", "last_name", "email"},
+	"tokens":          {"name", "email"},
+	"customer_merges": {"first_name", "last_name", "email"},
+	"email_log":       {"to_address"},
+	"data_requests":   {"email"},
+	"users":           {"totp_secret"},
+}
+
+// blindIndexes maps each table with an indexed email column to that column
+// and its index
+var blindIndexes = map[string][2]string{
+	"customers":       {"email", "email_hash"},
+	"tokens":          {"email", "email_hash"},
+	"customer_merges": {"email", "email_hash"},
+	"email_log":       {"to_address", "to_hash"},
+	"data_requests":   {"email", "email_hash"},
+}
+
+// seal encrypts a value for storage
+func (m *DBModel) seal(s string) (string, error) {
+	if m.Cipher == nil || s == "" {
+		return s, nil
+	}
+
+	enc, err := m.Cipher.Encrypt(s)
+	if err != nil {
+		return "", err
+	}
+
+	return encryptedPrefix + enc, nil
+}
+
+// open decrypts a stored value, returning plaintext values as they are
+func (m *DBModel) open(s string) (string, error) {
+	if !strings.HasPrefix(s, encryptedPrefix) {
+		return s, nil
+	}
+	if m.Cipher == nil {
+		return "", fmt.Errorf("value is encrypted, but no encryption key is set")
+	}
+
+	s = strings.TrimPrefix(s, encryptedPrefix)
+	if encryption.IsLegacy(s) {
+		// written to the database by an earlier version, so not tampered with
+		return m.Cipher.DecryptLegacy(s)
+	}
+
+	return m.Cipher.Decrypt(s)
+}
+
+// emailHash returns the blind index of an email address
+func (m *DBModel) emailHash(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if m.Cipher == nil {
+		sum := sha256.Sum256([]byte(email))
+		return hex.EncodeToString(sum[:])
+	}
+
+	return m.Cipher.Hash(email)
+}
+
+// emailKey returns the SQL expression that identifies the email address of a
+// row: its blind index, or the address itself on rows written before the
+// index was kept. Compare it with the values emailKeys returns.
+func emailKey(indexCol, emailCol string) string {
+	return fmt.Sprintf("coalesce(%s, lower(%s))", indexCol, emailCol)
+}
+
+// emailKeys returns the values emailKey may take for an email address: its
+// blind index with the current key and with each retired key still in use,
+// and the address itself
+func (m *DBModel) emailKeys(email string) []interface{} {
+	email = strings.ToLower(strings.TrimSpace(email))
+
+	var keys []interface{}
+	if m.Cipher == nil {
+		keys = append(keys, m.emailHash(email))
+	} else {
+		for _, h := range m.Cipher.Hashes(email) {
+			keys = append(keys, h)
+		}
+	}
+
+	return append(keys, email)
+}
+
+// emailKeyList stands for the list of values emailKeys returns in a
+// statement, which bindEmail fills in
+const emailKeyList = "(:email_keys)"
+
+// bindEmail replaces each emailKeyList in stmt with a placeholder for each of
+// the values emailKeys returns for email, and returns it with those values,
+// once for each list
+func (m *DBModel) bindEmail(stmt, email string) (string, []interface{}) {
+	keys := m.emailKeys(email)
+	n := strings.Count(stmt, emailKeyList)
+
+	var args []interface{}
+	for i := 0; i < n; i++ {
+		args = append(args, keys...)
+	}
+
+	return strings.ReplaceAll(stmt, emailKeyList, placeholders(len(keys))), args
+}
+
+// placeholders returns a parenthesized list of n placeholders
+func placeholders(n int) string {
+	return "(" + strings.TrimSuffix(strings.Repeat("?, ", n), ", ") + ")"
+}
+
+// openCustomer decrypts the personal data of a customer
+func (m *DBModel) openCustomer(c *Customer) error {
+	for _, f := range []*string{&c.FirstName, &c.LastName, &c.Email} {
+		v, err := m.open(*f)
+		if err != nil {
+			return err
+		}
+		*f = v
+	}
+	return nil
+}
+
+// openColumns decrypts the encrypted columns of rows read whole from table
+func (m *DBModel) openColumns(table string, rows []map[string]interface{}) error {
+	for _, row := range rows {
+		for _, col := range encryptedColumns[table] {
+			s, ok := row[col].(string)
+			if !ok {
+				continue
+			}
+			v, err := m.open(s)
+			if err != nil {
+				return err
+			}
+			row[col] = v
+		}
+	}
+	return nil
+}
+
+// EncryptPII encrypts the personal data written in plaintext and fills in the
+// blind indexes, batchSize rows at a time, each batch in its own transaction.
+// Values encrypted with a retired key, or before ciphertexts were versioned,
+// are encrypted again with the primary key, and indexes written with another
+// blind index key are rebuilt; until then those rows are found by email only
+// while the retired key is in the ring. The index of an erased customer's
+// data requests cannot be rebuilt, since the address it indexes is gone, so
+// it keeps the key it was written with, and is found by email for as long as
+// that key is kept.
+// It calls progress after each batch with the rows changed so far. Rows that
+// are up to date are left alone, so it can be run again safely, and while the
+// application is running.
+func (m *DBModel) EncryptPII(batchSize int, progress func(table string, changed int)) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+
+	for _, table := range []string{"customers", "tokens", "customer_merges", "email_log", "data_requests", "users"} {
+		changed := 0
+		lastID := 0
+
+		for {
+			n, last, err := m.encryptBatch(ctx, table, lastID, batchSize)
+			if err != nil {
+				return fmt.Errorf("%s: %w", table, err)
+			}
+			if last == 0 {
+				break
+			}
+
+			changed += n
+			lastID = last
+			if progress != nil {
+				progress(table, changed)
+			}
+		}
+	}
+
+	return nil
+}
+
+// encryptBatch encrypts the next batchSize rows of table after lastID, and
+// returns how many it changed and the ID of the last row read, 0 when there
+// were none
+func (m *DBModel) encryptBatch(ctx context.Context, table string, lastID, batchSize int) (int, int, error) {
+	cols := encryptedColumns[table]
+	index, indexed := blindIndexes[table]
+
+	selectCols := append([]string{"id"}, cols...)
+	if indexed {
+		selectCols = append(selectCols, fmt.Sprintf("coalesce(%s, '')", index[1]))
+	}
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	stmt := fmt.Sprintf("select %s from %s where id > ? order by id limit ? for update",
+		strings.Join(selectCols, ", "), table)
+
+	rows, err := tx.QueryContext(ctx, stmt, lastID, batchSize)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	type update struct {
+		set  string
+		args []interface{}
+	}
+	var updates []update
+	last := 0
+
+	for rows.Next() {
+		var id int
+		values := make([]sql.NullString, len(cols)+1)
+		dest := []interface{}{&id}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if !indexed {
+			dest = dest[:len(dest)-1]
+		}
+
+		err = rows.Scan(dest...)
+		if err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		last = id
+
+		var sets []string
+		var args []interface{}
+		for i, col := range cols {
+			v := values[i].String
+			if v == "" {
+				continue
+			}
+
+			// v becomes the plaintext, so the index can be checked too
+			var sealed string
+			switch {
+			case !strings.HasPrefix(v, encryptedPrefix):
+				sealed, err = m.seal(v)
+			case m.Cipher == nil:
+				continue
+			default:
+				sealed, v, err = m.Cipher.Rotate(strings.TrimPrefix(v, encryptedPrefix))
+				sealed = encryptedPrefix + sealed
+			}
+			if err != nil {
+				rows.Close()
+				return 0, 0, err
+			}
+			if sealed != values[i].String {
+				sets = append(sets, col+" = ?")
+				args = append(args, sealed)
+			}
+
+			// the index of an erased address is all that is left of it, so
+			// it cannot be rebuilt from the pseudonym that replaced it
+			if indexed && col == index[0] && !isErasedEmail(v) {
+				if hash := m.emailHash(v); hash != values[len(cols)].String {
+					sets = append(sets, index[1]+" = ?")
+					args = append(args, hash)
+				}
+			}
+		}
+
+		if len(sets) > 0 {
+			updates = append(updates, update{strings.Join(sets, ", "), append(args, id)})
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	for _, u := range updates {
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("update %s set %s where id = ?", table, u.set), u.args...)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return len(updates), last, nil
+}
+
+// DecryptPII writes the personal data encrypted by EncryptPII back in
+// plaintext, in batches, so the migration that added the blind indexes can be
+// rolled back. TOTP secrets stay encrypted. The shop must be stopped while it
+// runs, or it will encrypt what it writes in the meantime.
+func (m *DBModel) DecryptPII(batchSize int, progress func(table string, changed int)) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+
+	for _, table := range []string{"customers", "tokens", "customer_merges", "email_log", "data_requests"} {
+		changed := 0
+		lastID := 0
+
+		for {
+			n, last, err := m.decryptBatch(ctx, table, lastID, batchSize)
+			if err != nil {
+				return fmt.Errorf("%s: %w", table, err)
+			}
+			if last == 0 {
+				break
+			}
+
+			changed += n
+			lastID = last
+			if progress != nil {
+				progress(table, changed)
+			}
+		}
+	}
+
+	return nil
+}
+
+// decryptBatch decrypts the next batchSize rows of table after lastID, and
+// returns how many it changed and the ID of the last row read, 0 when there
+// were none
+func (m *DBModel) decryptBatch(ctx context.Context, table string, lastID, batchSize int) (int, int, error) {
+	cols := encryptedColumns[table]
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	stmt := fmt.Sprintf("select id, %s from %s where id > ? order by id limit ? for update",
+		strings.Join(cols, ", "), table)
+
+	rows, err := tx.QueryContext(ctx, stmt, lastID, batchSize)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	type update struct {
+		set  string
+		args []interface{}
+	}
+	var updates []update
+	last := 0
+
+	for rows.Next() {
+		var id int
+		values := make([]sql.NullString, len(cols))
+		dest := []interface{}{&id}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+
+		err = rows.Scan(dest...)
+		if err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		last = id
+
+		var sets []string
+		var args []interface{}
+		for i, col := range cols {
+			if !strings.HasPrefix(values[i].String, encryptedPrefix) {
+				continue
+			}
+
+			v, err := m.open(values[i].String)
+			if err != nil {
+				rows.Close()
+				return 0, 0, err
+			}
+			sets = append(sets, col+" = ?")
+			args = append(args, v)
+		}
+
+		if len(sets) > 0 {
+			updates = append(updates, update{strings.Join(sets, ", "), append(args, id)})
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	for _, u := range updates {
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("update %s set %s where id = ?", table, u.set), u.args...)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return len(updates), last, nil
+}
@@ -0,0 +1,89 @@
+package models
+
+import (
+	"database/sql/driver"
+	"maize/internal/encryption"
+	"strings"
+	"testing"
+)
+
+func TestBindEmail(t *testing.T) {
+	e, err := encryption.New([]byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.HashKey = []byte("current blind index key")
+	e.RetiredHashKeys = [][]byte{[]byte("retired blind index key")}
+
+	m := &DBModel{Cipher: e}
+
+	stmt, args := m.bindEmail(`select * from a where x in `+emailKeyList+` or y in `+emailKeyList, " Jane@Example.com ")
+
+	if want := `select * from a where x in (?, ?, ?) or y in (?, ?, ?)`; stmt != want {
+		t.Errorf("stmt = %s, want %s", stmt, want)
+	}
+
+	want := []interface{}{
+		e.Hash("jane@example.com"),
+		(&encryption.Encryption{HashKey: e.RetiredHashKeys[0]}).Hash("jane@example.com"),
+		"jane@example.com",
+	}
+	want = append(want, want...)
+	if len(args) != len(want) {
+		t.Fatalf("args = %v, want %v", args, want)
+	}
+	for i := range want {
+		if args[i] != want[i] {
+			t.Errorf("args[%d] = %v, want %v", i, args[i], want[i])
+		}
+	}
+}
+
+func TestEmailKeysWithoutCipher(t *testing.T) {
+	m := &DBModel{}
+
+	keys := m.emailKeys("Jane@Example.com")
+	if len(keys) != 2 || keys[0] != m.emailHash("jane@example.com") || keys[1] != "jane@example.com" {
+		t.Errorf("emailKeys = %v, want the plain hash and the address", keys)
+	}
+}
+
+func TestDecryptPII(t *testing.T) {
+	e, err := encryption.New([]byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealer := &DBModel{Cipher: e}
+
+	name, err := sealer.seal("Jane")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var updates [][]driver.Value
+
+	f := &fakeDB{
+		query: func(query string, args []driver.Value) ([][]driver.Value, error) {
+			// one row per table, then none
+			if args[0].(int64) > 0 || !strings.Contains(query, "from customers") {
+				return nil, nil
+			}
+			return [][]driver.Value{{int64(1), name, "Smith", ""}}, nil
+		},
+		exec: func(query string, args []driver.Value) (int64, error) {
+			updates = append(updates, args)
+			return 1, nil
+		},
+	}
+	m := openFake(t, f)
+	m.Cipher = e
+
+	err = m.DecryptPII(10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(updates) != 1 || len(updates[0]) != 2 || updates[0][0] != "Jane" || updates[0][1] != int64(1) {
+		t.Errorf("updates = %v, want only the encrypted first name written back", updates)
+	}
+}
@@ -0,0 +1,386 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Data request kinds
+const (
+	DataRequestExport = "export"
+	DataRequestErase  = "erase"
+)
+
+// EmailLog is a model for the email_log table, a record of every email sent
+type EmailLog struct {
+	ID        int       `json:"id"`
+	To        string    `json:"to_address"`
+	Subject   string    `json:"subject"`
+	Template  string    `json:"template"`
+	Error     string    `json:"error"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DataRequest is a model for the data_requests table, the audit trail of
+// exports and erasures of a customer's personal data. Requests are found by
+// the blind index of the email address, which outlives its erasure so the
+// shop can still show what it did when asked about the address later. The
+// index is keyed, so without the key it cannot be matched against a list of
+// candidate addresses to find out who was erased.
+type DataRequest struct {
+	ID        int       `json:"id"`
+	Kind      string    `json:"kind"`
+	Email     string    `json:"email"`
+	EmailHash string    `json:"email_hash"`
+	Customers int       `json:"customers"`
+	Detail    string    `json:"detail"`
+	Actor     string    `json:"actor"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DataTable is the rows of one table held about a customer, column by column
+type DataTable struct {
+	Name string                   `json:"name"`
+	Rows []map[string]interface{} `json:"rows"`
+}
+
+// LogEmail records an email sent, or that failed to send
+func (m *DBModel) LogEmail(e EmailLog) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var sendErr interface{}
+	if e.Error != "" {
+		sendErr = e.Error
+	}
+
+	to, err := m.seal(e.To)
+	if err != nil {
+		return err
+	}
+
+	stmt := `
+	INSERT INTO email_log
+		(to_address, to_hash, subject, template, error, created_at, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?)`
+
+	_, err = m.DB.ExecContext(ctx, stmt,
+		to,
+		m.emailHash(e.To),
+		e.Subject,
+		e.Template,
+		sendErr,
+		time.Now(),
+		time.Now())
+
+	return err
+}
+
+// customersOfEmail selects the IDs of the customer rows with an email address.
+// Like every condition below it is bound to the address with bindEmail.
+var customersOfEmail = `(select id from customers c where ` + customerKey + ` in ` + emailKeyList + `)`
+
+// ordersOfEmail selects the IDs of the orders of the customer rows with an
+// email address
+var ordersOfEmail = `(select id from orders where customer_id in ` + customersOfEmail + `)`
+
+// personalData lists the tables holding data about a customer, and how to
+// find their rows from the email address
+var personalData = []struct {
+	table string
+	where string
+}{
+	{"customers", `id in ` + customersOfEmail},
+	{"addresses", `customer_id in ` + customersOfEmail},
+	{"orders", `customer_id in ` + customersOfEmail},
+	{"transactions", `id in (select transaction_id from orders where customer_id in ` + customersOfEmail + `)`},
+	{"order_status_history", `order_id in ` + ordersOfEmail},
+	{"shipments", `order_id in ` + ordersOfEmail},
+	{"returns", `order_id in ` + ordersOfEmail},
+	{"return_events", `return_id in (select id from returns where order_id in ` + ordersOfEmail + `)`},
+	{"inventory_movements", `order_id in ` + ordersOfEmail},
+	{"refunds", `order_id in ` + ordersOfEmail},
+	{"disputes", `order_id in ` + ordersOfEmail},
+	{"customer_notes", `customer_id in ` + customersOfEmail},
+	{"customer_merges", emailKey("email_hash", "email") + ` in ` + emailKeyList},
+	{"email_log", emailKey("to_hash", "to_address") + ` in ` + emailKeyList},
+}
+
+// GetCustomerData returns every row held about the customer with an email
+// address, table by table, decrypted. Rows are read whole, so columns added
+// later are included without changing this.
+func (m *DBModel) GetCustomerData(email string) ([]*DataTable, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var tables []*DataTable
+
+	for _, pd := range personalData {
+		stmt, args := m.bindEmail(fmt.Sprintf("select * from %s where %s order by id", pd.table, pd.where), email)
+		rows, err := m.DB.QueryContext(ctx, stmt, args...)
+		if err != nil {
+			return nil, err
+		}
+
+		t := &DataTable{Name: pd.table}
+		t.Rows, err = scanMaps(rows)
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		err = m.openColumns(pd.table, t.Rows)
+		if err != nil {
+			return nil, err
+		}
+
+		tables = append(tables, t)
+	}
+
+	stmt, args := m.bindEmail(`select * from data_requests where email_hash in `+emailKeyList+` order by id`, email)
+	rows, err := m.DB.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	t := &DataTable{Name: "data_requests"}
+	t.Rows, err = scanMaps(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.openColumns("data_requests", t.Rows)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(tables, t), nil
+}
+
+// scanMaps scans rows into maps of column name to value. Numbers stay
+// numbers, and everything else becomes a string.
+func scanMaps(rows *sql.Rows) ([]map[string]interface{}, error) {
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []map[string]interface{}
+
+	for rows.Next() {
+		values := make([]sql.RawBytes, len(types))
+		dest := make([]interface{}, len(types))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+
+		err = rows.Scan(dest...)
+		if err != nil {
+			return nil, err
+		}
+
+		row := make(map[string]interface{}, len(types))
+		for i, ct := range types {
+			switch {
+			case values[i] == nil:
+				row[ct.Name()] = nil
+			case isNumeric(ct.DatabaseTypeName()):
+				row[ct.Name()] = json.Number(string(values[i]))
+			default:
+				row[ct.Name()] = string(values[i])
+			}
+		}
+
+		result = append(result, row)
+	}
+
+	return result, rows.Err()
+}
+
+// isNumeric reports whether a MySQL column type holds numbers
+func isNumeric(databaseType string) bool {
+	switch strings.TrimPrefix(databaseType, "UNSIGNED ") {
+	case "TINYINT", "SMALLINT", "MEDIUMINT", "INT", "BIGINT", "DECIMAL", "FLOAT", "DOUBLE":
+		return true
+	}
+	return false
+}
+
+// InsertDataRequest records an export or erasure of a customer's data
+func (m *DBModel) InsertDataRequest(dr DataRequest) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.insertDataRequest(ctx, m.DB, dr)
+}
+
+// insertDataRequest records a data request through db, which may be a transaction
+func (m *DBModel) insertDataRequest(ctx context.Context, db execer, dr DataRequest) (int, error) {
+	email, err := m.seal(dr.Email)
+	if err != nil {
+		return 0, err
+	}
+
+	stmt := `
+	INSERT INTO data_requests
+		(kind, email, email_hash, customers, detail, actor, created_at, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+
+	result, err := db.ExecContext(ctx, stmt,
+		dr.Kind,
+		email,
+		m.emailHash(dr.Email),
+		dr.Customers,
+		dr.Detail,
+		dr.Actor,
+		time.Now(),
+		time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// CountCustomers returns the number of customer rows with an email address
+func (m *DBModel) CountCustomers(email string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var n int
+	stmt, args := m.bindEmail(`select count(*) from customers c where `+customerKey+` in `+emailKeyList, email)
+	err := m.DB.QueryRowContext(ctx, stmt, args...).Scan(&n)
+	return n, err
+}
+
+// erasedDomain is the domain of the addresses erased customers are known by
+const erasedDomain = "@erased.invalid"
+
+// ErasedEmail returns the address an erased customer is known by afterwards
+func ErasedEmail(requestID int) string {
+	return fmt.Sprintf("erased-%d%s", requestID, erasedDomain)
+}
+
+// isErasedEmail reports whether an address is one ErasedEmail returned
+func isErasedEmail(email string) bool {
+	return strings.HasSuffix(email, erasedDomain)
+}
+
+// erasures lists what erasing a customer changes, table by table. Amounts,
+// currencies, dates, products and payment references stay for the accounts;
+// names, addresses, card details, free text and email addresses go. Email
+// addresses are replaced by the pseudonym, and their hashes by its hash,
+// except on data_requests, whose blind index is kept so the erasure can be
+// found again by the address it erased. Customers are recorded as the actor of
+// what they did by CustomerActor, which needs no erasing, but rows written
+// before that hold their address.
+var erasures = []struct {
+	table string
+	set   string
+	where string
+}{
+	{"addresses", `name = '', line1 = '', line2 = '', city = '', postal_code = ''`, `customer_id in ` + customersOfEmail},
+	{"transactions", `last_four = '', expiry_month = 0, expiry_year = 0`,
+		`id in (select transaction_id from orders where customer_id in ` + customersOfEmail + `)`},
+	{"returns", `reason = ''`, `order_id in ` + ordersOfEmail},
+	{"return_events", `note = ''`, `return_id in (select id from returns where order_id in ` + ordersOfEmail + `)`},
+	{"return_events", `actor = ?`,
+		`return_id in (select id from returns where order_id in ` + ordersOfEmail + `) and lower(actor) in ` + emailKeyList},
+	{"inventory_movements", `actor = ?`, `order_id in ` + ordersOfEmail + ` and lower(actor) in ` + emailKeyList},
+	{"customer_merges", `first_name = '', last_name = '', email = ?, email_hash = ?`, emailKey("email_hash", "email") + ` in ` + emailKeyList},
+	{"email_log", `to_address = ?, to_hash = ?`, emailKey("to_hash", "to_address") + ` in ` + emailKeyList},
+	{"data_requests", `email = ?`, `email_hash in ` + emailKeyList},
+	{"customers", `first_name = 'Erased', last_name = '', email = ?, email_hash = ?`, customerKey + ` in ` + emailKeyList},
+}
+
+// EraseCustomer pseudonymizes everything held about the customer with an
+// email address, in one transaction, and records the erasure. The customer
+// rows and their orders are kept under the address ErasedEmail returns, and
+// notes about the customer are deleted. It returns the data request recorded.
+func (m *DBModel) EraseCustomer(email, actor string) (DataRequest, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	dr := DataRequest{Kind: DataRequestErase, Actor: actor}
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return dr, err
+	}
+	defer tx.Rollback()
+
+	stmt, args := m.bindEmail(`select count(*) from customers c where `+customerKey+` in `+emailKeyList+` for update`, email)
+	err = tx.QueryRowContext(ctx, stmt, args...).Scan(&dr.Customers)
+	if err != nil {
+		return dr, err
+	}
+
+	// recorded under the real address first, so the hash matches earlier
+	// requests; the address itself is replaced below
+	dr.Email = email
+	dr.ID, err = m.insertDataRequest(ctx, tx, dr)
+	if err != nil {
+		return dr, err
+	}
+	pseudonym := ErasedEmail(dr.ID)
+
+	var detail []string
+
+	stmt, args = m.bindEmail(`delete from customer_notes where customer_id in `+customersOfEmail, email)
+	res, err := tx.ExecContext(ctx, stmt, args...)
+	if err != nil {
+		return dr, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return dr, err
+	}
+	detail = append(detail, fmt.Sprintf("customer_notes: %d deleted", n))
+
+	for _, e := range erasures {
+		var args []interface{}
+		if strings.Contains(e.set, "?") {
+			args = append(args, pseudonym)
+		}
+		if strings.Contains(e.set, "_hash = ?") {
+			args = append(args, m.emailHash(pseudonym))
+		}
+		where, whereArgs := m.bindEmail(e.where, email)
+		args = append(args, whereArgs...)
+
+		res, err = tx.ExecContext(ctx, fmt.Sprintf("update %s set %s where %s", e.table, e.set, where), args...)
+		if err != nil {
+			return dr, err
+		}
+		n, err = res.RowsAffected()
+		if err != nil {
+			return dr, err
+		}
+		detail = append(detail, fmt.Sprintf("%s: %d erased", e.table, n))
+	}
+
+	dr.Email = pseudonym
+	dr.Detail = strings.Join(detail, "\n")
+
+	_, err = tx.ExecContext(ctx, `update data_requests set detail = ? where id = ?`, dr.Detail, dr.ID)
+	if err != nil {
+		return dr, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return dr, err
+	}
+
+	return dr, nil
+}
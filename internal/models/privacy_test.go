@@ -0,0 +1,50 @@
+package models
+
+import (
+	"database/sql/driver"
+	"strings"
+	"testing"
+)
+
+func TestEraseCustomerActors(t *testing.T) {
+	actors := make(map[string][]driver.Value)
+
+	f := &fakeDB{
+		exec: func(query string, args []driver.Value) (int64, error) {
+			if strings.Contains(query, "set actor = ?") {
+				table := strings.Fields(query)[1]
+				actors[table] = args
+			}
+			return 7, nil
+		},
+		query: func(query string, args []driver.Value) ([][]driver.Value, error) {
+			return [][]driver.Value{{int64(1)}}, nil
+		},
+	}
+	m := openFake(t, f)
+
+	dr, err := m.EraseCustomer("Jane@Example.com", "admin@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, table := range []string{"return_events", "inventory_movements"} {
+		args, ok := actors[table]
+		if !ok {
+			t.Errorf("%s actors are not erased", table)
+			continue
+		}
+		if args[0] != dr.Email {
+			t.Errorf("%s actor = %v, want the pseudonym %s", table, args[0], dr.Email)
+		}
+		found := false
+		for _, a := range args[1:] {
+			if a == "jane@example.com" {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%s actors are not matched by the address: %v", table, args)
+		}
+	}
+}
@@ -0,0 +1,464 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Shipping rate rules
+const (
+	RuleFlat     = "flat"
+	RuleWeight   = "weight"
+	RuleFreeOver = "free_over"
+)
+
+// restOfWorld is the country list of the zone used when no other zone matches
+const restOfWorld = "*"
+
+// ErrNoShippingRate is returned when a rate cannot be used for an order
+var ErrNoShippingRate = errors.New("shipping is not available to that destination")
+
+// ErrNoQuote is returned for a payment that was not priced for an order
+var ErrNoQuote = errors.New("payment has no order price")
+
+// ShippingZone is a model for the shipping_zones table. Countries is a comma
+// separated list of ISO country codes, or * for everywhere not otherwise covered.
+type ShippingZone struct {
+	ID        int             `json:"id"`
+	Name      string          `json:"name"`
+	Countries string          `json:"countries"`
+	CreatedAt time.Time       `json:"-"`
+	UpdatedAt time.Time       `json:"-"`
+	Rates     []*ShippingRate `json:"rates"`
+}
+
+// Covers reports whether the zone lists the country
+func (z ShippingZone) Covers(country string) bool {
+	for _, c := range strings.Split(z.Countries, ",") {
+		if strings.EqualFold(strings.TrimSpace(c), country) {
+			return true
+		}
+	}
+	return false
+}
+
+// ShippingRate is a model for the shipping_rates table. A flat rate costs
+// Amount; a weight rate costs Amount plus PerKg for every started kilogram; a
+// free_over rate costs Amount unless the subtotal is at least FreeOver. Rates
+// with a MaxWeightGrams only apply to parcels up to that weight.
+type ShippingRate struct {
+	ID             int       `json:"id"`
+	ZoneID         int       `json:"zone_id"`
+	Name           string    `json:"name"`
+	Rule           string    `json:"rule"`
+	Amount         int       `json:"amount"`
+	PerKg          int       `json:"per_kg"`
+	FreeOver       int       `json:"free_over"`
+	MaxWeightGrams int       `json:"max_weight_grams"`
+	CreatedAt      time.Time `json:"-"`
+	UpdatedAt      time.Time `json:"-"`
+}
+
+// ValidShippingRule reports whether r is one of the known rate rules
+func ValidShippingRule(r string) bool {
+	return r == RuleFlat || r == RuleWeight || r == RuleFreeOver
+}
+
+// Applies reports whether the rate can be used for a parcel of the given weight
+func (r ShippingRate) Applies(weightGrams int) bool {
+	return r.MaxWeightGrams == 0 || weightGrams <= r.MaxWeightGrams
+}
+
+// Cost returns the shipping charge for an order with the given subtotal and weight
+func (r ShippingRate) Cost(subtotal, weightGrams int) int {
+	switch r.Rule {
+	case RuleWeight:
+		kg := (weightGrams + 999) / 1000
+		return r.Amount + kg*r.PerKg
+	case RuleFreeOver:
+		if r.FreeOver > 0 && subtotal >= r.FreeOver {
+			return 0
+		}
+		return r.Amount
+	default:
+		return r.Amount
+	}
+}
+
+// ShippingQuote is the cost of shipping an order with one rate
+type ShippingQuote struct {
+	RateID int    `json:"rate_id"`
+	Name   string `json:"name"`
+	Amount int    `json:"amount"`
+}
+
+// OrderPrice is the server side price of an order, including shipping
+type OrderPrice struct {
+	MaizeID        int    `json:"maize_id"`
+	VariantID      int    `json:"variant_id"`
+	Country        string `json:"country"`
+	Subtotal       int    `json:"subtotal"`
+	ShippingRateID int    `json:"shipping_rate_id"`
+	ShippingMethod string `json:"shipping_method"`
+	Shipping       int    `json:"shipping"`
+	Total          int    `json:"total"`
+}
+
+// Metadata returns the price as payment metadata, so the order saved once the
+// payment succeeds is split the way it was quoted
+func (p OrderPrice) Metadata() map[string]string {
+	return map[string]string{
+		"maize_id":         strconv.Itoa(p.MaizeID),
+		"variant_id":       strconv.Itoa(p.VariantID),
+		"country":          p.Country,
+		"subtotal":         strconv.Itoa(p.Subtotal),
+		"shipping_rate_id": strconv.Itoa(p.ShippingRateID),
+		"shipping_method":  p.ShippingMethod,
+		"shipping":         strconv.Itoa(p.Shipping),
+	}
+}
+
+// QuotedPrice reads back a price stored with Metadata. It returns ErrNoQuote
+// if the metadata does not hold one.
+func QuotedPrice(metadata map[string]string) (OrderPrice, error) {
+	var p OrderPrice
+	var err error
+
+	ints := map[string]*int{
+		"maize_id":         &p.MaizeID,
+		"variant_id":       &p.VariantID,
+		"subtotal":         &p.Subtotal,
+		"shipping_rate_id": &p.ShippingRateID,
+		"shipping":         &p.Shipping,
+	}
+	for key, n := range ints {
+		*n, err = strconv.Atoi(metadata[key])
+		if err != nil {
+			return OrderPrice{}, ErrNoQuote
+		}
+	}
+
+	p.Country = metadata["country"]
+	p.ShippingMethod = metadata["shipping_method"]
+	p.Total = p.Subtotal + p.Shipping
+
+	return p, nil
+}
+
+// GetShippingZones returns every shipping zone along with its rates
+func (m *DBModel) GetShippingZones() ([]*ShippingZone, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var zones []*ShippingZone
+	byID := make(map[int]*ShippingZone)
+
+	rows, err := m.DB.QueryContext(ctx, `
+	select
+		id, name, countries, created_at, updated_at
+	from
+		shipping_zones
+	order by
+		countries = '*', name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var z ShippingZone
+		err = rows.Scan(
+			&z.ID,
+			&z.Name,
+			&z.Countries,
+			&z.CreatedAt,
+			&z.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		zones = append(zones, &z)
+		byID[z.ID] = &z
+	}
+
+	rRows, err := m.DB.QueryContext(ctx, `
+	select
+		id, zone_id, name, rule, amount, per_kg, free_over, max_weight_grams,
+		created_at, updated_at
+	from
+		shipping_rates
+	order by
+		amount, name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rRows.Close()
+
+	for rRows.Next() {
+		var r ShippingRate
+		err = rRows.Scan(
+			&r.ID,
+			&r.ZoneID,
+			&r.Name,
+			&r.Rule,
+			&r.Amount,
+			&r.PerKg,
+			&r.FreeOver,
+			&r.MaxWeightGrams,
+			&r.CreatedAt,
+			&r.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		if z, ok := byID[r.ZoneID]; ok {
+			z.Rates = append(z.Rates, &r)
+		}
+	}
+
+	return zones, nil
+}
+
+// zoneFor returns the zone that ships to a country, falling back to the rest of
+// the world zone, or nil when there is neither
+func zoneFor(zones []*ShippingZone, country string) *ShippingZone {
+	var fallback *ShippingZone
+	for _, z := range zones {
+		if z.Countries == restOfWorld {
+			fallback = z
+			continue
+		}
+		if z.Covers(country) {
+			return z
+		}
+	}
+	return fallback
+}
+
+// QuoteShipping returns the cost of every rate that can ship an order with the
+// given subtotal and weight to the country
+func (m *DBModel) QuoteShipping(country string, subtotal, weightGrams int) ([]ShippingQuote, error) {
+	zones, err := m.GetShippingZones()
+	if err != nil {
+		return nil, err
+	}
+
+	var quotes []ShippingQuote
+
+	zone := zoneFor(zones, country)
+	if zone == nil {
+		return quotes, nil
+	}
+
+	for _, r := range zone.Rates {
+		if !r.Applies(weightGrams) {
+			continue
+		}
+		quotes = append(quotes, ShippingQuote{
+			RateID: r.ID,
+			Name:   r.Name,
+			Amount: r.Cost(subtotal, weightGrams),
+		})
+	}
+
+	return quotes, nil
+}
+
+// ShippingOptions returns the subtotal for quantity units of a maize, or of
+// one of its variants, and the shipping options for sending them to country.
+// Prices always come from the database, never from the client.
+func (m *DBModel) ShippingOptions(maizeID, variantID, quantity int, country string) (int, []ShippingQuote, error) {
+	maize, err := m.GetMaize(maizeID)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	unit := maize.Price
+	if variantID > 0 {
+		variant, err := m.GetVariant(variantID)
+		if err != nil {
+			return 0, nil, err
+		}
+		if variant.MaizeID != maize.ID {
+			return 0, nil, errors.New("variant does not belong to product")
+		}
+		unit = variant.PriceFor(maize)
+	}
+
+	subtotal := unit * quantity
+
+	quotes, err := m.QuoteShipping(country, subtotal, maize.WeightGrams*quantity)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return subtotal, quotes, nil
+}
+
+// PriceOrder works out what to charge for quantity units of a maize, or of one
+// of its variants, shipped to country with the chosen rate. ErrNoShippingRate
+// is returned when the rate cannot ship the order to the country.
+func (m *DBModel) PriceOrder(maizeID, variantID, quantity, rateID int, country string) (OrderPrice, error) {
+	var price OrderPrice
+
+	subtotal, quotes, err := m.ShippingOptions(maizeID, variantID, quantity, country)
+	if err != nil {
+		return price, err
+	}
+
+	for _, q := range quotes {
+		if q.RateID == rateID {
+			price.MaizeID = maizeID
+			price.VariantID = variantID
+			price.Country = strings.ToUpper(country)
+			price.Subtotal = subtotal
+			price.ShippingRateID = q.RateID
+			price.ShippingMethod = q.Name
+			price.Shipping = q.Amount
+			price.Total = subtotal + q.Amount
+			return price, nil
+		}
+	}
+
+	return price, ErrNoShippingRate
+}
+
+// InsertShippingZone inserts a new shipping zone
+func (m *DBModel) InsertShippingZone(z ShippingZone) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+	INSERT INTO shipping_zones (name, countries, created_at, updated_at)
+	VALUES (?, ?, ?, ?)`
+
+	result, err := m.DB.ExecContext(ctx, stmt, z.Name, normalizeCountries(z.Countries), time.Now(), time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// UpdateShippingZone updates an existing shipping zone
+func (m *DBModel) UpdateShippingZone(z ShippingZone) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `update shipping_zones set name = ?, countries = ?, updated_at = ? where id = ?`
+
+	_, err := m.DB.ExecContext(ctx, stmt, z.Name, normalizeCountries(z.Countries), time.Now(), z.ID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteShippingZone deletes a shipping zone along with its rates
+func (m *DBModel) DeleteShippingZone(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from shipping_zones where id = ?`, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// InsertShippingRate inserts a new rate into a shipping zone
+func (m *DBModel) InsertShippingRate(r ShippingRate) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+	INSERT INTO shipping_rates
+		(zone_id, name, rule, amount, per_kg, free_over, max_weight_grams, created_at, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	result, err := m.DB.ExecContext(ctx, stmt,
+		r.ZoneID,
+		r.Name,
+		r.Rule,
+		r.Amount,
+		r.PerKg,
+		r.FreeOver,
+		r.MaxWeightGrams,
+		time.Now(),
+		time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// UpdateShippingRate updates an existing shipping rate
+func (m *DBModel) UpdateShippingRate(r ShippingRate) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+	update shipping_rates set
+		name = ?, rule = ?, amount = ?, per_kg = ?, free_over = ?, max_weight_grams = ?,
+		updated_at = ?
+	where id = ? and zone_id = ?`
+
+	_, err := m.DB.ExecContext(ctx, stmt,
+		r.Name,
+		r.Rule,
+		r.Amount,
+		r.PerKg,
+		r.FreeOver,
+		r.MaxWeightGrams,
+		time.Now(),
+		r.ID,
+		r.ZoneID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteShippingRate deletes a shipping rate
+func (m *DBModel) DeleteShippingRate(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from shipping_rates where id = ?`, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// normalizeCountries upper cases a comma separated country list and strips spaces
+func normalizeCountries(countries string) string {
+	var list []string
+	for _, c := range strings.Split(countries, ",") {
+		c = strings.ToUpper(strings.TrimSpace(c))
+		if c != "" {
+			list = append(list, c)
+		}
+	}
+	return strings.Join(list, ",")
+}
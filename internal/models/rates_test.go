@@ -0,0 +1,37 @@
+package models
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestQuotedPrice(t *testing.T) {
+	quoted := OrderPrice{
+		MaizeID:        4,
+		VariantID:      9,
+		Country:        "CA",
+		Subtotal:       1500,
+		ShippingRateID: 2,
+		ShippingMethod: "Standard",
+		Shipping:       700,
+		Total:          2200,
+	}
+
+	got, err := QuotedPrice(quoted.Metadata())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != quoted {
+		t.Errorf("QuotedPrice = %+v, want %+v", got, quoted)
+	}
+
+	_, err = QuotedPrice(map[string]string{"subtotal": "1500"})
+	if !errors.Is(err, ErrNoQuote) {
+		t.Errorf("err = %v, want ErrNoQuote", err)
+	}
+
+	_, err = QuotedPrice(nil)
+	if !errors.Is(err, ErrNoQuote) {
+		t.Errorf("err = %v, want ErrNoQuote for a payment without metadata", err)
+	}
+}
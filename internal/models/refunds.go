@@ -0,0 +1,68 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// Refund is a model for the refunds table, the ledger of money given back
+// to customers. An order may have several partial refunds.
+type Refund struct {
+	ID            int       `json:"id"`
+	OrderID       int       `json:"order_id"`
+	TransactionID int       `json:"transaction_id"`
+	Amount        int       `json:"amount"`
+	Currency      string    `json:"currency"`
+	Reason        string    `json:"reason"`
+	Actor         string    `json:"actor"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// InsertRefund records money refunded to a customer
+func (m *DBModel) InsertRefund(rf Refund) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	now := time.Now()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	stmt := `
+	INSERT INTO refunds
+		(order_id, transaction_id, amount, currency, reason, actor, created_at, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+
+	result, err := tx.ExecContext(ctx, stmt,
+		rf.OrderID,
+		rf.TransactionID,
+		rf.Amount,
+		rf.Currency,
+		rf.Reason,
+		rf.Actor,
+		now,
+		now)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	err = m.refreshOrderDay(ctx, tx, rf.OrderID, now)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
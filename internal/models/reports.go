@@ -0,0 +1,567 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"time"
+)
+
+// Report intervals
+const (
+	IntervalDay   = "day"
+	IntervalWeek  = "week"
+	IntervalMonth = "month"
+)
+
+// ReportRange is a range of whole days in a time zone, reported on in periods
+// of a day, a week starting on Monday, or a calendar month
+type ReportRange struct {
+	From     time.Time // midnight starting the first day
+	To       time.Time // midnight ending the last day
+	Interval string
+	Location *time.Location
+}
+
+// NewReportRange returns the range from the first to the last day, both
+// inclusive, in loc
+func NewReportRange(first, last time.Time, interval string, loc *time.Location) ReportRange {
+	y, m, d := first.Date()
+	from := time.Date(y, m, d, 0, 0, 0, 0, loc)
+	y, m, d = last.Date()
+	to := time.Date(y, m, d, 0, 0, 0, 0, loc).AddDate(0, 0, 1)
+
+	return ReportRange{
+		From:     from,
+		To:       to,
+		Interval: interval,
+		Location: loc,
+	}
+}
+
+// periodStart returns the start of the period t falls in
+func (rr ReportRange) periodStart(t time.Time) time.Time {
+	y, m, d := t.In(rr.Location).Date()
+
+	switch rr.Interval {
+	case IntervalMonth:
+		return time.Date(y, m, 1, 0, 0, 0, 0, rr.Location)
+	case IntervalWeek:
+		day := time.Date(y, m, d, 0, 0, 0, 0, rr.Location)
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	default:
+		return time.Date(y, m, d, 0, 0, 0, 0, rr.Location)
+	}
+}
+
+// nextPeriod returns the start of the period after the one starting at p
+func (rr ReportRange) nextPeriod(p time.Time) time.Time {
+	switch rr.Interval {
+	case IntervalMonth:
+		return p.AddDate(0, 1, 0)
+	case IntervalWeek:
+		return p.AddDate(0, 0, 7)
+	default:
+		return p.AddDate(0, 0, 1)
+	}
+}
+
+// Periods returns the starts of the periods the range covers. The first and
+// last periods may reach outside the range.
+func (rr ReportRange) Periods() []time.Time {
+	var periods []time.Time
+	for p := rr.periodStart(rr.From); p.Before(rr.To); p = rr.nextPeriod(p) {
+		periods = append(periods, p)
+	}
+	return periods
+}
+
+// period returns the label of the period t falls in
+func (rr ReportRange) period(t time.Time) string {
+	return rr.periodStart(t).Format("2006-01-02")
+}
+
+// paidTransactionStatuses are the statuses of transactions that took money,
+// whether or not some of it was refunded later
+var paidTransactionStatuses = []interface{}{TransactionCleared, TransactionRefunded, TransactionPartiallyRefunded}
+
+// RevenuePoint is the revenue in one currency over one period. Gross is what
+// orders placed in the period took, Refunds what was refunded in the period.
+type RevenuePoint struct {
+	Period            string `json:"period"`
+	Currency          string `json:"currency"`
+	Orders            int    `json:"orders"`
+	Gross             int    `json:"gross"`
+	Refunds           int    `json:"refunds"`
+	Net               int    `json:"net"`
+	AverageOrderValue int    `json:"average_order_value"`
+}
+
+// SubscriptionPoint is the movement of subscriptions in one currency over one
+// period. Active and MRR are as at the end of the period; subscriptions are
+// billed monthly, so MRR is the sum of their amounts.
+type SubscriptionPoint struct {
+	Period   string `json:"period"`
+	Currency string `json:"currency"`
+	New      int    `json:"new"`
+	Churned  int    `json:"churned"`
+	Active   int    `json:"active"`
+	MRR      int    `json:"mrr"`
+}
+
+// ProductReport is what one product sold in one currency over a range.
+// Refunds are those made in the range.
+type ProductReport struct {
+	MaizeID  int    `json:"maize_id"`
+	Name     string `json:"name"`
+	Currency string `json:"currency"`
+	Orders   int    `json:"orders"`
+	Units    int    `json:"units"`
+	Gross    int    `json:"gross"`
+	Refunds  int    `json:"refunds"`
+	Net      int    `json:"net"`
+}
+
+// currencySeries holds a value per period for each currency seen, so that
+// every currency gets a point for every period, even an empty one
+type currencySeries struct {
+	rr     ReportRange
+	points map[string]map[string]interface{}
+	blank  func(period, currency string) interface{}
+}
+
+func newCurrencySeries(rr ReportRange, blank func(period, currency string) interface{}) *currencySeries {
+	return &currencySeries{
+		rr:     rr,
+		points: make(map[string]map[string]interface{}),
+		blank:  blank,
+	}
+}
+
+// at returns the point of currency for the period starting at p
+func (s *currencySeries) at(currency string, p time.Time) interface{} {
+	byPeriod, ok := s.points[currency]
+	if !ok {
+		byPeriod = make(map[string]interface{})
+		for _, period := range s.rr.Periods() {
+			label := period.Format("2006-01-02")
+			byPeriod[label] = s.blank(label, currency)
+		}
+		s.points[currency] = byPeriod
+	}
+	return byPeriod[s.rr.period(p)]
+}
+
+// each calls fn with every point, by currency and then by period
+func (s *currencySeries) each(fn func(interface{})) {
+	var currencies []string
+	for c := range s.points {
+		currencies = append(currencies, c)
+	}
+	sort.Strings(currencies)
+
+	periods := s.rr.Periods()
+	for _, c := range currencies {
+		for _, p := range periods {
+			fn(s.points[c][p.Format("2006-01-02")])
+		}
+	}
+}
+
+// RevenueReport returns gross and net revenue, refunds and the average order
+// value for each period of the range, per currency. Ranges in the time zone
+// of the daily summaries are read from them; others from the orders.
+func (m *DBModel) RevenueReport(rr ReportRange) ([]*RevenuePoint, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	series := newCurrencySeries(rr, func(period, currency string) interface{} {
+		return &RevenuePoint{Period: period, Currency: currency}
+	})
+
+	add := func(currency string, at time.Time, orders, gross, refunds int) {
+		p := series.at(currency, at).(*RevenuePoint)
+		p.Orders += orders
+		p.Gross += gross
+		p.Refunds += refunds
+	}
+
+	var err error
+	if m.usesSummaries(rr) {
+		err = m.eachSummaryDay(ctx, rr.From, rr.To, func(s summaryDay) {
+			add(s.currency, s.day, s.orders, s.gross, s.refunds)
+		})
+	} else {
+		err = m.scanRevenue(ctx, rr, add)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var points []*RevenuePoint
+	series.each(func(v interface{}) {
+		p := v.(*RevenuePoint)
+		p.Net = p.Gross - p.Refunds
+		if p.Orders > 0 {
+			p.AverageOrderValue = p.Gross / p.Orders
+		}
+		points = append(points, p)
+	})
+
+	return points, nil
+}
+
+// scanRevenue calls add with every paid order placed, and every refund made,
+// in the range
+func (m *DBModel) scanRevenue(ctx context.Context, rr ReportRange, add func(currency string, at time.Time, orders, gross, refunds int)) error {
+	stmt := `
+	select
+		o.created_at, t.amount, t.currency
+	from
+		orders o
+			join transactions t on (o.transaction_id = t.id)
+	where
+		o.created_at >= ? and o.created_at < ?
+		and t.transaction_status_id in (?, ?, ?)`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, append([]interface{}{rr.From, rr.To}, paidTransactionStatuses...)...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var at time.Time
+		var amount int
+		var currency string
+		err = rows.Scan(&at, &amount, &currency)
+		if err != nil {
+			return err
+		}
+
+		add(currency, at, 1, amount, 0)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = m.DB.QueryContext(ctx,
+		`select created_at, amount, currency from refunds where created_at >= ? and created_at < ?`,
+		rr.From, rr.To)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var at time.Time
+		var amount int
+		var currency string
+		err = rows.Scan(&at, &amount, &currency)
+		if err != nil {
+			return err
+		}
+
+		add(currency, at, 0, 0, amount)
+	}
+
+	return rows.Err()
+}
+
+// subscriptionMovement is what happened to the subscriptions of one currency
+// over one period
+type subscriptionMovement struct {
+	currency   string
+	at         time.Time
+	added      int
+	mrrAdded   int
+	churned    int
+	mrrChurned int
+}
+
+// SubscriptionReport returns new and churned subscriptions for each period of
+// the range, with the active subscriptions and MRR at its end, per currency.
+// Ranges in the time zone of the daily summaries are read from them; others
+// from the orders.
+func (m *DBModel) SubscriptionReport(rr ReportRange) ([]*SubscriptionPoint, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var moves []subscriptionMovement
+	var err error
+	if m.usesSummaries(rr) {
+		moves, err = m.summarySubscriptionMoves(ctx, rr)
+	} else {
+		moves, err = m.scanSubscriptionMoves(ctx, rr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	series := newCurrencySeries(rr, func(period, currency string) interface{} {
+		return &SubscriptionPoint{Period: period, Currency: currency}
+	})
+
+	// moves before the range are filed under its first period, but only count
+	// towards the subscriptions active at its end
+	for _, mv := range moves {
+		at := mv.at
+		if at.Before(rr.From) {
+			at = rr.From
+		}
+		p := series.at(mv.currency, at).(*SubscriptionPoint)
+		p.Active += mv.added - mv.churned
+		p.MRR += mv.mrrAdded - mv.mrrChurned
+		if !mv.at.Before(rr.From) {
+			p.New += mv.added
+			p.Churned += mv.churned
+		}
+	}
+
+	var points []*SubscriptionPoint
+	var last *SubscriptionPoint
+	series.each(func(v interface{}) {
+		p := v.(*SubscriptionPoint)
+		// Active and MRR carry over from the period before, in the same currency
+		if last != nil && last.Currency == p.Currency {
+			p.Active += last.Active
+			p.MRR += last.MRR
+		}
+		last = p
+		points = append(points, p)
+	})
+
+	return points, nil
+}
+
+// scanSubscriptionMoves reads the subscriptions started and cancelled up to
+// the end of the range from the orders
+func (m *DBModel) scanSubscriptionMoves(ctx context.Context, rr ReportRange) ([]subscriptionMovement, error) {
+	// subscriptions cancelled before their history was kept count as cancelled
+	// when the order was last updated
+	stmt := `
+	select
+		o.created_at, t.amount, t.currency,
+		coalesce(
+			(select max(h.created_at) from order_status_history h
+				where h.order_id = o.id and h.to_status_id = ?),
+			case when o.status_id = ? then o.updated_at end)
+	from
+		orders o
+			join maize m on (o.maize_id = m.id)
+			join transactions t on (o.transaction_id = t.id)
+	where
+		m.is_recurring = 1 and o.created_at < ?
+		and t.transaction_status_id in (?, ?, ?)`
+
+	args := append([]interface{}{StatusCancelled, StatusCancelled, rr.To}, paidTransactionStatuses...)
+
+	rows, err := m.DB.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var moves []subscriptionMovement
+
+	for rows.Next() {
+		var created time.Time
+		var cancelled sql.NullTime
+		var amount int
+		var currency string
+		err = rows.Scan(&created, &amount, &currency, &cancelled)
+		if err != nil {
+			return nil, err
+		}
+
+		moves = append(moves, subscriptionMovement{
+			currency: currency,
+			at:       created,
+			added:    1,
+			mrrAdded: amount,
+		})
+
+		if cancelled.Valid && cancelled.Time.Before(rr.To) {
+			moves = append(moves, subscriptionMovement{
+				currency:   currency,
+				at:         cancelled.Time,
+				churned:    1,
+				mrrChurned: amount,
+			})
+		}
+	}
+
+	return moves, rows.Err()
+}
+
+// summarySubscriptionMoves reads the subscriptions started and cancelled up to
+// the end of the range from the daily summaries, with those before the range
+// added up into one per currency
+func (m *DBModel) summarySubscriptionMoves(ctx context.Context, rr ReportRange) ([]subscriptionMovement, error) {
+	var moves []subscriptionMovement
+
+	stmt := `
+	select
+		s.currency, sum(s.orders), sum(s.gross), sum(s.churned_subs), sum(s.mrr_churned)
+	from
+		daily_sales_summary s
+			join maize m on (s.maize_id = m.id)
+	where
+		m.is_recurring = 1 and s.day < ?
+	group by
+		s.currency`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, rr.From.Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		mv := subscriptionMovement{at: rr.From.AddDate(0, 0, -1)}
+		err = rows.Scan(&mv.currency, &mv.added, &mv.mrrAdded, &mv.churned, &mv.mrrChurned)
+		if err != nil {
+			return nil, err
+		}
+		moves = append(moves, mv)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	err = m.eachSummaryDay(ctx, rr.From, rr.To, func(s summaryDay) {
+		if !s.recurring {
+			return
+		}
+		moves = append(moves, subscriptionMovement{
+			currency:   s.currency,
+			at:         s.day,
+			added:      s.orders,
+			mrrAdded:   s.gross,
+			churned:    s.churnedSubs,
+			mrrChurned: s.mrrChurned,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return moves, nil
+}
+
+// TopProducts returns the products that took the most net revenue in the
+// range, best first, at most limit of them. Revenue is that of the orders
+// placed in the range, less the refunds made in it.
+func (m *DBModel) TopProducts(rr ReportRange, limit int) ([]*ProductReport, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if m.usesSummaries(rr) {
+		return m.summaryTopProducts(ctx, rr, limit)
+	}
+
+	var products []*ProductReport
+
+	stmt := `
+	select
+		maize_id, name, currency, sum(orders), sum(units), sum(gross), sum(refunds)
+	from (
+		select
+			m.id as maize_id, m.name, t.currency, 1 as orders, o.quantity as units,
+			t.amount as gross, 0 as refunds
+		from
+			orders o
+				join maize m on (o.maize_id = m.id)
+				join transactions t on (o.transaction_id = t.id)
+		where
+			o.created_at >= ? and o.created_at < ?
+			and t.transaction_status_id in (?, ?, ?)
+		union all
+		select
+			m.id, m.name, rf.currency, 0, 0, 0, rf.amount
+		from
+			refunds rf
+				join orders o on (rf.order_id = o.id)
+				join maize m on (o.maize_id = m.id)
+		where
+			rf.created_at >= ? and rf.created_at < ?
+	) activity
+	group by
+		maize_id, name, currency
+	order by
+		sum(gross) - sum(refunds) desc, maize_id
+	limit ?`
+
+	args := append([]interface{}{rr.From, rr.To}, paidTransactionStatuses...)
+	args = append(args, rr.From, rr.To, limit)
+
+	rows, err := m.DB.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p ProductReport
+		err = rows.Scan(
+			&p.MaizeID,
+			&p.Name,
+			&p.Currency,
+			&p.Orders,
+			&p.Units,
+			&p.Gross,
+			&p.Refunds,
+		)
+		if err != nil {
+			return nil, err
+		}
+		p.Net = p.Gross - p.Refunds
+
+		products = append(products, &p)
+	}
+
+	return products, rows.Err()
+}
+
+// summaryTopProducts adds up the daily summaries of each product in the range
+// for TopProducts
+func (m *DBModel) summaryTopProducts(ctx context.Context, rr ReportRange, limit int) ([]*ProductReport, error) {
+	type key struct {
+		maizeID  int
+		currency string
+	}
+
+	totals := make(map[key]*ProductReport)
+	var products []*ProductReport
+
+	err := m.eachSummaryDay(ctx, rr.From, rr.To, func(s summaryDay) {
+		k := key{s.maizeID, s.currency}
+		p, ok := totals[k]
+		if !ok {
+			p = &ProductReport{MaizeID: s.maizeID, Name: s.name, Currency: s.currency}
+			totals[k] = p
+			products = append(products, p)
+		}
+		p.Orders += s.orders
+		p.Units += s.units
+		p.Gross += s.gross
+		p.Refunds += s.refunds
+		p.Net = p.Gross - p.Refunds
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(products, func(i, j int) bool {
+		if products[i].Net != products[j].Net {
+			return products[i].Net > products[j].Net
+		}
+		return products[i].MaizeID < products[j].MaizeID
+	})
+
+	if len(products) > limit {
+		products = products[:limit]
+	}
+
+	return products, nil
+}
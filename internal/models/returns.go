@@ -0,0 +1,350 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Return statuses. A return is requested, approved with a return label,
+// received back into stock and then refunded; it may be rejected before the
+// goods are received. It is refunding from when its refund is claimed until
+// the refund has been issued.
+const (
+	ReturnRequested = "requested"
+	ReturnApproved  = "approved"
+	ReturnReceived  = "received"
+	ReturnRefunding = "refunding"
+	ReturnRefunded  = "refunded"
+	ReturnRejected  = "rejected"
+)
+
+// returnTransitions lists the statuses a return may move to from each status
+var returnTransitions = map[string][]string{
+	ReturnRequested: {ReturnApproved, ReturnRejected},
+	ReturnApproved:  {ReturnReceived, ReturnRejected},
+	ReturnReceived:  {ReturnRefunding},
+	ReturnRefunding: {ReturnRefunded},
+}
+
+// ErrReturnTransition is returned when a return cannot move to the requested status
+var ErrReturnTransition = errors.New("return cannot be moved to that status")
+
+// Return is a model for the returns table
+type Return struct {
+	ID           int            `json:"id"`
+	OrderID      int            `json:"order_id"`
+	Quantity     int            `json:"quantity"`
+	Reason       string         `json:"reason"`
+	Status       string         `json:"status"`
+	RefundAmount int            `json:"refund_amount"`
+	LabelURL     string         `json:"label_url"`
+	CreatedAt    time.Time      `json:"created_at"`
+	UpdatedAt    time.Time      `json:"updated_at"`
+	Order        Order          `json:"order"`
+	Events       []*ReturnEvent `json:"events,omitempty"`
+}
+
+// ReturnEvent is a model for the return_events table, recording every change
+// to the status of a return
+type ReturnEvent struct {
+	ID         int       `json:"id"`
+	ReturnID   int       `json:"return_id"`
+	FromStatus string    `json:"from_status"`
+	ToStatus   string    `json:"to_status"`
+	Actor      string    `json:"actor"`
+	Note       string    `json:"note"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// CanMoveTo reports whether the return may move to status from its current status
+func (rt Return) CanMoveTo(status string) bool {
+	for _, s := range returnTransitions[rt.Status] {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// insertReturnEvent records a change of status of a return
+func insertReturnEvent(ctx context.Context, tx *sql.Tx, returnID int, from, to, actor, note string) error {
+	stmt := `
+	INSERT INTO return_events
+		(return_id, from_status, to_status, actor, note, created_at, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?)`
+
+	_, err := tx.ExecContext(ctx, stmt, returnID, from, to, actor, note, time.Now(), time.Now())
+	return err
+}
+
+// InsertReturn opens a new return request and records who opened it
+func (m *DBModel) InsertReturn(rt Return, actor string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	stmt := `
+	INSERT INTO returns
+		(order_id, quantity, reason, status, created_at, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?)`
+
+	result, err := tx.ExecContext(ctx, stmt,
+		rt.OrderID,
+		rt.Quantity,
+		rt.Reason,
+		ReturnRequested,
+		time.Now(),
+		time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	err = insertReturnEvent(ctx, tx, int(id), "", ReturnRequested, actor, rt.Reason)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// TransitionReturn moves a return from its current status to a new one, saving
+// its label URL and refund amount and recording the change. ErrReturnTransition
+// is returned when the move is not allowed, or when the return has been changed
+// by someone else in the meantime.
+func (m *DBModel) TransitionReturn(rt Return, to, actor, note string) error {
+	if !rt.CanMoveTo(to) {
+		return ErrReturnTransition
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `
+	update returns set
+		status = ?, label_url = ?, refund_amount = ?, updated_at = ?
+	where
+		id = ? and status = ?`
+
+	result, err := tx.ExecContext(ctx, stmt,
+		to,
+		rt.LabelURL,
+		rt.RefundAmount,
+		time.Now(),
+		rt.ID,
+		rt.Status)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrReturnTransition
+	}
+
+	err = insertReturnEvent(ctx, tx, rt.ID, rt.Status, to, actor, note)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// returnSelect is the query shared by GetReturn and GetReturns
+const returnSelect = `
+	select
+		r.id, r.order_id, r.quantity, r.reason, r.status, r.refund_amount,
+		coalesce(r.label_url, ''), r.created_at, r.updated_at,
+		o.id, o.maize_id, o.customer_id, o.status_id, o.quantity, o.amount,
+		coalesce(o.variant_id, 0), coalesce(o.shipping_address_id, 0),
+		m.name, coalesce(v.name, ''), coalesce(v.sku, ''),
+		t.id, t.amount, t.currency, t.payment_intent,
+		c.first_name, c.last_name, c.email
+	from
+		returns r
+			left join orders o on (r.order_id = o.id)
+			left join maize m on (o.maize_id = m.id)
+			left join maize_variants v on (o.variant_id = v.id)
+			left join transactions t on (o.transaction_id = t.id)
+			left join customers c on (o.customer_id = c.id)`
+
+// scanReturn scans a row selected by returnSelect
+func (m *DBModel) scanReturn(row interface{ Scan(...interface{}) error }) (Return, error) {
+	var rt Return
+	err := row.Scan(
+		&rt.ID,
+		&rt.OrderID,
+		&rt.Quantity,
+		&rt.Reason,
+		&rt.Status,
+		&rt.RefundAmount,
+		&rt.LabelURL,
+		&rt.CreatedAt,
+		&rt.UpdatedAt,
+		&rt.Order.ID,
+		&rt.Order.MaizeID,
+		&rt.Order.CustomerID,
+		&rt.Order.StatusID,
+		&rt.Order.Quantity,
+		&rt.Order.Amount,
+		&rt.Order.VariantID,
+		&rt.Order.ShippingAddressID,
+		&rt.Order.Maize.Name,
+		&rt.Order.Variant.Name,
+		&rt.Order.Variant.SKU,
+		&rt.Order.Transaction.ID,
+		&rt.Order.Transaction.Amount,
+		&rt.Order.Transaction.Currency,
+		&rt.Order.Transaction.PaymentIntent,
+		&rt.Order.Customer.FirstName,
+		&rt.Order.Customer.LastName,
+		&rt.Order.Customer.Email,
+	)
+	if err != nil {
+		return rt, err
+	}
+	rt.Order.TransactionID = rt.Order.Transaction.ID
+
+	err = m.openCustomer(&rt.Order.Customer)
+	return rt, err
+}
+
+// GetReturn returns a single return by ID along with its order and history
+func (m *DBModel) GetReturn(id int) (Return, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rt, err := m.scanReturn(m.DB.QueryRowContext(ctx, returnSelect+` where r.id = ?`, id))
+	if err != nil {
+		return rt, err
+	}
+
+	rt.Events, err = m.GetReturnEvents(id)
+	if err != nil {
+		return rt, err
+	}
+
+	return rt, nil
+}
+
+// GetReturns returns all returns with the given status, or every return when
+// status is empty, newest first
+func (m *DBModel) GetReturns(status string) ([]*Return, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var returns []*Return
+
+	rows, err := m.DB.QueryContext(ctx,
+		returnSelect+` where (? = '' or r.status = ?) order by r.created_at desc, r.id desc`,
+		status, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		rt, err := m.scanReturn(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		returns = append(returns, &rt)
+	}
+
+	return returns, nil
+}
+
+// GetReturnEvents returns the status history of a return, oldest first
+func (m *DBModel) GetReturnEvents(returnID int) ([]*ReturnEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var events []*ReturnEvent
+
+	stmt := `
+	select
+		id, return_id, from_status, to_status, actor, note, created_at
+	from
+		return_events
+	where
+		return_id = ?
+	order by
+		created_at, id`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, returnID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e ReturnEvent
+		err = rows.Scan(
+			&e.ID,
+			&e.ReturnID,
+			&e.FromStatus,
+			&e.ToStatus,
+			&e.Actor,
+			&e.Note,
+			&e.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, &e)
+	}
+
+	return events, nil
+}
+
+// ReturnedQuantity returns how many units of an order are covered by returns
+// that have not been rejected, and how many of those have been refunded
+func (m *DBModel) ReturnedQuantity(orderID int) (int, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var open, refunded int
+
+	stmt := `
+	select
+		coalesce(sum(quantity), 0),
+		coalesce(sum(case when status = ? then quantity else 0 end), 0)
+	from
+		returns
+	where
+		order_id = ? and status <> ?`
+
+	err := m.DB.QueryRowContext(ctx, stmt, ReturnRefunded, orderID, ReturnRejected).Scan(&open, &refunded)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return open, refunded, nil
+}
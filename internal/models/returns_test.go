@@ -0,0 +1,38 @@
+package models
+
+import (
+	"database/sql/driver"
+	"errors"
+	"testing"
+)
+
+func TestReturnRefundIsClaimedFirst(t *testing.T) {
+	rt := Return{ID: 3, Status: ReturnReceived}
+
+	if rt.CanMoveTo(ReturnRefunded) {
+		t.Error("a received return can be refunded without being claimed")
+	}
+	if !rt.CanMoveTo(ReturnRefunding) {
+		t.Error("a received return cannot start refunding")
+	}
+}
+
+func TestTransitionReturnLostRace(t *testing.T) {
+	// another request moved the return on, so the update matches no row
+	f := &fakeDB{
+		exec: func(query string, args []driver.Value) (int64, error) {
+			return 0, nil
+		},
+	}
+	m := openFake(t, f)
+
+	err := m.TransitionReturn(Return{ID: 3, Status: ReturnReceived}, ReturnRefunding, "admin@example.com", "")
+	if !errors.Is(err, ErrReturnTransition) {
+		t.Fatalf("err = %v, want ErrReturnTransition", err)
+	}
+
+	want := "begin\nupdate returns set\nrollback"
+	if got := statements(f.log); got != want {
+		t.Errorf("statements:\n%s\nwant:\n%s", got, want)
+	}
+}
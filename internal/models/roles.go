@@ -0,0 +1,366 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Permissions, as named in the permissions table. Roles grant them to users.
+const (
+	PermOrdersRead         = "orders:read"
+	PermOrdersWrite        = "orders:write"
+	PermRefundsWrite       = "refunds:write"
+	PermSubscriptionsWrite = "subscriptions:write"
+	PermTerminalCharge     = "terminal:charge"
+	PermReportsRead        = "reports:read"
+	PermExportsRead        = "exports:read"
+	PermReturnsRead        = "returns:read"
+	PermReturnsWrite       = "returns:write"
+	PermCustomersRead      = "customers:read"
+	PermCustomersWrite     = "customers:write"
+	PermCustomersPrivacy   = "customers:privacy"
+	PermCatalogRead        = "catalog:read"
+	PermCatalogWrite       = "catalog:write"
+	PermUsersRead          = "users:read"
+	PermUsersWrite         = "users:write"
+	PermAPIKeysWrite       = "api-keys:write"
+)
+
+// RoleAdmin is the role that grants every permission. At least one user
+// always has it, so there is always someone who can assign roles.
+const RoleAdmin = "admin"
+
+// ErrLastAdmin is returned when a change would leave no user with RoleAdmin
+var ErrLastAdmin = errors.New("at least one user must keep the admin role")
+
+// ErrUnknownRole is returned when a role to assign does not exist
+var ErrUnknownRole = errors.New("no such role")
+
+// Role is a model for the roles table, with the names of its permissions
+type Role struct {
+	ID          int      `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+// Permission is a model for the permissions table
+type Permission struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// GetPermissions returns every permission, ordered by name
+func (m *DBModel) GetPermissions() ([]*Permission, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var perms []*Permission
+
+	rows, err := m.DB.QueryContext(ctx, `select id, name, description from permissions order by name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p Permission
+		err = rows.Scan(
+			&p.ID,
+			&p.Name,
+			&p.Description,
+		)
+		if err != nil {
+			return nil, err
+		}
+		perms = append(perms, &p)
+	}
+
+	return perms, rows.Err()
+}
+
+// GetRoles returns every role with its permissions, ordered by ID
+func (m *DBModel) GetRoles() ([]*Role, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var roles []*Role
+
+	stmt := `
+	select
+		r.id, r.name, r.description, coalesce(p.name, '')
+	from
+		roles r
+		left join role_permissions rp on (rp.role_id = r.id)
+		left join permissions p on (p.id = rp.permission_id)
+	order by r.id, p.name`
+
+	rows, err := m.DB.QueryContext(ctx, stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r Role
+		var perm string
+		err = rows.Scan(
+			&r.ID,
+			&r.Name,
+			&r.Description,
+			&perm,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(roles) == 0 || roles[len(roles)-1].ID != r.ID {
+			r.Permissions = []string{}
+			roles = append(roles, &r)
+		}
+		if perm != "" {
+			last := roles[len(roles)-1]
+			last.Permissions = append(last.Permissions, perm)
+		}
+	}
+
+	return roles, rows.Err()
+}
+
+// GetUserRoles returns the names of the roles a user has
+func (m *DBModel) GetUserRoles(userID int) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	roles := []string{}
+
+	stmt := `
+	select
+		r.name
+	from
+		user_roles ur
+		left join roles r on (r.id = ur.role_id)
+	where
+		ur.user_id = ?
+	order by r.id`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, name)
+	}
+
+	return roles, rows.Err()
+}
+
+// GetUserPermissions returns the permissions a user has through any of their
+// roles, as a set
+func (m *DBModel) GetUserPermissions(userID int) (map[string]bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	perms := make(map[string]bool)
+
+	stmt := `
+	select distinct
+		p.name
+	from
+		user_roles ur
+		left join role_permissions rp on (rp.role_id = ur.role_id)
+		left join permissions p on (p.id = rp.permission_id)
+	where
+		ur.user_id = ? and p.name is not null`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		perms[name] = true
+	}
+
+	return perms, rows.Err()
+}
+
+// HasPermission reports whether any of a user's roles grants a permission
+func (m *DBModel) HasPermission(userID int, perm string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+	select
+		count(*)
+	from
+		user_roles ur
+		left join role_permissions rp on (rp.role_id = ur.role_id)
+		left join permissions p on (p.id = rp.permission_id)
+	where
+		ur.user_id = ? and p.name = ?`
+
+	var n int
+	err := m.DB.QueryRowContext(ctx, stmt, userID, perm).Scan(&n)
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
+
+// GetUsersWithPermission returns the users who have a permission through any
+// of their roles, ordered by name
+func (m *DBModel) GetUsersWithPermission(perm string) ([]*User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var users []*User
+
+	stmt := `
+	select distinct
+		u.id, u.first_name, u.last_name, u.email, u.created_at, u.updated_at
+	from
+		users u
+		left join user_roles ur on (ur.user_id = u.id)
+		left join role_permissions rp on (rp.role_id = ur.role_id)
+		left join permissions p on (p.id = rp.permission_id)
+	where
+		p.name = ?
+	order by u.last_name, u.first_name`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, perm)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var u User
+		err = rows.Scan(
+			&u.ID,
+			&u.FirstName,
+			&u.LastName,
+			&u.Email,
+			&u.CreatedAt,
+			&u.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, &u)
+	}
+
+	return users, rows.Err()
+}
+
+// SetUserRoles replaces the roles of a user with the named ones. It returns
+// ErrUnknownRole if any of them does not exist, and ErrLastAdmin if it would
+// take the admin role from the only user who has it.
+func (m *DBModel) SetUserRoles(userID int, roles []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = setUserRoles(ctx, tx, userID, roles)
+	if err != nil {
+		return err
+	}
+
+	err = m.checkAdminLeft(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// setUserRoles replaces the roles of a user within tx
+func setUserRoles(ctx context.Context, tx queryExecer, userID int, roles []string) error {
+	var roleIDs []int
+	seen := make(map[string]bool)
+
+	for _, name := range roles {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		var id int
+		err := tx.QueryRowContext(ctx, `select id from roles where name = ?`, name).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("%w %q", ErrUnknownRole, name)
+		} else if err != nil {
+			return err
+		}
+		roleIDs = append(roleIDs, id)
+	}
+
+	_, err := tx.ExecContext(ctx, `delete from user_roles where user_id = ?`, userID)
+	if err != nil {
+		return err
+	}
+
+	if len(roleIDs) > 0 {
+		values := strings.TrimSuffix(strings.Repeat("(?, ?, ?, ?),", len(roleIDs)), ",")
+		var args []interface{}
+		for _, id := range roleIDs {
+			args = append(args, userID, id, time.Now(), time.Now())
+		}
+
+		_, err = tx.ExecContext(ctx,
+			`insert into user_roles (user_id, role_id, created_at, updated_at) values `+values, args...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkAdminLeft returns ErrLastAdmin when no user has the admin role. Run it
+// inside the transaction that takes the role away, so the change rolls back.
+func (m *DBModel) checkAdminLeft(ctx context.Context, tx queryExecer) error {
+	stmt := `
+	select
+		count(*)
+	from
+		user_roles ur
+		left join roles r on (r.id = ur.role_id)
+	where
+		r.name = ?`
+
+	var n int
+	err := tx.QueryRowContext(ctx, stmt, RoleAdmin).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrLastAdmin
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package models
+
+import (
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// rolesDB is a fakeDB that knows the admin and support roles
+func rolesDB() *fakeDB {
+	ids := map[string]int64{"admin": 1, "support": 2}
+
+	return &fakeDB{
+		exec: func(query string, args []driver.Value) (int64, error) {
+			return 9, nil
+		},
+		query: func(query string, args []driver.Value) ([][]driver.Value, error) {
+			if id, ok := ids[args[0].(string)]; ok {
+				return [][]driver.Value{{id}}, nil
+			}
+			return nil, nil
+		},
+	}
+}
+
+func TestAddUserWithRoles(t *testing.T) {
+	f := rolesDB()
+	m := openFake(t, f)
+
+	id, err := m.AddUser(User{Email: "jane@example.com", Roles: []string{"support"}}, "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 9 {
+		t.Errorf("id = %d, want 9", id)
+	}
+
+	if f.log[0] != "begin" || f.log[len(f.log)-1] != "commit" {
+		t.Fatalf("statements not in one transaction: %v", f.log)
+	}
+	var inserted bool
+	for _, s := range f.log {
+		if strings.HasPrefix(s, "insert into user_roles") {
+			inserted = true
+		}
+	}
+	if !inserted {
+		t.Errorf("roles not assigned: %v", f.log)
+	}
+}
+
+func TestAddUserUnknownRole(t *testing.T) {
+	f := rolesDB()
+	m := openFake(t, f)
+
+	_, err := m.AddUser(User{Email: "jane@example.com", Roles: []string{"support", "owner"}}, "hash")
+	if !errors.Is(err, ErrUnknownRole) {
+		t.Fatalf("AddUser = %v, want %v", err, ErrUnknownRole)
+	}
+
+	// the user row is rolled back with the roles
+	if last := f.log[len(f.log)-1]; last != "rollback" {
+		t.Errorf("last statement = %s, want rollback", last)
+	}
+	for _, s := range f.log {
+		if s == "commit" {
+			t.Error("a user with an unknown role was committed")
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrIncompleteAddress is returned when an order is placed without an address
+// that it can be shipped to
+var ErrIncompleteAddress = errors.New("shipping address is incomplete")
+
+// Fulfillment states of an order, derived from its shipments
+const (
+	FulfillmentUnfulfilled = "unfulfilled"
+	FulfillmentShipped     = "shipped"
+	FulfillmentDelivered   = "delivered"
+)
+
+// Address is a model for the addresses table
+type Address struct {
+	ID         int       `json:"id"`
+	CustomerID int       `json:"customer_id"`
+	Name       string    `json:"name"`
+	Line1      string    `json:"line1"`
+	Line2      string    `json:"line2"`
+	City       string    `json:"city"`
+	State      string    `json:"state"`
+	PostalCode string    `json:"postal_code"`
+	Country    string    `json:"country"`
+	CreatedAt  time.Time `json:"-"`
+	UpdatedAt  time.Time `json:"-"`
+}
+
+// Complete reports whether the address has everything needed to ship to it
+func (a Address) Complete() bool {
+	return strings.TrimSpace(a.Line1) != "" &&
+		strings.TrimSpace(a.City) != "" &&
+		strings.TrimSpace(a.PostalCode) != "" &&
+		len(strings.TrimSpace(a.Country)) == 2
+}
+
+// Shipment is a model for the shipments table
+type Shipment struct {
+	ID             int        `json:"id"`
+	OrderID        int        `json:"order_id"`
+	Carrier        string     `json:"carrier"`
+	TrackingNumber string     `json:"tracking_number"`
+	ShippedAt      time.Time  `json:"shipped_at"`
+	DeliveredAt    *time.Time `json:"delivered_at"`
+	CreatedAt      time.Time  `json:"-"`
+	UpdatedAt      time.Time  `json:"-"`
+}
+
+// FulfillmentStatus derives the fulfillment state of an order from its shipments
+func FulfillmentStatus(shipments []*Shipment) string {
+	if len(shipments) == 0 {
+		return FulfillmentUnfulfilled
+	}
+
+	for _, s := range shipments {
+		if s.DeliveredAt == nil {
+			return FulfillmentShipped
+		}
+	}
+
+	return FulfillmentDelivered
+}
+
+// InsertAddress inserts a new address for a customer
+func (m *DBModel) InsertAddress(a Address) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+	INSERT INTO addresses
+		(customer_id, name, line1, line2, city, state, postal_code, country,
+		created_at, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	result, err := m.DB.ExecContext(ctx, stmt,
+		a.CustomerID,
+		a.Name,
+		a.Line1,
+		a.Line2,
+		a.City,
+		a.State,
+		a.PostalCode,
+		strings.ToUpper(a.Country),
+		time.Now(),
+		time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// SaveAddresses saves the billing and shipping addresses of a customer, and
+// returns their IDs. The billing address is optional, and is stored once when
+// both are the same. Nothing is saved unless the shipping address is complete.
+func (m *DBModel) SaveAddresses(customerID int, billing, shipping Address) (int, int, error) {
+	if !shipping.Complete() {
+		return 0, 0, ErrIncompleteAddress
+	}
+
+	billing.CustomerID = customerID
+	shipping.CustomerID = customerID
+
+	var billingID int
+	var err error
+
+	if billing.Line1 != "" {
+		billingID, err = m.InsertAddress(billing)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if billing == shipping {
+			return billingID, billingID, nil
+		}
+	}
+
+	shippingID, err := m.InsertAddress(shipping)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return billingID, shippingID, nil
+}
+
+// GetAddress returns a single address by ID
+func (m *DBModel) GetAddress(id int) (Address, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var a Address
+
+	stmt := `
+	select
+		id, customer_id, name, line1, line2, city, state, postal_code, country,
+		created_at, updated_at
+	from
+		addresses
+	where
+		id = ?`
+
+	err := m.DB.QueryRowContext(ctx, stmt, id).Scan(
+		&a.ID,
+		&a.CustomerID,
+		&a.Name,
+		&a.Line1,
+		&a.Line2,
+		&a.City,
+		&a.State,
+		&a.PostalCode,
+		&a.Country,
+		&a.CreatedAt,
+		&a.UpdatedAt,
+	)
+	if err != nil {
+		return a, err
+	}
+
+	return a, nil
+}
+
+// InsertShipment records that an order, or part of it, has been shipped
+func (m *DBModel) InsertShipment(s Shipment) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+	INSERT INTO shipments
+		(order_id, carrier, tracking_number, shipped_at, created_at, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?)`
+
+	result, err := m.DB.ExecContext(ctx, stmt,
+		s.OrderID,
+		s.Carrier,
+		s.TrackingNumber,
+		s.ShippedAt,
+		time.Now(),
+		time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// GetShipmentsForOrder returns the shipments of an order, oldest first
+func (m *DBModel) GetShipmentsForOrder(orderID int) ([]*Shipment, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var shipments []*Shipment
+
+	stmt := `
+	select
+		id, order_id, carrier, tracking_number, shipped_at, delivered_at,
+		created_at, updated_at
+	from
+		shipments
+	where
+		order_id = ?
+	order by
+		shipped_at, id`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s Shipment
+		var delivered sql.NullTime
+		err = rows.Scan(
+			&s.ID,
+			&s.OrderID,
+			&s.Carrier,
+			&s.TrackingNumber,
+			&s.ShippedAt,
+			&delivered,
+			&s.CreatedAt,
+			&s.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		if delivered.Valid {
+			s.DeliveredAt = &delivered.Time
+		}
+
+		shipments = append(shipments, &s)
+	}
+
+	return shipments, nil
+}
+
+// GetShipment returns a single shipment by ID
+func (m *DBModel) GetShipment(id int) (Shipment, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var s Shipment
+	var delivered sql.NullTime
+
+	stmt := `
+	select
+		id, order_id, carrier, tracking_number, shipped_at, delivered_at,
+		created_at, updated_at
+	from
+		shipments
+	where
+		id = ?`
+
+	err := m.DB.QueryRowContext(ctx, stmt, id).Scan(
+		&s.ID,
+		&s.OrderID,
+		&s.Carrier,
+		&s.TrackingNumber,
+		&s.ShippedAt,
+		&delivered,
+		&s.CreatedAt,
+		&s.UpdatedAt,
+	)
+	if err != nil {
+		return s, err
+	}
+
+	if delivered.Valid {
+		s.DeliveredAt = &delivered.Time
+	}
+
+	return s, nil
+}
+
+// MarkShipmentDelivered records when a shipment reached the customer
+func (m *DBModel) MarkShipmentDelivered(id int, deliveredAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `update shipments set delivered_at = ?, updated_at = ? where id = ?`
+
+	_, err := m.DB.ExecContext(ctx, stmt, deliveredAt, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
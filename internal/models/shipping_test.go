@@ -0,0 +1,48 @@
+package models
+
+import (
+	"database/sql/driver"
+	"errors"
+	"testing"
+)
+
+func TestSaveAddressesIncompleteShipping(t *testing.T) {
+	f := &fakeDB{
+		exec: func(query string, args []driver.Value) (int64, error) {
+			return 7, nil
+		},
+	}
+	m := openFake(t, f)
+
+	billing := Address{Line1: "1 Main St", City: "Springfield", PostalCode: "12345", Country: "US"}
+
+	_, _, err := m.SaveAddresses(3, billing, Address{Line1: "1 Main St", Country: "US"})
+	if !errors.Is(err, ErrIncompleteAddress) {
+		t.Fatalf("err = %v, want ErrIncompleteAddress", err)
+	}
+	if len(f.log) != 0 {
+		t.Errorf("statements run for a rejected order:\n%s", statements(f.log))
+	}
+}
+
+func TestSaveAddressesSameAddress(t *testing.T) {
+	f := &fakeDB{
+		exec: func(query string, args []driver.Value) (int64, error) {
+			return 7, nil
+		},
+	}
+	m := openFake(t, f)
+
+	a := Address{Line1: "1 Main St", City: "Springfield", PostalCode: "12345", Country: "US"}
+
+	billingID, shippingID, err := m.SaveAddresses(3, a, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if billingID != 7 || shippingID != 7 {
+		t.Errorf("ids = %d, %d, want 7, 7", billingID, shippingID)
+	}
+	if len(f.log) != 1 {
+		t.Errorf("want the address stored once, got:\n%s", statements(f.log))
+	}
+}
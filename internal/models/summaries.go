@@ -0,0 +1,272 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	// summaries and reports take any IANA time zone, even where the host has
+	// no zone database
+	_ "time/tzdata"
+)
+
+// The daily_sales_summary table holds, for each day, product and currency,
+// the orders placed and what they took, the refunds made, and the
+// subscriptions cancelled. Days are those of the model's Location. A day's
+// rows for a product are worked out again from the orders, refunds and status
+// history whenever one of those changes, in the same transaction, so they
+// never drift; BackfillSummaries rebuilds them all.
+
+// location returns the time zone of the daily summaries
+func (m *DBModel) location() *time.Location {
+	if m.Location == nil {
+		return time.UTC
+	}
+	return m.Location
+}
+
+// dayOf returns the day t falls on, in loc, as midnight in loc
+func dayOf(t time.Time, loc *time.Location) time.Time {
+	y, mo, d := t.In(loc).Date()
+	return time.Date(y, mo, d, 0, 0, 0, 0, loc)
+}
+
+// refreshDailySummary works out the summary rows of a product for the day
+// starting at midnight day again
+func (m *DBModel) refreshDailySummary(ctx context.Context, tx queryExecer, day time.Time, maizeID int) error {
+	from, to := day, day.AddDate(0, 0, 1)
+
+	_, err := tx.ExecContext(ctx, `delete from daily_sales_summary where day = ? and maize_id = ?`,
+		day.Format("2006-01-02"), maizeID)
+	if err != nil {
+		return err
+	}
+
+	// each part of the union adds up one side of the day; refunds count on the
+	// day they were made, and cancelled subscriptions on the day they were
+	// cancelled, or last updated when that was before their history was kept
+	stmt := `
+	insert into daily_sales_summary
+		(day, maize_id, currency, orders, units, gross, refunds, churned_subs, mrr_churned,
+		created_at, updated_at)
+	select
+		?, ?, currency, sum(orders), sum(units), sum(gross), sum(refunds),
+		sum(churned_subs), sum(mrr_churned), ?, ?
+	from (
+		select
+			t.currency, 1 as orders, o.quantity as units, t.amount as gross, 0 as refunds,
+			0 as churned_subs, 0 as mrr_churned
+		from
+			orders o
+				join transactions t on (o.transaction_id = t.id)
+		where
+			o.maize_id = ? and o.created_at >= ? and o.created_at < ?
+			and t.transaction_status_id in (?, ?, ?)
+		union all
+		select
+			rf.currency, 0, 0, 0, rf.amount, 0, 0
+		from
+			refunds rf
+				join orders o on (rf.order_id = o.id)
+		where
+			o.maize_id = ? and rf.created_at >= ? and rf.created_at < ?
+		union all
+		select
+			t.currency, 0, 0, 0, 0, 1, t.amount
+		from
+			orders o
+				join maize m on (o.maize_id = m.id)
+				join transactions t on (o.transaction_id = t.id)
+		where
+			o.maize_id = ? and m.is_recurring = 1 and o.status_id = ?
+			and t.transaction_status_id in (?, ?, ?)
+			and coalesce(
+				(select max(h.created_at) from order_status_history h
+					where h.order_id = o.id and h.to_status_id = ?),
+				o.updated_at) >= ?
+			and coalesce(
+				(select max(h.created_at) from order_status_history h
+					where h.order_id = o.id and h.to_status_id = ?),
+				o.updated_at) < ?
+	) activity
+	group by
+		currency`
+
+	args := []interface{}{day.Format("2006-01-02"), maizeID, time.Now(), time.Now(), maizeID, from, to}
+	args = append(args, paidTransactionStatuses...)
+	args = append(args, maizeID, from, to, maizeID, StatusCancelled)
+	args = append(args, paidTransactionStatuses...)
+	args = append(args, StatusCancelled, from, StatusCancelled, to)
+
+	_, err = tx.ExecContext(ctx, stmt, args...)
+	return err
+}
+
+// refreshOrderDay works out the summary of the day at falls on again, for the
+// product of an order
+func (m *DBModel) refreshOrderDay(ctx context.Context, tx queryExecer, orderID int, at time.Time) error {
+	var maizeID int
+	err := tx.QueryRowContext(ctx, `select maize_id from orders where id = ?`, orderID).Scan(&maizeID)
+	if err != nil {
+		return err
+	}
+
+	return m.refreshDailySummary(ctx, tx, dayOf(at, m.location()), maizeID)
+}
+
+// BackfillSummaries rebuilds the daily summaries from the whole history of
+// orders, refunds and cancellations, a day at a time, calling progress after
+// each day. Reports stay available throughout, and it is safe to run while
+// orders are being taken.
+func (m *DBModel) BackfillSummaries(progress func(day time.Time, maizeID int)) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+
+	started := time.Now().Truncate(time.Second)
+
+	type key struct {
+		day     string
+		maizeID int
+	}
+
+	// every time something happened to each product
+	stmt := `
+	select o.maize_id, o.created_at from orders o
+	union all
+	select o.maize_id, rf.created_at from refunds rf join orders o on (rf.order_id = o.id)
+	union all
+	select o.maize_id, h.created_at from order_status_history h join orders o on (h.order_id = o.id)
+		where h.to_status_id = ?
+	union all
+	select o.maize_id, o.updated_at from orders o where o.status_id = ?`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, StatusCancelled, StatusCancelled)
+	if err != nil {
+		return err
+	}
+
+	loc := m.location()
+	seen := make(map[key]bool)
+	var todo []key
+
+	for rows.Next() {
+		var maizeID int
+		var at time.Time
+		err = rows.Scan(&maizeID, &at)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		k := key{dayOf(at, loc).Format("2006-01-02"), maizeID}
+		if !seen[k] {
+			seen[k] = true
+			todo = append(todo, k)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, k := range todo {
+		day, err := time.ParseInLocation("2006-01-02", k.day, loc)
+		if err != nil {
+			return err
+		}
+
+		tx, err := m.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+
+		err = m.refreshDailySummary(ctx, tx, day, k.maizeID)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+
+		if progress != nil {
+			progress(day, k.maizeID)
+		}
+	}
+
+	// whatever was not refreshed belongs to days that no longer have activity
+	_, err = m.DB.ExecContext(ctx, `delete from daily_sales_summary where updated_at < ?`, started)
+	return err
+}
+
+// summaryDay is a row of daily_sales_summary along with whether its product
+// is a subscription
+type summaryDay struct {
+	day         time.Time
+	maizeID     int
+	name        string
+	recurring   bool
+	currency    string
+	orders      int
+	units       int
+	gross       int
+	refunds     int
+	churnedSubs int
+	mrrChurned  int
+}
+
+// usesSummaries reports whether a report on rr can be read from the daily
+// summaries, which only hold whole days of the model's time zone
+func (m *DBModel) usesSummaries(rr ReportRange) bool {
+	return rr.Location.String() == m.location().String()
+}
+
+// eachSummaryDay calls fn with every summary row from the day starting at
+// from up to the one starting at to
+func (m *DBModel) eachSummaryDay(ctx context.Context, from, to time.Time, fn func(summaryDay)) error {
+	stmt := `
+	select
+		s.day, s.maize_id, m.name, m.is_recurring, s.currency, s.orders, s.units,
+		s.gross, s.refunds, s.churned_subs, s.mrr_churned
+	from
+		daily_sales_summary s
+			join maize m on (s.maize_id = m.id)
+	where
+		s.day >= ? and s.day < ?`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, from.Format("2006-01-02"), to.Format("2006-01-02"))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	loc := m.location()
+
+	for rows.Next() {
+		var s summaryDay
+		err = rows.Scan(
+			&s.day,
+			&s.maizeID,
+			&s.name,
+			&s.recurring,
+			&s.currency,
+			&s.orders,
+			&s.units,
+			&s.gross,
+			&s.refunds,
+			&s.churnedSubs,
+			&s.mrrChurned,
+		)
+		if err != nil {
+			return err
+		}
+
+		// dates come back as midnight UTC
+		s.day = time.Date(s.day.Year(), s.day.Month(), s.day.Day(), 0, 0, 0, 0, loc)
+
+		fn(s)
+	}
+
+	return rows.Err()
+}
@@ -4,7 +4,10 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
 	"encoding/base32"
+	"errors"
 	"log"
 	"time"
 )
@@ -13,15 +16,31 @@ const (
 	ScopeAuthentication = "authentication"
 )
 
-// Token represents a token used to authenticate a user.
+// Token represents a token used to authenticate a user. A user has a token
+// for each device they log in on, named after it.
 type Token struct {
-	PlainText  string    `json:"token"`
-	UserID     int64     `json:"-"`
-	Hash       []byte    `json:"-"`
-	Expiration time.Time `json:"expiration"`
-	Scope      string    `json:"-"`
+	ID         int        `json:"id"`
+	PlainText  string     `json:"token,omitempty"`
+	UserID     int64      `json:"-"`
+	Hash       []byte     `json:"-"`
+	Name       string     `json:"name"`
+	Expiration time.Time  `json:"expiration"`
+	Scope      string     `json:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	// SecondFactor is set on tokens issued by a login that checked the
+	// user's second factor
+	SecondFactor bool `json:"-"`
 }
 
+// ErrTokenNotFound is returned when a token to revoke does not exist, or
+// belongs to someone else
+var ErrTokenNotFound = errors.New("no such token")
+
+// lastUsedPrecision is how stale a token's last use may be before it is
+// written again, so a busy client does not write on every request
+const lastUsedPrecision = time.Minute
+
 // GenerateToken generates a new token for the given user.
 func GenerateToken(userID int, ttl time.Duration, scope string) (*Token, error) {
 	token := &Token{
@@ -43,46 +62,67 @@ func GenerateToken(userID int, ttl time.Duration, scope string) (*Token, error)
 	return token, nil
 }
 
+// InsertToken stores a new token for a user, alongside the tokens they have
+// on other devices
 func (m *DBModel) InsertToken(t *Token, u User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	stmt := `delete from tokens where user_id = ?`
-	_, err := m.DB.ExecContext(ctx, stmt, u.ID)
+	name, err := m.seal(t.Name)
+	if err != nil {
+		return err
+	}
+
+	email, err := m.seal(u.Email)
 	if err != nil {
 		return err
 	}
 
-	stmt = `
+	t.CreatedAt = time.Now()
+
+	stmt := `
 	INSERT INTO tokens
-	(user_id, name, email, token_hash, expiration, created_at, updated_at)
-	VALUES (?, ?, ?, ?, ?, ?, ?)`
+	(user_id, name, email, email_hash, token_hash, expiration, second_factor,
+	created_at, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
 
-	_, err = m.DB.ExecContext(ctx, stmt,
+	result, err := m.DB.ExecContext(ctx, stmt,
 		u.ID,
-		u.LastName,
-		u.Email,
+		name,
+		email,
+		m.emailHash(u.Email),
 		t.Hash,
 		t.Expiration,
-		time.Now(),
-		time.Now(),
+		t.SecondFactor,
+		t.CreatedAt,
+		t.CreatedAt,
 	)
 	if err != nil {
 		return err
 	}
 
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	t.ID = int(id)
+
 	return nil
 }
 
+// GetUserByToken returns the user an unexpired token belongs to, and notes
+// that the token was used
 func (m *DBModel) GetUserByToken(token string) (*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	tokenHash := sha256.Sum256([]byte(token))
 	var user User
+	var tokenID int
+	var lastUsed sql.NullTime
 
 	stmt := `
-	SELECT u.id, u.first_name, u.last_name, u.email
+	SELECT u.id, u.first_name, u.last_name, u.email, u.totp_enabled, t.id, t.last_used_at
 		FROM Users u
 		INNER JOIN tokens t on (u.id = t.user_id)
 	WHERE t.token_hash = ? and t.expiration > ?`
@@ -92,11 +132,183 @@ func (m *DBModel) GetUserByToken(token string) (*User, error) {
 		&user.FirstName,
 		&user.LastName,
 		&user.Email,
+		&user.TwoFactorEnabled,
+		&tokenID,
+		&lastUsed,
 	)
 	if err != nil {
 		log.Println(err)
 		return nil, err
 	}
 
+	if !lastUsed.Valid || time.Since(lastUsed.Time) > lastUsedPrecision {
+		_, err = m.DB.ExecContext(ctx, `update tokens set last_used_at = ? where id = ?`, time.Now(), tokenID)
+		if err != nil {
+			// the token is still good, only its last use is not recorded
+			log.Println(err)
+		}
+	}
+
 	return &user, nil
 }
+
+// SecondFactorToken reports whether token is an unexpired token of the user,
+// issued less than maxAge ago by a login that checked their second factor
+func (m *DBModel) SecondFactorToken(userID int, token string, maxAge time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tokenHash := sha256.Sum256([]byte(token))
+	var n int
+
+	stmt := `
+	select count(id) from tokens
+	where token_hash = ? and user_id = ? and second_factor = 1
+		and created_at > ? and expiration > ?`
+
+	err := m.DB.QueryRowContext(ctx, stmt, tokenHash[:], userID, time.Now().Add(-maxAge), time.Now()).Scan(&n)
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
+
+// GetTokensForUser returns a user's unexpired tokens, most recently used
+// first
+func (m *DBModel) GetTokensForUser(userID int) ([]*Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var tokens []*Token
+
+	stmt := `
+	select
+		id, user_id, name, token_hash, expiration, created_at, last_used_at
+	from
+		tokens
+	where
+		user_id = ? and expiration > ?
+	order by coalesce(last_used_at, created_at) desc`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t Token
+		var lastUsed sql.NullTime
+		err = rows.Scan(
+			&t.ID,
+			&t.UserID,
+			&t.Name,
+			&t.Hash,
+			&t.Expiration,
+			&t.CreatedAt,
+			&lastUsed,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		if lastUsed.Valid {
+			t.LastUsedAt = &lastUsed.Time
+		}
+
+		t.Name, err = m.open(t.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		tokens = append(tokens, &t)
+	}
+
+	return tokens, rows.Err()
+}
+
+// IsToken reports whether t is the token whose plain text is given
+func (t *Token) IsToken(plainText string) bool {
+	hash := sha256.Sum256([]byte(plainText))
+	return subtle.ConstantTimeCompare(t.Hash, hash[:]) == 1
+}
+
+// RevokeToken deletes one of a user's tokens, logging out the device it was
+// issued to. It returns ErrTokenNotFound if the user has no such token.
+func (m *DBModel) RevokeToken(userID, tokenID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `delete from tokens where id = ? and user_id = ?`, tokenID, userID)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrTokenNotFound
+	}
+
+	return nil
+}
+
+// RevokePlainTextToken deletes the token whose plain text is given, for a
+// client logging out
+func (m *DBModel) RevokePlainTextToken(token string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tokenHash := sha256.Sum256([]byte(token))
+
+	_, err := m.DB.ExecContext(ctx, `delete from tokens where token_hash = ?`, tokenHash[:])
+	return err
+}
+
+// RevokeOtherTokens deletes every token of a user but the one whose plain text
+// is keep, or every one of them when keep is empty, and returns how many it
+// deleted
+func (m *DBModel) RevokeOtherTokens(userID int, keep string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	n, err := revokeOtherTokens(ctx, m.DB, userID, keep)
+	return int(n), err
+}
+
+// revokeOtherTokens deletes the tokens of a user but keep, with tx
+func revokeOtherTokens(ctx context.Context, tx execer, userID int, keep string) (int64, error) {
+	stmt := `delete from tokens where user_id = ?`
+	args := []interface{}{userID}
+
+	if keep != "" {
+		keepHash := sha256.Sum256([]byte(keep))
+		stmt += ` and token_hash <> ?`
+		args = append(args, keepHash[:])
+	}
+
+	result, err := tx.ExecContext(ctx, stmt, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// DeleteExpiredTokens deletes the tokens that have expired, and returns how
+// many it deleted
+func (m *DBModel) DeleteExpiredTokens() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `delete from tokens where expiration <= ?`, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := result.RowsAffected()
+	return int(n), err
+}
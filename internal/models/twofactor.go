@@ -0,0 +1,366 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"maize/internal/totp"
+	"strings"
+	"time"
+)
+
+// totpIssuer names the application in authenticator apps
+const totpIssuer = "maize"
+
+// recoveryCodeCount is how many recovery codes a user is given at a time
+const recoveryCodeCount = 10
+
+// Errors returned by the two-factor methods
+var (
+	ErrTwoFactorCode       = errors.New("invalid two-factor code")
+	ErrTwoFactorNotStarted = errors.New("two-factor authentication has not been set up")
+	ErrTwoFactorEnabled    = errors.New("two-factor authentication is already on")
+	ErrTwoFactorDisabled   = errors.New("two-factor authentication is off")
+)
+
+// TwoFactorSetup is what an authenticator app needs to enrol a user: the
+// secret, to type in, and the URI to show as a QR code
+type TwoFactorSetup struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// StartTwoFactor gives a user a new TOTP secret, which does not take effect
+// until EnableTwoFactor confirms the user's app produces its codes
+func (m *DBModel) StartTwoFactor(u User) (TwoFactorSetup, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var setup TwoFactorSetup
+
+	if u.TwoFactorEnabled {
+		return setup, ErrTwoFactorEnabled
+	}
+
+	secret, err := totp.NewSecret()
+	if err != nil {
+		return setup, err
+	}
+
+	sealed, err := m.seal(secret)
+	if err != nil {
+		return setup, err
+	}
+
+	stmt := `
+	update users set totp_secret = ?, totp_enabled = 0, totp_last_step = 0, updated_at = ?
+	where id = ? and totp_enabled = 0`
+
+	result, err := m.DB.ExecContext(ctx, stmt, sealed, time.Now(), u.ID)
+	if err != nil {
+		return setup, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return setup, err
+	}
+	if n == 0 {
+		return setup, ErrTwoFactorEnabled
+	}
+
+	setup.Secret = secret
+	setup.URI = totp.URI(totpIssuer, u.Email, secret)
+
+	return setup, nil
+}
+
+// EnableTwoFactor turns on two-factor authentication for a user once code
+// shows their app has the secret StartTwoFactor gave them, and returns their
+// recovery codes. The codes are only kept hashed, so this is the one time
+// they can be shown. Every token of the user but keep, the one they enabled it
+// from, is revoked, since those were issued on a password alone.
+func (m *DBModel) EnableTwoFactor(userID int, code, keep string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var sealed string
+	var enabled bool
+
+	row := tx.QueryRowContext(ctx, `select totp_secret, totp_enabled from users where id = ? for update`, userID)
+	err = row.Scan(&sealed, &enabled)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case enabled:
+		return nil, ErrTwoFactorEnabled
+	case sealed == "":
+		return nil, ErrTwoFactorNotStarted
+	}
+
+	secret, err := m.open(sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	step, err := totp.Validate(secret, code, time.Now(), 0)
+	if errors.Is(err, totp.ErrInvalidCode) {
+		return nil, ErrTwoFactorCode
+	} else if err != nil {
+		return nil, err
+	}
+
+	stmt := `update users set totp_enabled = 1, totp_last_step = ?, updated_at = ? where id = ?`
+	_, err = tx.ExecContext(ctx, stmt, step, time.Now(), userID)
+	if err != nil {
+		return nil, err
+	}
+
+	codes, err := m.replaceRecoveryCodes(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = revokeOtherTokens(ctx, tx, userID, keep)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// VerifyTwoFactor checks the second factor of a user who has two-factor
+// authentication on: a code from their app, or one of their recovery codes.
+// Either is accepted only once. It returns ErrTwoFactorCode when the code is
+// wrong or was used already.
+func (m *DBModel) VerifyTwoFactor(userID int, code string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	code = strings.ReplaceAll(code, " ", "")
+	if !isTOTPCode(code) {
+		return m.useRecoveryCode(ctx, userID, code)
+	}
+
+	var sealed string
+	var lastStep int64
+
+	row := m.DB.QueryRowContext(ctx,
+		`select totp_secret, totp_last_step from users where id = ? and totp_enabled = 1`, userID)
+	err := row.Scan(&sealed, &lastStep)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrTwoFactorDisabled
+	} else if err != nil {
+		return err
+	}
+
+	secret, err := m.open(sealed)
+	if err != nil {
+		return err
+	}
+
+	step, err := totp.Validate(secret, code, time.Now(), lastStep)
+	if errors.Is(err, totp.ErrInvalidCode) {
+		return ErrTwoFactorCode
+	} else if err != nil {
+		return err
+	}
+
+	// only one request can move the step on, so a code raced twice is used once
+	stmt := `update users set totp_last_step = ? where id = ? and totp_last_step < ?`
+	result, err := m.DB.ExecContext(ctx, stmt, step, userID, step)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrTwoFactorCode
+	}
+
+	return nil
+}
+
+// isTOTPCode reports whether code is shaped like a code from an app rather
+// than a recovery code
+func isTOTPCode(code string) bool {
+	if len(code) != totp.Digits {
+		return false
+	}
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// useRecoveryCode marks one of a user's unused recovery codes used
+func (m *DBModel) useRecoveryCode(ctx context.Context, userID int, code string) error {
+	stmt := `
+	update user_recovery_codes set used_at = ?, updated_at = ?
+	where user_id = ? and code_hash = ? and used_at is null`
+
+	result, err := m.DB.ExecContext(ctx, stmt, time.Now(), time.Now(), userID, recoveryCodeHash(code))
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrTwoFactorCode
+	}
+
+	return nil
+}
+
+// NewRecoveryCodes replaces a user's recovery codes, used or not, with new
+// ones and returns them
+func (m *DBModel) NewRecoveryCodes(userID int) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	codes, err := m.replaceRecoveryCodes(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// replaceRecoveryCodes generates a user's recovery codes and stores their
+// hashes in place of any they had
+func (m *DBModel) replaceRecoveryCodes(ctx context.Context, tx execer, userID int) ([]string, error) {
+	_, err := tx.ExecContext(ctx, `delete from user_recovery_codes where user_id = ?`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		_, err = rand.Read(b)
+		if err != nil {
+			return nil, err
+		}
+
+		c := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		codes[i] = c[:4] + "-" + c[4:8] + "-" + c[8:12] + "-" + c[12:]
+
+		stmt := `
+		insert into user_recovery_codes (user_id, code_hash, created_at, updated_at)
+		values (?, ?, ?, ?)`
+
+		_, err = tx.ExecContext(ctx, stmt, userID, recoveryCodeHash(codes[i]), time.Now(), time.Now())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return codes, nil
+}
+
+// recoveryCodeHash returns the hash a recovery code is stored as. The codes
+// are random and long, so a fast hash is enough, as it is for tokens.
+func recoveryCodeHash(code string) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// RecoveryCodesLeft returns how many of a user's recovery codes are unused
+func (m *DBModel) RecoveryCodesLeft(userID int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var n int
+	err := m.DB.QueryRowContext(ctx,
+		`select count(*) from user_recovery_codes where user_id = ? and used_at is null`, userID).Scan(&n)
+
+	return n, err
+}
+
+// DisableTwoFactor turns off two-factor authentication for a user and
+// forgets their secret and recovery codes
+func (m *DBModel) DisableTwoFactor(userID int) error {
+	return m.resetTwoFactor(userID, false)
+}
+
+// ResetTwoFactor turns off two-factor authentication for a user who has lost
+// their second factor, as DisableTwoFactor does, and signs them out
+// everywhere, since whoever has the lost device may also have their tokens
+func (m *DBModel) ResetTwoFactor(userID int) error {
+	return m.resetTwoFactor(userID, true)
+}
+
+// resetTwoFactor clears a user's two-factor settings, and their tokens if
+// signOut is set
+func (m *DBModel) resetTwoFactor(userID int, signOut bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `
+	update users set totp_secret = '', totp_enabled = 0, totp_last_step = 0, updated_at = ?
+	where id = ?`
+
+	_, err = tx.ExecContext(ctx, stmt, time.Now(), userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from user_recovery_codes where user_id = ?`, userID)
+	if err != nil {
+		return err
+	}
+
+	if signOut {
+		_, err = tx.ExecContext(ctx, `delete from tokens where user_id = ?`, userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
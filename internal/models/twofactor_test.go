@@ -0,0 +1,135 @@
+package models
+
+import (
+	"database/sql/driver"
+	"errors"
+	"maize/internal/totp"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestVerifyTwoFactorReplay(t *testing.T) {
+	var lastStep int64
+
+	m := openFake(t, &fakeDB{
+		query: func(query string, args []driver.Value) ([][]driver.Value, error) {
+			return [][]driver.Value{{testTOTPSecret, lastStep}}, nil
+		},
+		exec: func(query string, args []driver.Value) (int64, error) {
+			// update users set totp_last_step = ? where id = ? and totp_last_step < ?
+			if step := args[0].(int64); step > lastStep {
+				lastStep = step
+				return 1, nil
+			}
+			return 0, nil
+		},
+	})
+
+	code, err := totp.Code(testTOTPSecret, totp.Step(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.VerifyTwoFactor(1, code)
+	if err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if lastStep == 0 {
+		t.Fatal("the step of the code was not kept")
+	}
+
+	err = m.VerifyTwoFactor(1, code)
+	if !errors.Is(err, ErrTwoFactorCode) {
+		t.Errorf("replayed code: %v, want %v", err, ErrTwoFactorCode)
+	}
+
+	// a code another request used first, between the read and the update
+	code, err = totp.Code(testTOTPSecret, lastStep+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := lastStep
+	m = openFake(t, &fakeDB{
+		query: func(query string, args []driver.Value) ([][]driver.Value, error) {
+			return [][]driver.Value{{testTOTPSecret, stale}}, nil
+		},
+		exec: func(query string, args []driver.Value) (int64, error) {
+			return 0, nil
+		},
+	})
+	err = m.VerifyTwoFactor(1, code)
+	if !errors.Is(err, ErrTwoFactorCode) {
+		t.Errorf("raced code: %v, want %v", err, ErrTwoFactorCode)
+	}
+}
+
+func TestEnableTwoFactorRevokesOtherTokens(t *testing.T) {
+	f := &fakeDB{
+		query: func(query string, args []driver.Value) ([][]driver.Value, error) {
+			// select totp_secret, totp_enabled from users
+			return [][]driver.Value{{testTOTPSecret, false}}, nil
+		},
+		exec: func(query string, args []driver.Value) (int64, error) {
+			return 1, nil
+		},
+	}
+	m := openFake(t, f)
+
+	code, err := totp.Code(testTOTPSecret, totp.Step(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	codes, err := m.EnableTwoFactor(1, code, "KEEPTHISTOKENKEEPTHISTOKE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) == 0 {
+		t.Error("no recovery codes returned")
+	}
+
+	revoked, committed := -1, -1
+	for i, s := range f.log {
+		switch {
+		case strings.HasPrefix(s, "delete from tokens where user_id = ? and token_hash <> ?"):
+			revoked = i
+		case s == "commit":
+			committed = i
+		}
+	}
+	if revoked < 0 || committed < revoked {
+		t.Errorf("other tokens not revoked in the transaction; statements:\n%s", strings.Join(f.log, "\n"))
+	}
+}
+
+func TestSecondFactorTokenIsFresh(t *testing.T) {
+	var cutoff time.Time
+
+	m := openFake(t, &fakeDB{
+		query: func(query string, args []driver.Value) ([][]driver.Value, error) {
+			if !strings.Contains(query, "second_factor = 1") {
+				t.Errorf("tokens from logins without a code are not excluded: %s", query)
+			}
+			if args[1].(int64) != 4 {
+				t.Errorf("user = %v, want 4", args[1])
+			}
+			cutoff = args[2].(time.Time)
+			return [][]driver.Value{{int64(0)}}, nil
+		},
+	})
+
+	ok, err := m.SecondFactorToken(4, "TOKEN", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("a token that matched no row was accepted")
+	}
+
+	if age := time.Since(cutoff); age < time.Minute || age > time.Minute+time.Second {
+		t.Errorf("tokens accepted from %v ago, want a minute", age)
+	}
+}
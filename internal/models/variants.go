@@ -0,0 +1,373 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// MaizeVariant is a model for the maize_variants table. A variant with a
+// Price of zero is sold at the price of its parent maize.
+type MaizeVariant struct {
+	ID             int       `json:"id"`
+	MaizeID        int       `json:"maize_id"`
+	Name           string    `json:"name"`
+	SKU            string    `json:"sku"`
+	Price          int       `json:"price"`
+	InventoryLevel int       `json:"inventory_level"`
+	CreatedAt      time.Time `json:"-"`
+	UpdatedAt      time.Time `json:"-"`
+}
+
+// PriceFor returns the price of the variant, falling back to the parent's price
+func (v MaizeVariant) PriceFor(parent Maize) int {
+	if v.Price > 0 {
+		return v.Price
+	}
+	return parent.Price
+}
+
+// ProductInventory is the inventory and sales rollup for a single maize product
+type ProductInventory struct {
+	MaizeID        int                 `json:"maize_id"`
+	Name           string              `json:"name"`
+	IsRecurring    bool                `json:"is_recurring"`
+	IsActive       bool                `json:"is_active"`
+	InventoryLevel int                 `json:"inventory_level"`
+	UnitsSold      int                 `json:"units_sold"`
+	Revenue        int                 `json:"revenue"`
+	Variants       []*VariantInventory `json:"variants"`
+}
+
+// VariantInventory is the inventory and sales rollup for a single variant
+type VariantInventory struct {
+	VariantID      int    `json:"variant_id"`
+	Name           string `json:"name"`
+	SKU            string `json:"sku"`
+	InventoryLevel int    `json:"inventory_level"`
+	UnitsSold      int    `json:"units_sold"`
+	Revenue        int    `json:"revenue"`
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// queryExecer is satisfied by both *sql.DB and *sql.Tx
+type queryExecer interface {
+	execer
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// nullInt maps the zero value of an optional foreign key to NULL
+func nullInt(i int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(i), Valid: i != 0}
+}
+
+// GetVariantsForMaize returns all variants of the given maize
+func (m *DBModel) GetVariantsForMaize(maizeID int) ([]*MaizeVariant, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var variants []*MaizeVariant
+
+	stmt := `
+	select
+		id, maize_id, name, sku, price, inventory_level, created_at, updated_at
+	from
+		maize_variants
+	where
+		maize_id = ?
+	order by
+		name`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, maizeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var v MaizeVariant
+		err = rows.Scan(
+			&v.ID,
+			&v.MaizeID,
+			&v.Name,
+			&v.SKU,
+			&v.Price,
+			&v.InventoryLevel,
+			&v.CreatedAt,
+			&v.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		variants = append(variants, &v)
+	}
+
+	return variants, nil
+}
+
+// GetVariant returns a single variant by ID
+func (m *DBModel) GetVariant(id int) (MaizeVariant, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var v MaizeVariant
+
+	stmt := `
+	select
+		id, maize_id, name, sku, price, inventory_level, created_at, updated_at
+	from
+		maize_variants
+	where
+		id = ?`
+
+	err := m.DB.QueryRowContext(ctx, stmt, id).Scan(
+		&v.ID,
+		&v.MaizeID,
+		&v.Name,
+		&v.SKU,
+		&v.Price,
+		&v.InventoryLevel,
+		&v.CreatedAt,
+		&v.UpdatedAt,
+	)
+	if err != nil {
+		return v, err
+	}
+
+	return v, nil
+}
+
+// InsertVariant inserts a new variant and rolls its inventory up to the parent.
+// Its opening stock, v.InventoryLevel, is recorded as a movement by the user,
+// in the same transaction; later changes go through AdjustInventory.
+func (m *DBModel) InsertVariant(v MaizeVariant, userID int, actor string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	stmt := `
+	INSERT INTO maize_variants
+		 (maize_id, name, sku, price, inventory_level, created_at, updated_at)
+	VALUES (?, ?, ?, ?, 0, ?, ?)`
+
+	result, err := tx.ExecContext(ctx, stmt,
+		v.MaizeID,
+		v.Name,
+		v.SKU,
+		v.Price,
+		time.Now(),
+		time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	// the opening movement rolls the stock up; with none, the parent's own
+	// stock still gives way to the sum of its variants
+	if v.InventoryLevel != 0 {
+		err = adjustInventory(ctx, tx, InventoryMovement{
+			MaizeID:        v.MaizeID,
+			VariantID:      int(id),
+			QuantityChange: v.InventoryLevel,
+			Reason:         MovementOpening,
+			Note:           "Variant created",
+			UserID:         userID,
+			Actor:          actor,
+		})
+	} else {
+		err = syncParentInventory(ctx, tx, v.MaizeID)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// UpdateVariant updates an existing variant. Stock is left alone; it only
+// changes through AdjustInventory.
+func (m *DBModel) UpdateVariant(v MaizeVariant) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+	update maize_variants set
+		name = ?, sku = ?, price = ?, updated_at = ?
+	where id = ? and maize_id = ?`
+
+	_, err := m.DB.ExecContext(ctx, stmt,
+		v.Name,
+		v.SKU,
+		v.Price,
+		time.Now(),
+		v.ID,
+		v.MaizeID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteVariant deletes a variant and rolls the remaining inventory up to the parent
+func (m *DBModel) DeleteVariant(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var maizeID int
+	err = tx.QueryRowContext(ctx, `select maize_id from maize_variants where id = ?`, id).Scan(&maizeID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from maize_variants where id = ?`, id)
+	if err != nil {
+		return err
+	}
+
+	// the parent's stock was the sum of its variants, so it falls to zero when
+	// the last one goes, rather than keeping the stale sum
+	stmt := `
+	update maize set
+		inventory_level = (select coalesce(sum(inventory_level), 0) from maize_variants where maize_id = ?)
+	where
+		id = ?`
+
+	_, err = tx.ExecContext(ctx, stmt, maizeID, maizeID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// syncParentInventory sets the inventory of a maize that has variants to the
+// sum of its variants' inventory; maize without variants are left alone
+func syncParentInventory(ctx context.Context, db execer, maizeID int) error {
+	stmt := `
+	update maize set
+		inventory_level = (select coalesce(sum(inventory_level), 0) from maize_variants where maize_id = ?)
+	where
+		id = ? and exists (select 1 from maize_variants where maize_id = ?)`
+
+	_, err := db.ExecContext(ctx, stmt, maizeID, maizeID, maizeID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetInventoryReport returns stock and sales for every maize, with variants
+// rolled up under their parent product. Refunded and cancelled orders are not
+// counted as sales.
+func (m *DBModel) GetInventoryReport() ([]*ProductInventory, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var products []*ProductInventory
+	byID := make(map[int]*ProductInventory)
+
+	stmt := `
+	select
+		m.id, m.name, m.is_recurring, m.is_active, m.inventory_level,
+		coalesce(sum(o.quantity), 0), coalesce(sum(o.amount), 0)
+	from
+		maize m
+			left join orders o on (o.maize_id = m.id and o.status_id not in (2, 3))
+	group by
+		m.id, m.name, m.is_recurring, m.is_active, m.inventory_level
+	order by
+		m.name`
+
+	rows, err := m.DB.QueryContext(ctx, stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p ProductInventory
+		err = rows.Scan(
+			&p.MaizeID,
+			&p.Name,
+			&p.IsRecurring,
+			&p.IsActive,
+			&p.InventoryLevel,
+			&p.UnitsSold,
+			&p.Revenue,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		products = append(products, &p)
+		byID[p.MaizeID] = &p
+	}
+
+	stmt = `
+	select
+		v.id, v.maize_id, v.name, v.sku, v.inventory_level,
+		coalesce(sum(o.quantity), 0), coalesce(sum(o.amount), 0)
+	from
+		maize_variants v
+			left join orders o on (o.variant_id = v.id and o.status_id not in (2, 3))
+	group by
+		v.id, v.maize_id, v.name, v.sku, v.inventory_level
+	order by
+		v.name`
+
+	vRows, err := m.DB.QueryContext(ctx, stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer vRows.Close()
+
+	for vRows.Next() {
+		var v VariantInventory
+		var maizeID int
+		err = vRows.Scan(
+			&v.VariantID,
+			&maizeID,
+			&v.Name,
+			&v.SKU,
+			&v.InventoryLevel,
+			&v.UnitsSold,
+			&v.Revenue,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		if p, ok := byID[maizeID]; ok {
+			p.Variants = append(p.Variants, &v)
+		}
+	}
+
+	return products, nil
+}
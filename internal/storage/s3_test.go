@@ -0,0 +1,307 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testAccessKey = "minioadmin"
+	testSecretKey = "minio-secret-key"
+	testRegion    = "eu-west-1"
+)
+
+// fakeS3 is a MinIO-style stand-in: an in-memory bucket behind an HTTP server
+// that checks each request's Signature Version 4 independently of the client
+type fakeS3 struct {
+	t *testing.T
+
+	mu      sync.Mutex
+	objects map[string]fakeObject
+	// requests is the method and path of every request, in order
+	requests []string
+}
+
+type fakeObject struct {
+	body        []byte
+	contentType string
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{t: t, objects: make(map[string]fakeObject)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+var authRE = regexp.MustCompile(`^AWS4-HMAC-SHA256 Credential=([^/]+)/(\d{8})/([^/]+)/s3/aws4_request, SignedHeaders=([^,]+), Signature=([0-9a-f]{64})$`)
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests = append(f.requests, r.Method+" "+r.URL.EscapedPath())
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := f.checkSignature(r, body); err != nil {
+		f.t.Logf("rejected %s %s: %v", r.Method, r.URL, err)
+		http.Error(w, "<Error><Code>SignatureDoesNotMatch</Code></Error>", http.StatusForbidden)
+		return
+	}
+
+	// path-style requests name the bucket first; virtual-hosted ones in Host
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	if !strings.HasPrefix(r.Host, "maize.") {
+		key = strings.TrimPrefix(key, "maize/")
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		f.objects[key] = fakeObject{body, r.Header.Get("Content-Type")}
+	case http.MethodGet:
+		o, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", o.contentType)
+		w.Write(o.body)
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// checkSignature verifies a request as S3 does, from the AWS Signature
+// Version 4 specification rather than the client's code
+func (f *fakeS3) checkSignature(r *http.Request, body []byte) error {
+	m := authRE.FindStringSubmatch(r.Header.Get("Authorization"))
+	if m == nil {
+		return fmt.Errorf("malformed Authorization header %q", r.Header.Get("Authorization"))
+	}
+	accessKey, day, region, signedHeaders, signature := m[1], m[2], m[3], m[4], m[5]
+
+	if accessKey != testAccessKey {
+		return fmt.Errorf("unknown access key %q", accessKey)
+	}
+
+	amzDate := r.Header.Get("X-Amz-Date")
+	if !strings.HasPrefix(amzDate, day) {
+		return fmt.Errorf("X-Amz-Date %q is not on the credential day %s", amzDate, day)
+	}
+
+	sum := sha256.Sum256(body)
+	if got, want := r.Header.Get("X-Amz-Content-Sha256"), hex.EncodeToString(sum[:]); got != want {
+		return fmt.Errorf("x-amz-content-sha256 = %s, but the body hashes to %s", got, want)
+	}
+
+	var canonicalHeaders strings.Builder
+	for _, h := range strings.Split(signedHeaders, ";") {
+		v := r.Header.Get(h)
+		if h == "host" {
+			v = r.Host
+		}
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", h, strings.TrimSpace(v))
+	}
+	for _, h := range []string{"host", "x-amz-content-sha256", "x-amz-date"} {
+		if !strings.Contains(";"+signedHeaders+";", ";"+h+";") {
+			return fmt.Errorf("%s is not signed", h)
+		}
+	}
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		r.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		r.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" +
+		day + "/" + region + "/s3/aws4_request\n" + hex.EncodeToString(requestHash[:])
+
+	mac := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+	key := mac([]byte("AWS4"+testSecretKey), day)
+	key = mac(key, region)
+	key = mac(key, "s3")
+	key = mac(key, "aws4_request")
+
+	if want := hex.EncodeToString(mac(key, stringToSign)); signature != want {
+		return fmt.Errorf("signature %s, want %s", signature, want)
+	}
+
+	return nil
+}
+
+func TestS3PathStyle(t *testing.T) {
+	f, srv := newFakeS3(t)
+
+	s := &S3{
+		Endpoint:  srv.URL,
+		Region:    testRegion,
+		Bucket:    "maize",
+		AccessKey: testAccessKey,
+		SecretKey: testSecretKey,
+		PathStyle: true,
+	}
+	ctx := context.Background()
+
+	key := "products/12/corn cob+1.png"
+	body := []byte("not really a png")
+
+	err := s.Put(ctx, key, bytes.NewReader(body), "image/png")
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	r, contentType, err := s.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	got, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, body) || contentType != "image/png" {
+		t.Errorf("Get = %q, %s; want %q, image/png", got, contentType, body)
+	}
+
+	err = s.Delete(ctx, key)
+	if err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	_, _, err = s.Get(ctx, key)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get after Delete: %v, want %v", err, ErrNotFound)
+	}
+
+	// deleting what is gone is not an error, as with S3
+	err = s.Delete(ctx, key)
+	if err != nil {
+		t.Errorf("Delete of a missing object: %v", err)
+	}
+
+	const path = "/maize/products/12/corn%20cob%2B1.png"
+	want := []string{"PUT " + path, "GET " + path, "DELETE " + path, "GET " + path, "DELETE " + path}
+	if strings.Join(f.requests, "\n") != strings.Join(want, "\n") {
+		t.Errorf("requests:\n%s\nwant:\n%s", strings.Join(f.requests, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestS3VirtualHosted(t *testing.T) {
+	f, srv := newFakeS3(t)
+
+	// send bucket.host requests to the test server
+	addr := srv.Listener.Addr().String()
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+
+	s := &S3{
+		Endpoint:  "http://s3.test",
+		Region:    testRegion,
+		Bucket:    "maize",
+		AccessKey: testAccessKey,
+		SecretKey: testSecretKey,
+		Client:    client,
+	}
+
+	err := s.Put(context.Background(), "a/b.txt", strings.NewReader("hello"), "text/plain")
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	if len(f.requests) != 1 || f.requests[0] != "PUT /a/b.txt" {
+		t.Errorf("requests = %v, want PUT /a/b.txt", f.requests)
+	}
+	if _, ok := f.objects["a/b.txt"]; !ok {
+		t.Error("object not stored")
+	}
+}
+
+func TestS3Errors(t *testing.T) {
+	_, srv := newFakeS3(t)
+	ctx := context.Background()
+
+	s := &S3{
+		Endpoint:  srv.URL,
+		Region:    testRegion,
+		Bucket:    "maize",
+		AccessKey: testAccessKey,
+		SecretKey: "wrong secret",
+		PathStyle: true,
+	}
+
+	err := s.Put(ctx, "a.txt", strings.NewReader("hello"), "text/plain")
+	if err == nil || !strings.Contains(err.Error(), "403") || !strings.Contains(err.Error(), "SignatureDoesNotMatch") {
+		t.Errorf("Put with the wrong secret: %v, want a 403 with the error document", err)
+	}
+
+	s.SecretKey = testSecretKey
+	for _, key := range []string{"", "/etc/passwd", "../escape", "a/../../escape"} {
+		err = s.Put(ctx, key, strings.NewReader("hello"), "text/plain")
+		if err == nil {
+			t.Errorf("Put with key %q succeeded", key)
+		}
+	}
+}
+
+func TestS3SignDeterministic(t *testing.T) {
+	s := &S3{Endpoint: "http://localhost:9000", Region: testRegion, Bucket: "maize", AccessKey: testAccessKey, SecretKey: testSecretKey, PathStyle: true}
+	now := time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC)
+
+	sign := func() *http.Request {
+		req, err := s.newRequest(context.Background(), http.MethodGet, "x.png", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.sign(req, nil, now)
+		return req
+	}
+
+	a, b := sign(), sign()
+	if a.Header.Get("Authorization") != b.Header.Get("Authorization") {
+		t.Error("the same request signed twice differs")
+	}
+	if got := a.Header.Get("X-Amz-Date"); got != "20220801T120000Z" {
+		t.Errorf("X-Amz-Date = %s", got)
+	}
+	// the SHA-256 of an empty body
+	if got := a.Header.Get("X-Amz-Content-Sha256"); got != "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+		t.Errorf("X-Amz-Content-Sha256 = %s", got)
+	}
+	if !strings.Contains(a.Header.Get("Authorization"), "Credential="+testAccessKey+"/20220801/"+testRegion+"/s3/aws4_request") {
+		t.Errorf("Authorization = %s", a.Header.Get("Authorization"))
+	}
+}
@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// ErrNotFound is returned when no object is stored under the requested key
+var ErrNotFound = errors.New("storage: object not found")
+
+// Storage stores and retrieves objects, such as product images, by key
+type Storage interface {
+	Put(ctx context.Context, key string, r io.Reader, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, string, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// Config describes which storage backend to use and how to reach it
+type Config struct {
+	Driver string
+	Local  struct {
+		Root string
+	}
+	S3 struct {
+		Endpoint  string
+		Region    string
+		Bucket    string
+		AccessKey string
+		SecretKey string
+		PathStyle bool
+	}
+}
+
+// RegisterFlags defines the storage flags on fs, which set cfg when fs is
+// parsed. The S3 credentials are read from the S3_ACCESS_KEY and
+// S3_SECRET_KEY environment variables rather than flags, so they stay out of
+// the process list.
+func (cfg *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&cfg.Driver, "storage", "local", "Image storage driver {local|s3}")
+	fs.StringVar(&cfg.Local.Root, "storagepath", "./uploads", "Directory for locally stored images")
+	fs.StringVar(&cfg.S3.Endpoint, "s3endpoint", "", "S3 endpoint, e.g. http://localhost:9000 for MinIO")
+	fs.StringVar(&cfg.S3.Region, "s3region", "us-east-1", "S3 region")
+	fs.StringVar(&cfg.S3.Bucket, "s3bucket", "", "S3 bucket")
+	fs.BoolVar(&cfg.S3.PathStyle, "s3pathstyle", false, "Address the S3 bucket in the path, as MinIO expects")
+
+	cfg.S3.AccessKey = os.Getenv("S3_ACCESS_KEY")
+	cfg.S3.SecretKey = os.Getenv("S3_SECRET_KEY")
+}
+
+// New returns the storage backend described by the given config
+func New(cfg Config) (Storage, error) {
+	switch cfg.Driver {
+	case "", "local":
+		return &Local{Root: cfg.Local.Root}, nil
+	case "s3":
+		if cfg.S3.Bucket == "" {
+			return nil, errors.New("storage: s3 bucket is required")
+		}
+		return &S3{
+			Endpoint:  cfg.S3.Endpoint,
+			Region:    cfg.S3.Region,
+			Bucket:    cfg.S3.Bucket,
+			AccessKey: cfg.S3.AccessKey,
+			SecretKey: cfg.S3.SecretKey,
+			PathStyle: cfg.S3.PathStyle,
+		}, nil
+	default:
+		return nil, fmt.Errorf("storage: unknown driver %q", cfg.Driver)
+	}
+}
+
+// cleanKey rejects keys that are empty, absolute or that try to escape the store
+func cleanKey(key string) (string, error) {
+	cleaned := path.Clean(strings.TrimPrefix(key, "/"))
+	if key == "" || cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") || strings.HasPrefix(key, "/") {
+		return "", fmt.Errorf("storage: invalid key %q", key)
+	}
+	return cleaned, nil
+}
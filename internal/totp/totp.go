@@ -0,0 +1,118 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Codes are the RFC 6238 defaults every authenticator app supports: six digits
+// from HMAC-SHA1, changing every 30 seconds.
+const (
+	Period = 30
+	Digits = 6
+)
+
+// skew is how many periods either side of now a code is still accepted in, for
+// clocks that drift and codes typed slowly
+const skew = 1
+
+// secretSize is the size of generated secrets, the 160 bits RFC 4226 advises
+const secretSize = 20
+
+// ErrInvalidCode is returned for a code that does not match the secret now
+var ErrInvalidCode = errors.New("totp: invalid code")
+
+// encoding is how secrets are written, and typed into authenticator apps
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewSecret returns a random secret, base32 encoded
+func NewSecret() (string, error) {
+	b := make([]byte, secretSize)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return encoding.EncodeToString(b), nil
+}
+
+// Step returns the time step t falls in
+func Step(t time.Time) int64 {
+	return t.Unix() / Period
+}
+
+// Code returns the code of a secret for a time step
+func Code(secret string, step int64) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", fmt.Errorf("totp: malformed secret: %w", err)
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// dynamic truncation, RFC 4226 section 5.3
+	offset := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < Digits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", Digits, n%mod), nil
+}
+
+// Validate checks a code against a secret at time t, and returns the time step
+// it matched. Codes of steps up to and including after are rejected, so the
+// caller can keep the last step accepted and refuse to accept a code twice.
+func Validate(secret, code string, t time.Time, after int64) (int64, error) {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != Digits {
+		return 0, ErrInvalidCode
+	}
+
+	now := Step(t)
+	for step := now - skew; step <= now+skew; step++ {
+		if step <= after {
+			continue
+		}
+
+		want, err := Code(secret, step)
+		if err != nil {
+			return 0, err
+		}
+		if hmac.Equal([]byte(want), []byte(code)) {
+			return step, nil
+		}
+	}
+
+	return 0, ErrInvalidCode
+}
+
+// URI returns the otpauth URI authenticator apps read from a QR code, naming
+// the account and who issued it
+func URI(issuer, account, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(Digits))
+	v.Set("period", fmt.Sprint(Period))
+
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
@@ -0,0 +1,123 @@
+package totp
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 secret of the RFC 6238 test vectors, "12345678901234567890"
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// TestCodeRFC6238 checks Code against the SHA1 test vectors of RFC 6238
+// Appendix B. Those are eight digits; six digit codes are their last six.
+func TestCodeRFC6238(t *testing.T) {
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+
+	for _, tt := range tests {
+		got, err := Code(rfcSecret, Step(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := tt.want[len(tt.want)-Digits:]; got != want {
+			t.Errorf("Code at %d = %s, want %s", tt.unix, got, want)
+		}
+	}
+}
+
+func TestCodeMalformedSecret(t *testing.T) {
+	_, err := Code("not base32!", 1)
+	if err == nil {
+		t.Error("Code with a malformed secret succeeded")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := Step(now)
+
+	code := func(step int64) string {
+		c, err := Code(rfcSecret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name     string
+		code     string
+		after    int64
+		wantStep int64
+		wantErr  error
+	}{
+		{"current step", code(step), 0, step, nil},
+		{"spaced", code(step)[:3] + " " + code(step)[3:], 0, step, nil},
+		{"previous step", code(step - 1), 0, step - 1, nil},
+		{"next step", code(step + 1), 0, step + 1, nil},
+		{"outside the window, before", code(step - skew - 1), 0, 0, ErrInvalidCode},
+		{"outside the window, after", code(step + skew + 1), 0, 0, ErrInvalidCode},
+		{"wrong code", "000000", 0, 0, ErrInvalidCode},
+		{"too short", code(step)[1:], 0, 0, ErrInvalidCode},
+		{"replayed", code(step), step, 0, ErrInvalidCode},
+		{"older than the last used", code(step - 1), step, 0, ErrInvalidCode},
+		{"newer than the last used", code(step + 1), step, step + 1, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Validate(rfcSecret, tt.code, now, tt.after)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Validate = %d, %v; want error %v", got, err, tt.wantErr)
+			}
+			if got != tt.wantStep {
+				t.Errorf("Validate step = %d, want %d", got, tt.wantStep)
+			}
+		})
+	}
+}
+
+func TestNewSecret(t *testing.T) {
+	a, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a == b {
+		t.Error("NewSecret returned the same secret twice")
+	}
+	if _, err := Code(a, 1); err != nil {
+		t.Errorf("Code with a new secret: %v", err)
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("Maize Shop", "admin@example.com", rfcSecret)
+
+	for _, want := range []string{
+		"otpauth://totp/Maize%20Shop:admin@example.com?",
+		"secret=" + rfcSecret,
+		"issuer=Maize+Shop",
+		"digits=6",
+		"period=30",
+	} {
+		if !strings.Contains(uri, want) {
+			t.Errorf("URI = %s, want it to contain %s", uri, want)
+		}
+	}
+}
@@ -1,47 +1,149 @@
 package urlsigner
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
+)
+
+// Link purposes. A link signed for one purpose does not verify for another.
+const (
+	PurposeReset    = "reset"
+	PurposeInvite   = "invite"
+	PurposeReceipt  = "receipt"
+	PurposeDownload = "download"
+)
 
-	goalone "github.com/bwmarrin/go-alone"
+// Errors returned by Verify
+var (
+	ErrMalformed    = errors.New("urlsigner: link is not signed")
+	ErrUnknownKey   = errors.New("urlsigner: link is signed with an unknown key")
+	ErrBadSignature = errors.New("urlsigner: invalid signature")
+	ErrWrongPurpose = errors.New("urlsigner: link is for another purpose")
+	ErrExpired      = errors.New("urlsigner: link has expired")
 )
 
+// errNoSecret is returned by Sign when the signer has no secret
+var errNoSecret = errors.New("urlsigner: no secret to sign with")
+
+// sigParam is the query parameter holding the signature, always the last one
+const sigParam = "&sig="
+
+// Signer signs links with Secret, and verifies them with it or any of the
+// Retired secrets, by key ID
 type Signer struct {
 	Secret []byte
+	// KeyID names Secret in the links it signs
+	KeyID string
+	// Retired holds secrets that no longer sign, but still verify the links
+	// they signed, by key ID
+	Retired map[string][]byte
+}
+
+// Claims are what a signed link carries besides its own URL
+type Claims struct {
+	Purpose   string
+	ExpiresAt time.Time
+	// Nonce is unique to the link, so it can be marked used
+	Nonce string
 }
 
-func (s *Signer) GenerateTokenFromString(data string) string {
-	var urlToSign string
+// Sign returns the link with its purpose, an expiry ttl from now, a nonce and
+// the key ID added to its query, followed by a signature of all of it
+func (s *Signer) Sign(link, purpose string, ttl time.Duration) (string, error) {
+	if len(s.Secret) == 0 {
+		return "", errNoSecret
+	}
+
+	nonce := make([]byte, 16)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
 
-	crypt := goalone.New(s.Secret, goalone.Timestamp)
-	if strings.Contains(data, "?") {
-		urlToSign = fmt.Sprintf("%s&hash=", data)
-	} else {
-		urlToSign = fmt.Sprintf("%s?hash=", data)
+	sep := "?"
+	if strings.Contains(link, "?") {
+		sep = "&"
 	}
 
-	tokenBytes := crypt.Sign([]byte(urlToSign))
-	token := string(tokenBytes)
-	return token
+	signed := fmt.Sprintf("%s%spurpose=%s&exp=%d&nonce=%s&kid=%s", link, sep,
+		url.QueryEscape(purpose), time.Now().Add(ttl).Unix(), hex.EncodeToString(nonce), url.QueryEscape(s.KeyID))
+
+	return signed + sigParam + sign(s.Secret, signed), nil
 }
 
-func (s *Signer) VerifyToken(token string) bool {
-	crypt := goalone.New(s.Secret, goalone.Timestamp)
-	_, err := crypt.Unsign([]byte(token))
+// Verify checks that a link was signed by Sign for purpose and has not
+// expired, and returns its claims. It returns ErrMalformed, ErrUnknownKey,
+// ErrBadSignature, ErrWrongPurpose or ErrExpired otherwise. It does not mark
+// the link used; callers of single-use links do that with the nonce.
+func (s *Signer) Verify(link, purpose string) (Claims, error) {
+	var c Claims
+
+	i := strings.LastIndex(link, sigParam)
+	if i < 0 {
+		return c, ErrMalformed
+	}
+	signed, sig := link[:i], link[i+len(sigParam):]
+
+	u, err := url.Parse(signed)
 	if err != nil {
-		fmt.Println(err)
-		return false
+		return c, ErrMalformed
 	}
+	q := u.Query()
 
-	return true
+	secret, err := s.secret(q.Get("kid"))
+	if err != nil {
+		return c, err
+	}
+
+	if !hmac.Equal([]byte(sig), []byte(sign(secret, signed))) {
+		return c, ErrBadSignature
+	}
+
+	exp, err := strconv.ParseInt(q.Get("exp"), 10, 64)
+	if err != nil {
+		return c, ErrMalformed
+	}
+
+	c = Claims{
+		Purpose:   q.Get("purpose"),
+		ExpiresAt: time.Unix(exp, 0),
+		Nonce:     q.Get("nonce"),
+	}
 
+	if c.Purpose != purpose {
+		return c, ErrWrongPurpose
+	}
+
+	if !time.Now().Before(c.ExpiresAt) {
+		return c, ErrExpired
+	}
+
+	return c, nil
 }
 
-func (s *Signer) Expired(token string, minutesToExpire int) bool {
-	crypt := goalone.New(s.Secret, goalone.Timestamp)
-	ts := crypt.Parse([]byte(token))
+// secret returns the secret with a key ID
+func (s *Signer) secret(id string) ([]byte, error) {
+	if id == s.KeyID && len(s.Secret) > 0 {
+		return s.Secret, nil
+	}
+	if secret, ok := s.Retired[id]; ok {
+		return secret, nil
+	}
+	return nil, ErrUnknownKey
+}
 
-	return time.Since(ts.Timestamp) > time.Duration(minutesToExpire)*time.Minute
+// sign returns the base64url HMAC-SHA256 of data with secret
+func sign(secret []byte, data string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(data))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
 }
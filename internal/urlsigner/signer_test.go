@@ -0,0 +1,139 @@
+package urlsigner_test
+
+import (
+	"errors"
+	"maize/internal/keyring"
+	"maize/internal/urlsigner"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testLink = "https://maize.test/reset-password?email=jane%40example.com"
+
+func TestSignVerify(t *testing.T) {
+	s := &urlsigner.Signer{Secret: []byte("current secret"), KeyID: "k2"}
+	old := &urlsigner.Signer{Secret: []byte("retired secret"), KeyID: "k1"}
+	ring := &urlsigner.Signer{
+		Secret:  s.Secret,
+		KeyID:   s.KeyID,
+		Retired: map[string][]byte{old.KeyID: old.Secret},
+	}
+
+	mustSign := func(s *urlsigner.Signer, purpose string, ttl time.Duration) string {
+		t.Helper()
+		link, err := s.Sign(testLink, purpose, ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return link
+	}
+
+	good := mustSign(s, urlsigner.PurposeReset, time.Hour)
+
+	tests := []struct {
+		name    string
+		signer  *urlsigner.Signer
+		link    string
+		purpose string
+		want    error
+	}{
+		{"valid", s, good, urlsigner.PurposeReset, nil},
+		{"wrong purpose", s, good, urlsigner.PurposeDownload, urlsigner.ErrWrongPurpose},
+		{"receipt link as reset link", s, mustSign(s, urlsigner.PurposeReceipt, time.Hour), urlsigner.PurposeReset, urlsigner.ErrWrongPurpose},
+		{"reset link as invite link", s, good, urlsigner.PurposeInvite, urlsigner.ErrWrongPurpose},
+		{"expired", s, mustSign(s, urlsigner.PurposeReset, -time.Second), urlsigner.PurposeReset, urlsigner.ErrExpired},
+		{"altered query parameter", s, strings.Replace(good, "jane", "joan", 1), urlsigner.PurposeReset, urlsigner.ErrBadSignature},
+		{"altered purpose", s, strings.Replace(good, "purpose=reset", "purpose=download", 1), urlsigner.PurposeDownload, urlsigner.ErrBadSignature},
+		{"bad signature", s, good[:len(good)-4] + "AAAA", urlsigner.PurposeReset, urlsigner.ErrBadSignature},
+		{"other secret", &urlsigner.Signer{Secret: []byte("another secret"), KeyID: "k2"}, good, urlsigner.PurposeReset, urlsigner.ErrBadSignature},
+		{"unsigned", s, testLink, urlsigner.PurposeReset, urlsigner.ErrMalformed},
+		{"retired key", ring, mustSign(old, urlsigner.PurposeReset, time.Hour), urlsigner.PurposeReset, nil},
+		{"unknown key", s, mustSign(old, urlsigner.PurposeReset, time.Hour), urlsigner.PurposeReset, urlsigner.ErrUnknownKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := tt.signer.Verify(tt.link, tt.purpose)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Verify = %v, want %v", err, tt.want)
+			}
+			if err == nil && (c.Purpose != tt.purpose || c.Nonce == "") {
+				t.Errorf("Verify claims = %+v", c)
+			}
+		})
+	}
+}
+
+func TestSignNonceUnique(t *testing.T) {
+	s := &urlsigner.Signer{Secret: []byte("secret"), KeyID: "k1"}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		link, err := s.Sign(testLink, urlsigner.PurposeDownload, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := s.Verify(link, urlsigner.PurposeDownload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[c.Nonce] {
+			t.Fatalf("nonce %s signed twice", c.Nonce)
+		}
+		seen[c.Nonce] = true
+	}
+}
+
+func TestSignNoSecret(t *testing.T) {
+	_, err := (&urlsigner.Signer{}).Sign(testLink, urlsigner.PurposeReset, time.Hour)
+	if err == nil {
+		t.Error("Sign without a secret succeeded")
+	}
+}
+
+// TestRetiredKeyGrace checks that a link signed with a key rotated out of a
+// ring verifies during the key's grace period, and not after
+func TestRetiredKeyGrace(t *testing.T) {
+	ring := keyring.FromSecrets(map[string][]byte{keyring.PurposeURLSigning: []byte("first secret")})
+
+	before, err := ring.Signer(keyring.PurposeURLSigning)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := before.Sign(testLink, urlsigner.PurposeReset, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ring.Rotate(keyring.PurposeURLSigning, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inGrace, err := ring.Signer(keyring.PurposeURLSigning)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = inGrace.Verify(link, urlsigner.PurposeReset)
+	if err != nil {
+		t.Errorf("Verify in the grace period: %v", err)
+	}
+
+	// end the grace period of the retired key
+	past := time.Now().Add(-time.Minute)
+	for _, k := range ring.Keys {
+		if k.RetiredAt != nil {
+			k.ExpiresAt = &past
+		}
+	}
+
+	afterGrace, err := ring.Signer(keyring.PurposeURLSigning)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = afterGrace.Verify(link, urlsigner.PurposeReset)
+	if !errors.Is(err, urlsigner.ErrUnknownKey) {
+		t.Errorf("Verify after the grace period: %v, want %v", err, urlsigner.ErrUnknownKey)
+	}
+}
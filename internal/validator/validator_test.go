@@ -0,0 +1,37 @@
+package validator
+
+import "testing"
+
+func TestCheck(t *testing.T) {
+	v := New()
+	if !v.Valid() {
+		t.Fatal("a new validator is not valid")
+	}
+
+	v.Check(true, "name", "Name is required")
+	if !v.Valid() {
+		t.Errorf("a passing check added an error: %v", v.Errors)
+	}
+
+	v.Check(false, "price", "Price must be greater than zero")
+	if v.Valid() {
+		t.Fatal("a failing check left the validator valid")
+	}
+	if got := v.Errors["price"]; got != "Price must be greater than zero" {
+		t.Errorf("price error = %q", got)
+	}
+}
+
+func TestAddErrorKeepsFirst(t *testing.T) {
+	v := New()
+
+	v.AddError("email", "Email is required")
+	v.AddError("email", "Email is not valid")
+
+	if len(v.Errors) != 1 {
+		t.Fatalf("errors = %v, want one", v.Errors)
+	}
+	if got := v.Errors["email"]; got != "Email is required" {
+		t.Errorf("email error = %q, want the first one added", got)
+	}
+}